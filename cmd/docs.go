@@ -0,0 +1,61 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
+	"os"
+)
+
+var (
+	docsCmd = &cobra.Command{
+		Use:   "docs",
+		Short: "Generate man pages or a markdown CLI reference for systemd-docker.",
+		Example: `systemd-docker docs --format man -o /usr/share/man/man1
+systemd-docker docs --format markdown -o docs`,
+		Args: cobra.NoArgs,
+		RunE: docs,
+	}
+	docsFormat    string
+	docsOutputDir string
+)
+
+func init() {
+	docsCmd.Flags().StringVar(&docsFormat, "format", "man", "Format of the documentation, 'man' or 'markdown'")
+	docsCmd.Flags().StringVarP(&docsOutputDir, "output-dir", "o", ".", "Directory to write the documentation to")
+	rootCmd.AddCommand(docsCmd)
+}
+
+func docs(_ *cobra.Command, _ []string) error {
+	if err := os.MkdirAll(docsOutputDir, 0755); err != nil {
+		return err
+	}
+
+	rootCmd.DisableAutoGenTag = true
+	switch docsFormat {
+	case "man":
+		header := &doc.GenManHeader{
+			Title:   "SYSTEMD-DOCKER",
+			Section: "1",
+		}
+		return doc.GenManTree(rootCmd, header, docsOutputDir)
+	case "markdown":
+		return doc.GenMarkdownTree(rootCmd, docsOutputDir)
+	}
+	return fmt.Errorf("unsupported documentation format '%s'", docsFormat)
+}
@@ -0,0 +1,60 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/kadaan/systemd-docker/lib"
+	"github.com/spf13/cobra"
+)
+
+var (
+	execCmd = &cobra.Command{
+		Use:   "exec [flags] -- COMMAND [ARG...]",
+		Short: "Run a command in the container of a unit.",
+		Long: `Run a command in the container of a unit.
+
+The command is attached to the standard streams, with a TTY if they are
+terminals, and its exit code is propagated.  Without --name, the container is
+named after the unit systemd-docker runs in, as with --name %n.`,
+		Example: `ExecStartPost=/usr/bin/systemd-docker exec -- /usr/local/bin/migrate
+systemd-docker exec --name nginx.service -- sh`,
+		Args:         cobra.MinimumNArgs(1),
+		RunE:         execContainer,
+		SilenceUsage: true,
+	}
+	execContext = &lib.Context{}
+	execOptions lib.ExecOptions
+)
+
+func init() {
+	execCmd.Flags().StringVar(&execContext.Name, "name", "", "Name of the container, defaults to the name of the unit")
+	execCmd.Flags().StringVarP(&execOptions.User, "user", "u", "", "User to run the command as, <NAME|UID>[:<GROUP|GID>]")
+	execCmd.Flags().StringVarP(&execOptions.Workdir, "workdir", "w", "", "Working directory of the command in the container")
+	execCmd.Flags().StringArrayVarP(&execOptions.Env, "env", "e", []string{}, "Environment variables of the command, <NAME>=<VALUE>")
+	execCmd.Flags().StringVar(&execContext.Engine, "engine", lib.DefaultEngine, "Engine managing the container")
+	execCmd.Flags().StringVar(&execContext.Docker.Config, "config", "", "Location of docker client config files")
+	execCmd.Flags().StringVar(&execContext.Docker.Context, "context", "", "Name of the docker context to use")
+	execCmd.Flags().StringVarP(&execContext.Docker.Host, "host", "H", "", "Docker daemon socket to connect to")
+	rootCmd.AddCommand(execCmd)
+}
+
+func execContainer(_ *cobra.Command, args []string) error {
+	execContext.Log = c.Log
+	if err := lib.ValidateEngine(execContext); err != nil {
+		return err
+	}
+	return lib.ExecContainer(execContext, execOptions, args)
+}
@@ -0,0 +1,78 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/kadaan/systemd-docker/lib"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	gcCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "Remove resources managed by systemd-docker which are no longer owned by a unit.",
+		Long: `Remove resources managed by systemd-docker which are no longer owned by a unit.
+
+Containers, volumes and networks labeled as managed by systemd-docker are
+removed once the unit they were created by no longer exists.  Exited
+containers which were not created by a unit are removed as well.  With
+--dry-run, the resources are only printed.`,
+		Example: `systemd-docker gc --dry-run
+systemd-docker gc`,
+		Args:         cobra.NoArgs,
+		RunE:         gc,
+		SilenceUsage: true,
+	}
+	gcContext = &lib.Context{}
+	gcDryRun  bool
+)
+
+func init() {
+	gcCmd.Flags().BoolVar(&gcDryRun, "dry-run", false, "Print the resources which would be removed without removing them")
+	gcCmd.Flags().BoolVar(&gcContext.UserManager, "user-manager", false, "Look up the units in the systemd user manager")
+	gcCmd.Flags().StringVar(&gcContext.Docker.Config, "config", "", "Location of docker client config files")
+	gcCmd.Flags().StringVar(&gcContext.Docker.Context, "context", "", "Name of the docker context to use")
+	gcCmd.Flags().StringVarP(&gcContext.Docker.Host, "host", "H", "", "Docker daemon socket to connect to")
+	rootCmd.AddCommand(gcCmd)
+}
+
+func gc(_ *cobra.Command, _ []string) error {
+	gcContext.Log = c.Log
+	garbage, err := lib.FindGarbage(gcContext)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, item := range garbage {
+		if gcDryRun {
+			_, _ = fmt.Fprintf(os.Stdout, "Would remove %s '%s', as %s\n", item.Kind, item.Name, item.Reason)
+			continue
+		}
+		if err = lib.RemoveGarbage(gcContext, item); err != nil {
+			c.Log.Errorf("Failed to remove %s '%s': %s\n", item.Kind, item.Name, err)
+			failed++
+			continue
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "Removed %s '%s', as %s\n", item.Kind, item.Name, item.Reason)
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to remove %d of %d resources", failed, len(garbage))
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kadaan/systemd-docker/lib"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+)
+
+var (
+	listCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the containers managed by systemd-docker.",
+		Long: `List the containers managed by systemd-docker.
+
+Every container created by systemd-docker is labeled with the unit supervising
+it, so the containers of all units on the host are listed along with their
+state, health, and whether their image reference now resolves to a different
+image than the one they were created from.  With --output json or
+--output go-template=TEMPLATE, scripts can extract the fields they need.`,
+		Example: `systemd-docker list
+systemd-docker list --output json
+systemd-docker list --output 'go-template={{.Unit}} {{.Drift}}'`,
+		Args:         cobra.NoArgs,
+		RunE:         list,
+		SilenceUsage: true,
+	}
+	listContext = &lib.Context{}
+	listOutput  string
+)
+
+func init() {
+	listCmd.Flags().StringVarP(&listOutput, "output", "o", "text", "Format to print the containers in, 'text', 'json' or 'go-template=<TEMPLATE>'")
+	listCmd.Flags().StringVar(&listContext.Docker.Config, "config", "", "Location of docker client config files")
+	listCmd.Flags().StringVar(&listContext.Docker.Context, "context", "", "Name of the docker context to use")
+	listCmd.Flags().StringVarP(&listContext.Docker.Host, "host", "H", "", "Docker daemon socket to connect to")
+	rootCmd.AddCommand(listCmd)
+}
+
+func list(_ *cobra.Command, _ []string) error {
+	var tmpl *template.Template
+	switch {
+	case listOutput == "text", listOutput == "json":
+	case strings.HasPrefix(listOutput, goTemplateOutputPrefix):
+		var err error
+		tmpl, err = template.New("list").Parse(strings.TrimPrefix(listOutput, goTemplateOutputPrefix))
+		if err != nil {
+			return fmt.Errorf("list template is invalid: %v", err)
+		}
+	default:
+		return fmt.Errorf("unsupported list output '%s'", listOutput)
+	}
+
+	listContext.Log = c.Log
+	containers, err := lib.ListManaged(listContext)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case tmpl != nil:
+		for _, container := range containers {
+			if err = tmpl.Execute(os.Stdout, container); err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintln(os.Stdout)
+		}
+	case listOutput == "json":
+		data, err := json.MarshalIndent(containers, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "%s\n", data)
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		_, _ = fmt.Fprintln(w, "UNIT\tNAME\tSTATE\tHEALTH\tDRIFT")
+		for _, container := range containers {
+			unit := container.Unit
+			if len(unit) == 0 {
+				unit = "-"
+			}
+			health := container.Health
+			if len(health) == 0 {
+				health = "-"
+			}
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", unit, container.Name, container.State, health, container.Drift)
+		}
+		return w.Flush()
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/kadaan/systemd-docker/lib"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var (
+	logsCmd = &cobra.Command{
+		Use:   "logs NAME",
+		Short: "Print the output of a container managed by systemd-docker.",
+		Long: `Print the output of a container managed by systemd-docker.
+
+The output is printed from the line after the one last printed by a previous
+invocation, as its cursor is persisted in the state directory, so that
+consumers resume exactly where they stopped.  --since and --cursor override
+where to start from, and --show-cursor prints the cursor after the last line
+to stderr.`,
+		Example: `systemd-docker logs nginx.service
+systemd-docker logs --follow --since 10m nginx.service
+systemd-docker logs --cursor 2021-08-01T12:00:00.123456789Z nginx.service`,
+		Args:         cobra.ExactArgs(1),
+		RunE:         logs,
+		SilenceUsage: true,
+	}
+	logsContext    = &lib.Context{}
+	logsOptions    lib.ReadLogsOptions
+	logsShowCursor bool
+)
+
+func init() {
+	logsCmd.Flags().BoolVarP(&logsOptions.Follow, "follow", "f", false, "Follow the output until the container stops")
+	logsCmd.Flags().StringVar(&logsOptions.Since, "since", "", "Print the output since the time, e.g. 2021-08-01T12:00:00Z, or the duration before now, e.g. 10m")
+	logsCmd.Flags().StringVar(&logsOptions.Cursor, "cursor", "", "Print the output after the cursor printed by 'show-cursor'")
+	logsCmd.Flags().BoolVar(&logsShowCursor, "show-cursor", false, "Print the cursor after the last line to stderr")
+	logsCmd.Flags().StringVar(&logsContext.Engine, "engine", lib.DefaultEngine, "Engine managing the container")
+	logsCmd.Flags().StringVar(&logsContext.Docker.Config, "config", "", "Location of docker client config files")
+	logsCmd.Flags().StringVar(&logsContext.Docker.Context, "context", "", "Name of the docker context to use")
+	logsCmd.Flags().StringVarP(&logsContext.Docker.Host, "host", "H", "", "Docker daemon socket to connect to")
+	rootCmd.AddCommand(logsCmd)
+}
+
+func logs(_ *cobra.Command, args []string) error {
+	if len(logsOptions.Since) > 0 && len(logsOptions.Cursor) > 0 {
+		return fmt.Errorf("flags 'since' and 'cursor' cannot be used together")
+	}
+
+	logsContext.Name = args[0]
+	logsContext.Log = c.Log
+	if err := lib.ValidateEngine(logsContext); err != nil {
+		return err
+	}
+
+	stopHandlingSignals := lib.HandleSignals(logsContext)
+	defer stopHandlingSignals()
+
+	cursor, err := lib.ReadLogs(logsContext, logsOptions, os.Stdout, os.Stderr)
+	if logsShowCursor && len(cursor) > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "-- cursor: %s\n", cursor)
+	}
+	return err
+}
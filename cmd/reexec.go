@@ -0,0 +1,51 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/kadaan/systemd-docker/lib"
+	"github.com/spf13/cobra"
+)
+
+var (
+	reexecCmd = &cobra.Command{
+		Use:   "reexec NAME",
+		Short: "Re-execute the systemd-docker instance supervising a container, e.g. after upgrading systemd-docker.",
+		Long: `Re-execute the systemd-docker instance supervising a container, e.g. after upgrading systemd-docker.
+
+The instance serializes its supervision state, re-executes the systemd-docker
+binary and resumes supervising the container without restarting it.  Sending
+SIGUSR2 to the instance has the same effect.`,
+		Example: `ExecReload=/usr/bin/systemd-docker reexec %n`,
+		Args:    cobra.ExactArgs(1),
+		RunE:    reexec,
+	}
+	reexecUserManager bool
+)
+
+func init() {
+	reexecCmd.Flags().BoolVar(&reexecUserManager, "user-manager", false, "The instance runs under a systemd user manager")
+	rootCmd.AddCommand(reexecCmd)
+}
+
+func reexec(_ *cobra.Command, args []string) error {
+	rc := &lib.Context{
+		Name:        args[0],
+		UserManager: reexecUserManager,
+		Log:         c.Log,
+	}
+	return lib.SignalReexec(rc)
+}
@@ -0,0 +1,139 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kadaan/systemd-docker/lib"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const goTemplateOutputPrefix = "go-template="
+
+var (
+	statusCmd = &cobra.Command{
+		Use:   "status NAME",
+		Short: "Print the status of a container managed by systemd-docker.",
+		Long: `Print the status of a container managed by systemd-docker.
+
+The status contains the ID, state, PID, health, IP addresses and image digest
+of the container, and whether a systemd-docker instance is supervising it.
+With --output json or --output go-template=TEMPLATE, scripts can extract the
+fields they need.`,
+		Example: `systemd-docker status nginx.service
+systemd-docker status --output json nginx.service
+systemd-docker status --output 'go-template={{.Pid}}' nginx.service`,
+		Args:         cobra.ExactArgs(1),
+		RunE:         status,
+		SilenceUsage: true,
+	}
+	statusContext = &lib.Context{}
+	statusOutput  string
+)
+
+func init() {
+	statusCmd.Flags().StringVarP(&statusOutput, "output", "o", "text", "Format to print the status in, 'text', 'json' or 'go-template=<TEMPLATE>'")
+	statusCmd.Flags().BoolVar(&statusContext.UserManager, "user-manager", false, "The instance runs under a systemd user manager")
+	statusCmd.Flags().StringVar(&statusContext.Engine, "engine", lib.DefaultEngine, "Engine managing the container")
+	statusCmd.Flags().StringVar(&statusContext.Docker.Config, "config", "", "Location of docker client config files")
+	statusCmd.Flags().StringVar(&statusContext.Docker.Context, "context", "", "Name of the docker context to use")
+	statusCmd.Flags().StringVarP(&statusContext.Docker.Host, "host", "H", "", "Docker daemon socket to connect to")
+	rootCmd.AddCommand(statusCmd)
+}
+
+func status(_ *cobra.Command, args []string) error {
+	var tmpl *template.Template
+	switch {
+	case statusOutput == "text", statusOutput == "json":
+	case strings.HasPrefix(statusOutput, goTemplateOutputPrefix):
+		var err error
+		tmpl, err = template.New("status").Parse(strings.TrimPrefix(statusOutput, goTemplateOutputPrefix))
+		if err != nil {
+			return fmt.Errorf("status template is invalid: %v", err)
+		}
+	default:
+		return fmt.Errorf("unsupported status output '%s'", statusOutput)
+	}
+
+	statusContext.Name = args[0]
+	statusContext.Log = c.Log
+	if err := lib.ValidateEngine(statusContext); err != nil {
+		return err
+	}
+	s, err := lib.GetStatus(statusContext)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case tmpl != nil:
+		if err = tmpl.Execute(os.Stdout, s); err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintln(os.Stdout)
+	case statusOutput == "json":
+		data, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "%s\n", data)
+	default:
+		printStatus(s)
+	}
+	return nil
+}
+
+func printStatus(s *lib.ContainerStatus) {
+	networks := make([]string, 0, len(s.IpAddresses))
+	for name, ip := range s.IpAddresses {
+		networks = append(networks, fmt.Sprintf("%s %s", name, ip))
+	}
+	sort.Strings(networks)
+	supervised := "no"
+	if s.Supervised {
+		supervised = fmt.Sprintf("yes (pid %d)", s.WrapperPid)
+	}
+	startedAt := ""
+	if !s.StartedAt.IsZero() {
+		startedAt = s.StartedAt.Format(time.RFC3339)
+	}
+
+	lines := [][2]string{
+		{"name", s.Name},
+		{"id", s.Id},
+		{"state", s.State},
+		{"pid", fmt.Sprintf("%d", s.Pid)},
+		{"health", s.Health},
+		{"started at", startedAt},
+		{"exit code", fmt.Sprintf("%d", s.ExitCode)},
+		{"image", s.Image},
+		{"image id", s.ImageId},
+		{"digest", s.Digest},
+		{"ip addresses", strings.Join(networks, ", ")},
+		{"supervised", supervised},
+	}
+	for _, line := range lines {
+		if len(line[1]) > 0 {
+			_, _ = fmt.Fprintf(os.Stdout, "%-14s%s\n", line[0]+":", line[1])
+		}
+	}
+}
@@ -5,16 +5,15 @@ go 1.17
 replace github.com/Sirupsen/logrus => github.com/sirupsen/logrus v1.8.1
 
 require (
+	github.com/coreos/go-systemd/v22 v22.3.2
+	github.com/docker/go-units v0.4.0
 	github.com/fsouza/go-dockerclient v1.7.2
-	github.com/opencontainers/runc v1.0.1
+	github.com/klauspost/compress v1.11.13
 )
 
 require (
 	github.com/Azure/go-ansiterm v0.0.0-20170929234023-d6e3b3328b78 // indirect
-	github.com/coreos/go-systemd/v22 v22.3.2 // indirect
-	github.com/cyphar/filepath-securejoin v0.2.2 // indirect
 	github.com/docker/go-connections v0.4.0 // indirect
-	github.com/docker/go-units v0.4.0 // indirect
 	github.com/godbus/dbus/v5 v5.0.4 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
@@ -24,13 +23,18 @@ require (
 	github.com/morikuni/aec v1.0.0 // indirect
 	github.com/opencontainers/go-digest v1.0.0 // indirect
 	github.com/opencontainers/image-spec v1.0.1 // indirect
-	github.com/opencontainers/runtime-spec v1.0.3-0.20210326190908-1c3f411f0417 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/opencontainers/runc v1.0.1 // indirect
+	github.com/spf13/pflag v1.0.5
 )
 
 require (
+	github.com/cpuguy83/go-md2man/v2 v2.0.0 // indirect
 	github.com/docker/docker v20.10.3-0.20210804232411-deda3d4933d3+incompatible // indirect
-	github.com/sirupsen/logrus v1.8.1
+	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/russross/blackfriday/v2 v2.0.1 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	github.com/sirupsen/logrus v1.8.1 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
 
 require (
@@ -40,6 +44,6 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.0.0
 	github.com/stretchr/testify v1.7.0 // indirect
-	golang.org/x/sys v0.0.0-20210510120138-977fb7262007 // indirect
+	golang.org/x/sys v0.0.0-20210510120138-977fb7262007
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
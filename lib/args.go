@@ -0,0 +1,168 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// docker run flags which do not take a value
+var dockerBoolFlags = map[string]bool{
+	"d": true, "detach": true,
+	"i": true, "interactive": true,
+	"t": true, "tty": true,
+	"P": true, "publish-all": true,
+	"q": true, "quiet": true,
+	"rm":                    true,
+	"init":                  true,
+	"privileged":            true,
+	"read-only":             true,
+	"no-healthcheck":        true,
+	"oom-kill-disable":      true,
+	"sig-proxy":             true,
+	"disable-content-trust": true,
+	"help":                  true,
+}
+
+// FindImage returns the index and value of the image argument in the docker
+// run arguments, or -1 if there is none.
+func FindImage(args []string) (int, string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+1 < len(args) {
+				return i + 1, args[i+1]
+			}
+			return -1, ""
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return i, arg
+		}
+		if strings.Contains(arg, "=") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if !strings.HasPrefix(arg, "--") && len(name) > 1 {
+			// combined short flags, only the last one can take a value
+			name = name[len(name)-1:]
+		}
+		if !dockerBoolFlags[name] {
+			i++
+		}
+	}
+	return -1, ""
+}
+
+// dockerBoolFlag returns the value of the boolean docker flag in the docker
+// run arguments, and whether it is specified.
+func dockerBoolFlag(args []string, name string) (bool, bool) {
+	end, _ := FindImage(args)
+	if end < 0 {
+		end = len(args)
+	}
+
+	value, specified := false, false
+	for _, arg := range args[:end] {
+		if arg == "--"+name {
+			value, specified = true, true
+		} else if strings.HasPrefix(arg, "--"+name+"=") {
+			value, _ = strconv.ParseBool(strings.TrimPrefix(arg, "--"+name+"="))
+			specified = true
+		}
+	}
+	return value, specified
+}
+
+// ExpandArgFiles replaces each '@<FILE>' argument with the arguments read from
+// the file, one per line.  Empty lines and lines starting with '#' are
+// ignored, and '@@' escapes a literal leading '@'.  Only the flags of
+// systemd-docker before '--' and the docker flags up to the image are
+// expanded, the command of the container is passed on unchanged.
+func ExpandArgFiles(args []string) ([]string, error) {
+	result := make([]string, 0, len(args))
+	docker := -1
+	for i, arg := range args {
+		if docker < 0 && arg == "--" {
+			docker = len(result) + 1
+		} else if docker >= 0 {
+			if index, _ := FindImage(result[docker:]); index >= 0 {
+				return append(result, args[i:]...), nil
+			}
+		}
+
+		expanded, err := expandArgFile(arg)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expanded...)
+	}
+	return result, nil
+}
+
+func expandArgFile(arg string) ([]string, error) {
+	if strings.HasPrefix(arg, "@@") {
+		return []string{arg[1:]}, nil
+	}
+	if !strings.HasPrefix(arg, "@") || len(arg) == 1 {
+		return []string{arg}, nil
+	}
+
+	data, err := ioutil.ReadFile(arg[1:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read argument file '%s': %v", arg[1:], err)
+	}
+	var result []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		result = append(result, line)
+	}
+	return result, nil
+}
+
+// dockerFlagValues returns the values of the docker run flag with any of the
+// names, in the order they were specified.  Only the arguments before the
+// image are considered.
+func dockerFlagValues(args []string, names ...string) []string {
+	end, _ := FindImage(args)
+	if end < 0 {
+		end = len(args)
+	}
+
+	var result []string
+	for i := 0; i < end; i++ {
+		arg := args[i]
+		for _, name := range names {
+			flag := "--" + name
+			if len(name) == 1 {
+				flag = "-" + name
+			}
+			if arg == flag && i+1 < end {
+				result = append(result, args[i+1])
+			} else if strings.HasPrefix(arg, flag+"=") {
+				result = append(result, arg[len(flag)+1:])
+			} else if len(name) == 1 && strings.HasPrefix(arg, flag) && !strings.HasPrefix(arg, "--") && len(arg) > 2 {
+				result = append(result, arg[2:])
+			}
+		}
+	}
+	return result
+}
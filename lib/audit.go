@@ -0,0 +1,140 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiVersionPrefix matches the API version prefix of request paths.
+var apiVersionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// auditTransport records every request to the docker API.
+type auditTransport struct {
+	context *Context
+	next    http.RoundTripper
+}
+
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	result := ""
+	if err != nil {
+		result = err.Error()
+	} else {
+		result = resp.Status
+	}
+	path := apiVersionPrefix.ReplaceAllString(req.URL.Path, "/")
+	t.context.audit("api", fmt.Sprintf("%s %s", req.Method, path), req.URL.RawQuery, start, result, err == nil && resp.StatusCode < 400)
+	return resp, err
+}
+
+func (t *auditTransport) CloseIdleConnections() {
+	if transport, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+// auditClient makes the client record its API requests with --audit.
+func (c *Context) auditClient(client *docker.Client) {
+	if !c.Audit || client.HTTPClient == nil {
+		return
+	}
+	next := client.HTTPClient.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	client.HTTPClient.Transport = &auditTransport{context: c, next: next}
+}
+
+// auditCommand records a docker CLI command which was started at start and
+// finished with err.
+func (c *Context) auditCommand(cmd *exec.Cmd, start time.Time, err error) {
+	if !c.Audit {
+		return
+	}
+	// the docker global options precede the operation of docker commands
+	program := "docker"
+	args := cmd.Args[1:]
+	if cmd.Args[0] == getDockerCommand() {
+		args = args[len(c.Docker.Args()):]
+	} else {
+		program = filepath.Base(cmd.Args[0])
+	}
+	operation := ""
+	if len(args) > 0 {
+		operation = args[0]
+		if (operation == "network" || operation == "service") && len(args) > 1 {
+			operation = fmt.Sprintf("%s %s", args[0], args[1])
+		}
+	}
+	result := "exit status 0"
+	if err != nil {
+		result = err.Error()
+	}
+	c.audit("cli", fmt.Sprintf("%s %s", program, operation), strings.Join(redactedArgs(args), " "), start, result, err == nil)
+}
+
+func (c *Context) audit(kind string, operation string, arguments string, start time.Time, result string, success bool) {
+	c.Log.Structured(PriorityInfo, fmt.Sprintf("Audit: %s for container '%s': %s", operation, c.Name, result), map[string]string{
+		"CONTAINER_NAME":  c.Name,
+		"AUDIT_KIND":      kind,
+		"AUDIT_OPERATION": operation,
+		"AUDIT_ARGUMENTS": arguments,
+		"AUDIT_DURATION":  time.Since(start).String(),
+		"AUDIT_RESULT":    result,
+		"AUDIT_SUCCESS":   strconv.FormatBool(success),
+	})
+}
+
+// redactedArgs hides the values of environment variables passed to docker,
+// which commonly carry secrets.
+func redactedArgs(args []string) []string {
+	result := make([]string, len(args))
+	redactNext := false
+	for i, arg := range args {
+		switch {
+		case redactNext:
+			result[i] = redactedEnv(arg)
+			redactNext = false
+		case arg == "-e" || arg == "--env":
+			result[i] = arg
+			redactNext = true
+		case strings.HasPrefix(arg, "--env="):
+			result[i] = "--env=" + redactedEnv(strings.TrimPrefix(arg, "--env="))
+		case strings.HasPrefix(arg, "-e") && strings.Contains(arg, "="):
+			result[i] = "-e" + redactedEnv(strings.TrimPrefix(arg, "-e"))
+		default:
+			result[i] = arg
+		}
+	}
+	return result
+}
+
+func redactedEnv(value string) string {
+	if i := strings.IndexByte(value, '='); i >= 0 {
+		return value[:i+1] + "***"
+	}
+	return value
+}
@@ -0,0 +1,180 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const backupTarPrefix = "tar:"
+
+// BackupData is the data available to --on-stop-backup command templates.
+type BackupData struct {
+	Name      string
+	Id        string
+	Volume    string
+	Source    string
+	Timestamp string
+}
+
+// BackupVolumes runs the --on-stop-backup hooks for the volumes of the
+// stopped container.  A hook is either a command template, run with
+// '/bin/sh -c', or 'tar:<DIRECTORY>' to snapshot the volume to a gzipped tar
+// archive in the directory.
+func BackupVolumes(c *Context) error {
+	if len(c.Backups) == 0 || len(c.Id) == 0 {
+		return nil
+	}
+
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	container, err := client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: c.Id})
+	if err != nil {
+		return err
+	}
+
+	mounts := make(map[string]docker.Mount, len(container.Mounts))
+	for _, mount := range container.Mounts {
+		if len(mount.Name) > 0 {
+			mounts[mount.Name] = mount
+		}
+	}
+
+	timestamp := time.Now().UTC().Format("20060102T150405Z")
+	for _, backup := range c.Backups {
+		parts := strings.SplitN(backup, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return fmt.Errorf("backup '%s' has a wrong format", backup)
+		}
+
+		mount, ok := mounts[parts[0]]
+		if !ok {
+			c.Log.Warnf("Container '%s' does not use volume '%s', skipping backup\n", c.Name, parts[0])
+			continue
+		}
+
+		data := BackupData{
+			Name:      c.Name,
+			Id:        container.ID,
+			Volume:    mount.Name,
+			Source:    mount.Source,
+			Timestamp: timestamp,
+		}
+
+		start := time.Now()
+		if strings.HasPrefix(parts[1], backupTarPrefix) {
+			err = snapshotVolume(data, strings.TrimPrefix(parts[1], backupTarPrefix))
+		} else {
+			err = runBackupCommand(data, parts[1])
+		}
+		if err != nil {
+			return fmt.Errorf("failed to back up volume '%s' of container '%s': %v", mount.Name, c.Name, err)
+		}
+		c.Log.Infof("Backed up volume '%s' of container '%s' in %s\n", mount.Name, c.Name, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+func runBackupCommand(data BackupData, text string) error {
+	t, err := template.New("backup").Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid backup template '%s': %v", text, err)
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, data); err != nil {
+		return fmt.Errorf("failed to render backup template '%s': %v", text, err)
+	}
+	_, err = runCommand("/bin/sh", "-c", buf.String())
+	return err
+}
+
+func snapshotVolume(data BackupData, directory string) (err error) {
+	if err = os.MkdirAll(directory, 0750); err != nil {
+		return err
+	}
+
+	archive := filepath.Join(directory, fmt.Sprintf("%s-%s-%s.tar.gz", filepath.Base(data.Name), data.Volume, data.Timestamp))
+	f, err := os.OpenFile(archive, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			_ = os.Remove(archive)
+		}
+	}()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	err = filepath.Walk(data.Source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(data.Source, path)
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		source, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer func(source *os.File) {
+			_ = source.Close()
+		}(source)
+		_, err = io.Copy(tw, source)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
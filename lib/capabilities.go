@@ -0,0 +1,137 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const capLastCapFile = "/proc/sys/kernel/cap_last_cap"
+
+// DropCapabilities drops the capabilities of systemd-docker which are only
+// needed to set up the container, f.ex. to move it to the cgroup of the unit,
+// once supervising it starts.  Only the capabilities needed to tear down the
+// firewall rules, traffic shaping and CNI networks of the container, and to
+// read its volumes for backups and disk usage monitoring, are kept.  The capabilities are dropped from all threads, which requires a
+// binary built without cgo.
+func DropCapabilities(c *Context) {
+	if !c.DropCapabilities {
+		return
+	}
+
+	var keep []uintptr
+	if len(c.firewallRules) > 0 || len(c.cniAttachments) > 0 || len(c.shapedDevices) > 0 {
+		keep = append(keep, unix.CAP_NET_ADMIN)
+	}
+	if len(c.cniAttachments) > 0 {
+		// CNI plugins enter the network namespace of the container
+		keep = append(keep, unix.CAP_SYS_ADMIN)
+	}
+	if len(c.Backups) > 0 || c.DiskUsageInterval > 0 {
+		// volumes are walked on the host, and are usually owned by the
+		// users of the container
+		keep = append(keep, unix.CAP_DAC_READ_SEARCH)
+	}
+
+	if err := dropCapabilities(keep); errors.Is(err, unix.ENOTSUP) {
+		c.Log.Warnf("Cannot drop capabilities while supervising container '%s', the binary was built with cgo\n", c.Name)
+		return
+	} else if err != nil {
+		c.Log.Warnf("Failed to drop capabilities while supervising container '%s': %s\n", c.Name, err)
+		return
+	}
+	if len(keep) == 0 {
+		c.Log.Infof("Dropped all capabilities while supervising container '%s'\n", c.Name)
+	} else {
+		c.Log.Infof("Dropped all capabilities but %s while supervising container '%s'\n", capabilityNames(keep), c.Name)
+	}
+}
+
+func dropCapabilities(keep []uintptr) error {
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return err
+	}
+
+	kept := make(map[uintptr]bool, len(keep))
+	for _, capability := range keep {
+		kept[capability] = true
+	}
+
+	// dropping from the bounding set requires CAP_SETPCAP, so it is dropped
+	// first, and only if the capability is still permitted
+	if data[0].Permitted&(1<<unix.CAP_SETPCAP) != 0 {
+		for capability := uintptr(0); capability <= lastCapability(); capability++ {
+			if kept[capability] {
+				continue
+			}
+			if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_CAPBSET_DROP, capability, 0); errno != 0 && errno != unix.EINVAL {
+				return fmt.Errorf("failed to drop capability %d from the bounding set: %w", capability, errno)
+			}
+		}
+	}
+	if _, _, errno := syscall.AllThreadsSyscall6(unix.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0, 0); errno != 0 && errno != unix.EINVAL {
+		return fmt.Errorf("failed to clear the ambient capabilities: %w", errno)
+	}
+
+	var permitted [2]uint32
+	for _, capability := range keep {
+		permitted[capability/32] |= 1 << (capability % 32)
+	}
+	for i := range data {
+		data[i].Permitted &= permitted[i]
+		data[i].Effective &= permitted[i]
+		data[i].Inheritable = 0
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// lastCapability returns the highest capability supported by the kernel.
+func lastCapability() uintptr {
+	data, err := ioutil.ReadFile(capLastCapFile)
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return unix.CAP_LAST_CAP
+	}
+	return uintptr(last)
+}
+
+func capabilityNames(capabilities []uintptr) string {
+	names := map[uintptr]string{
+		unix.CAP_NET_ADMIN:       "CAP_NET_ADMIN",
+		unix.CAP_SYS_ADMIN:       "CAP_SYS_ADMIN",
+		unix.CAP_DAC_READ_SEARCH: "CAP_DAC_READ_SEARCH",
+	}
+	var result []string
+	for _, capability := range capabilities {
+		result = append(result, names[capability])
+	}
+	return strings.Join(result, ",")
+}
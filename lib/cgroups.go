@@ -18,14 +18,20 @@ package lib
 import (
 	"bufio"
 	"fmt"
-	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
+const (
+	DefaultSysFsCgroupPath = "/sys/fs/cgroup"
+	DefaultProcPath        = "/proc"
+)
+
 func MoveCgroups(c *Context) error {
-	procFile := "/proc/self/cgroup"
+	procFile := c.procPath("self", "cgroup")
 	f, err := os.Open(procFile)
 	if err != nil {
 		return err
@@ -34,19 +40,38 @@ func MoveCgroups(c *Context) error {
 		_ = f.Close()
 	}(f)
 
-	unifiedMode := cgroups.IsCgroup2UnifiedMode()
+	mounts, err := readCgroupMounts(c.procPath("self", "mountinfo"))
+	if err != nil {
+		return err
+	}
+
+	// The paths in /proc/<pid>/cgroup are rendered relative to the cgroup
+	// namespace of the reader, so reading the container's file from our
+	// namespace yields the host-side paths even when the container uses a
+	// private cgroup namespace.
+	privateNamespace := hasPrivateCgroupNamespace(c, c.Pid)
+	if privateNamespace {
+		c.Log.Infof("Container '%s' uses a private cgroup namespace\n", c.Name)
+	}
+	containerCgroups, err := readCgroups(c.procPath(strconv.Itoa(c.Pid), "cgroup"))
+	if err != nil {
+		if HasPidDied(c, c.Pid) {
+			return nil
+		}
+		return err
+	}
 
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if err = moveCgroup(c, line, unifiedMode); err != nil {
+		if err = moveCgroup(c, line, mounts, containerCgroups, privateNamespace); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func moveCgroup(c *Context, line string, unifiedMode bool) error {
+func moveCgroup(c *Context, line string, mounts []cgroupMount, containerCgroups map[string]string, privateNamespace bool) error {
 	parts := strings.SplitN(line, ":", 3)
 	if len(parts) != 3 {
 		return fmt.Errorf("cannot parse cgroup line %q", line)
@@ -57,26 +82,22 @@ func moveCgroup(c *Context, line string, unifiedMode bool) error {
 		return nil
 	}
 
-	cgroupRoot := "/sys/fs/cgroup"
-	// Special case the unified mount on hybrid cgroup and named hierarchies.
-	// This works on Fedora 31, but we should really parse the mounts to see
-	// where the cgroup hierarchy is mounted.
-	if parts[1] == "" && !unifiedMode {
-		// If it is not using unified mode, the cgroup v2 hierarchy is
-		// usually mounted under /sys/fs/cgroup/unified
-		cgroupRoot = filepath.Join(cgroupRoot, "unified")
+	// already in the cgroup, skip it
+	if containerCgroups[parts[1]] == parts[2] {
+		return nil
+	}
 
-		// Ignore the unified mount if it doesn't exist
-		if _, err := os.Stat(cgroupRoot); err != nil && os.IsNotExist(err) {
-			//continue
-		}
-	} else if parts[1] != "" {
-		// Assume the controller is mounted at /sys/fs/cgroup/$CONTROLLER.
-		controller := strings.TrimPrefix(parts[1], "name=")
-		cgroupRoot = filepath.Join(cgroupRoot, controller)
+	// user managers are only delegated the unified hierarchy
+	if c.UserManager && parts[1] != "" {
+		return nil
 	}
 
-	newCgroup := filepath.Join(cgroupRoot, parts[2])
+	mount, ok := findCgroupMount(c, mounts, parts[1])
+	if !ok {
+		c.Log.Debugf("Cgroup hierarchy '%s' is not mounted, skipping it\n", parts[1])
+		return nil
+	}
+	newCgroup := mount.path(parts[2])
 	if err := os.MkdirAll(newCgroup, 0755); err != nil && !os.IsExist(err) {
 		return err
 	}
@@ -89,13 +110,268 @@ func moveCgroup(c *Context, line string, unifiedMode bool) error {
 		_ = f.Close()
 	}(f)
 
-	if HasPidDied(c.Pid) {
+	if HasPidDied(c, c.Pid) {
 		return nil
 	}
 
-	c.Log.Infof("Moving process %d to cgroup %s\n", c.Pid, newCgroup)
-	if _, err := f.Write([]byte(fmt.Sprintf("%d\n", c.Pid))); err != nil {
-		return fmt.Errorf("Cannot move process %d to cgroup %q: %v\n", c.Pid, newCgroup, err)
+	pids := []int{c.Pid}
+	if c.SharesPidNamespace() {
+		// The processes of the container cannot be told apart from the
+		// other processes in the PID namespace, so take the processes
+		// from the cgroup docker placed the container in.
+		sourceCgroup := mount.path(containerCgroups[parts[1]])
+		if containerPids, err := readCgroupProcs(sourceCgroup); err == nil && len(containerPids) > 0 {
+			pids = containerPids
+		}
+	}
+
+	for _, pid := range pids {
+		c.Log.Infof("Moving process %d to cgroup %s\n", pid, newCgroup)
+		if _, err := f.Write([]byte(fmt.Sprintf("%d\n", pid))); err != nil {
+			if pid != c.Pid && HasPidDied(c, pid) {
+				continue
+			}
+			if c.UserManager && os.IsPermission(err) {
+				return fmt.Errorf("Cannot move process %d to cgroup %q: %v, the docker daemon must use the systemd cgroup driver and run under the same user manager\n", pid, newCgroup, err)
+			}
+			if !c.UserManager && os.Geteuid() != 0 && os.IsPermission(err) {
+				return fmt.Errorf("Cannot move process %d to cgroup %q: %v, running as a non-root user requires the unified cgroup hierarchy and AmbientCapabilities=CAP_DAC_OVERRIDE in the unit\n", pid, newCgroup, err)
+			}
+			return fmt.Errorf("Cannot move process %d to cgroup %q: %v\n", pid, newCgroup, err)
+		}
+	}
+
+	if privateNamespace {
+		movedCgroups, err := readCgroups(c.procPath(strconv.Itoa(c.Pid), "cgroup"))
+		if err != nil {
+			if HasPidDied(c, c.Pid) {
+				return nil
+			}
+			return err
+		}
+		if movedCgroups[parts[1]] != parts[2] {
+			return fmt.Errorf("process %d is in cgroup %q instead of %q after moving it", c.Pid, movedCgroups[parts[1]], parts[2])
+		}
 	}
 	return nil
 }
+
+// cgroupMount is a mounted cgroup hierarchy.
+type cgroupMount struct {
+	// mountPoint is where the hierarchy is mounted.
+	mountPoint string
+	// root is the cgroup of the hierarchy which is mounted, f.ex. the
+	// cgroup of a container whose cgroups are mounted inside it.
+	root string
+	// unified is whether this is the cgroup v2 hierarchy.
+	unified bool
+	// options are the super options of a cgroup v1 hierarchy, which name
+	// its controllers.
+	options map[string]bool
+}
+
+// path returns the path of the cgroup, as listed in /proc/<pid>/cgroup,
+// below the mount point.
+func (m cgroupMount) path(cgroup string) string {
+	if m.root != "/" && (cgroup == m.root || strings.HasPrefix(cgroup, m.root+"/")) {
+		cgroup = strings.TrimPrefix(cgroup, m.root)
+	}
+	return filepath.Join(m.mountPoint, cgroup)
+}
+
+// readCgroupMounts returns the cgroup hierarchies listed in the mountinfo
+// file, where each line is formatted as
+// '<ID> <PARENT> <MAJOR:MINOR> <ROOT> <MOUNT POINT> <OPTIONS> [<OPTIONAL>...] - <TYPE> <SOURCE> <SUPER OPTIONS>'.
+func readCgroupMounts(mountinfo string) ([]cgroupMount, error) {
+	f, err := os.Open(mountinfo)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	var result []cgroupMount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || separator+3 >= len(fields) {
+			continue
+		}
+
+		mount := cgroupMount{
+			mountPoint: unescapeMountinfo(fields[4]),
+			root:       unescapeMountinfo(fields[3]),
+		}
+		switch fields[separator+1] {
+		case "cgroup2":
+			mount.unified = true
+		case "cgroup":
+			mount.options = make(map[string]bool)
+			for _, option := range strings.Split(fields[separator+3], ",") {
+				mount.options[option] = true
+			}
+		default:
+			continue
+		}
+		result = append(result, mount)
+	}
+	return result, scanner.Err()
+}
+
+// findCgroupMount returns the mount of the hierarchy listed in
+// /proc/<pid>/cgroup as controller: an empty string for the cgroup v2
+// hierarchy, else a comma-separated list of controllers or a named hierarchy
+// like 'name=systemd'.  Mounts below --sys-fs-cgroup-path win, and when the
+// hierarchy is not mounted there, f.ex. in a test harness, the usual layout
+// of the directory is assumed.
+func findCgroupMount(c *Context, mounts []cgroupMount, controller string) (cgroupMount, bool) {
+	root := c.sysFsCgroupPath()
+	var found *cgroupMount
+	for i, mount := range mounts {
+		if !mount.provides(controller) {
+			continue
+		}
+		if mount.mountPoint == root || strings.HasPrefix(mount.mountPoint, root+"/") {
+			return mount, true
+		}
+		if found == nil {
+			found = &mounts[i]
+		}
+	}
+
+	if root != DefaultSysFsCgroupPath {
+		if mount, ok := layoutCgroupMount(root, controller); ok {
+			return mount, true
+		}
+	}
+	if found != nil {
+		return *found, true
+	}
+	return cgroupMount{}, false
+}
+
+// provides returns whether the mount is of the hierarchy listed in
+// /proc/<pid>/cgroup as controller.
+func (m cgroupMount) provides(controller string) bool {
+	if controller == "" || m.unified {
+		return controller == "" && m.unified
+	}
+	for _, name := range strings.Split(controller, ",") {
+		if !m.options[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// layoutCgroupMount returns the mount of the hierarchy in the usual layout
+// of a cgroup directory: the cgroup v2 hierarchy at its root in unified mode
+// or in 'unified' on hybrid hosts, and each cgroup v1 hierarchy in a
+// directory named after its controllers.
+func layoutCgroupMount(root string, controller string) (cgroupMount, bool) {
+	var path string
+	if controller == "" {
+		path = root
+		if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+			path = filepath.Join(root, "unified")
+		}
+	} else {
+		path = filepath.Join(root, strings.TrimPrefix(controller, "name="))
+	}
+	if _, err := os.Stat(path); err != nil {
+		return cgroupMount{}, false
+	}
+	return cgroupMount{mountPoint: path, root: "/", unified: controller == ""}, true
+}
+
+// sysFsCgroupPath returns where the cgroup hierarchies are mounted.
+func (c *Context) sysFsCgroupPath() string {
+	if len(c.SysFsCgroupPath) == 0 {
+		return DefaultSysFsCgroupPath
+	}
+	return filepath.Clean(c.SysFsCgroupPath)
+}
+
+// procPath returns the path of the elements below where proc is mounted.
+func (c *Context) procPath(elem ...string) string {
+	root := c.ProcPath
+	if len(root) == 0 {
+		root = DefaultProcPath
+	}
+	return filepath.Join(append([]string{root}, elem...)...)
+}
+
+// unescapeMountinfo reverses the octal escaping of spaces, tabs, newlines
+// and backslashes in mountinfo paths.
+func unescapeMountinfo(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+	var result strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if value, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				result.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		result.WriteByte(path[i])
+	}
+	return result.String()
+}
+
+func readCgroupProcs(cgroup string) ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(cgroup, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+
+	var pids []int
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+func readCgroups(procFile string) (map[string]string, error) {
+	f, err := os.Open(procFile)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	result := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) == 3 {
+			result[parts[1]] = parts[2]
+		}
+	}
+	return result, scanner.Err()
+}
+
+func hasPrivateCgroupNamespace(c *Context, pid int) bool {
+	self, err := os.Readlink(c.procPath("self", "ns", "cgroup"))
+	if err != nil {
+		return false
+	}
+	container, err := os.Readlink(c.procPath(strconv.Itoa(pid), "ns", "cgroup"))
+	if err != nil {
+		return false
+	}
+	return self != container
+}
@@ -0,0 +1,103 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	CleanupNetworks         = "networks"
+	CleanupVolumes          = "volumes"
+	CleanupAnonymousVolumes = "anonymous-volumes"
+)
+
+// predefined networks, which can never be removed
+var predefinedNetworks = map[string]bool{
+	"bridge":  true,
+	"host":    true,
+	"none":    true,
+	"default": true,
+}
+
+// ValidateCleanup checks the --cleanup flag.
+func ValidateCleanup(c *Context) error {
+	for _, resource := range c.Cleanup {
+		switch resource {
+		case CleanupNetworks, CleanupVolumes, CleanupAnonymousVolumes:
+		default:
+			return fmt.Errorf("unsupported cleanup '%s'", resource)
+		}
+	}
+	return nil
+}
+
+func (c *Context) cleanupEnabled(resource string) bool {
+	for _, value := range c.Cleanup {
+		if value == resource {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanupResources removes the resources of the removed container specified
+// by --cleanup.  Resources still used by other containers are left alone.
+func cleanupResources(c *Context, client *docker.Client, container *docker.Container) {
+	if c.cleanupEnabled(CleanupVolumes) {
+		// only volume mounts have a name
+		for _, mount := range container.Mounts {
+			if len(mount.Name) == 0 {
+				continue
+			}
+			err := client.RemoveVolumeWithOptions(docker.RemoveVolumeOptions{Name: mount.Name})
+			switch err {
+			case nil:
+				c.Log.Infof("Removed volume '%s' of container '%s'\n", mount.Name, c.Name)
+			case docker.ErrNoSuchVolume:
+			case docker.ErrVolumeInUse:
+				c.Log.Debugf("Volume '%s' of container '%s' is still in use\n", mount.Name, c.Name)
+			default:
+				c.Log.Warnf("Failed to remove volume '%s' of container '%s': %s\n", mount.Name, c.Name, err)
+			}
+		}
+	}
+
+	if c.cleanupEnabled(CleanupNetworks) && container.NetworkSettings != nil {
+		for name, network := range container.NetworkSettings.Networks {
+			if predefinedNetworks[name] {
+				continue
+			}
+			info, err := client.NetworkInfo(network.NetworkID)
+			if err != nil {
+				if _, ok := err.(*docker.NoSuchNetwork); !ok {
+					c.Log.Warnf("Failed to inspect network '%s' of container '%s': %s\n", name, c.Name, err)
+				}
+				continue
+			}
+			if len(info.Containers) > 0 {
+				c.Log.Debugf("Network '%s' of container '%s' is still in use\n", name, c.Name)
+				continue
+			}
+			if err = client.RemoveNetwork(network.NetworkID); err != nil {
+				c.Log.Warnf("Failed to remove network '%s' of container '%s': %s\n", name, c.Name, err)
+			} else {
+				c.Log.Infof("Removed network '%s' of container '%s'\n", name, c.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultCniConfDir = "/etc/cni/net.d"
+	DefaultCniBinDir  = "/opt/cni/bin"
+)
+
+type cniNetworkConfig struct {
+	name       string
+	cniVersion string
+	plugins    []map[string]interface{}
+}
+
+type cniAttachment struct {
+	config    *cniNetworkConfig
+	ifName    string
+	netns     string
+	container string
+}
+
+// AttachCniNetworks attaches the started container to each of the CNI
+// networks specified by --cni-networks by invoking the CNI plugins of the
+// network with the network namespace of the container.
+func AttachCniNetworks(c *Context) error {
+	for i, name := range c.CniNetworks {
+		config, err := loadCniNetworkConfig(c, name)
+		if err != nil {
+			return err
+		}
+
+		attachment := &cniAttachment{
+			config:    config,
+			ifName:    fmt.Sprintf("cni%d", i),
+			netns:     c.procPath(strconv.Itoa(c.Pid), "ns", "net"),
+			container: c.Id,
+		}
+
+		var prevResult json.RawMessage
+		for _, plugin := range config.plugins {
+			prevResult, err = attachment.invoke(c, "ADD", plugin, prevResult)
+			if err != nil {
+				_ = attachment.del(c)
+				return fmt.Errorf("failed to attach container '%s' to CNI network '%s': %v", c.Name, name, err)
+			}
+		}
+		c.supervisionMu.Lock()
+		c.cniAttachments = append(c.cniAttachments, attachment)
+		c.supervisionMu.Unlock()
+		c.Log.Infof("Container '%s' joined CNI network '%s' with interface %s\n", c.Name, name, attachment.ifName)
+	}
+	return nil
+}
+
+// DetachCniNetworks detaches the container from all CNI networks joined by
+// AttachCniNetworks.
+func DetachCniNetworks(c *Context) error {
+	var lastErr error
+	for i := len(c.cniAttachments) - 1; i >= 0; i-- {
+		attachment := c.cniAttachments[i]
+		if err := attachment.del(c); err != nil {
+			c.Log.Errorf("Failed to detach container '%s' from CNI network '%s': %s\n", c.Name, attachment.config.name, err)
+			lastErr = err
+		} else {
+			c.Log.Infof("Container '%s' left CNI network '%s'\n", c.Name, attachment.config.name)
+		}
+	}
+	c.supervisionMu.Lock()
+	c.cniAttachments = nil
+	c.supervisionMu.Unlock()
+	return lastErr
+}
+
+func (a *cniAttachment) del(c *Context) error {
+	var lastErr error
+	for i := len(a.config.plugins) - 1; i >= 0; i-- {
+		if _, err := a.invoke(c, "DEL", a.config.plugins[i], nil); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (a *cniAttachment) invoke(c *Context, command string, plugin map[string]interface{}, prevResult json.RawMessage) (json.RawMessage, error) {
+	pluginType, ok := plugin["type"].(string)
+	if !ok || len(pluginType) == 0 {
+		return nil, fmt.Errorf("CNI network '%s' has a plugin without a type", a.config.name)
+	}
+
+	binary, err := findCniPlugin(c, pluginType)
+	if err != nil {
+		return nil, err
+	}
+
+	config := make(map[string]interface{}, len(plugin)+3)
+	for key, value := range plugin {
+		config[key] = value
+	}
+	config["name"] = a.config.name
+	config["cniVersion"] = a.config.cniVersion
+	if len(prevResult) > 0 {
+		config["prevResult"] = prevResult
+	}
+	stdin, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("CNI_COMMAND=%s", command),
+		fmt.Sprintf("CNI_CONTAINERID=%s", a.container),
+		fmt.Sprintf("CNI_NETNS=%s", a.netns),
+		fmt.Sprintf("CNI_IFNAME=%s", a.ifName),
+		fmt.Sprintf("CNI_PATH=%s", strings.Join(cniBinDirs(c), string(os.PathListSeparator))),
+	)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		message := strings.TrimSpace(stdout.String())
+		if len(message) == 0 {
+			message = strings.TrimSpace(stderr.String())
+		}
+		return nil, fmt.Errorf("CNI plugin '%s' %s failed: %v: %s", pluginType, command, err, message)
+	}
+	return stdout.Bytes(), nil
+}
+
+func loadCniNetworkConfig(c *Context, name string) (*cniNetworkConfig, error) {
+	confDir := c.CniConfDir
+	if len(confDir) == 0 {
+		confDir = DefaultCniConfDir
+	}
+
+	files, err := ioutil.ReadDir(confDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if file.IsDir() || (ext != ".conflist" && ext != ".conf" && ext != ".json") {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(confDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var raw map[string]interface{}
+		if err = json.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("failed to parse CNI configuration '%s': %v", file.Name(), err)
+		}
+		if raw["name"] != name {
+			continue
+		}
+
+		config := &cniNetworkConfig{name: name}
+		config.cniVersion, _ = raw["cniVersion"].(string)
+		if plugins, ok := raw["plugins"].([]interface{}); ok {
+			for _, plugin := range plugins {
+				if p, ok := plugin.(map[string]interface{}); ok {
+					config.plugins = append(config.plugins, p)
+				}
+			}
+		} else {
+			config.plugins = append(config.plugins, raw)
+		}
+		return config, nil
+	}
+	return nil, fmt.Errorf("CNI network '%s' not found in '%s'", name, confDir)
+}
+
+func cniBinDirs(c *Context) []string {
+	if len(c.CniBinDir) == 0 {
+		return []string{DefaultCniBinDir}
+	}
+	return filepath.SplitList(c.CniBinDir)
+}
+
+func findCniPlugin(c *Context, pluginType string) (string, error) {
+	for _, dir := range cniBinDirs(c) {
+		binary := filepath.Join(dir, pluginType)
+		if _, err := os.Stat(binary); err == nil {
+			return binary, nil
+		}
+	}
+	return "", fmt.Errorf("CNI plugin '%s' not found in '%s'", pluginType, strings.Join(cniBinDirs(c), string(os.PathListSeparator)))
+}
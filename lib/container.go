@@ -19,241 +19,528 @@ import (
 	"errors"
 	"fmt"
 	"github.com/fsouza/go-dockerclient"
-	"io"
-	"io/ioutil"
-	"os"
-	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func RunContainer(c *Context) error {
-	err := lookupNamedContainer(c)
+const (
+	failedContainerSuffix = "-failed-"
+
+	// containerResyncInterval is the interval at which the state of the
+	// container is resynced while waiting for it to exit.
+	containerResyncInterval = time.Minute
+)
+
+func RunContainer(c *Context) (err error) {
+	c.startTelemetry()
+
+	if len(c.AdoptId) > 0 {
+		err = resolveAdoptedContainer(c)
+		if err != nil {
+			return err
+		}
+	}
+
+	unlock, err := lockName(c)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if c.resumed != nil {
+		if resumed, err := resumeContainer(c); err != nil || resumed {
+			return err
+		}
+	}
+
+	if c.SwarmService {
+		return withClass(runService(c), ErrStart)
+	}
+
+	if len(c.AdoptId) > 0 {
+		err = adoptContainer(c)
+	} else {
+		err = lookupNamedContainer(c)
+	}
 	if err != nil {
 		return err
 	}
 
 	if len(c.Id) == 0 {
-		err := createContainer(c)
+		// rewrite the arguments, so they run before the concurrent phases
+		// reading them
+		err = validateSecurityProfiles(c)
+		if err != nil {
+			return withClass(err, ErrCreate)
+		}
+		err = checkLimits(c)
+		if err != nil {
+			return withClass(err, ErrCreate)
+		}
+
+		err = runConcurrently(
+			func() error { return validatePlatform(c) },
+			func() error { return validateNetworks(c) },
+			func() error { return waitForDevices(c) },
+			func() error {
+				if err := loadImageTar(c); err != nil {
+					return err
+				}
+				if err := checkOffline(c); err != nil {
+					return err
+				}
+				if err := pullImage(c); err != nil {
+					return err
+				}
+				if err := checkImageDigest(c); err != nil {
+					return err
+				}
+				return verifySignature(c)
+			},
+			func() error { return prepareVolumes(c) },
+		)
 		if err != nil {
 			return err
 		}
 
-		err = joinNetworks(c)
+		useMirrorImage(c)
+		pinImage(c)
+
+		// inspects the image, so it runs once the image was pulled
+		err = ensureInit(c)
+		if err != nil {
+			return withClass(err, ErrCreate)
+		}
+
+		setStatus(c, "Creating container")
+		start := time.Now()
+		err = createContainer(c)
+		if err != nil {
+			rollbackContainer(c)
+			return withClass(err, ErrCreate)
+		}
+		c.recordPhase(PhaseCreate, start)
+		defer func() {
+			if err != nil {
+				rollbackContainer(c)
+			}
+		}()
+
+		err = validateImagePlatform(c)
 		if err != nil {
 			return err
 		}
+
+		start = time.Now()
+		err = joinNetworks(c)
+		if err != nil {
+			return withClass(err, ErrCreate)
+		}
+		c.recordPhase(PhaseJoin, start)
 	}
 
 	if c.Pid == 0 {
-		err := startContainer(c)
+		setStatus(c, "Starting container")
+		start := time.Now()
+		err = startContainer(c)
 		if err != nil {
-			return err
+			return withClass(err, ErrStart)
+		}
+		c.recordPhase(PhaseStart, start)
+		c.Metrics().AddCounter("systemd_docker_starts_total", "Number of times the container was started", 1)
+		countStart(c)
+
+		err = AttachCniNetworks(c)
+		if err != nil {
+			return withClass(err, ErrStart)
 		}
 	}
 
 	if c.Pid == 0 {
-		return errors.New("failed to launch container, pid is 0")
+		return fmt.Errorf("%w: pid is 0", ErrStart)
 	}
 
 	return nil
 }
 
-func WaitForContainerExit(c *Context) error {
-	c.Log.Infof("Waiting for container '%s' to exit\n", c.Name)
+// rollbackContainer removes a container created by RunContainer which failed
+// to start, along with any network endpoints joined, so that the name is not
+// blocked for the next attempt.
+func rollbackContainer(c *Context) {
+	if err := DetachCniNetworks(c); err != nil {
+		c.Log.Warnf("Failed to detach partially created container '%s' from CNI networks: %s\n", c.Name, err)
+	}
+
+	if len(c.Id) == 0 {
+		return
+	}
 
-	client, err := c.GetClient()
+	engine, err := c.GetEngine()
 	if err != nil {
-		return err
+		c.Log.Errorf("Failed to remove partially created container '%s': %s\n", c.Name, err)
+		return
 	}
 
-	containerOptions := docker.InspectContainerOptions{ID: c.Id}
-	for true {
-		container, err := client.InspectContainerWithOptions(containerOptions)
-		if err != nil {
-			return err
-		}
+	err = engine.Remove(c, c.Id, true)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return
+	}
+	if err != nil {
+		c.Log.Errorf("Failed to remove partially created container '%s': %s\n", c.Name, err)
+		return
+	}
 
-		if container.State.Running {
-			break
-		} else {
-			c.Log.Infof("Container '%s' is not running\n", c.Name)
-			return nil
-		}
+	c.Log.Infof("Removed partially created container '%s'\n", c.Name)
+	setContainerId(c, "")
+	c.Pid = 0
+}
+
+func WaitForContainerExit(c *Context) error {
+	c.Log.Infof("Waiting for container '%s' to exit\n", c.Name)
+
+	engine, err := c.GetEngine()
+	if err != nil {
+		return err
 	}
 
+	// subscribe before inspecting, so that a die between the two cannot be
+	// missed
 	listener := make(chan *docker.APIEvents)
-
-	eventsOptions := docker.EventsOptions{
-		Filters: map[string][]string{
-			"type":      {"container"},
-			"container": {c.Id},
-			"event":     {"die"},
-		},
+	unsubscribe, err := engine.Events(c, c.Id, []string{"die"}, listener)
+	if err != nil {
+		return err
 	}
+	defer func() { unsubscribe() }()
 
-	if err = client.AddEventListenerWithOptions(eventsOptions, listener); err != nil {
+	if stopped, err := reconcileContainerExit(c, engine); err != nil || stopped {
 		return err
 	}
-	defer func() { _ = client.RemoveEventListener(listener) }()
+
+	// events can still be lost, e.g. when the daemon restarts, so resync
+	// with the container state periodically as a safety net
+	resync := time.NewTicker(containerResyncInterval)
+	defer resync.Stop()
+	shutdown := c.Done()
+	deadline := maxRuntimeDeadline(c, engine)
 
 	for {
 		select {
 		case ev, ok := <-listener:
 			if !ok || ev == nil {
-				return errors.New("event listener closed")
+				c.Log.Warnf("Event listener for container '%s' closed, resyncing\n", c.Name)
+				if stopped, err := reconcileContainerExit(c, engine); err != nil || stopped {
+					return err
+				}
+				listener = make(chan *docker.APIEvents)
+				if unsubscribe, err = engine.Events(c, c.Id, []string{"die"}, listener); err != nil {
+					return err
+				}
+				continue
 			}
 			if ev.Action == "die" {
 				c.Log.Infof("Container '%s' has stopped\n", c.Name)
+				c.stoppedAt = time.Now()
+				if exitCode, err := strconv.Atoi(ev.Actor.Attributes["exitCode"]); err == nil {
+					c.ExitCode = exitCode
+				}
 				return nil
 			}
+		case <-resync.C:
+			if stopped, err := reconcileContainerExit(c, engine); err != nil || stopped {
+				return err
+			}
+		case <-deadline:
+			// keep waiting for the die event of the stopped container
+			deadline = nil
+			c.Log.Noticef("Container '%s' reached its maximum runtime of %s\n", c.Name, c.MaxRuntime)
+			c.maxRuntimeReached = true
+			if err = stopContainer(c); err != nil {
+				return err
+			}
+		case <-shutdown:
+			if !c.StopOnSignal {
+				c.Log.Infof("Leaving container '%s' running\n", c.Name)
+				return ErrShutdown
+			}
+			// keep waiting for the die event of the stopped container
+			shutdown = nil
+			if err = stopContainer(c); err != nil {
+				return err
+			}
 		}
 	}
 }
 
+// reconcileContainerExit inspects the container and records its exit if it
+// is no longer running.  A container which was replaced or lost meanwhile is
+// remediated according to --stale-container.
+func reconcileContainerExit(c *Context, engine ContainerEngine) (bool, error) {
+	container, err := engine.Inspect(c, c.Id)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return true, remediateStaleContainer(c, engine, fmt.Sprintf("container '%s' (%s) no longer exists", c.Name, shortId(c.Id)))
+	}
+	if err != nil {
+		return false, err
+	}
+	if container.State.Running {
+		return false, checkStaleContainer(c, engine, container)
+	}
+
+	c.Log.Infof("Container '%s' is not running\n", c.Name)
+	c.stoppedAt = time.Now()
+	c.ExitCode = container.State.ExitCode
+	return true, nil
+}
+
+// ContainerExitError returns an ExitError propagating the exit code of the
+// stopped container, unless it is one of the --ok-exit-codes.
+func ContainerExitError(c *Context) error {
+	if c.maxRuntimeReached {
+		if c.MaxRuntimeExitCode == 0 {
+			return nil
+		}
+		return &ExitError{
+			Code: c.MaxRuntimeExitCode,
+			Err:  fmt.Errorf("container '%s' was stopped after its maximum runtime of %s", c.Name, c.MaxRuntime),
+		}
+	}
+	if atomic.LoadInt32(&c.deviceReplugged) != 0 {
+		return &ExitError{
+			Code: ExitCodeDeviceReplugged,
+			Err:  fmt.Errorf("container '%s' was stopped after a device was added again", c.Name),
+		}
+	}
+	if c.IsOkExitCode(c.ExitCode) {
+		if c.ExitCode != 0 {
+			c.Log.Infof("Container '%s' exited with code %d, which is treated as success\n", c.Name, c.ExitCode)
+		}
+		return nil
+	}
+	err := fmt.Errorf("container '%s' exited with code %d", c.Name, c.ExitCode)
+	if c.unhealthyBeforeReady() {
+		err = fmt.Errorf("%w: container '%s' exited with code %d before it became healthy", ErrUnhealthy, c.Name, c.ExitCode)
+	}
+	return &ExitError{
+		Code: c.ExitCode,
+		Err:  err,
+	}
+}
+
 func RemoveContainer(c *Context) error {
 	if !c.Rm {
+		stopReached(c)
 		return nil
 	}
 
-	client, err := c.GetClient()
-	if err != nil {
+	if c.SwarmService {
+		err := removeService(c)
+		if err == nil {
+			stopReached(c)
+		}
 		return err
 	}
 
-	return client.RemoveContainer(docker.RemoveContainerOptions{
-		ID:    c.Id,
-		Force: true,
-	})
-}
-
-func lookupNamedContainer(c *Context) error {
-	client, err := c.GetClient()
+	engine, err := c.GetEngine()
 	if err != nil {
 		return err
 	}
 
-	containerOptions := docker.InspectContainerOptions{ID: c.Name}
-	container, err := client.InspectContainerWithOptions(containerOptions)
+	container, err := engine.Inspect(c, c.Id)
 	if _, ok := err.(*docker.NoSuchContainer); ok {
 		return nil
 	}
-	if err != nil || container == nil {
+	if err != nil {
 		return err
 	}
 
-	if container.State.Running {
-		c.Id = container.ID
-		c.Pid = container.State.Pid
-		return nil
-	} else if c.Rm {
-		return client.RemoveContainer(docker.RemoveContainerOptions{
-			ID:    container.ID,
-			Force: true,
-		})
+	err = removeStoppedContainer(c, container)
+	if err == nil {
+		stopReached(c)
 	}
-	return nil
+	return err
 }
 
-func getDockerCommand() string {
-	dockerCommand := os.Getenv("DOCKER_COMMAND")
-	if len(dockerCommand) == 0 {
-		dockerCommand = "docker"
+// removeStoppedContainer removes the stopped container, unless it failed and
+// --keep-on-failure is set, in which case it is renamed out of the way so that
+// it can be inspected later.
+func removeStoppedContainer(c *Context, container *docker.Container) error {
+	if !c.KeepOnFailure || c.maxRuntimeReached || c.IsOkExitCode(container.State.ExitCode) {
+		engine, err := c.GetEngine()
+		if err != nil {
+			return err
+		}
+		if err = engine.Remove(c, container.ID, c.cleanupEnabled(CleanupAnonymousVolumes)); err != nil {
+			return err
+		}
+		if !c.daemonless() {
+			client, err := c.GetClient()
+			if err != nil {
+				return err
+			}
+			cleanupResources(c, client, container)
+		}
+		return nil
 	}
-	return dockerCommand
-}
-
-func createContainer(c *Context) error {
-	args := append([]string{"create"}, c.Args...)
-	dockerCommand := getDockerCommand()
-
-	c.Cmd = exec.Command(dockerCommand, args...)
 
-	errorPipe, err := c.Cmd.StderrPipe()
+	engine, err := c.GetEngine()
 	if err != nil {
 		return err
 	}
+	name := fmt.Sprintf("%s%s%d", c.Name, failedContainerSuffix, container.State.FinishedAt.Unix())
+	if err = engine.Rename(c, container.ID, name); err != nil {
+		return err
+	}
+	c.Log.Noticef("Container '%s' exited with code %d, keeping it as '%s'\n", c.Name, container.State.ExitCode, name)
+
+	return pruneFailedContainers(c, engine)
+}
+
+func pruneFailedContainers(c *Context, engine ContainerEngine) error {
+	if c.KeepFailed <= 0 {
+		return nil
+	}
 
-	outputPipe, err := c.Cmd.StdoutPipe()
+	prefix := fmt.Sprintf("/%s%s", c.Name, failedContainerSuffix)
+	containers, err := engine.List(c, prefix[1:])
 	if err != nil {
 		return err
 	}
 
-	err = c.Cmd.Start()
+	var failed []docker.APIContainers
+	for _, container := range containers {
+		for _, name := range container.Names {
+			if strings.HasPrefix(name, prefix) {
+				failed = append(failed, container)
+				break
+			}
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].Created > failed[j].Created
+	})
+
+	for i := c.KeepFailed; i < len(failed); i++ {
+		if err = engine.Remove(c, failed[i].ID, false); err != nil {
+			return err
+		}
+		c.Log.Infof("Removed failed container '%s'\n", strings.TrimPrefix(failed[i].Names[0], "/"))
+	}
+	return nil
+}
+
+// resolveAdoptedContainer resolves the name of the container specified by
+// --id.
+func resolveAdoptedContainer(c *Context) error {
+	engine, err := c.GetEngine()
 	if err != nil {
 		return err
 	}
 
-	go func() {
-		_, _ = io.Copy(os.Stderr, errorPipe)
-	}()
-
-	bytes, err := ioutil.ReadAll(outputPipe)
+	container, err := engine.Inspect(c, c.AdoptId)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return fmt.Errorf("container '%s' does not exist", c.AdoptId)
+	}
 	if err != nil {
 		return err
 	}
 
-	c.Id = strings.TrimSpace(string(bytes))
+	name := strings.TrimPrefix(container.Name, "/")
+	if len(c.Name) > 0 && c.Name != name {
+		return fmt.Errorf("container '%s' is named '%s' instead of '%s'", c.AdoptId, name, c.Name)
+	}
+	c.Name = name
+	return nil
+}
 
-	err = c.Cmd.Wait()
+// adoptContainer supervises the existing container specified by --id,
+// starting it if it is not running.
+func adoptContainer(c *Context) error {
+	engine, err := c.GetEngine()
 	if err != nil {
 		return err
 	}
 
-	if !c.Cmd.ProcessState.Success() {
+	container, err := engine.Inspect(c, c.AdoptId)
+	if err != nil {
 		return err
 	}
 
+	setContainerId(c, container.ID)
+	if container.State.Running {
+		c.Pid = container.State.Pid
+		setPidMode(c, container)
+		rememberContainer(c, container)
+		c.Log.Infof("Adopted running container '%s' (%s)\n", c.Name, c.Id)
+	} else {
+		c.Log.Infof("Adopted stopped container '%s' (%s)\n", c.Name, c.Id)
+	}
 	return nil
 }
 
-func joinNetworks(c *Context) error {
-	dockerCommand := getDockerCommand()
-	for name, ipAddress := range c.Networks.Get() {
-		args := []string{
-			"network",
-			"connect",
-		}
+func lookupNamedContainer(c *Context) error {
+	engine, err := c.GetEngine()
+	if err != nil {
+		return err
+	}
 
-		var ipMessage string
-		if len(ipAddress) == 0 {
-			ipMessage = "dhcp"
-		} else {
-			ipMessage = fmt.Sprintf("IP %s", ipAddress)
-			args = append(args, "--ip", ipAddress)
-		}
-		args = append(args, name, c.Id)
-		c.Cmd = exec.Command(dockerCommand, args...)
+	container, err := engine.Inspect(c, c.Name)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return nil
+	}
+	if err != nil || container == nil {
+		return err
+	}
 
-		errorPipe, err := c.Cmd.StderrPipe()
-		if err != nil {
-			return err
+	if container.State.Running {
+		if c.RecreateOnImageChange {
+			if changed, err := imageChanged(c, engine, container); err != nil {
+				return err
+			} else if changed {
+				return recreateContainer(c, engine, container)
+			}
 		}
+		setContainerId(c, container.ID)
+		c.Pid = container.State.Pid
+		setPidMode(c, container)
+		rememberContainer(c, container)
+		return nil
+	} else if c.Rm {
+		return removeStoppedContainer(c, container)
+	}
+	return nil
+}
 
-		outputPipe, err := c.Cmd.StdoutPipe()
-		if err != nil {
-			return err
-		}
+func createContainer(c *Context) error {
+	engine, err := c.GetEngine()
+	if err != nil {
+		return err
+	}
+	c.Id, err = engine.Create(c)
+	return err
+}
 
-		err = c.Cmd.Start()
-		if err != nil {
-			return err
+func joinNetworks(c *Context) error {
+	networks := c.Networks.Get()
+	joined := 0
+	for name, ipAddress := range networks {
+		joined++
+		setStatus(c, "Connecting networks (%d/%d)", joined, len(networks))
+
+		ipMessage := "dhcp"
+		if len(ipAddress) > 0 {
+			ipMessage = fmt.Sprintf("IP %s", ipAddress)
 		}
 
-		go func() {
-			_, _ = io.Copy(os.Stdout, outputPipe)
-		}()
-
-		go func() {
-			_, _ = io.Copy(os.Stderr, errorPipe)
-		}()
-
-		err = c.Cmd.Wait()
+		engine, err := c.GetEngine()
 		if err != nil {
 			return err
 		}
-
-		if !c.Cmd.ProcessState.Success() {
-			return err
+		if err = engine.NetworkConnect(c, c.Id, name, ipAddress); err != nil {
+			return fmt.Errorf("failed to connect container '%s' to network '%s': %v", c.Name, name, err)
 		}
 
 		c.Log.Infof("Container '%s' joined network '%s' with %s\n", c.Name, name, ipMessage)
@@ -263,53 +550,78 @@ func joinNetworks(c *Context) error {
 }
 
 func startContainer(c *Context) error {
-	dockerCommand := getDockerCommand()
-	c.Cmd = exec.Command(dockerCommand, "start", c.Id)
-
-	errorPipe, err := c.Cmd.StderrPipe()
+	engine, err := c.GetEngine()
 	if err != nil {
 		return err
 	}
-
-	outputPipe, err := c.Cmd.StdoutPipe()
-	if err != nil {
+	if err = engine.Start(c, c.Id); err != nil {
 		return err
 	}
+	c.Pid, err = getContainerPid(c)
+	return err
+}
 
-	err = c.Cmd.Start()
-	if err != nil {
-		return err
+// runConcurrently runs the independent startup phases concurrently, so that
+// the time to READY is bounded by the slowest phase rather than their sum.  It
+// returns the error of the first phase in order which failed.
+func runConcurrently(phases ...func() error) error {
+	errs := make([]error, len(phases))
+	var wg sync.WaitGroup
+	for i, phase := range phases {
+		wg.Add(1)
+		go func(i int, phase func() error) {
+			defer wg.Done()
+			errs[i] = phase()
+		}(i, phase)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	go func() {
-		_, _ = io.Copy(os.Stdout, outputPipe)
-	}()
-
-	go func() {
-		_, _ = io.Copy(os.Stderr, errorPipe)
-	}()
+// inspectContainer returns the inspection of the container taken when it was
+// found or started, inspecting it if there is none.  The phases up to READY
+// only read its configuration and network settings, which do not change
+// while it runs, so they share the inspection instead of repeating it.
+func inspectContainer(c *Context) (*docker.Container, error) {
+	c.inspectedMu.Lock()
+	defer c.inspectedMu.Unlock()
+	if c.inspected != nil && c.inspected.ID == c.Id {
+		return c.inspected, nil
+	}
 
-	err = c.Cmd.Wait()
+	engine, err := c.GetEngine()
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if !c.Cmd.ProcessState.Success() {
-		return err
+	container, err := engine.Inspect(c, c.Id)
+	if err != nil {
+		return nil, err
 	}
+	c.inspected = container
+	return container, nil
+}
 
-	c.Pid, err = getContainerPid(c)
-
-	return err
+// rememberContainer records the inspection of the running container for
+// inspectContainer.
+func rememberContainer(c *Context, container *docker.Container) {
+	c.inspectedMu.Lock()
+	defer c.inspectedMu.Unlock()
+	c.inspected = container
 }
 
 func getContainerPid(c *Context) (int, error) {
-	client, err := c.GetClient()
+	engine, err := c.GetEngine()
 	if err != nil {
 		return 0, err
 	}
 
-	container, err := client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: c.Id})
+	container, err := engine.Inspect(c, c.Id)
 	if err != nil {
 		return 0, err
 	}
@@ -322,5 +634,18 @@ func getContainerPid(c *Context) (int, error) {
 		return 0, errors.New(fmt.Sprintf("Pid is %d for container '%s'", container.State.Pid, c.Id))
 	}
 
+	setPidMode(c, container)
+	rememberContainer(c, container)
+
 	return container.State.Pid, nil
 }
+
+func setPidMode(c *Context, container *docker.Container) {
+	if container.HostConfig == nil {
+		return
+	}
+	c.PidMode = container.HostConfig.PidMode
+	if c.SharesPidNamespace() {
+		c.Log.Infof("Container '%s' shares the PID namespace '%s'\n", c.Name, c.PidMode)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// ExecOptions configure a command run in the container of a unit.
+type ExecOptions struct {
+	User    string
+	Workdir string
+	Env     []string
+}
+
+// ExecContainer runs the command in the running container of the unit,
+// attached to the standard streams and with a TTY if they are terminals.
+// Without a name, the container is named after the unit systemd-docker runs
+// in, as with --name %n.  A failing command yields an ExitError with its exit
+// code.
+func ExecContainer(c *Context, options ExecOptions, command []string) error {
+	if len(command) == 0 {
+		return errors.New("no command specified")
+	}
+
+	if len(c.Name) == 0 {
+		unit, err := currentUnit()
+		if err != nil {
+			return fmt.Errorf("cannot determine the unit of the container, specify its name: %v", err)
+		}
+		c.Name = unit
+	}
+
+	engine, err := c.GetEngine()
+	if err != nil {
+		return err
+	}
+
+	container, err := engine.Inspect(c, c.Name)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return fmt.Errorf("container '%s' does not exist", c.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if !container.State.Running {
+		return fmt.Errorf("container '%s' is not running", c.Name)
+	}
+
+	return engine.Exec(c, container.ID, options, command)
+}
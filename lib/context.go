@@ -16,45 +16,289 @@
 package lib
 
 import (
+	"context"
+	"fmt"
 	dockerClient "github.com/fsouza/go-dockerclient"
+	"github.com/spf13/pflag"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"time"
 )
 
+// clientCheckInterval is the minimum interval between checks whether the
+// current daemon is still responding, when failover endpoints are specified.
+const clientCheckInterval = 5 * time.Second
+
 type Context struct {
-	Args          []string
-	Cgroups       []string
-	AllCgroups    bool
-	Logs          bool
-	Notify        bool
-	Action        string
-	Name          string
-	Env           bool
-	Rm            bool
-	Id            string
-	NotifySocket  string
-	Cmd           *exec.Cmd
-	Pid           int
-	PidFile       string
-	client        *dockerClient.Client
-	Networks      Networks
-	Log           *logger
-	PrintVersion  bool
-	CpuProfile    string
-	MemoryProfile string
-	TraceProfile  string
+	Args                     []string
+	Cgroups                  []string
+	AllCgroups               bool
+	Logs                     bool
+	SyslogIdentifier         string
+	LogBufferSize            int
+	logBufferSize            string
+	EventQueueSize           int
+	LogFile                  string
+	LogFileMaxSize           int64
+	logFileMaxSize           string
+	LogFileMaxFiles          int
+	LogFileMaxAge            time.Duration
+	LogFileCompress          string
+	Notify                   bool
+	NotifyBridge             string
+	NotifyBridgeUrl          string
+	notifyBridgeToken        string
+	UserManager              bool
+	UnitPreflight            bool
+	UnitMetadata             []string
+	Audit                    bool
+	WatchdogCheck            string
+	WatchdogStaleness        time.Duration
+	WatchdogTriggerFailures  int
+	WatchdogTriggerUnhealthy time.Duration
+	Probes                   []string
+	ProbePolicy              string
+	ProbeInterval            time.Duration
+	ProbeTimeout             time.Duration
+	Sidecars                 []string
+	GroupPolicy              string
+	GroupInterval            time.Duration
+	MonitorEvents            []string
+	ReadyGates               []string
+	ReadyGateInterval        time.Duration
+	ReadyGateTimeout         time.Duration
+	readyGatesPassed         int
+	readyGatesMu             sync.Mutex
+	Action                   string
+	Name                     string
+	HostnameTemplate         string
+	Image                    string
+	ImageTar                 string
+	Offline                  bool
+	Platform                 string
+	RegistryMirrors          []string
+	PullPolicy               string
+	PullRetries              int
+	PullRetryDelay           time.Duration
+	RegistryAuthFile         string
+	VerifySignature          string
+	pinnedImage              string
+	ExpectedDigest           string
+	DigestCheck              string
+	mirrorImage              string
+	AllowEmulation           bool
+	DenyPrivileged           bool
+	MaxCaps                  []string
+	EnforceReadOnly          bool
+	ReadOnlyTmpfs            []string
+	DropCapabilities         bool
+	EnsureInit               string
+	LimitCheck               string
+	RecreateOnImageChange    bool
+	Env                      bool
+	EnvInclude               []string
+	EnvExclude               []string
+	EnvMap                   []string
+	EncryptedEnvFiles        []string
+	secretEnv                []string
+	ExpandEnv                bool
+	Rm                       bool
+	Cleanup                  []string
+	FreshVolumes             bool
+	VolumeRetentionDays      int
+	VolumePruneDryRun        bool
+	StopOnSignal             bool
+	MaxRuntime               time.Duration
+	MaxRuntimeExitCode       int
+	StaleContainer           string
+	maxRuntimeReached        bool
+	FdStore                  bool
+	DockerRestart            string
+	RestartCheck             string
+	Backups                  []string
+	KeepOnFailure            bool
+	KeepFailed               int
+	Id                       string
+	inspected                *dockerClient.Container
+	inspectedMu              sync.Mutex
+	stateFile                string
+	stateFileMu              sync.Mutex
+	runtimeState             runtimeState
+	runtimeStateMu           sync.Mutex
+	supervisionMu            sync.Mutex
+	AdoptId                  string
+	startedAt                time.Time
+	resumed                  *reexecState
+	fdStoreSlot              int
+	notifyFile               *os.File
+	SwarmService             bool
+	SwarmTaskWait            time.Duration
+	NotifySocket             string
+	Cmd                      *exec.Cmd
+	Pid                      int
+	ExitCode                 int
+	OkExitCodes              []int
+	PidMode                  string
+	PidFile                  string
+	EnvFile                  string
+	IpFile                   string
+	Firewall                 string
+	FirewallRules            []string
+	FirewallZone             string
+	TrafficShaping           []string
+	trafficShaping           []*trafficShaping
+	shapedDevices            []string
+	firewallRules            []string
+	client                   *dockerClient.Client
+	clientMu                 sync.Mutex
+	clientChecked            time.Time
+	phases                   phaseTimings
+	StatsD                   StatsDOptions
+	MetricsListen            string
+	stoppedAt                time.Time
+	Docker                   DockerOptions
+	Engine                   string
+	engine                   ContainerEngine
+	enginePlugged            bool
+	engineMu                 sync.Mutex
+	metrics                  *Metrics
+	metricsOnce              sync.Once
+	shutdown                 chan struct{}
+	shutdownInit             sync.Once
+	shutdownOnce             sync.Once
+	stoppingOnce             sync.Once
+	DaemonWait               time.Duration
+	Networks                 Networks
+	NetworkWait              time.Duration
+	DeviceWait               time.Duration
+	DeviceHotplug            string
+	deviceReplugged          int32
+	DiskUsageInterval        time.Duration
+	DiskUsageLimit           int64
+	diskUsageLimit           string
+	CniNetworks              []string
+	CniConfDir               string
+	CniBinDir                string
+	SysFsCgroupPath          string
+	ProcPath                 string
+	cniAttachments           []*cniAttachment
+	Log                      *logger
+	flags                    *pflag.FlagSet
+	embedded                 bool
+	onEvent                  func(LifecycleEvent)
+	monitorCtx               context.Context
+	stopMonitorCtx           context.CancelFunc
+	monitors                 sync.WaitGroup
+	PrintVersion             bool
+	CpuProfile               string
+	MemoryProfile            string
+	TraceProfile             string
 }
 
+// GetClient returns the API client.  When several daemon endpoints are
+// specified, the first responding endpoint is used, and the client fails over
+// to the next responding endpoint once the current one stops responding.
+// Once the container was created or adopted, the endpoint is kept for the
+// rest of the run, as no other daemon knows the container.
 func (c *Context) GetClient() (*dockerClient.Client, error) {
-	var err error
-	if c.client == nil {
-		endpoint := os.Getenv("DOCKER_HOST")
-		if len(endpoint) == 0 {
-			endpoint = "unix:///var/run/docker.sock"
+	c.clientMu.Lock()
+	defer c.clientMu.Unlock()
+
+	if c.client != nil {
+		if !c.Docker.HasFailover() || time.Since(c.clientChecked) < clientCheckInterval || c.hasContainer() {
+			return c.client, nil
+		}
+		c.clientChecked = time.Now()
+		if err := c.client.Ping(); err == nil {
+			return c.client, nil
+		}
+		c.Log.Warnf("Docker daemon '%s' is not responding, failing over\n", c.Docker.endpoint)
+		closeIdleConnections(c.client)
+	}
+
+	endpoints, err := c.Docker.Endpoints()
+	if err != nil {
+		return nil, err
+	}
+	if len(endpoints) == 1 {
+		c.client, err = c.Docker.NewClient(endpoints[0])
+		if err == nil {
+			c.auditClient(c.client)
+		}
+		c.Docker.endpoint = endpoints[0]
+		return c.client, err
+	}
+
+	var lastErr error
+	for _, endpoint := range endpoints {
+		client, err := c.Docker.NewClient(endpoint)
+		if err == nil {
+			c.auditClient(client)
+			err = client.Ping()
+		}
+		if err != nil {
+			if client != nil {
+				closeIdleConnections(client)
+			}
+			c.Log.Debugf("Docker daemon '%s' is not available: %s\n", endpoint, err)
+			lastErr = err
+			continue
+		}
+		if c.client != nil && c.client != client {
+			closeIdleConnections(c.client)
 		}
+		if endpoint != c.Docker.endpoint {
+			c.Log.Infof("Using docker daemon '%s'\n", endpoint)
+		}
+		c.client = client
+		c.clientChecked = time.Now()
+		c.Docker.endpoint = endpoint
+		return c.client, nil
+	}
+	return nil, fmt.Errorf("%w, tried '%s': %v", ErrDaemonUnavailable, strings.Join(endpoints, ","), lastErr)
+}
 
-		c.client, err = dockerClient.NewClient(endpoint)
+// hasContainer returns whether the container was created or adopted.
+func (c *Context) hasContainer() bool {
+	c.supervisionMu.Lock()
+	defer c.supervisionMu.Unlock()
+	return len(c.Id) > 0
+}
+
+// IsOkExitCode returns whether the exit code of the container is treated as
+// success.
+func (c *Context) IsOkExitCode(exitCode int) bool {
+	if exitCode == 0 {
+		return true
+	}
+	for _, ok := range c.OkExitCodes {
+		if ok == exitCode {
+			return true
+		}
 	}
+	return false
+}
+
+// SharesPidNamespace returns whether the container shares the PID namespace
+// of the host or of another container.
+func (c *Context) SharesPidNamespace() bool {
+	return c.PidMode == "host" || strings.HasPrefix(c.PidMode, "container:")
+}
+
+// Metrics returns the registry of metrics reported for the container.
+func (c *Context) Metrics() *Metrics {
+	c.metricsOnce.Do(func() {
+		c.metrics = newMetrics()
+	})
+	return c.metrics
+}
 
-	return c.client, err
+// StatsDOptions configure the emission of metrics to StatsD.
+type StatsDOptions struct {
+	Address   string
+	Prefix    string
+	Tags      []string
+	DogStatsD bool
 }
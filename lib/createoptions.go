@@ -0,0 +1,778 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUnsupportedDockerFlag is returned by createOptions for docker run flags
+// which are not translated to the docker API.
+var errUnsupportedDockerFlag = errors.New("unsupported docker flag")
+
+// shorthands of docker run flags
+var dockerShortFlags = map[string]string{
+	"a": "attach",
+	"c": "cpu-shares",
+	"d": "detach",
+	"e": "env",
+	"h": "hostname",
+	"i": "interactive",
+	"l": "label",
+	"m": "memory",
+	"p": "publish",
+	"P": "publish-all",
+	"q": "quiet",
+	"t": "tty",
+	"u": "user",
+	"v": "volume",
+	"w": "workdir",
+}
+
+// deprecated names of docker run flags
+var dockerFlagAliases = map[string]string{
+	"net":       "network",
+	"net-alias": "network-alias",
+	"dns-opt":   "dns-option",
+}
+
+type dockerFlag struct {
+	name  string
+	value string
+}
+
+// parseDockerRunArgs splits the docker run arguments into the flags, with
+// shorthands and deprecated names replaced by the names of the flags, the
+// image and the command.
+func parseDockerRunArgs(args []string) ([]dockerFlag, string, []string, error) {
+	var flags []dockerFlag
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+1 < len(args) {
+				return flags, args[i+1], args[i+2:], nil
+			}
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return flags, arg, args[i+1:], nil
+		}
+
+		if strings.HasPrefix(arg, "--") {
+			name, value, hasValue := arg[2:], "", false
+			if j := strings.Index(name, "="); j >= 0 {
+				name, value, hasValue = name[:j], name[j+1:], true
+			}
+			if alias, ok := dockerFlagAliases[name]; ok {
+				name = alias
+			}
+			if !hasValue {
+				if dockerBoolFlags[name] {
+					value = "true"
+				} else if i+1 < len(args) {
+					i++
+					value = args[i]
+				} else {
+					return nil, "", nil, fmt.Errorf("docker flag '%s' needs a value", name)
+				}
+			}
+			flags = append(flags, dockerFlag{name: name, value: value})
+			continue
+		}
+
+		// combined short flags, only the last one can take a value
+		shorthands := arg[1:]
+		for k := 0; k < len(shorthands); k++ {
+			name, ok := dockerShortFlags[shorthands[k:k+1]]
+			if !ok {
+				return nil, "", nil, fmt.Errorf("%w '-%s'", errUnsupportedDockerFlag, shorthands[k:k+1])
+			}
+			if dockerBoolFlags[name] {
+				flags = append(flags, dockerFlag{name: name, value: "true"})
+				continue
+			}
+			value := strings.TrimPrefix(shorthands[k+1:], "=")
+			if len(value) == 0 {
+				if i+1 >= len(args) {
+					return nil, "", nil, fmt.Errorf("docker flag '%s' needs a value", name)
+				}
+				i++
+				value = args[i]
+			}
+			flags = append(flags, dockerFlag{name: name, value: value})
+			break
+		}
+	}
+	return nil, "", nil, fmt.Errorf("docker run arguments do not contain an image")
+}
+
+// createOptions translates the docker run arguments of the context to the
+// options of the docker API creating the container, like the docker CLI
+// does.  An error wrapping errUnsupportedDockerFlag is returned for flags
+// which are not translated.
+func createOptions(c *Context) (docker.CreateContainerOptions, error) {
+	flags, image, command, err := parseDockerRunArgs(c.Args)
+	if err != nil {
+		return docker.CreateContainerOptions{}, err
+	}
+
+	config := &docker.Config{
+		Image:        image,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	if len(command) > 0 {
+		config.Cmd = command
+	}
+	hostConfig := &docker.HostConfig{}
+	endpoint := &docker.EndpointConfig{}
+	options := docker.CreateContainerOptions{
+		Config:     config,
+		HostConfig: hostConfig,
+	}
+
+	var env, envFiles, labels, labelFiles []string
+	for _, flag := range flags {
+		name, value := flag.name, flag.value
+		invalid := func(err error) error {
+			return fmt.Errorf("docker flag '%s' has an invalid value '%s': %v", name, value, err)
+		}
+
+		switch name {
+		case "name":
+			options.Name = value
+		case "detach", "quiet", "pull", "attach":
+			// images are pulled by pullImage, and the container is
+			// never attached to
+		case "platform":
+			if len(value) > 0 {
+				return options, fmt.Errorf("%w '%s'", errUnsupportedDockerFlag, name)
+			}
+
+		// config
+		case "hostname":
+			config.Hostname = value
+		case "domainname":
+			config.Domainname = value
+		case "user":
+			config.User = value
+		case "workdir":
+			config.WorkingDir = value
+		case "env":
+			env = append(env, value)
+		case "env-file":
+			envFiles = append(envFiles, value)
+		case "label":
+			labels = append(labels, value)
+		case "label-file":
+			labelFiles = append(labelFiles, value)
+		case "entrypoint":
+			// an empty entrypoint resets the entrypoint of the image
+			config.Entrypoint = []string{value}
+		case "expose":
+			ports, err := parsePortRange(value)
+			if err != nil {
+				return options, invalid(err)
+			}
+			if config.ExposedPorts == nil {
+				config.ExposedPorts = make(map[docker.Port]struct{})
+			}
+			for _, port := range ports {
+				config.ExposedPorts[port] = struct{}{}
+			}
+		case "publish":
+			bindings, err := parsePublish(value)
+			if err != nil {
+				return options, invalid(err)
+			}
+			if config.ExposedPorts == nil {
+				config.ExposedPorts = make(map[docker.Port]struct{})
+				hostConfig.PortBindings = make(map[docker.Port][]docker.PortBinding)
+			} else if hostConfig.PortBindings == nil {
+				hostConfig.PortBindings = make(map[docker.Port][]docker.PortBinding)
+			}
+			for port, binding := range bindings {
+				config.ExposedPorts[port] = struct{}{}
+				hostConfig.PortBindings[port] = append(hostConfig.PortBindings[port], binding)
+			}
+		case "tty":
+			config.Tty, err = strconv.ParseBool(value)
+		case "interactive":
+			config.OpenStdin, err = strconv.ParseBool(value)
+			config.AttachStdin = config.OpenStdin
+		case "stop-signal":
+			config.StopSignal = value
+		case "stop-timeout":
+			config.StopTimeout, err = strconv.Atoi(value)
+		case "mac-address":
+			config.MacAddress = value
+		case "health-cmd", "health-interval", "health-timeout", "health-start-period", "health-retries", "no-healthcheck":
+			if config.Healthcheck == nil {
+				config.Healthcheck = &docker.HealthConfig{}
+			}
+			err = parseHealthFlag(config.Healthcheck, name, value)
+		case "volume":
+			if strings.Contains(value, ":") {
+				hostConfig.Binds = append(hostConfig.Binds, value)
+			} else {
+				if config.Volumes == nil {
+					config.Volumes = make(map[string]struct{})
+				}
+				config.Volumes[value] = struct{}{}
+			}
+
+		// host config
+		case "mount":
+			mount, err := parseMount(value)
+			if err != nil {
+				return options, invalid(err)
+			}
+			hostConfig.Mounts = append(hostConfig.Mounts, mount)
+		case "tmpfs":
+			if hostConfig.Tmpfs == nil {
+				hostConfig.Tmpfs = make(map[string]string)
+			}
+			parts := strings.SplitN(value, ":", 2)
+			if len(parts) == 2 {
+				hostConfig.Tmpfs[parts[0]] = parts[1]
+			} else {
+				hostConfig.Tmpfs[parts[0]] = ""
+			}
+		case "volumes-from":
+			hostConfig.VolumesFrom = append(hostConfig.VolumesFrom, value)
+		case "link":
+			hostConfig.Links = append(hostConfig.Links, value)
+		case "network":
+			if len(hostConfig.NetworkMode) > 0 {
+				// docker connects the container to the other
+				// networks after creating it
+				return options, fmt.Errorf("%w '%s' specified more than once", errUnsupportedDockerFlag, name)
+			}
+			hostConfig.NetworkMode = value
+		case "network-alias":
+			endpoint.Aliases = append(endpoint.Aliases, value)
+		case "ip", "ip6":
+			if endpoint.IPAMConfig == nil {
+				endpoint.IPAMConfig = &docker.EndpointIPAMConfig{}
+			}
+			if name == "ip" {
+				endpoint.IPAMConfig.IPv4Address = value
+			} else {
+				endpoint.IPAMConfig.IPv6Address = value
+			}
+		case "dns":
+			hostConfig.DNS = append(hostConfig.DNS, value)
+		case "dns-search":
+			hostConfig.DNSSearch = append(hostConfig.DNSSearch, value)
+		case "dns-option":
+			hostConfig.DNSOptions = append(hostConfig.DNSOptions, value)
+		case "add-host":
+			hostConfig.ExtraHosts = append(hostConfig.ExtraHosts, value)
+		case "restart":
+			hostConfig.RestartPolicy, err = parseRestartPolicy(value)
+		case "rm":
+			hostConfig.AutoRemove, err = strconv.ParseBool(value)
+		case "init":
+			hostConfig.Init, err = strconv.ParseBool(value)
+		case "privileged":
+			hostConfig.Privileged, err = strconv.ParseBool(value)
+		case "read-only":
+			hostConfig.ReadonlyRootfs, err = strconv.ParseBool(value)
+		case "publish-all":
+			hostConfig.PublishAllPorts, err = strconv.ParseBool(value)
+		case "cap-add":
+			hostConfig.CapAdd = append(hostConfig.CapAdd, value)
+		case "cap-drop":
+			hostConfig.CapDrop = append(hostConfig.CapDrop, value)
+		case "security-opt":
+			var opt string
+			opt, err = parseSecurityOpt(value)
+			hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, opt)
+		case "device":
+			var device docker.Device
+			device, err = parseDevice(value)
+			hostConfig.Devices = append(hostConfig.Devices, device)
+		case "group-add":
+			hostConfig.GroupAdd = append(hostConfig.GroupAdd, value)
+		case "memory":
+			hostConfig.Memory, err = units.RAMInBytes(value)
+		case "memory-reservation":
+			hostConfig.MemoryReservation, err = units.RAMInBytes(value)
+		case "memory-swap":
+			if value == "-1" {
+				hostConfig.MemorySwap = -1
+			} else {
+				hostConfig.MemorySwap, err = units.RAMInBytes(value)
+			}
+		case "shm-size":
+			hostConfig.ShmSize, err = units.RAMInBytes(value)
+		case "cpus":
+			var cpus float64
+			cpus, err = strconv.ParseFloat(value, 64)
+			hostConfig.NanoCPUs = int64(cpus * 1e9)
+		case "cpu-shares":
+			hostConfig.CPUShares, err = strconv.ParseInt(value, 10, 64)
+		case "cpuset-cpus":
+			hostConfig.CPUSetCPUs = value
+		case "cpuset-mems":
+			hostConfig.CPUSetMEMs = value
+		case "pids-limit":
+			var limit int64
+			limit, err = strconv.ParseInt(value, 10, 64)
+			hostConfig.PidsLimit = &limit
+		case "oom-score-adj":
+			hostConfig.OomScoreAdj, err = strconv.Atoi(value)
+		case "oom-kill-disable":
+			var disable bool
+			disable, err = strconv.ParseBool(value)
+			hostConfig.OOMKillDisable = &disable
+		case "ulimit":
+			var ulimit *units.Ulimit
+			if ulimit, err = units.ParseUlimit(value); err == nil {
+				hostConfig.Ulimits = append(hostConfig.Ulimits, docker.ULimit{Name: ulimit.Name, Soft: ulimit.Soft, Hard: ulimit.Hard})
+			}
+		case "sysctl":
+			parts := strings.SplitN(value, "=", 2)
+			if len(parts) != 2 {
+				return options, invalid(fmt.Errorf("expected KEY=VALUE"))
+			}
+			if hostConfig.Sysctls == nil {
+				hostConfig.Sysctls = make(map[string]string)
+			}
+			hostConfig.Sysctls[parts[0]] = parts[1]
+		case "log-driver":
+			hostConfig.LogConfig.Type = value
+		case "log-opt":
+			parts := strings.SplitN(value, "=", 2)
+			if len(parts) != 2 {
+				return options, invalid(fmt.Errorf("expected KEY=VALUE"))
+			}
+			if hostConfig.LogConfig.Config == nil {
+				hostConfig.LogConfig.Config = make(map[string]string)
+			}
+			hostConfig.LogConfig.Config[parts[0]] = parts[1]
+		case "pid":
+			hostConfig.PidMode = value
+		case "ipc":
+			hostConfig.IpcMode = value
+		case "uts":
+			hostConfig.UTSMode = value
+		case "userns":
+			hostConfig.UsernsMode = value
+		case "cgroupns":
+			hostConfig.CgroupnsMode = value
+		case "cgroup-parent":
+			hostConfig.CgroupParent = value
+		case "runtime":
+			hostConfig.Runtime = value
+		default:
+			return options, fmt.Errorf("%w '%s'", errUnsupportedDockerFlag, name)
+		}
+		if err != nil {
+			return options, invalid(err)
+		}
+	}
+
+	if config.Env, err = createEnv(c, envFiles, env); err != nil {
+		return options, err
+	}
+	if config.Labels, err = createLabels(labelFiles, labels); err != nil {
+		return options, err
+	}
+
+	if len(endpoint.Aliases) > 0 || endpoint.IPAMConfig != nil {
+		switch mode := hostConfig.NetworkMode; {
+		case mode == "", mode == "default", mode == "bridge", mode == "host", mode == "none", strings.HasPrefix(mode, "container:"):
+			return options, fmt.Errorf("docker flags 'network-alias', 'ip' and 'ip6' need a user-defined network")
+		default:
+			options.NetworkingConfig = &docker.NetworkingConfig{
+				EndpointsConfig: map[string]*docker.EndpointConfig{mode: endpoint},
+			}
+		}
+	}
+	return options, nil
+}
+
+// createEnv returns the environment of the container, the variables of the
+// env files followed by those of the env flags.  Like docker, a name without
+// a value is taken from our environment, which includes the variables of
+// the encrypted env files.
+func createEnv(c *Context, envFiles []string, env []string) ([]string, error) {
+	var result []string
+	for _, path := range envFiles {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read env file '%s': %v", path, err)
+		}
+		environ, err := parseEnvLines(bytes.NewReader(data), "env file", path)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, environ...)
+	}
+
+	for _, value := range env {
+		if strings.Contains(value, "=") {
+			result = append(result, value)
+		} else if value, ok := lookupEnv(c, value); ok {
+			result = append(result, value)
+		}
+	}
+	return result, nil
+}
+
+// lookupEnv returns the NAME=VALUE pair of the variable from the encrypted
+// env files or our environment.
+func lookupEnv(c *Context, name string) (string, bool) {
+	for i := len(c.secretEnv) - 1; i >= 0; i-- {
+		if strings.HasPrefix(c.secretEnv[i], name+"=") {
+			return c.secretEnv[i], true
+		}
+	}
+	if value, ok := os.LookupEnv(name); ok {
+		return name + "=" + value, true
+	}
+	return "", false
+}
+
+func createLabels(labelFiles []string, labels []string) (map[string]string, error) {
+	for _, path := range labelFiles {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read label file '%s': %v", path, err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) > 0 && !strings.HasPrefix(line, "#") {
+				labels = append([]string{line}, labels...)
+			}
+		}
+	}
+
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	result := make(map[string]string, len(labels))
+	for _, label := range labels {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) == 2 {
+			result[parts[0]] = parts[1]
+		} else {
+			result[parts[0]] = ""
+		}
+	}
+	return result, nil
+}
+
+// parsePublish parses the value of the docker flag publish,
+// '[[IP:][HOST_PORT]:]CONTAINER_PORT[/PROTOCOL]', where the ports may be
+// ranges of the same length.  Like docker, a single container port may be
+// published on a range of host ports, of which the daemon picks a free one.
+func parsePublish(value string) (map[docker.Port]docker.PortBinding, error) {
+	spec, proto := value, "tcp"
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		spec, proto = spec[:i], spec[i+1:]
+	}
+
+	var ip, hostPort, containerPort string
+	// split from the right, as the IP may be an IPv6 address
+	if i := strings.LastIndex(spec, ":"); i < 0 {
+		containerPort = spec
+	} else {
+		containerPort = spec[i+1:]
+		hostPort = spec[:i]
+		if j := strings.LastIndex(hostPort, ":"); j >= 0 {
+			ip = strings.Trim(hostPort[:j], "[]")
+			hostPort = hostPort[j+1:]
+		}
+	}
+
+	containerStart, containerEnd, err := parsePorts(containerPort)
+	if err != nil {
+		return nil, err
+	}
+	var hostStart, hostEnd uint64
+	if len(hostPort) > 0 {
+		if hostStart, hostEnd, err = parsePorts(hostPort); err != nil {
+			return nil, err
+		}
+		if hostEnd-hostStart != containerEnd-containerStart {
+			if containerEnd != containerStart {
+				return nil, fmt.Errorf("the host and container port ranges differ in length")
+			}
+			return map[docker.Port]docker.PortBinding{
+				docker.Port(fmt.Sprintf("%d/%s", containerStart, proto)): {HostIP: ip, HostPort: fmt.Sprintf("%d-%d", hostStart, hostEnd)},
+			}, nil
+		}
+	}
+
+	result := make(map[docker.Port]docker.PortBinding)
+	for i := uint64(0); i <= containerEnd-containerStart; i++ {
+		binding := docker.PortBinding{HostIP: ip}
+		if len(hostPort) > 0 {
+			binding.HostPort = strconv.FormatUint(hostStart+i, 10)
+		}
+		result[docker.Port(fmt.Sprintf("%d/%s", containerStart+i, proto))] = binding
+	}
+	return result, nil
+}
+
+// parsePortRange parses the value of the docker flag expose,
+// 'PORT[-PORT][/PROTOCOL]'.
+func parsePortRange(value string) ([]docker.Port, error) {
+	spec, proto := value, "tcp"
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		spec, proto = spec[:i], spec[i+1:]
+	}
+	start, end, err := parsePorts(spec)
+	if err != nil {
+		return nil, err
+	}
+	var result []docker.Port
+	for port := start; port <= end; port++ {
+		result = append(result, docker.Port(fmt.Sprintf("%d/%s", port, proto)))
+	}
+	return result, nil
+}
+
+// parseMount parses the value of the docker flag mount, a comma separated
+// list of KEY=VALUE options.
+func parseMount(value string) (docker.HostMount, error) {
+	fields, err := csv.NewReader(strings.NewReader(value)).Read()
+	if err != nil {
+		return docker.HostMount{}, err
+	}
+
+	mount := docker.HostMount{Type: "volume"}
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		key := strings.ToLower(parts[0])
+		if len(parts) == 1 {
+			switch key {
+			case "readonly", "ro":
+				mount.ReadOnly = true
+				continue
+			case "volume-nocopy":
+				if mount.VolumeOptions == nil {
+					mount.VolumeOptions = &docker.VolumeOptions{}
+				}
+				mount.VolumeOptions.NoCopy = true
+				continue
+			}
+			return mount, fmt.Errorf("option '%s' needs a value", key)
+		}
+
+		option := parts[1]
+		switch key {
+		case "type":
+			mount.Type = option
+		case "source", "src":
+			mount.Source = option
+		case "target", "destination", "dst":
+			mount.Target = option
+		case "readonly", "ro":
+			if mount.ReadOnly, err = strconv.ParseBool(option); err != nil {
+				return mount, err
+			}
+		case "bind-propagation":
+			mount.BindOptions = &docker.BindOptions{Propagation: option}
+		case "volume-nocopy", "volume-driver", "volume-label", "volume-opt":
+			if mount.VolumeOptions == nil {
+				mount.VolumeOptions = &docker.VolumeOptions{}
+			}
+			switch key {
+			case "volume-nocopy":
+				if mount.VolumeOptions.NoCopy, err = strconv.ParseBool(option); err != nil {
+					return mount, err
+				}
+			case "volume-driver":
+				mount.VolumeOptions.DriverConfig.Name = option
+			case "volume-label", "volume-opt":
+				keyValue := strings.SplitN(option, "=", 2)
+				if len(keyValue) != 2 {
+					return mount, fmt.Errorf("option '%s' needs a KEY=VALUE value", key)
+				}
+				if key == "volume-label" {
+					if mount.VolumeOptions.Labels == nil {
+						mount.VolumeOptions.Labels = make(map[string]string)
+					}
+					mount.VolumeOptions.Labels[keyValue[0]] = keyValue[1]
+				} else {
+					if mount.VolumeOptions.DriverConfig.Options == nil {
+						mount.VolumeOptions.DriverConfig.Options = make(map[string]string)
+					}
+					mount.VolumeOptions.DriverConfig.Options[keyValue[0]] = keyValue[1]
+				}
+			}
+		case "tmpfs-size", "tmpfs-mode":
+			if mount.TempfsOptions == nil {
+				mount.TempfsOptions = &docker.TempfsOptions{}
+			}
+			if key == "tmpfs-size" {
+				if mount.TempfsOptions.SizeBytes, err = units.RAMInBytes(option); err != nil {
+					return mount, err
+				}
+			} else {
+				mode, err := strconv.ParseUint(option, 8, 32)
+				if err != nil {
+					return mount, err
+				}
+				mount.TempfsOptions.Mode = int(mode)
+			}
+		default:
+			return mount, fmt.Errorf("unsupported option '%s'", key)
+		}
+	}
+	if len(mount.Target) == 0 {
+		return mount, fmt.Errorf("target is missing")
+	}
+	return mount, nil
+}
+
+// parseHealthFlag applies the docker health check flag to the health check.
+func parseHealthFlag(health *docker.HealthConfig, name string, value string) error {
+	var err error
+	switch name {
+	case "health-cmd":
+		health.Test = []string{"CMD-SHELL", value}
+	case "no-healthcheck":
+		var disabled bool
+		if disabled, err = strconv.ParseBool(value); err == nil && disabled {
+			health.Test = []string{"NONE"}
+		}
+	case "health-interval":
+		health.Interval, err = time.ParseDuration(value)
+	case "health-timeout":
+		health.Timeout, err = time.ParseDuration(value)
+	case "health-start-period":
+		health.StartPeriod, err = time.ParseDuration(value)
+	case "health-retries":
+		health.Retries, err = strconv.Atoi(value)
+	}
+	return err
+}
+
+// parseRestartPolicy parses the value of the docker flag restart,
+// 'no|always|unless-stopped|on-failure[:MAX_RETRIES]'.
+func parseRestartPolicy(value string) (docker.RestartPolicy, error) {
+	parts := strings.SplitN(value, ":", 2)
+	policy := docker.RestartPolicy{Name: parts[0]}
+	switch parts[0] {
+	case "no", "always", "unless-stopped":
+		if len(parts) == 2 {
+			return policy, fmt.Errorf("maximum retry count cannot be used with restart policy '%s'", parts[0])
+		}
+	case "on-failure":
+		if len(parts) == 2 {
+			retries, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return policy, err
+			}
+			policy.MaximumRetryCount = retries
+		}
+	default:
+		return policy, fmt.Errorf("unsupported restart policy '%s'", parts[0])
+	}
+	return policy, nil
+}
+
+// parseSecurityOpt parses the value of the docker flag security-opt.  Like
+// the docker CLI, the seccomp profile is read from the file, as the daemon
+// expects the profile itself.
+func parseSecurityOpt(value string) (string, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) == 1 && strings.Contains(value, ":") {
+		// the deprecated 'KEY:VALUE' format
+		parts = strings.SplitN(value, ":", 2)
+	}
+	if len(parts) != 2 || parts[0] != "seccomp" || parts[1] == "unconfined" {
+		return strings.Join(parts, "="), nil
+	}
+
+	data, err := ioutil.ReadFile(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("failed to read seccomp profile '%s': %v", parts[1], err)
+	}
+	var profile bytes.Buffer
+	if err = json.Compact(&profile, data); err != nil {
+		return "", fmt.Errorf("seccomp profile '%s' is not valid JSON: %v", parts[1], err)
+	}
+	return fmt.Sprintf("seccomp=%s", profile.String()), nil
+}
+
+// parseDevice parses the value of the docker flag device,
+// 'HOST_PATH[:CONTAINER_PATH][:PERMISSIONS]'.
+func parseDevice(value string) (docker.Device, error) {
+	parts := strings.Split(value, ":")
+	device := docker.Device{PathOnHost: parts[0], PathInContainer: parts[0], CgroupPermissions: "rwm"}
+	switch len(parts) {
+	case 1:
+	case 2:
+		if isDevicePermissions(parts[1]) {
+			device.CgroupPermissions = parts[1]
+		} else {
+			device.PathInContainer = parts[1]
+		}
+	case 3:
+		if !isDevicePermissions(parts[2]) {
+			return device, fmt.Errorf("invalid permissions '%s'", parts[2])
+		}
+		device.PathInContainer = parts[1]
+		device.CgroupPermissions = parts[2]
+	default:
+		return device, fmt.Errorf("expected HOST_PATH[:CONTAINER_PATH][:PERMISSIONS]")
+	}
+	return device, nil
+}
+
+// parsePorts parses a port or a range of ports, 'PORT[-PORT]'.
+func parsePorts(value string) (uint64, uint64, error) {
+	parts := strings.SplitN(value, "-", 2)
+	start, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port '%s'", parts[0])
+	}
+	end := start
+	if len(parts) == 2 {
+		if end, err = strconv.ParseUint(parts[1], 10, 16); err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid port range '%s'", value)
+		}
+	}
+	return start, end, nil
+}
+
+func isDevicePermissions(value string) bool {
+	if len(value) == 0 {
+		return false
+	}
+	for _, r := range value {
+		if r != 'r' && r != 'w' && r != 'm' {
+			return false
+		}
+	}
+	return true
+}
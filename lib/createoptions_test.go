@@ -0,0 +1,219 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestCreateOptions(t *testing.T) {
+	t.Setenv("SYSTEMD_DOCKER_TEST_ENV", "from-environment")
+
+	tests := []struct {
+		name       string
+		args       []string
+		config     docker.Config
+		hostConfig docker.HostConfig
+		options    docker.CreateContainerOptions
+	}{
+		{
+			name:   "image",
+			args:   []string{"nginx"},
+			config: docker.Config{Image: "nginx"},
+		},
+		{
+			name:    "name and command",
+			args:    []string{"--name", "web", "nginx", "nginx", "-g", "daemon off;"},
+			config:  docker.Config{Image: "nginx", Cmd: []string{"nginx", "-g", "daemon off;"}},
+			options: docker.CreateContainerOptions{Name: "web"},
+		},
+		{
+			name:   "command after separator",
+			args:   []string{"--", "busybox", "-v"},
+			config: docker.Config{Image: "busybox", Cmd: []string{"-v"}},
+		},
+		{
+			name:       "combined shorthands",
+			args:       []string{"-itd", "--rm", "nginx"},
+			config:     docker.Config{Image: "nginx", Tty: true, OpenStdin: true, AttachStdin: true},
+			hostConfig: docker.HostConfig{AutoRemove: true},
+		},
+		{
+			name:       "combined shorthands with value",
+			args:       []string{"-tm", "64m", "-ufoo", "-w=/app", "nginx"},
+			config:     docker.Config{Image: "nginx", Tty: true, User: "foo", WorkingDir: "/app"},
+			hostConfig: docker.HostConfig{Memory: 64 * 1024 * 1024},
+		},
+		{
+			name:       "flags with equal sign",
+			args:       []string{"--env=FOO=bar", "--memory=1g", "--restart=on-failure:3", "--rm=false", "nginx"},
+			config:     docker.Config{Image: "nginx", Env: []string{"FOO=bar"}},
+			hostConfig: docker.HostConfig{Memory: 1024 * 1024 * 1024, RestartPolicy: docker.RestartPolicy{Name: "on-failure", MaximumRetryCount: 3}},
+		},
+		{
+			name:   "env without value",
+			args:   []string{"-e", "SYSTEMD_DOCKER_TEST_ENV", "-e", "SYSTEMD_DOCKER_TEST_MISSING", "-e", "FOO=", "nginx"},
+			config: docker.Config{Image: "nginx", Env: []string{"SYSTEMD_DOCKER_TEST_ENV=from-environment", "FOO="}},
+		},
+		{
+			name:   "labels",
+			args:   []string{"-l", "a=b", "--label", "c", "nginx"},
+			config: docker.Config{Image: "nginx", Labels: map[string]string{"a": "b", "c": ""}},
+		},
+		{
+			name: "publish",
+			args: []string{"-p", "8080:80", "-p", "127.0.0.1::53/udp", "nginx"},
+			config: docker.Config{Image: "nginx", ExposedPorts: map[docker.Port]struct{}{
+				"80/tcp": {},
+				"53/udp": {},
+			}},
+			hostConfig: docker.HostConfig{PortBindings: map[docker.Port][]docker.PortBinding{
+				"80/tcp": {{HostPort: "8080"}},
+				"53/udp": {{HostIP: "127.0.0.1"}},
+			}},
+		},
+		{
+			name:   "publish on IPv4 and IPv6",
+			args:   []string{"-p", "0.0.0.0:80:80", "-p", "[::]:80:80", "-p", "[::1]:8443:443/tcp", "nginx"},
+			config: docker.Config{Image: "nginx", ExposedPorts: map[docker.Port]struct{}{"80/tcp": {}, "443/tcp": {}}},
+			hostConfig: docker.HostConfig{PortBindings: map[docker.Port][]docker.PortBinding{
+				"80/tcp":  {{HostIP: "0.0.0.0", HostPort: "80"}, {HostIP: "::", HostPort: "80"}},
+				"443/tcp": {{HostIP: "::1", HostPort: "8443"}},
+			}},
+		},
+		{
+			name:   "publish port ranges",
+			args:   []string{"-p", "8000-8001:80-81", "nginx"},
+			config: docker.Config{Image: "nginx", ExposedPorts: map[docker.Port]struct{}{"80/tcp": {}, "81/tcp": {}}},
+			hostConfig: docker.HostConfig{PortBindings: map[docker.Port][]docker.PortBinding{
+				"80/tcp": {{HostPort: "8000"}},
+				"81/tcp": {{HostPort: "8001"}},
+			}},
+		},
+		{
+			name:   "publish on host port range",
+			args:   []string{"-p", "8000-8010:80", "nginx"},
+			config: docker.Config{Image: "nginx", ExposedPorts: map[docker.Port]struct{}{"80/tcp": {}}},
+			hostConfig: docker.HostConfig{PortBindings: map[docker.Port][]docker.PortBinding{
+				"80/tcp": {{HostPort: "8000-8010"}},
+			}},
+		},
+		{
+			name:       "volumes",
+			args:       []string{"-v", "/data:/data:ro", "--volume", "/cache", "--tmpfs", "/tmp:size=64m", "nginx"},
+			config:     docker.Config{Image: "nginx", Volumes: map[string]struct{}{"/cache": {}}},
+			hostConfig: docker.HostConfig{Binds: []string{"/data:/data:ro"}, Tmpfs: map[string]string{"/tmp": "size=64m"}},
+		},
+		{
+			name:       "network",
+			args:       []string{"--net", "backend", "--network-alias", "web", "--ip", "10.0.0.2", "nginx"},
+			config:     docker.Config{Image: "nginx"},
+			hostConfig: docker.HostConfig{NetworkMode: "backend"},
+			options: docker.CreateContainerOptions{NetworkingConfig: &docker.NetworkingConfig{
+				EndpointsConfig: map[string]*docker.EndpointConfig{"backend": {
+					Aliases:    []string{"web"},
+					IPAMConfig: &docker.EndpointIPAMConfig{IPv4Address: "10.0.0.2"},
+				}},
+			}},
+		},
+		{
+			name:   "health check",
+			args:   []string{"--health-cmd", "curl -f localhost", "--health-interval=5s", "--health-retries", "3", "nginx"},
+			config: docker.Config{Image: "nginx", Healthcheck: &docker.HealthConfig{Test: []string{"CMD-SHELL", "curl -f localhost"}, Interval: 5e9, Retries: 3}},
+		},
+		{
+			name:   "ignored flags",
+			args:   []string{"-d", "-q", "--pull", "always", "-a", "stdout", "nginx"},
+			config: docker.Config{Image: "nginx"},
+		},
+		{
+			name:       "resources",
+			args:       []string{"--cpus", "1.5", "-c", "512", "--pids-limit", "100", "--ulimit", "nofile=1024:2048", "nginx"},
+			config:     docker.Config{Image: "nginx"},
+			hostConfig: docker.HostConfig{NanoCPUs: 15e8, CPUShares: 512, PidsLimit: int64Pointer(100), Ulimits: []docker.ULimit{{Name: "nofile", Soft: 1024, Hard: 2048}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expected := test.options
+			expected.Config = &test.config
+			expected.Config.AttachStdout = true
+			expected.Config.AttachStderr = true
+			expected.HostConfig = &test.hostConfig
+
+			actual, err := createOptions(&Context{Args: test.args})
+			if err != nil {
+				t.Fatalf("createOptions failed: %v", err)
+			}
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("createOptions\n%+v %+v %+v,\nexpected\n%+v %+v %+v", actual, actual.Config, actual.HostConfig, expected, expected.Config, expected.HostConfig)
+			}
+		})
+	}
+}
+
+func TestCreateOptionsSecretEnv(t *testing.T) {
+	t.Setenv("SYSTEMD_DOCKER_TEST_ENV", "from-environment")
+	c := &Context{
+		Args:      []string{"-e", "SYSTEMD_DOCKER_TEST_ENV", "nginx"},
+		secretEnv: []string{"SYSTEMD_DOCKER_TEST_ENV=from-secret"},
+	}
+	actual, err := createOptions(c)
+	if err != nil {
+		t.Fatalf("createOptions failed: %v", err)
+	}
+	if expected := []string{"SYSTEMD_DOCKER_TEST_ENV=from-secret"}; !reflect.DeepEqual(actual.Config.Env, expected) {
+		t.Errorf("env %v, expected %v", actual.Config.Env, expected)
+	}
+}
+
+func TestCreateOptionsErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		args        []string
+		unsupported bool
+	}{
+		{"unsupported flag", []string{"--gpus", "all", "nginx"}, true},
+		{"unsupported shorthand", []string{"-itX", "nginx"}, true},
+		{"platform", []string{"--platform=linux/arm64", "nginx"}, true},
+		{"network more than once", []string{"--network", "a", "--network", "b", "nginx"}, true},
+		{"no image", []string{"--rm"}, false},
+		{"missing value", []string{"--name"}, false},
+		{"port ranges of different length", []string{"-p", "8000-8002:80-81", "nginx"}, false},
+		{"invalid port", []string{"-p", "80:http", "nginx"}, false},
+		{"invalid memory", []string{"-m", "lots", "nginx"}, false},
+		{"alias without user-defined network", []string{"--network-alias", "web", "nginx"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := createOptions(&Context{Args: test.args})
+			if err == nil {
+				t.Fatalf("createOptions succeeded, expected an error")
+			}
+			if unsupported := errors.Is(err, errUnsupportedDockerFlag); unsupported != test.unsupported {
+				t.Errorf("createOptions failed with '%v', unsupported %t, expected %t", err, unsupported, test.unsupported)
+			}
+		})
+	}
+}
+
+func int64Pointer(value int64) *int64 {
+	return &value
+}
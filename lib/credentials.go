@@ -0,0 +1,103 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EncryptedEnvArgs decrypts the --encrypted-env-file credentials produced by
+// 'systemd-creds encrypt', which are bound to the host and/or its TPM, and
+// returns the docker flags passing the variables to the container.  The
+// flags only carry the names of the variables, their values are sent over
+// the docker API or handed to the docker CLI through its environment, so
+// that the plaintext is neither written to disk nor visible in the
+// arguments of a process.
+func EncryptedEnvArgs(c *Context) ([]string, error) {
+	var args []string
+	for _, path := range c.EncryptedEnvFiles {
+		environ, err := decryptEnvFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range environ {
+			args = append(args, "-e", strings.SplitN(val, "=", 2)[0])
+		}
+		c.secretEnv = append(c.secretEnv, environ...)
+		c.Log.Infof("Decrypted %d environment variables from '%s'\n", len(environ), path)
+	}
+	return args, nil
+}
+
+// decryptEnvFile decrypts the credential and parses the plaintext like a
+// docker env file.
+func decryptEnvFile(path string) ([]string, error) {
+	// systemd-creds checks the name embedded in the credential against the
+	// name of the file, like it derived it when encrypting
+	cmd := exec.Command("systemd-creds", "decrypt", path, "-")
+	var output bytes.Buffer
+	var stderr strings.Builder
+	cmd.Stdout = &output
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("failed to decrypt encrypted env file '%s': %v: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return parseEnvLines(&output, "encrypted env file", path)
+}
+
+// parseEnvLines parses the lines of a docker env file into NAME=VALUE
+// pairs.  The kind and path of the file are used in error messages.
+func parseEnvLines(r io.Reader, kind string, path string) ([]string, error) {
+	var result []string
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimLeft(scanner.Text(), " \t")
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, "=", 2)
+		name := strings.TrimRight(parts[0], " \t")
+		if !envNamePattern.MatchString(name) {
+			// the line is not quoted, as it may be a secret
+			return nil, fmt.Errorf("%s '%s' has an invalid variable name on line %d", kind, path, line)
+		}
+		if len(parts) == 1 {
+			// like docker, a name without a value is taken from our environment
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				continue
+			}
+			parts = append(parts, value)
+		}
+		result = append(result, name+"="+parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s '%s': %v", kind, path, err)
+	}
+	return result, nil
+}
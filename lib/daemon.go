@@ -0,0 +1,54 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"time"
+)
+
+const DefaultDaemonWait = 2 * time.Minute
+
+// WaitForDaemon waits for up to --wait-for-daemon for the docker daemon to
+// respond to API pings.
+func WaitForDaemon(c *Context) error {
+	if c.DaemonWait <= 0 {
+		return nil
+	}
+
+	// with several endpoints, GetClient fails while none of them responds,
+	// which is not ready yet rather than a failure
+	var lastErr error
+	err := waitFor(c, "docker daemon to accept API requests", c.DaemonWait, func() (bool, error) {
+		var client *docker.Client
+		if client, lastErr = c.GetClient(); errors.Is(lastErr, ErrDaemonUnavailable) {
+			return false, nil
+		} else if lastErr != nil {
+			return false, lastErr
+		}
+		lastErr = client.Ping()
+		return lastErr == nil, nil
+	})
+	if err == ErrShutdown || (err != nil && err == lastErr) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w after %s: %v", ErrDaemonUnavailable, c.DaemonWait, lastErr)
+	}
+	return nil
+}
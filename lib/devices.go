@@ -0,0 +1,55 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// deviceNodes returns the host device nodes passed with the docker run flag
+// --device=<HOST>[:<CONTAINER>[:<PERMISSIONS>]].
+func deviceNodes(args []string) []string {
+	var result []string
+	for _, value := range dockerFlagValues(args, "device") {
+		if node := strings.SplitN(value, ":", 2)[0]; len(node) > 0 {
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// waitForDevices waits for up to --device-wait for the device nodes of the
+// container to appear, f.ex. for USB or serial adapters which enumerate
+// slowly at boot.
+func waitForDevices(c *Context) error {
+	if c.DeviceWait <= 0 {
+		return nil
+	}
+
+	for _, node := range deviceNodes(c.Args) {
+		description := fmt.Sprintf("device '%s' of container '%s' to appear", node, c.Name)
+		err := waitFor(c, description, c.DeviceWait, func() (bool, error) {
+			_, err := os.Stat(node)
+			return err == nil, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
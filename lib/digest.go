@@ -0,0 +1,181 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// ExpectedDigestRecord records the digest of the image on the first
+	// start, and expects it on later starts.
+	ExpectedDigestRecord = "record"
+
+	DigestCheckWarn = "warn"
+	DigestCheckFail = "fail"
+)
+
+var digestPattern = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// ValidateExpectedDigest checks the --expected-digest and --digest-check
+// flags.
+func ValidateExpectedDigest(c *Context) error {
+	if c.DigestCheck != DigestCheckWarn && c.DigestCheck != DigestCheckFail {
+		return fmt.Errorf("unsupported digest check '%s'", c.DigestCheck)
+	}
+	if len(c.ExpectedDigest) > 0 && c.ExpectedDigest != ExpectedDigestRecord && !digestPattern.MatchString(c.ExpectedDigest) {
+		return fmt.Errorf("expected digest '%s' has a wrong format", c.ExpectedDigest)
+	}
+	return nil
+}
+
+// digestFile returns the file the digest of the image is recorded in with
+// --expected-digest=record.
+func digestFile(c *Context) string {
+	return filepath.Join(stateDirectory(), "digests", filepath.Base(c.Name))
+}
+
+// checkImageDigest ensures that the image of the container resolves to the
+// digest specified by --expected-digest, or recorded on the first start, so
+// that a tampered or silently changed tag is not run.  The image resolves to
+// a digest if it was pulled by it from a registry, or if it is the ID of the
+// image.  A mismatch fails with --digest-check=fail, and is logged with
+// --digest-check=warn.  The container is created from the checked image, see
+// pinImage.
+func checkImageDigest(c *Context) error {
+	if len(c.ExpectedDigest) == 0 || len(c.Image) == 0 {
+		return nil
+	}
+
+	expected := c.ExpectedDigest
+	if expected == ExpectedDigestRecord {
+		data, err := ioutil.ReadFile(digestFile(c))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		expected = strings.TrimSpace(string(data))
+	}
+
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+	image, err := client.InspectImage(c.Image)
+	if err == docker.ErrNoSuchImage {
+		return &ExitError{
+			Code: ExitCodeDigestMismatch,
+			Err:  fmt.Errorf("image '%s' is not present, its digest cannot be checked before it was pulled", c.Image),
+		}
+	}
+	if err != nil {
+		return err
+	}
+	c.pinnedImage = pinnedReference(c.Image, image)
+	digests := imageDigests(c.Image, image)
+
+	if len(expected) == 0 {
+		// first start with --expected-digest=record
+		path := digestFile(c)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = writeFileAtomic(path, []byte(digests[0]+"\n"), 0644)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to record the digest of image '%s' in '%s': %v", c.Image, path, err)
+		}
+		c.Log.Noticef("Recorded digest '%s' of image '%s' for container '%s'\n", digests[0], c.Image, c.Name)
+		return nil
+	}
+
+	for _, digest := range digests {
+		if digest == expected {
+			c.Log.Debugf("Image '%s' of container '%s' resolves to the expected digest '%s'\n", c.Image, c.Name, expected)
+			return nil
+		}
+	}
+
+	c.Metrics().AddCounter("systemd_docker_digest_mismatches_total", "Number of times the image resolved to another digest than expected", 1)
+	message := fmt.Sprintf("image '%s' of container '%s' resolves to digest '%s' instead of the expected digest '%s'", c.Image, c.Name, digests[0], expected)
+	if c.DigestCheck == DigestCheckWarn {
+		c.Log.Warnf("The %s\n", message)
+		return nil
+	}
+	setStatus(c, "Image %s does not match the expected digest", c.Image)
+	return &ExitError{
+		Code: ExitCodeDigestMismatch,
+		Err:  errors.New(message),
+	}
+}
+
+// pinnedReference returns the immutable reference of the image, which is the
+// digest of the repository of the reference if it was pulled from a registry,
+// and the ID of the image otherwise.
+func pinnedReference(reference string, image *docker.Image) string {
+	repository, _ := docker.ParseRepositoryTag(reference)
+	for _, repoDigest := range image.RepoDigests {
+		if strings.HasPrefix(repoDigest, repository+"@") {
+			return repoDigest
+		}
+	}
+	return image.ID
+}
+
+// pinImage makes docker create use the image by the immutable reference it
+// was checked or verified with, so that a pull or retag of the tag in between
+// cannot swap the image which is run.  It rewrites the docker run arguments,
+// so it runs once the concurrent phases reading them are done.
+func pinImage(c *Context) {
+	if len(c.pinnedImage) == 0 {
+		return
+	}
+	index, _ := FindImage(c.Args)
+	if index < 0 {
+		return
+	}
+	c.Log.Debugf("Creating container '%s' from image '%s' pinned to '%s'\n", c.Name, c.Image, c.pinnedImage)
+	c.Args[index] = c.pinnedImage
+	// the image was pulled already, and an ID cannot be pulled
+	if values := dockerFlagValues(c.Args, "pull"); len(values) > 0 && values[len(values)-1] == "always" {
+		c.Args = append(c.Args[:index], append([]string{"--pull", "missing"}, c.Args[index:]...)...)
+	}
+}
+
+// imageDigests returns the digests the image resolves to, the one of the
+// repository of the reference first, followed by the ones of other
+// repositories, f.ex. mirrors, and finally the ID of the image.
+func imageDigests(reference string, image *docker.Image) []string {
+	repository, _ := docker.ParseRepositoryTag(reference)
+	var own, other []string
+	for _, repoDigest := range image.RepoDigests {
+		parts := strings.SplitN(repoDigest, "@", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if parts[0] == repository {
+			own = append(own, parts[1])
+		} else {
+			other = append(other, parts[1])
+		}
+	}
+	return append(append(own, other...), image.ID)
+}
@@ -0,0 +1,146 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/fsouza/go-dockerclient"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StartDiskUsageMonitor periodically samples the size of the writable layer
+// and named volumes of the container, reporting them as metrics and warning
+// when they exceed --disk-usage-limit.  The returned function stops the
+// monitor.
+func StartDiskUsageMonitor(c *Context) func() {
+	if c.DiskUsageInterval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(c.DiskUsageInterval)
+		defer ticker.Stop()
+		exceeded := false
+		for {
+			if err := sampleDiskUsage(c, &exceeded); err != nil {
+				c.Log.Warnf("Failed to sample disk usage of container '%s': %s\n", c.Name, err)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+func sampleDiskUsage(c *Context, exceeded *bool) error {
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	containers, err := client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Size:    true,
+		Filters: map[string][]string{"id": {c.Id}},
+	})
+	if err != nil {
+		return err
+	}
+
+	var layerSize int64
+	for _, container := range containers {
+		if container.ID == c.Id {
+			layerSize = container.SizeRw
+			break
+		}
+	}
+	c.Metrics().SetGauge("systemd_docker_container_writable_layer_bytes", "Size of the writable layer of the container", float64(layerSize))
+
+	container, err := client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: c.Id})
+	if err != nil {
+		return err
+	}
+
+	var volumeSize int64
+	var largest string
+	var largestSize int64
+	for _, mount := range container.Mounts {
+		// only local named volumes have a host path which can be measured
+		if len(mount.Name) == 0 || (mount.Driver != "" && mount.Driver != "local") {
+			continue
+		}
+		size, err := directorySize(mount.Source)
+		if err != nil {
+			c.Log.Debugf("Failed to measure volume '%s' of container '%s': %s\n", mount.Name, c.Name, err)
+			continue
+		}
+		volumeSize += size
+		if size > largestSize {
+			largest = mount.Name
+			largestSize = size
+		}
+		c.Metrics().SetGauge("systemd_docker_container_volume_bytes", "Size of the named volumes of the container", float64(size), "volume", mount.Name)
+	}
+
+	if c.DiskUsageLimit <= 0 {
+		return nil
+	}
+
+	var message string
+	if layerSize > c.DiskUsageLimit {
+		message = fmt.Sprintf("writable layer of container '%s' uses %s, exceeding the limit of %s", c.Name, units.BytesSize(float64(layerSize)), units.BytesSize(float64(c.DiskUsageLimit)))
+	} else if volumeSize > c.DiskUsageLimit {
+		message = fmt.Sprintf("volumes of container '%s' use %s, exceeding the limit of %s (largest is '%s' with %s)", c.Name, units.BytesSize(float64(volumeSize)), units.BytesSize(float64(c.DiskUsageLimit)), largest, units.BytesSize(float64(largestSize)))
+	}
+
+	if len(message) > 0 {
+		c.Log.Warnf("Disk usage of %s\n", message)
+		_ = sendNotify(c, fmt.Sprintf("STATUS=Disk usage of %s", message))
+		*exceeded = true
+	} else if *exceeded {
+		c.Log.Infof("Disk usage of container '%s' is below the limit of %s again\n", c.Name, units.BytesSize(float64(c.DiskUsageLimit)))
+		_ = sendNotify(c, "STATUS=")
+		*exceeded = false
+	}
+	return nil
+}
+
+func directorySize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
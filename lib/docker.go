@@ -0,0 +1,261 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	dockerClient "github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultDockerHost = "unix:///var/run/docker.sock"
+
+	dockerDialTimeout     = 30 * time.Second
+	dockerKeepAlive       = 30 * time.Second
+	dockerIdleConnTimeout = 60 * time.Second
+	dockerMaxIdleConns    = 2
+)
+
+// DockerOptions are the docker global options, which are applied to both the
+// docker CLI commands and the API client.
+type DockerOptions struct {
+	Config    string
+	Context   string
+	Host      string
+	Tls       bool
+	TlsVerify bool
+	TlsCaCert string
+	TlsCert   string
+	TlsKey    string
+	endpoint  string
+}
+
+// Args returns the options as docker CLI global flags.
+func (o *DockerOptions) Args() []string {
+	var args []string
+	if len(o.Config) > 0 {
+		args = append(args, "--config", o.Config)
+	}
+	if len(o.Context) > 0 {
+		args = append(args, "--context", o.Context)
+	}
+	if o.HasFailover() {
+		// the docker CLI only supports a single endpoint
+		endpoint, _ := o.Endpoint()
+		args = append(args, "--host", endpoint)
+	} else if len(o.Host) > 0 {
+		args = append(args, "--host", o.Host)
+	}
+	if o.Tls {
+		args = append(args, "--tls")
+	}
+	if o.TlsVerify {
+		args = append(args, "--tlsverify")
+	}
+	if len(o.TlsCaCert) > 0 {
+		args = append(args, "--tlscacert", o.TlsCaCert)
+	}
+	if len(o.TlsCert) > 0 {
+		args = append(args, "--tlscert", o.TlsCert)
+	}
+	if len(o.TlsKey) > 0 {
+		args = append(args, "--tlskey", o.TlsKey)
+	}
+	return args
+}
+
+// ConfigDir returns the docker CLI configuration directory.
+func (o *DockerOptions) ConfigDir() string {
+	if len(o.Config) > 0 {
+		return o.Config
+	}
+	if dir := os.Getenv("DOCKER_CONFIG"); len(dir) > 0 {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker")
+}
+
+// Endpoint returns the daemon endpoint, resolved from --host, --context,
+// DOCKER_HOST and DOCKER_CONTEXT in that order.  Of a failover list, the
+// endpoint in use or otherwise the first endpoint is returned.
+func (o *DockerOptions) Endpoint() (string, error) {
+	if len(o.endpoint) > 0 {
+		return o.endpoint, nil
+	}
+	endpoints, err := o.Endpoints()
+	if err != nil {
+		return "", err
+	}
+	return endpoints[0], nil
+}
+
+// Endpoints returns the daemon endpoints in failover order.  --host and
+// DOCKER_HOST accept a comma separated list of endpoints.
+func (o *DockerOptions) Endpoints() ([]string, error) {
+	if len(o.Host) > 0 {
+		return splitEndpoints(o.Host), nil
+	}
+	dockerContext := o.Context
+	if len(dockerContext) == 0 {
+		if endpoint := os.Getenv("DOCKER_HOST"); len(endpoint) > 0 {
+			return splitEndpoints(endpoint), nil
+		}
+		dockerContext = os.Getenv("DOCKER_CONTEXT")
+	}
+	if len(dockerContext) > 0 && dockerContext != "default" {
+		endpoint, err := o.contextEndpoint(dockerContext)
+		if err != nil {
+			return nil, err
+		}
+		return []string{endpoint}, nil
+	}
+	return []string{DefaultDockerHost}, nil
+}
+
+// HasFailover returns whether several daemon endpoints are specified.
+func (o *DockerOptions) HasFailover() bool {
+	endpoints, err := o.Endpoints()
+	return err == nil && len(endpoints) > 1
+}
+
+func splitEndpoints(value string) []string {
+	var endpoints []string
+	for _, endpoint := range strings.Split(value, ",") {
+		if endpoint = strings.TrimSpace(endpoint); len(endpoint) > 0 {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		return []string{DefaultDockerHost}
+	}
+	return endpoints
+}
+
+func (o *DockerOptions) contextEndpoint(name string) (string, error) {
+	digest := sha256.Sum256([]byte(name))
+	metaFile := filepath.Join(o.ConfigDir(), "contexts", "meta", hex.EncodeToString(digest[:]), "meta.json")
+	data, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read docker context '%s': %v", name, err)
+	}
+
+	var meta struct {
+		Endpoints map[string]struct {
+			Host string
+		}
+	}
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return "", fmt.Errorf("failed to parse docker context '%s': %v", name, err)
+	}
+	endpoint, ok := meta.Endpoints["docker"]
+	if !ok || len(endpoint.Host) == 0 {
+		return "", fmt.Errorf("docker context '%s' does not have a docker endpoint", name)
+	}
+	return endpoint.Host, nil
+}
+
+// NewClient creates an API client for the endpoint using the TLS options.
+// The client keeps its connections to the daemon alive and reuses them.
+func (o *DockerOptions) NewClient(endpoint string) (*dockerClient.Client, error) {
+	client, err := o.newClient(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	pooledConnections(client)
+	return client, nil
+}
+
+func (o *DockerOptions) newClient(endpoint string) (*dockerClient.Client, error) {
+	if !o.Tls && !o.TlsVerify && len(os.Getenv("DOCKER_TLS_VERIFY")) == 0 {
+		return dockerClient.NewClient(endpoint)
+	}
+
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if len(certPath) == 0 {
+		certPath = o.ConfigDir()
+	}
+	file := func(value string, name string) string {
+		if len(value) > 0 {
+			return value
+		}
+		return filepath.Join(certPath, name)
+	}
+
+	var cert, key, ca []byte
+	var err error
+	if cert, err = ioutil.ReadFile(file(o.TlsCert, "cert.pem")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if key, err = ioutil.ReadFile(file(o.TlsKey, "key.pem")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if o.TlsVerify || len(os.Getenv("DOCKER_TLS_VERIFY")) > 0 {
+		if ca, err = ioutil.ReadFile(file(o.TlsCaCert, "ca.pem")); err != nil {
+			return nil, err
+		}
+	}
+	return dockerClient.NewTLSClientFromBytes(endpoint, cert, key, ca)
+}
+
+// pooledConnections enables keep-alive on the transport of the client, which
+// go-dockerclient disables by default, so that requests reuse a pooled
+// connection instead of dialing the daemon every time.  Idle connections are
+// closed after a while, so that hosts running many units do not keep
+// hundreds of idle connections to the daemon open.
+func pooledConnections(client *dockerClient.Client) {
+	client.Dialer = &net.Dialer{
+		Timeout:   dockerDialTimeout,
+		KeepAlive: dockerKeepAlive,
+	}
+	if transport, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+		transport.DisableKeepAlives = false
+		transport.MaxIdleConns = dockerMaxIdleConns
+		transport.MaxIdleConnsPerHost = dockerMaxIdleConns
+		transport.IdleConnTimeout = dockerIdleConnTimeout
+	}
+}
+
+// closeIdleConnections closes the pooled connections of the client.
+func closeIdleConnections(client *dockerClient.Client) {
+	if transport, ok := client.HTTPClient.Transport.(interface{ CloseIdleConnections() }); ok {
+		transport.CloseIdleConnections()
+	}
+}
+
+func getDockerCommand() string {
+	dockerCommand := os.Getenv("DOCKER_COMMAND")
+	if len(dockerCommand) == 0 {
+		dockerCommand = "docker"
+	}
+	return dockerCommand
+}
+
+// dockerCommand creates a docker CLI command with the docker global options.
+func dockerCommand(c *Context, args ...string) *exec.Cmd {
+	return exec.Command(getDockerCommand(), append(c.Docker.Args(), args...)...)
+}
@@ -0,0 +1,305 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterEngine(DefaultEngine, newDockerEngine)
+}
+
+// dockerEngine creates, starts and supervises containers over the docker
+// API.  Containers using docker run flags which are not translated to the
+// API are created with the docker CLI instead, if it is installed.
+type dockerEngine struct{}
+
+func newDockerEngine(_ *Context) (ContainerEngine, error) {
+	return &dockerEngine{}, nil
+}
+
+func (e *dockerEngine) Create(c *Context) (string, error) {
+	options, err := createOptions(c)
+	if errors.Is(err, errUnsupportedDockerFlag) {
+		if !hasDockerCli() {
+			return "", fmt.Errorf("%v, which needs the docker CLI", err)
+		}
+		c.Log.Debugf("Creating container '%s' with the docker CLI, as the %s\n", c.Name, err)
+		return e.createWithCli(c)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	client, err := c.GetClient()
+	if err != nil {
+		return "", err
+	}
+	container, err := client.CreateContainer(options)
+	switch {
+	case err == docker.ErrContainerAlreadyExists:
+		return "", fmt.Errorf("%w: '%s': %v", ErrNameConflict, c.Name, err)
+	case err == docker.ErrNoSuchImage && hasDockerCli():
+		// pullImage could not pull the image through the API, while the
+		// docker CLI pulls missing images itself, f.ex. with the
+		// credentials of a credential helper
+		c.Log.Debugf("Creating container '%s' with the docker CLI, as image '%s' is missing\n", c.Name, c.Image)
+		return e.createWithCli(c)
+	case err == docker.ErrNoSuchImage:
+		return "", fmt.Errorf("%w '%s': %v", ErrImagePull, c.Image, err)
+	case err != nil:
+		return "", err
+	}
+	return container.ID, nil
+}
+
+// createWithCli creates the container with docker create.
+func (e *dockerEngine) createWithCli(c *Context) (string, error) {
+	args := append([]string{"create"}, c.Args...)
+	c.Cmd = dockerCommand(c, args...)
+	if len(c.secretEnv) > 0 {
+		// the docker flag env takes the value of a bare name from here
+		c.Cmd.Env = append(os.Environ(), c.secretEnv...)
+	}
+
+	var stderr strings.Builder
+	c.Cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+
+	outputPipe, err := c.Cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+
+	start := time.Now()
+	err = c.Cmd.Start()
+	if err != nil {
+		return "", err
+	}
+
+	bytes, err := ioutil.ReadAll(outputPipe)
+	if err != nil {
+		return "", err
+	}
+
+	id := strings.TrimSpace(string(bytes))
+
+	err = c.Cmd.Wait()
+	c.auditCommand(c.Cmd, start, err)
+	if err != nil {
+		return id, createError(c, stderr.String(), err)
+	}
+
+	return id, nil
+}
+
+func (e *dockerEngine) Start(c *Context, id string) error {
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+	err = client.StartContainer(id, nil)
+	if _, ok := err.(*docker.ContainerAlreadyRunning); ok {
+		return nil
+	}
+	return err
+}
+
+func (e *dockerEngine) Inspect(c *Context, id string) (*docker.Container, error) {
+	client, err := c.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: id})
+}
+
+func (e *dockerEngine) Events(c *Context, id string, actions []string, listener chan *docker.APIEvents) (func(), error) {
+	client, err := c.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	options := docker.EventsOptions{
+		Filters: map[string][]string{
+			"type":      {"container"},
+			"container": {id},
+			"event":     actions,
+		},
+	}
+	return addEventListener(c, client, options, listener)
+}
+
+func (e *dockerEngine) Logs(ctx context.Context, c *Context, id string, options LogsOptions, stdout io.Writer, stderr io.Writer) error {
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+	var sinceUnix int64
+	if !options.Since.IsZero() {
+		sinceUnix = options.Since.Unix()
+	}
+	return client.Logs(docker.LogsOptions{
+		Context:      ctx,
+		Container:    id,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Since:        sinceUnix,
+		Follow:       options.Follow,
+		Timestamps:   options.Timestamps,
+		Stdout:       true,
+		Stderr:       true,
+	})
+}
+
+func (e *dockerEngine) Remove(c *Context, id string, removeVolumes bool) error {
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+	return client.RemoveContainer(docker.RemoveContainerOptions{
+		ID:            id,
+		RemoveVolumes: removeVolumes,
+		Force:         true,
+	})
+}
+
+func (e *dockerEngine) Rename(c *Context, id string, name string) error {
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+	return client.RenameContainer(docker.RenameContainerOptions{
+		ID:   id,
+		Name: name,
+	})
+}
+
+func (e *dockerEngine) List(c *Context, name string) ([]docker.APIContainers, error) {
+	client, err := c.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.ListContainers(docker.ListContainersOptions{
+		All: true,
+		Filters: map[string][]string{
+			"name": {name},
+		},
+	})
+}
+
+func (e *dockerEngine) InspectImage(c *Context, reference string) (*docker.Image, error) {
+	client, err := c.GetClient()
+	if err != nil {
+		return nil, err
+	}
+	return client.InspectImage(reference)
+}
+
+func (e *dockerEngine) Exec(c *Context, id string, options ExecOptions, command []string) error {
+	args := []string{"exec", "--interactive"}
+	if isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		args = append(args, "--tty")
+	}
+	if len(options.User) > 0 {
+		args = append(args, "--user", options.User)
+	}
+	if len(options.Workdir) > 0 {
+		args = append(args, "--workdir", options.Workdir)
+	}
+	for _, env := range options.Env {
+		args = append(args, "--env", env)
+	}
+	args = append(args, id)
+	args = append(args, command...)
+
+	cmd := dockerCommand(c, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	err := cmd.Run()
+	c.auditCommand(cmd, start, err)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{
+			Code: exitErr.ExitCode(),
+			Err:  fmt.Errorf("command in container '%s' exited with code %d", c.Name, exitErr.ExitCode()),
+		}
+	}
+	return err
+}
+
+// NetworkConnect connects the container to the network over the API.
+func (e *dockerEngine) NetworkConnect(c *Context, id string, network string, ipAddress string) error {
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	options := docker.NetworkConnectionOptions{Container: id}
+	if len(ipAddress) > 0 {
+		ipam := &docker.EndpointIPAMConfig{}
+		if ip := net.ParseIP(ipAddress); ip != nil && ip.To4() == nil {
+			ipam.IPv6Address = ipAddress
+		} else {
+			ipam.IPv4Address = ipAddress
+		}
+		options.EndpointConfig = &docker.EndpointConfig{IPAMConfig: ipam}
+	}
+	return client.ConnectNetwork(network, options)
+}
+
+// createError classifies a failure of docker create by its output and by
+// whether the image is present.
+func createError(c *Context, output string, err error) error {
+	if strings.Contains(output, "is already in use") {
+		return fmt.Errorf("%w: '%s': %v", ErrNameConflict, c.Name, err)
+	}
+	if len(c.Image) == 0 {
+		return err
+	}
+	client, clientErr := c.GetClient()
+	if clientErr != nil {
+		return err
+	}
+	// docker create pulls missing images itself, so a missing image after a
+	// failed create means that it could not be pulled
+	if exists, existsErr := imageExists(client, c.Image); existsErr == nil && !exists {
+		return fmt.Errorf("%w '%s': %v", ErrImagePull, c.Image, err)
+	}
+	return err
+}
+
+// hasDockerCli returns whether the docker CLI is installed.
+func hasDockerCli() bool {
+	_, err := exec.LookPath(getDockerCommand())
+	return err == nil
+}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
@@ -0,0 +1,157 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventHealthy   = "healthy"
+	EventUnhealthy = "unhealthy"
+)
+
+// LifecycleEvent is an event in the lifecycle of a container run by
+// RunManaged.  The type is one of the phases, which is sent once the phase
+// completed, or EventHealthy or EventUnhealthy, which are sent when the
+// health of the container changes.
+type LifecycleEvent struct {
+	Type     string
+	Time     time.Time
+	Name     string
+	Id       string
+	Pid      int
+	Duration time.Duration
+}
+
+// ManagedOptions configure a container run by RunManaged.
+type ManagedOptions struct {
+	// Flags are systemd-docker flags like on the command line, f.ex.
+	// '--probe=http://:8080/healthz'.
+	Flags []string
+
+	// Args are the docker run flags, image and command, like the arguments
+	// after '--' on the command line.
+	Args []string
+
+	// NotifySocket is the sd_notify socket READY=1, WATCHDOG=1, STATUS= and
+	// MAINPID= are sent to, f.ex. NOTIFY_SOCKET of the unit of the embedding
+	// process.  Without it, systemd is not notified and the health of the
+	// container is not monitored.
+	NotifySocket string
+
+	// Events receives the lifecycle events of the container, and is closed
+	// once RunManaged returns.  Events are dropped when the channel is full,
+	// so that supervision is never blocked.
+	Events chan<- LifecycleEvent
+
+	// OnEvent is called with each lifecycle event, and must not block.
+	OnEvent func(LifecycleEvent)
+
+	// Engine manages the container instead of the engine specified by
+	// --engine, if set.  Engines which do not implement DaemonlessEngine
+	// are expected to be backed by a docker daemon.
+	Engine ContainerEngine
+}
+
+// RunManaged runs and supervises a container like systemd-docker does, for
+// supervisors and provisioning agents embedding it instead of running the
+// systemd-docker binary.  It returns once the container exited, with an
+// error carrying the exit code like ExitCode, or once ctx is done, which
+// stops the container with --stop-on-signal.  Signals and re-exec requests
+// are left to the embedding process.
+func RunManaged(ctx context.Context, opts ManagedOptions) error {
+	// Run stops the monitor before it returns, the flag guards against
+	// events emitted late by any other goroutine
+	var eventsMu sync.Mutex
+	eventsClosed := false
+	defer func() {
+		eventsMu.Lock()
+		defer eventsMu.Unlock()
+		eventsClosed = true
+		if opts.Events != nil {
+			close(opts.Events)
+		}
+	}()
+
+	c := &Context{Log: NewLogger()}
+	flags := pflag.NewFlagSet("systemd-docker", pflag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	AddFlags(flags, c)
+	if err := flags.Parse(opts.Flags); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments '%s' in flags, pass docker run arguments as args", strings.Join(flags.Args(), " "))
+	}
+
+	c.embedded = true
+	c.NotifySocket = opts.NotifySocket
+	if opts.Engine != nil {
+		c.SetEngine(opts.Engine)
+	}
+	c.onEvent = func(event LifecycleEvent) {
+		eventsMu.Lock()
+		defer eventsMu.Unlock()
+		if eventsClosed {
+			return
+		}
+		if opts.OnEvent != nil {
+			opts.OnEvent(event)
+		}
+		if opts.Events != nil {
+			select {
+			case opts.Events <- event:
+			default:
+				c.Log.Debugf("Dropped lifecycle event '%s' of container '%s', the channel is full\n", event.Type, c.Name)
+			}
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Log.Infof("Context of container '%s' is done, shutting down\n", c.Name)
+			c.Shutdown()
+		case <-done:
+		}
+	}()
+
+	return Run(c, opts.Args)
+}
+
+// emitEvent sends the lifecycle event to the embedding process.
+func emitEvent(c *Context, eventType string, duration time.Duration) {
+	if c.onEvent == nil {
+		return
+	}
+	c.onEvent(LifecycleEvent{
+		Type:     eventType,
+		Time:     time.Now(),
+		Name:     c.Name,
+		Id:       c.Id,
+		Pid:      c.Pid,
+		Duration: duration,
+	})
+}
@@ -0,0 +1,255 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultEngine is the name of the engine used unless --engine is specified.
+const DefaultEngine = "docker"
+
+// ContainerEngine creates and supervises containers.  Engines report the
+// state and events of containers in the types of the docker API, so that the
+// lifecycle code does not depend on the engine.
+type ContainerEngine interface {
+	// Create creates the container from the docker run arguments of the
+	// context and returns its ID.
+	Create(c *Context) (string, error)
+
+	// Start starts the created container.
+	Start(c *Context, id string) error
+
+	// Inspect returns the state of the container with the ID or name, or a
+	// *docker.NoSuchContainer error if it does not exist.
+	Inspect(c *Context, id string) (*docker.Container, error)
+
+	// Events sends the events of the container with any of the actions to
+	// the listener, which is closed when the subscription is lost.  The
+	// returned function unsubscribes.
+	Events(c *Context, id string, actions []string, listener chan *docker.APIEvents) (func(), error)
+
+	// Logs writes the output of the container since the time of the
+	// options, following it until it stops or ctx is cancelled with Follow,
+	// and prefixing each line with its RFC3339Nano timestamp with
+	// Timestamps.
+	Logs(ctx context.Context, c *Context, id string, options LogsOptions, stdout io.Writer, stderr io.Writer) error
+
+	// Remove removes the container, along with its anonymous volumes if
+	// removeVolumes is set.
+	Remove(c *Context, id string, removeVolumes bool) error
+
+	// Rename renames the container.
+	Rename(c *Context, id string, name string) error
+
+	// List returns the containers, running or not, whose name contains
+	// name.
+	List(c *Context, name string) ([]docker.APIContainers, error)
+
+	// InspectImage returns the image with the reference, or
+	// docker.ErrNoSuchImage if it is not present.
+	InspectImage(c *Context, reference string) (*docker.Image, error)
+
+	// Exec runs the command in the running container, attached to the
+	// standard streams.
+	Exec(c *Context, id string, options ExecOptions, command []string) error
+
+	// NetworkConnect connects the created container to the network, with
+	// the IPv4 or IPv6 address, or an address assigned by the network if
+	// ipAddress is empty.
+	NetworkConnect(c *Context, id string, network string, ipAddress string) error
+}
+
+// DaemonlessEngine is implemented by engines which manage containers without
+// a docker daemon.  The features of systemd-docker which rely on the docker
+// API, like joining networks, sidecars or volume retention, cannot be used
+// with them, while the health check of the container is only monitored
+// through its events.
+type DaemonlessEngine interface {
+	ContainerEngine
+
+	// Stop stops the container, killing it once the timeout elapsed.
+	Stop(c *Context, id string, timeout time.Duration) error
+}
+
+// LogsOptions configure which output of a container is written by Logs.
+type LogsOptions struct {
+	Since      time.Time
+	Follow     bool
+	Timestamps bool
+}
+
+// EngineFactory creates the engine for the context.
+type EngineFactory func(c *Context) (ContainerEngine, error)
+
+var engines = map[string]EngineFactory{}
+
+// RegisterEngine makes the engine available with --engine=<NAME>.  It is
+// meant to be called from the init function of the package providing the
+// engine.
+func RegisterEngine(name string, factory EngineFactory) {
+	if _, ok := engines[name]; ok {
+		panic(fmt.Sprintf("engine '%s' is already registered", name))
+	}
+	engines[name] = factory
+}
+
+// Engines returns the names of the registered engines.
+func Engines() []string {
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateEngine checks the --engine flag.
+func ValidateEngine(c *Context) error {
+	if len(c.Engine) == 0 {
+		return nil
+	}
+	if _, ok := engines[c.Engine]; !ok {
+		return fmt.Errorf("unsupported engine '%s', expected one of '%s'", c.Engine, strings.Join(Engines(), "', '"))
+	}
+	return nil
+}
+
+// ValidateDaemonless rejects the flags which rely on the docker API when the
+// engine manages containers without a docker daemon.
+func ValidateDaemonless(c *Context) error {
+	if !c.daemonless() {
+		return nil
+	}
+
+	var flag string
+	switch {
+	case c.SwarmService:
+		flag = "swarm-service"
+	case len(c.AdoptId) > 0:
+		flag = "id"
+	case c.Networks.Len() > 0:
+		flag = "networks"
+	case len(c.Sidecars) > 0:
+		flag = "sidecar"
+	case c.RecreateOnImageChange:
+		flag = "recreate-on-image-change"
+	case c.KeepOnFailure:
+		flag = "keep-on-failure"
+	case c.FreshVolumes:
+		flag = "fresh-volumes"
+	case c.VolumeRetentionDays > 0:
+		flag = "volume-retention-days"
+	case len(c.Backups) > 0:
+		flag = "on-stop-backup"
+	case c.EnsureInit != EnsureInitOff:
+		flag = "ensure-init"
+	case len(c.ImageTar) > 0:
+		flag = "image-tar"
+	case len(c.RegistryMirrors) > 0:
+		flag = "registry-mirror"
+	case c.Offline:
+		flag = "offline"
+	case c.DaemonWait > 0:
+		flag = "wait-for-daemon"
+	case c.DiskUsageInterval > 0:
+		flag = "disk-usage-interval"
+	case len(c.DeviceHotplug) > 0:
+		flag = "device-hotplug"
+	case c.cleanupEnabled(CleanupVolumes) || c.cleanupEnabled(CleanupNetworks):
+		flag = "cleanup"
+	case len(c.VerifySignature) > 0:
+		flag = "verify-signature"
+	case len(c.ExpectedDigest) > 0:
+		flag = "expected-digest"
+	}
+	for _, gate := range c.ReadyGates {
+		if strings.HasPrefix(gate, "exec:") {
+			flag = "ready-gate"
+		}
+	}
+	if len(flag) > 0 {
+		return fmt.Errorf("flag '%s' cannot be used with engine '%s'", flag, c.engineName())
+	}
+	return nil
+}
+
+// engineName returns the name of the engine specified by --engine, or the
+// type of the one plugged in with SetEngine.
+func (c *Context) engineName() string {
+	c.engineMu.Lock()
+	defer c.engineMu.Unlock()
+
+	if c.enginePlugged {
+		return fmt.Sprintf("%T", c.engine)
+	}
+	if len(c.Engine) == 0 {
+		return DefaultEngine
+	}
+	return c.Engine
+}
+
+// daemonless returns whether the engine manages containers without a docker
+// daemon.
+func (c *Context) daemonless() bool {
+	engine, err := c.GetEngine()
+	if err != nil {
+		return false
+	}
+	_, ok := engine.(DaemonlessEngine)
+	return ok
+}
+
+// SetEngine plugs in the engine managing the container instead of the one
+// specified by --engine, f.ex. an engine of the embedding program or a fake
+// in tests.
+func (c *Context) SetEngine(engine ContainerEngine) {
+	c.engineMu.Lock()
+	defer c.engineMu.Unlock()
+	c.engine = engine
+	c.enginePlugged = true
+}
+
+// GetEngine returns the engine specified by --engine, or the one plugged in
+// with SetEngine.
+func (c *Context) GetEngine() (ContainerEngine, error) {
+	c.engineMu.Lock()
+	defer c.engineMu.Unlock()
+
+	if c.engine != nil {
+		return c.engine, nil
+	}
+	name := c.Engine
+	if len(name) == 0 {
+		name = DefaultEngine
+	}
+	factory, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported engine '%s'", name)
+	}
+	engine, err := factory(c)
+	if err != nil {
+		return nil, err
+	}
+	c.engine = engine
+	return engine, nil
+}
@@ -0,0 +1,224 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type envMapping struct {
+	fromPrefix string
+	fromSuffix string
+	toPrefix   string
+	toSuffix   string
+	wildcard   bool
+}
+
+// InheritedEnvironment filters the environment variables to be passed to the
+// container by --env.  HOME and PATH are never inherited.  If --env-include
+// is set, only variables whose name matches one of its expressions are
+// inherited, and variables whose name matches any --env-exclude expression
+// are never inherited.  The names of the inherited variables are then
+// renamed by the first matching --env-map rule.
+func InheritedEnvironment(c *Context, environ []string) ([]string, error) {
+	include, err := compileExpressions(c.EnvInclude)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compileExpressions(c.EnvExclude)
+	if err != nil {
+		return nil, err
+	}
+	mappings, err := parseEnvMappings(c.EnvMap)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, val := range environ {
+		name := strings.SplitN(val, "=", 2)[0]
+		if name == "HOME" || name == "PATH" {
+			continue
+		}
+		if len(include) > 0 && !matchesAny(include, name) {
+			continue
+		}
+		if matchesAny(exclude, name) {
+			continue
+		}
+		for _, mapping := range mappings {
+			if mapped, ok := mapping.apply(name); ok {
+				if len(mapped) == 0 {
+					return nil, fmt.Errorf("environment variable '%s' is mapped to an empty name", name)
+				}
+				val = mapped + val[len(name):]
+				break
+			}
+		}
+		result = append(result, val)
+	}
+	return result, nil
+}
+
+// parseEnvMappings parses <FROM>=<TO> rules, where FROM and TO either both
+// contain a single '*' wildcard, or are plain variable names.
+func parseEnvMappings(rules []string) ([]envMapping, error) {
+	result := make([]envMapping, 0, len(rules))
+	for _, rule := range rules {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || strings.Count(parts[0], "*") > 1 || strings.Count(parts[1], "*") != strings.Count(parts[0], "*") {
+			return nil, fmt.Errorf("environment mapping '%s' has a wrong format", rule)
+		}
+		mapping := envMapping{fromPrefix: parts[0], toPrefix: parts[1]}
+		if i := strings.Index(parts[0], "*"); i >= 0 {
+			j := strings.Index(parts[1], "*")
+			mapping = envMapping{
+				fromPrefix: parts[0][:i],
+				fromSuffix: parts[0][i+1:],
+				toPrefix:   parts[1][:j],
+				toSuffix:   parts[1][j+1:],
+				wildcard:   true,
+			}
+		}
+		result = append(result, mapping)
+	}
+	return result, nil
+}
+
+func (m envMapping) apply(name string) (string, bool) {
+	if !m.wildcard {
+		return m.toPrefix, name == m.fromPrefix
+	}
+	if len(name) < len(m.fromPrefix)+len(m.fromSuffix) || !strings.HasPrefix(name, m.fromPrefix) || !strings.HasSuffix(name, m.fromSuffix) {
+		return "", false
+	}
+	match := name[len(m.fromPrefix) : len(name)-len(m.fromSuffix)]
+	return m.toPrefix + match + m.toSuffix, true
+}
+
+func compileExpressions(expressions []string) ([]*regexp.Regexp, error) {
+	result := make([]*regexp.Regexp, 0, len(expressions))
+	for _, expression := range expressions {
+		// expressions must match the whole name
+		r, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", expression))
+		if err != nil {
+			return nil, fmt.Errorf("expression '%s' is invalid: %v", expression, err)
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func matchesAny(expressions []*regexp.Regexp, value string) bool {
+	for _, r := range expressions {
+		if r.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandEnvironment expands '${VAR}' references in the arguments using the
+// lookup function.  The shell forms '${VAR:-default}', '${VAR-default}',
+// '${VAR:?message}' and '${VAR?message}' are supported, and '$$' escapes a
+// literal '$'.
+func ExpandEnvironment(args []string, lookup func(string) (string, bool)) ([]string, error) {
+	result := make([]string, 0, len(args))
+	for _, arg := range args {
+		expanded, err := expandString(arg, lookup)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expanded)
+	}
+	return result, nil
+}
+
+func expandString(value string, lookup func(string) (string, bool)) (string, error) {
+	var buf strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' || i+1 >= len(value) {
+			buf.WriteByte(value[i])
+			continue
+		}
+		if value[i+1] == '$' {
+			buf.WriteByte('$')
+			i++
+			continue
+		}
+		if value[i+1] != '{' {
+			buf.WriteByte(value[i])
+			continue
+		}
+		end := strings.IndexByte(value[i+2:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference in '%s'", value)
+		}
+		expression := value[i+2 : i+2+end]
+		expanded, err := expandExpression(expression, lookup)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(expanded)
+		i += end + 2
+	}
+	return buf.String(), nil
+}
+
+func expandExpression(expression string, lookup func(string) (string, bool)) (string, error) {
+	name := expression
+	operator := ""
+	word := ""
+	if i := strings.IndexAny(expression, ":-?"); i >= 0 {
+		name = expression[:i]
+		operator = expression[i:]
+		if strings.HasPrefix(operator, ":") && len(operator) > 1 {
+			operator, word = operator[:2], operator[2:]
+		} else {
+			operator, word = operator[:1], operator[1:]
+		}
+	}
+	if len(name) == 0 {
+		return "", fmt.Errorf("invalid variable reference '${%s}'", expression)
+	}
+
+	value, ok := lookup(name)
+	switch operator {
+	case "":
+		return value, nil
+	case ":-":
+		if !ok || len(value) == 0 {
+			return word, nil
+		}
+	case "-":
+		if !ok {
+			return word, nil
+		}
+	case ":?":
+		if !ok || len(value) == 0 {
+			return "", fmt.Errorf("variable '%s' is not set: %s", name, word)
+		}
+	case "?":
+		if !ok {
+			return "", fmt.Errorf("variable '%s' is not set: %s", name, word)
+		}
+	default:
+		return "", fmt.Errorf("invalid variable reference '${%s}'", expression)
+	}
+	return value, nil
+}
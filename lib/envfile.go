@@ -0,0 +1,152 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WriteEnvFile writes the metadata of the running container to the file
+// specified by --env-out, in a format suitable for EnvironmentFile=.
+func WriteEnvFile(c *Context) error {
+	if len(c.EnvFile) == 0 || len(c.Id) == 0 {
+		return nil
+	}
+
+	container, err := inspectContainer(c)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]string{
+		"CONTAINER_ID":   container.ID,
+		"CONTAINER_NAME": c.Name,
+	}
+
+	if container.NetworkSettings != nil {
+		for name, network := range container.NetworkSettings.Networks {
+			if len(network.IPAddress) > 0 {
+				values[fmt.Sprintf("CONTAINER_IP_%s", envName(name))] = network.IPAddress
+			}
+			if len(network.GlobalIPv6Address) > 0 {
+				values[fmt.Sprintf("CONTAINER_IPV6_%s", envName(name))] = network.GlobalIPv6Address
+			}
+			if len(network.IPv6Gateway) > 0 {
+				values[fmt.Sprintf("CONTAINER_IPV6_GATEWAY_%s", envName(name))] = network.IPv6Gateway
+			}
+		}
+		for port, bindings := range container.NetworkSettings.Ports {
+			for _, binding := range bindings {
+				if len(binding.HostPort) > 0 {
+					values[fmt.Sprintf("CONTAINER_PORT_%s_%s", port.Port(), envName(port.Proto()))] = binding.HostPort
+					break
+				}
+			}
+		}
+	}
+
+	if !c.daemonless() {
+		client, err := c.GetClient()
+		if err != nil {
+			return err
+		}
+		if digest, err := getImageDigest(client, container.Image); err != nil {
+			return err
+		} else if len(digest) > 0 {
+			values["CONTAINER_IMAGE_DIGEST"] = digest
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		buf.WriteString(fmt.Sprintf("%s=%s\n", key, values[key]))
+	}
+
+	if err = writeFileAtomic(c.EnvFile, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	c.Log.Infof("Wrote environment file '%s' for container '%s'\n", c.EnvFile, c.Name)
+	return nil
+}
+
+// getImageDigest returns the registry digest of the image, or an empty string
+// if the image was not pulled from a registry, f.ex. when it was built or
+// loaded locally, as its ID is not a digest which can be pulled.
+func getImageDigest(client *docker.Client, imageId string) (string, error) {
+	image, err := client.InspectImage(imageId)
+	if err == docker.ErrNoSuchImage {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(image.RepoDigests) > 0 {
+		parts := strings.SplitN(image.RepoDigests[0], "@", 2)
+		if len(parts) == 2 {
+			return parts[1], nil
+		}
+	}
+	return "", nil
+}
+
+func envName(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, value)
+}
+
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), fmt.Sprintf(".%s.", filepath.Base(path)))
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	if _, err = f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	if err = os.Chmod(tmpName, perm); err != nil {
+		_ = os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, path)
+}
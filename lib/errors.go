@@ -0,0 +1,141 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Failure classes of supervising a container.  Errors returned by lib wrap
+// one of these when the failure falls into the class, so that callers can
+// branch on it with errors.Is.
+var (
+	// ErrImagePull is returned when the image of the container is not
+	// present and cannot be pulled.
+	ErrImagePull = errors.New("failed to pull image")
+
+	// ErrNameConflict is returned when a container with the name is already
+	// in use and cannot be taken over.
+	ErrNameConflict = errors.New("container name is already in use")
+
+	// ErrCreate is returned when the container cannot be created or
+	// connected to its networks.
+	ErrCreate = errors.New("failed to create container")
+
+	// ErrStart is returned when the container cannot be started.
+	ErrStart = errors.New("failed to start container")
+
+	// ErrStartTimeout is returned when a precondition of starting the
+	// container is not met within the configured wait.
+	ErrStartTimeout = errors.New("timed out starting container")
+
+	// ErrUnhealthy is returned when the container exits after it became
+	// unhealthy, before it was ever healthy.
+	ErrUnhealthy = errors.New("container is unhealthy")
+
+	// ErrDaemonUnavailable is returned when none of the docker daemons
+	// responds.
+	ErrDaemonUnavailable = errors.New("docker daemon is unavailable")
+)
+
+// failureClasses are the failure classes in order of precedence.
+var failureClasses = []error{
+	ErrUnhealthy,
+	ErrDaemonUnavailable,
+	ErrImagePull,
+	ErrNameConflict,
+	ErrCreate,
+	ErrStartTimeout,
+	ErrStart,
+}
+
+// Exit codes of systemd-docker for failures which are not caused by the exit
+// of the container.
+const (
+	ExitCodeImagePull         = 10
+	ExitCodeCreate            = 11
+	ExitCodeStart             = 12
+	ExitCodeUnhealthy         = 13
+	ExitCodeDaemonUnavailable = 14
+
+	// ExitCodeImageNotPresent is the exit code used when running with
+	// --offline and the image is not present locally.
+	ExitCodeImageNotPresent = 15
+
+	// ExitCodeDeviceReplugged is the exit code used when the container was
+	// stopped with --device-hotplug=restart, so that systemd restarts it.
+	ExitCodeDeviceReplugged = 16
+
+	// ExitCodeSignatureInvalid is the exit code used when the signature of
+	// the image cannot be verified with --verify-signature.
+	ExitCodeSignatureInvalid = 17
+
+	// ExitCodeDigestMismatch is the exit code used when the image does not
+	// resolve to the digest expected with --expected-digest.
+	ExitCodeDigestMismatch = 18
+)
+
+// ExitError is an error which should cause the process to exit with a
+// specific exit code.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// withClass wraps err in the failure class, unless it already falls into a
+// class.
+func withClass(err error, class error) error {
+	if err == nil || err == ErrShutdown {
+		return err
+	}
+	for _, c := range failureClasses {
+		if errors.Is(err, c) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %v", class, err)
+}
+
+// ExitCode returns the exit code of systemd-docker for the error: the exit
+// code of its failure class, else the code of an ExitError, else 1.
+func ExitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrUnhealthy):
+		return ExitCodeUnhealthy
+	case errors.Is(err, ErrDaemonUnavailable):
+		return ExitCodeDaemonUnavailable
+	case errors.Is(err, ErrImagePull):
+		return ExitCodeImagePull
+	case errors.Is(err, ErrNameConflict), errors.Is(err, ErrCreate):
+		return ExitCodeCreate
+	case errors.Is(err, ErrStartTimeout), errors.Is(err, ErrStart):
+		return ExitCodeStart
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return 1
+}
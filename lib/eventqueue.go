@@ -0,0 +1,102 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"github.com/fsouza/go-dockerclient"
+	"sync"
+)
+
+const (
+	DefaultEventQueueSize = 256
+	DefaultLogBufferSize  = 1024 * 1024
+)
+
+// addEventListener subscribes the listener to the events matching the
+// options through a queue bounded by --event-queue-size.  The client drops
+// events which cannot be delivered immediately, so the queue absorbs bursts
+// while the listener is busy, and drops the oldest events once it is full.
+// The returned function unsubscribes the listener.
+func addEventListener(c *Context, client *docker.Client, options docker.EventsOptions, listener chan *docker.APIEvents) (func(), error) {
+	size := c.EventQueueSize
+	if size <= 0 {
+		size = DefaultEventQueueSize
+	}
+
+	events := make(chan *docker.APIEvents, size)
+	if err := client.AddEventListenerWithOptions(options, events); err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go forwardEvents(c, events, listener, size, done)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			_ = client.RemoveEventListener(events)
+			close(done)
+		})
+	}, nil
+}
+
+// forwardEvents delivers the events to the listener in order, keeping at
+// most size pending events.  When the client closes the events, the pending
+// events are delivered before the listener is closed.
+func forwardEvents(c *Context, events chan *docker.APIEvents, listener chan *docker.APIEvents, size int, done chan struct{}) {
+	var pending []*docker.APIEvents
+	dropped := 0
+	for {
+		var out chan *docker.APIEvents
+		var next *docker.APIEvents
+		if len(pending) > 0 {
+			out, next = listener, pending[0]
+		}
+
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				for _, ev := range pending {
+					select {
+					case listener <- ev:
+					case <-done:
+						return
+					}
+				}
+				close(listener)
+				return
+			}
+			pending = append(pending, ev)
+			if len(pending) > size {
+				pending[0] = nil
+				pending = pending[1:]
+				if dropped == 0 {
+					c.Log.Warnf("Event queue of container '%s' is full, dropping the oldest events\n", c.Name)
+				}
+				dropped++
+			}
+		case out <- next:
+			pending[0] = nil
+			pending = pending[1:]
+			if len(pending) == 0 && dropped > 0 {
+				c.Log.Warnf("Dropped %d events of container '%s'\n", dropped, c.Name)
+				dropped = 0
+			}
+		case <-done:
+			return
+		}
+	}
+}
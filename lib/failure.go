@@ -0,0 +1,138 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Phases in which supervising the container failed.
+const (
+	FailurePhaseDaemon    = "daemon"
+	FailurePhasePull      = "pull"
+	FailurePhaseCreate    = "create"
+	FailurePhaseStart     = "start"
+	FailurePhaseUnhealthy = "unhealthy"
+	FailurePhaseExit      = "exit"
+	FailurePhaseOther     = "other"
+)
+
+// FailureReport describes why supervising the container failed.  It is
+// written to the state directory, so that an OnFailure= unit can report
+// the failure.
+type FailureReport struct {
+	Name              string    `json:"name"`
+	Id                string    `json:"id,omitempty"`
+	Unit              string    `json:"unit,omitempty"`
+	Phase             string    `json:"phase"`
+	Reason            string    `json:"reason"`
+	ExitCode          int       `json:"exitCode"`
+	ContainerExitCode int       `json:"containerExitCode"`
+	HealthOutput      string    `json:"healthOutput,omitempty"`
+	Time              time.Time `json:"time"`
+}
+
+// failureFile returns the file the failure report of the container is
+// written to.
+func failureFile(c *Context) string {
+	return filepath.Join(stateDirectory(), "failures", filepath.Base(c.Name)+".json")
+}
+
+// WriteFailure writes the failure report for the error which supervising
+// the container failed with.  Failing to write it is not fatal.
+func WriteFailure(c *Context, err error) {
+	if err == nil || err == ErrShutdown || len(c.Name) == 0 {
+		return
+	}
+
+	c.phases.mu.Lock()
+	healthOutput := c.phases.healthOutput
+	c.phases.mu.Unlock()
+
+	report := FailureReport{
+		Name:              c.Name,
+		Id:                c.Id,
+		Phase:             failurePhase(err),
+		Reason:            err.Error(),
+		ExitCode:          ExitCode(err),
+		ContainerExitCode: c.ExitCode,
+		HealthOutput:      healthOutput,
+		Time:              time.Now(),
+	}
+	if unit, err := currentUnit(); err == nil {
+		report.Unit = unit
+	}
+
+	path := failureFile(c)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = writeFileAtomic(path, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		c.Log.Warnf("Failed to write failure report '%s': %s\n", path, err)
+		return
+	}
+	c.Log.Debugf("Wrote failure report '%s' for container '%s'\n", path, c.Name)
+}
+
+// ClearFailure removes the failure report of a previous run once the
+// container was started.
+func ClearFailure(c *Context) {
+	if err := os.Remove(failureFile(c)); err != nil && !os.IsNotExist(err) {
+		c.Log.Debugf("Failed to remove failure report '%s': %s\n", failureFile(c), err)
+	}
+}
+
+// recordHealthOutput records the output of the last failed health check,
+// for the failure report.
+func recordHealthOutput(c *Context, output string) {
+	c.phases.mu.Lock()
+	c.phases.healthOutput = output
+	c.phases.mu.Unlock()
+}
+
+// failurePhase returns the phase of supervising the container which failed
+// with the error.
+func failurePhase(err error) string {
+	switch {
+	case errors.Is(err, ErrUnhealthy):
+		return FailurePhaseUnhealthy
+	case errors.Is(err, ErrDaemonUnavailable):
+		return FailurePhaseDaemon
+	case errors.Is(err, ErrImagePull):
+		return FailurePhasePull
+	case errors.Is(err, ErrNameConflict), errors.Is(err, ErrCreate):
+		return FailurePhaseCreate
+	case errors.Is(err, ErrStartTimeout), errors.Is(err, ErrStart):
+		return FailurePhaseStart
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.Code {
+		case ExitCodeImageNotPresent, ExitCodeSignatureInvalid, ExitCodeDigestMismatch:
+			return FailurePhasePull
+		}
+		return FailurePhaseExit
+	}
+	return FailurePhaseOther
+}
@@ -0,0 +1,256 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// fdStoreName is the name of the descriptor holding the supervision
+	// state in the FD store of the unit.  The state alternates with the
+	// descriptor named fdStoreNextName, see writeFdStore.
+	fdStoreName = "systemd-docker-state"
+
+	// fdStoreNextName is the name of the descriptor alternating with
+	// fdStoreName.
+	fdStoreNextName = "systemd-docker-state-next"
+
+	// fdStoreNotifyName is the name of the descriptor holding the socket
+	// connected to NOTIFY_SOCKET in the FD store of the unit.
+	fdStoreNotifyName = "notify"
+
+	// fdStoreInterval is the interval at which the supervision state in the
+	// FD store is updated.
+	fdStoreInterval = 5 * time.Second
+
+	// listenFdsStart is the first descriptor passed by systemd.
+	listenFdsStart = 3
+)
+
+// fdStoreNames are the names of the descriptors holding the supervision
+// state.
+var fdStoreNames = [2]string{fdStoreName, fdStoreNextName}
+
+// LoadFdStore loads the supervision state left in the FD store of the unit
+// by a previous instance, so that the container is resumed instead of being
+// restarted.  If both state descriptors are present, as the previous instance
+// crashed while replacing the state, the newer state is loaded.  The
+// descriptors are left in place for socket activation.
+func LoadFdStore(c *Context) error {
+	if !c.FdStore || c.resumed != nil {
+		return nil
+	}
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil
+	}
+
+	for i, name := range strings.Split(os.Getenv("LISTEN_FDNAMES"), ":") {
+		if i >= count {
+			break
+		}
+		switch name {
+		case fdStoreNotifyName:
+			c.notifyFile = os.NewFile(uintptr(listenFdsStart+i), name)
+		case fdStoreName, fdStoreNextName:
+			f := os.NewFile(uintptr(listenFdsStart+i), name)
+			state, err := readFdStore(f)
+			_ = f.Close()
+			if err != nil {
+				c.Log.Warnf("Ignoring invalid state '%s' in FD store: %s\n", name, err)
+				continue
+			}
+			if c.resumed != nil && !state.LogsSince.After(c.resumed.LogsSince) {
+				continue
+			}
+			c.resumed = state
+			if name == fdStoreName {
+				c.fdStoreSlot = 0
+			} else {
+				c.fdStoreSlot = 1
+			}
+		}
+	}
+	if c.resumed != nil {
+		c.Log.Infof("Resuming supervision of container '%s' from the FD store\n", c.resumed.Name)
+	}
+	return nil
+}
+
+func readFdStore(f *os.File) (*reexecState, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, info.Size())
+	if _, err = f.ReadAt(data, 0); err != nil {
+		return nil, fmt.Errorf("failed to read state: %v", err)
+	}
+	var state reexecState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// StartFdStore keeps the supervision state in the FD store of the unit, so
+// that a restarted systemd-docker resumes watchdog pings and log piping
+// without a gap.  The returned function stops updating the state and, once
+// the container has stopped, removes it from the FD store.
+func StartFdStore(c *Context) func() {
+	if !c.FdStore || len(c.NotifySocket) == 0 {
+		return func() {}
+	}
+
+	if err := writeFdStore(c); err != nil {
+		c.Log.Warnf("Failed to store state in the FD store, is FileDescriptorStoreMax= set: %s\n", err)
+		return func() {}
+	}
+
+	if c.notifyFile == nil {
+		if err := storeNotifySocket(c); err != nil {
+			c.Log.Warnf("Failed to store the notify socket in the FD store: %s\n", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(fdStoreInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			if err := writeFdStore(c); err != nil {
+				c.Log.Debugf("Failed to update FD store state: %s\n", err)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		if !c.stoppedAt.IsZero() {
+			for _, name := range []string{fdStoreName, fdStoreNextName, fdStoreNotifyName} {
+				if err := sendNotify(c, fmt.Sprintf("FDSTOREREMOVE=1\nFDNAME=%s", name)); err != nil {
+					c.Log.Debugf("Failed to remove '%s' from the FD store: %s\n", name, err)
+				}
+			}
+		}
+	}
+}
+
+// writeFdStore writes the supervision state to a new descriptor, which
+// replaces the stored one only once it is complete, so that a crash while
+// writing leaves the previous state in place.  As FDSTOREREMOVE removes all
+// descriptors with the name, the state alternates between two names: the new
+// descriptor is stored under the other name before the previous one is
+// removed.
+func writeFdStore(c *Context) error {
+	data, err := json.Marshal(supervisionState(c))
+	if err != nil {
+		return err
+	}
+	fd, err := unix.MemfdCreate(fdStoreName, unix.MFD_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	// systemd keeps its own copy of the stored descriptor
+	f := os.NewFile(uintptr(fd), fdStoreName)
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+
+	current, next := fdStoreNames[c.fdStoreSlot], fdStoreNames[1-c.fdStoreSlot]
+	// remove a state left under the name by a crash, or before a re-exec
+	_ = sendNotify(c, fmt.Sprintf("FDSTOREREMOVE=1\nFDNAME=%s", next))
+	if err = sendFd(c, fmt.Sprintf("FDSTORE=1\nFDNAME=%s", next), fd); err != nil {
+		return err
+	}
+	c.fdStoreSlot = 1 - c.fdStoreSlot
+	return sendNotify(c, fmt.Sprintf("FDSTOREREMOVE=1\nFDNAME=%s", current))
+}
+
+// storeNotifySocket connects a socket to NOTIFY_SOCKET and keeps it in the
+// FD store, so that a restarted systemd-docker notifies systemd over the same
+// connection instead of opening NOTIFY_SOCKET again.
+func storeNotifySocket(c *Context) error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: c.NotifySocket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	f, err := conn.File()
+	_ = conn.Close()
+	if err != nil {
+		return err
+	}
+
+	// replace any socket stored before a re-exec
+	_ = sendNotify(c, fmt.Sprintf("FDSTOREREMOVE=1\nFDNAME=%s", fdStoreNotifyName))
+	if err = sendFd(c, fmt.Sprintf("FDSTORE=1\nFDNAME=%s", fdStoreNotifyName), int(f.Fd())); err != nil {
+		_ = f.Close()
+		return err
+	}
+	c.notifyFile = f
+	return nil
+}
+
+// sendFd sends the notification along with the descriptor to systemd.
+func sendFd(c *Context, state string, fd int) error {
+	conn, err := dialNotify(c)
+	if err != nil {
+		return err
+	}
+	defer func(conn *net.UnixConn) {
+		_ = conn.Close()
+	}(conn)
+
+	return writeFd(conn, []byte(state), fd)
+}
+
+// writeFd sends the data along with the descriptor over the connected
+// datagram socket, which WriteMsgUnix refuses to do.
+func writeFd(conn syscall.Conn, data []byte, fd int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	err = raw.Write(func(s uintptr) bool {
+		sendErr = unix.Sendmsg(int(s), data, unix.UnixRights(fd), nil, 0)
+		return sendErr != unix.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
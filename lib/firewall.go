@@ -0,0 +1,220 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const (
+	FirewallNftables  = "nftables"
+	FirewallFirewalld = "firewalld"
+)
+
+var (
+	defaultFirewallRules = map[string][]string{
+		FirewallNftables: {`inet filter input {{.Proto}} dport {{.HostPort}} accept`},
+		FirewallFirewalld: {
+			`rule family="ipv4" port port="{{.HostPort}}" protocol="{{.Proto}}" accept`,
+			`rule family="ipv6" port port="{{.HostPort}}" protocol="{{.Proto}}" accept`,
+		},
+	}
+	nftablesHandleRegex = regexp.MustCompile(`# handle (\d+)`)
+)
+
+// FirewallRuleData is the data available to --firewall-rule templates.  A
+// rule is rendered once for every published port of the container.
+type FirewallRuleData struct {
+	Name          string
+	Id            string
+	IP            string
+	HostIP        string
+	HostPort      string
+	ContainerPort string
+	Proto         string
+}
+
+// AddFirewallRules renders the configured firewall rules for the published
+// ports of the container and adds them using the configured backend.  A rule
+// is only added once, f.ex. for a port published on both 0.0.0.0 and [::].
+func AddFirewallRules(c *Context) error {
+	// the rules were restored after a re-exec
+	if len(c.Firewall) == 0 || c.resumed != nil {
+		return nil
+	}
+
+	templates := c.FirewallRules
+	if len(templates) == 0 {
+		if rules, ok := defaultFirewallRules[c.Firewall]; ok {
+			templates = rules
+		} else {
+			return fmt.Errorf("unsupported firewall '%s'", c.Firewall)
+		}
+	}
+
+	container, err := inspectContainer(c)
+	if err != nil {
+		return err
+	}
+
+	added := make(map[string]bool)
+	for _, data := range firewallRuleData(c, container) {
+		for _, text := range templates {
+			rule, err := renderFirewallRule(text, data)
+			if err != nil {
+				return err
+			}
+			if added[rule] {
+				continue
+			}
+			added[rule] = true
+			if err = addFirewallRule(c, rule); err != nil {
+				return err
+			}
+			c.supervisionMu.Lock()
+			c.firewallRules = append(c.firewallRules, rule)
+			c.supervisionMu.Unlock()
+			c.Log.Infof("Added %s rule '%s' for container '%s'\n", c.Firewall, rule, c.Name)
+		}
+	}
+	return nil
+}
+
+// RemoveFirewallRules removes all firewall rules added by AddFirewallRules.
+func RemoveFirewallRules(c *Context) error {
+	c.supervisionMu.Lock()
+	rules := c.firewallRules
+	c.firewallRules = nil
+	c.supervisionMu.Unlock()
+
+	var lastErr error
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		if err := removeFirewallRule(c, rule); err != nil {
+			c.Log.Errorf("Failed to remove %s rule '%s' for container '%s': %s\n", c.Firewall, rule, c.Name, err)
+			lastErr = err
+		} else {
+			c.Log.Infof("Removed %s rule '%s' for container '%s'\n", c.Firewall, rule, c.Name)
+		}
+	}
+	return lastErr
+}
+
+func firewallRuleData(c *Context, container *docker.Container) []FirewallRuleData {
+	var result []FirewallRuleData
+	if container.NetworkSettings == nil {
+		return result
+	}
+
+	ip := container.NetworkSettings.IPAddress
+	for _, network := range container.NetworkSettings.Networks {
+		if len(ip) == 0 && len(network.IPAddress) > 0 {
+			ip = network.IPAddress
+		}
+	}
+
+	for port, bindings := range container.NetworkSettings.Ports {
+		for _, binding := range bindings {
+			result = append(result, FirewallRuleData{
+				Name:          c.Name,
+				Id:            container.ID,
+				IP:            ip,
+				HostIP:        binding.HostIP,
+				HostPort:      binding.HostPort,
+				ContainerPort: port.Port(),
+				Proto:         port.Proto(),
+			})
+		}
+	}
+	return result
+}
+
+func renderFirewallRule(text string, data FirewallRuleData) (string, error) {
+	t, err := template.New("firewall").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid firewall rule template '%s': %v", text, err)
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render firewall rule template '%s': %v", text, err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func addFirewallRule(c *Context, rule string) error {
+	switch c.Firewall {
+	case FirewallNftables:
+		args := append([]string{"add", "rule"}, strings.Fields(rule)...)
+		args = append(args, "comment", fmt.Sprintf("\"%s\"", nftablesComment(c)))
+		_, err := runCommand("nft", args...)
+		return err
+	case FirewallFirewalld:
+		_, err := runCommand("firewall-cmd", firewalldArgs(c, "--add-rich-rule", rule)...)
+		return err
+	}
+	return fmt.Errorf("unsupported firewall '%s'", c.Firewall)
+}
+
+func removeFirewallRule(c *Context, rule string) error {
+	switch c.Firewall {
+	case FirewallNftables:
+		// nftables rules can only be deleted by handle, so find the
+		// rules in the chain which carry our comment
+		fields := strings.Fields(rule)
+		if len(fields) < 3 {
+			return fmt.Errorf("cannot determine chain of nftables rule '%s'", rule)
+		}
+		chain := fields[:3]
+		output, err := runCommand("nft", append([]string{"-a", "list", "chain"}, chain...)...)
+		if err != nil {
+			return err
+		}
+		comment := fmt.Sprintf("comment \"%s\"", nftablesComment(c))
+		for _, line := range strings.Split(output, "\n") {
+			if !strings.Contains(line, comment) {
+				continue
+			}
+			if match := nftablesHandleRegex.FindStringSubmatch(line); match != nil {
+				args := append(append([]string{"delete", "rule"}, chain...), "handle", match[1])
+				if _, err = runCommand("nft", args...); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case FirewallFirewalld:
+		_, err := runCommand("firewall-cmd", firewalldArgs(c, "--remove-rich-rule", rule)...)
+		return err
+	}
+	return fmt.Errorf("unsupported firewall '%s'", c.Firewall)
+}
+
+func nftablesComment(c *Context) string {
+	return fmt.Sprintf("systemd-docker:%s", c.Name)
+}
+
+func firewalldArgs(c *Context, action string, rule string) []string {
+	var args []string
+	if len(c.FirewallZone) > 0 {
+		args = append(args, fmt.Sprintf("--zone=%s", c.FirewallZone))
+	}
+	return append(args, fmt.Sprintf("%s=%s", action, rule))
+}
@@ -0,0 +1,135 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"github.com/spf13/pflag"
+)
+
+// AddFlags registers the flags configuring how the container is run and
+// supervised on the flag set, bound to the context.
+func AddFlags(flags *pflag.FlagSet, c *Context) {
+	c.flags = flags
+	flags.StringVarP(&c.PidFile, "pid-file", "p", "", "Path to write PID of container to")
+	flags.StringVar(&c.EnvFile, "env-out", "", "Path to write container metadata environment file to")
+	flags.StringVar(&c.IpFile, "ip-file", "", "Path to write IP addresses of container to")
+	flags.BoolVar(&c.SwarmService, "swarm-service", false, "Run the container as a single replica swarm service, the arguments after '--' are passed to 'docker service create'")
+	flags.DurationVar(&c.SwarmTaskWait, "swarm-task-wait", DefaultSwarmTaskWait, "Time to wait for the task of the swarm service to start")
+	flags.StringVar(&c.HostnameTemplate, "hostname-template", "", "Hostname of the container with the unit specifiers %n, %N, %p and %i, unless the docker flag 'hostname' is used")
+	flags.StringVar(&c.AdoptId, "id", "", "ID of an existing container to supervise instead of the docker flag 'name'")
+	flags.BoolVarP(&c.Logs, "logs", "l", true, "Enable log piping")
+	flags.StringVar(&c.SyslogIdentifier, "syslog-identifier", "", "SYSLOG_IDENTIFIER of the piped container logs, piped by systemd-docker itself instead of the journald log driver")
+	flags.BoolVarP(&c.Notify, "notify", "n", false, "Setup systemd notify for container")
+	flags.StringVar(&c.NotifyBridge, "notify-bridge", "", "Relay notifications of the container posted to tcp://[HOST]:PORT or vsock://[CID]:PORT instead of sharing NOTIFY_SOCKET")
+	flags.StringVar(&c.NotifyBridgeUrl, "notify-bridge-url", "", "URL the container reaches the notify bridge on, defaults to the address of 'notify-bridge'")
+	flags.BoolVar(&c.UserManager, "user-manager", false, "Run under a systemd user manager, auto-detected by default")
+	flags.BoolVar(&c.UnitPreflight, "unit-preflight", true, "Validate the NotifyAccess, PrivateTmp and ProtectProc settings of the unit over D-Bus")
+	flags.StringSliceVar(&c.UnitMetadata, "unit-metadata", []string{}, "Attach the Description, PartOf and X-systemd-docker-<NAME> keys of the unit to the container as 'labels' and/or 'env'")
+	flags.BoolVar(&c.Audit, "audit", false, "Record every docker CLI command and API request as structured journal entry")
+	flags.StringArrayVar(&c.Probes, "probe", nil, "Readiness probe of the container as http://[HOST]:PORT/PATH or tcp://[HOST]:PORT, replacing the container health check")
+	flags.StringVar(&c.ProbePolicy, "probe-policy", ProbePolicyAll, "Whether 'all' or 'any' of the probes must succeed for the container to be healthy")
+	flags.DurationVar(&c.ProbeInterval, "probe-interval", DefaultProbeInterval, "Interval between probes")
+	flags.DurationVar(&c.ProbeTimeout, "probe-timeout", DefaultProbeTimeout, "Timeout of each probe")
+	flags.StringArrayVar(&c.Sidecars, "sidecar", nil, "Sidecar container whose health is aggregated with the health of the container")
+	flags.StringVar(&c.GroupPolicy, "group-policy", GroupPolicyAll, "Whether 'all' or a 'quorum' of the containers of the group must be healthy for the group to be healthy")
+	flags.DurationVar(&c.GroupInterval, "group-interval", DefaultGroupInterval, "Interval between health checks of the group")
+	flags.StringSliceVar(&c.MonitorEvents, "monitor-event", nil, "Additional docker event handled by the health check monitor as <EVENT>=<BEHAVIOR>, where the behavior is 'healthy', 'unhealthy' or 'log'")
+	flags.StringArrayVar(&c.ReadyGates, "ready-gate", nil, "Condition which must hold, in order, once the container is healthy before READY=1 is sent, as exec:<COMMAND> run in the container or hook:<TEMPLATE> run on the host")
+	flags.DurationVar(&c.ReadyGateInterval, "ready-gate-interval", DefaultReadyGateInterval, "Interval between attempts of the ready gates when the container has no health check")
+	flags.DurationVar(&c.ReadyGateTimeout, "ready-gate-timeout", DefaultReadyGateTimeout, "Timeout of each ready gate")
+	flags.StringSliceVar(&c.Cleanup, "cleanup", []string{CleanupAnonymousVolumes}, "Resources of the container to remove with it when the docker flag 'rm' is used: networks, volumes and anonymous-volumes")
+	flags.BoolVar(&c.FreshVolumes, "fresh-volumes", false, "Remove the named volumes created for the container before starting it")
+	flags.IntVar(&c.VolumeRetentionDays, "volume-retention-days", 0, "Remove the named volumes created for the container when they have not been used for the number of days")
+	flags.BoolVar(&c.VolumePruneDryRun, "volume-prune-dry-run", false, "Only log the named volumes which would be removed")
+	flags.BoolVar(&c.FdStore, "fd-store", false, "Keep the supervision state in the FD store of the unit to resume the container when systemd-docker is restarted, requires FileDescriptorStoreMax=")
+	flags.BoolVar(&c.StopOnSignal, "stop-on-signal", false, "Stop the container when systemd-docker receives SIGTERM or SIGINT")
+	flags.DurationVar(&c.MaxRuntime, "max-runtime", 0, "Time after which the container is stopped, 0 disables the limit")
+	flags.IntVar(&c.MaxRuntimeExitCode, "max-runtime-exit-code", 0, "Exit code of systemd-docker when the container was stopped after 'max-runtime'")
+	flags.StringVar(&c.StaleContainer, "stale-container", StaleContainerFail, "Action when the container was replaced or restarted outside of systemd-docker, 'fail' or 'adopt'")
+	flags.StringVar(&c.RestartCheck, "restart-check", RestartCheckWarn, "Action when the docker flag 'restart' is specified, 'warn' to ignore it or 'fail'")
+	flags.StringVar(&c.WatchdogCheck, "watchdog-check", WatchdogCheckWarn, "Action when the health check cannot confirm health within WatchdogSec, 'warn' to send synthetic pings or 'fail'")
+	flags.DurationVar(&c.WatchdogStaleness, "watchdog-staleness", 0, "How long after health was last confirmed synthetic watchdog pings are sent, defaults to the health check interval plus timeout")
+	flags.IntVar(&c.WatchdogTriggerFailures, "watchdog-trigger-failures", 0, "Send WATCHDOG=trigger once the health check of the ready container failed the number of times in a row, 0 to disable")
+	flags.DurationVar(&c.WatchdogTriggerUnhealthy, "watchdog-trigger-unhealthy", 0, "Send WATCHDOG=trigger once the ready container has been unhealthy for the duration, 0 to disable")
+	flags.BoolVarP(&c.Env, "env", "e", false, "Inherit environment variables")
+	flags.BoolVar(&c.KeepOnFailure, "keep-on-failure", false, "Keep containers which exited with a non-zero code instead of removing them")
+	flags.IntVar(&c.KeepFailed, "keep-failed", 0, "Number of failed containers to keep when 'keep-on-failure' is set, 0 keeps all")
+	flags.StringVar(&c.ImageTar, "image-tar", "", "Path to image archive to load if the image is not present")
+	flags.StringSliceVar(&c.RegistryMirrors, "registry-mirror", []string{}, "Mirror to pull the image from when pulling it from its registry fails, [<REGISTRY>=]<MIRROR> where the registry defaults to docker.io, tried in order")
+	flags.StringVar(&c.PullPolicy, "pull-policy", "", "When to pull the image before creating the container, 'always', 'missing' or 'never', defaults to the docker flag 'pull'")
+	flags.IntVar(&c.PullRetries, "pull-retries", 0, "Number of times pulling the image is retried when it fails")
+	flags.DurationVar(&c.PullRetryDelay, "pull-retry-delay", DefaultPullRetryDelay, "Delay before the first retry of pulling the image, doubled after each retry")
+	flags.StringVar(&c.RegistryAuthFile, "registry-auth-file", "", "Docker config file with the credentials and credential helpers of registries to pull the image with, before the config of the docker CLI")
+	flags.StringVar(&c.VerifySignature, "verify-signature", "", "Verify the signature of the image before creating the container, cosign:<KEY> or notation[:<CONFIG_DIR>]")
+	flags.StringVar(&c.ExpectedDigest, "expected-digest", "", "Digest the image must resolve to before creating the container, sha256:<HEX>, or 'record' to record it on the first start")
+	flags.StringVar(&c.DigestCheck, "digest-check", DigestCheckFail, "Whether to 'warn' or 'fail' when the image does not resolve to the expected digest")
+	flags.BoolVar(&c.Offline, "offline", false, "Never pull images, fail if the image is not present")
+	flags.BoolVar(&c.AllowEmulation, "allow-emulation", false, "Allow running images for a platform other than the daemon's")
+	flags.BoolVar(&c.RecreateOnImageChange, "recreate-on-image-change", false, "Recreate a running container with the name when its image resolves to another image than it was created from")
+	flags.IntSliceVar(&c.OkExitCodes, "ok-exit-codes", []int{}, "Exit codes of the container, besides 0, treated as success")
+	flags.StringArrayVar(&c.Backups, "on-stop-backup", []string{}, "Backup to run for a volume after the container stops, <VOLUME>=<COMMAND_TEMPLATE> or <VOLUME>=tar:<DIRECTORY>")
+	flags.StringArrayVar(&c.EnvInclude, "env-include", []string{}, "Regular expressions of environment variable names to inherit")
+	flags.StringArrayVar(&c.EnvExclude, "env-exclude", []string{}, "Regular expressions of environment variable names not to inherit")
+	flags.StringArrayVar(&c.EnvMap, "env-map", []string{}, "Rename inherited environment variables, <FROM>=<TO> where '*' matches any part of the name")
+	flags.StringArrayVar(&c.EncryptedEnvFiles, "encrypted-env-file", []string{}, "Decrypt the env file produced by 'systemd-creds encrypt' and pass its variables to the container")
+	flags.BoolVar(&c.ExpandEnv, "expand-env", false, "Expand ${VAR} references in the docker flags and the image")
+	flags.StringSliceVarP(&c.Cgroups, "cgroups", "c", []string{}, "CGroups to take ownership of or 'all' for all CGroups available")
+	flags.Var(&c.Networks, "networks", "Networks to join, <NETWORK_NAME>[:<IP_ADDRESS>]")
+	flags.DurationVar(&c.NetworkWait, "network-wait", 0, "Time to wait for the parent interfaces of macvlan/ipvlan networks to be up")
+	flags.BoolVar(&c.DenyPrivileged, "deny-privileged", false, "Refuse to run privileged containers")
+	flags.StringSliceVar(&c.MaxCaps, "max-caps", nil, "Capabilities the container is allowed to have, refusing containers with others")
+	flags.BoolVar(&c.EnforceReadOnly, "enforce-read-only", false, "Make the root filesystem of the container read-only, unless the docker flag 'read-only=false' is passed")
+	flags.StringSliceVar(&c.ReadOnlyTmpfs, "read-only-tmpfs", DefaultReadOnlyTmpfs, "Paths to mount a tmpfs on with 'enforce-read-only', unless they are already mounted")
+	flags.StringVar(&c.EnsureInit, "ensure-init", EnsureInitOff, "Whether to 'warn' or 'inject' the docker flag 'init' when PID 1 of the container is not a known init which reaps zombies, or 'off'")
+	flags.StringVar(&c.LimitCheck, "limit-check", LimitCheckOff, "Whether to 'clamp' or 'fail' on docker flags 'ulimit' and 'sysctl' exceeding the limits of the host, or 'off'")
+	flags.BoolVar(&c.DropCapabilities, "drop-capabilities", false, "Drop the capabilities only needed to set up the container once supervising it starts")
+	flags.StringVar(&c.SysFsCgroupPath, "sys-fs-cgroup-path", DefaultSysFsCgroupPath, "Path the cgroup hierarchies to move the container in are mounted at")
+	flags.StringVar(&c.ProcPath, "proc-path", DefaultProcPath, "Path proc is mounted at")
+	flags.StringVar(&c.DeviceHotplug, "device-hotplug", "", "Action when a device passed with the docker flag 'device' is removed and added again, 'restart' or 'hook:<TEMPLATE>'")
+	flags.DurationVar(&c.DeviceWait, "device-wait", 0, "Time to wait for the devices passed with the docker flag 'device' to appear")
+	flags.StringSliceVar(&c.CniNetworks, "cni-networks", []string{}, "CNI networks to attach the container to")
+	flags.StringVar(&c.CniConfDir, "cni-conf-dir", DefaultCniConfDir, "Directory containing CNI network configurations")
+	flags.StringVar(&c.CniBinDir, "cni-bin-dir", DefaultCniBinDir, "Directories containing CNI plugins")
+	flags.StringVar(&c.Firewall, "firewall", "", "Firewall to add rules for published ports to, 'nftables' or 'firewalld'")
+	flags.StringArrayVar(&c.FirewallRules, "firewall-rule", []string{}, "Firewall rule template added for each published port")
+	flags.StringVar(&c.FirewallZone, "firewall-zone", "", "Firewalld zone to add rules to")
+	flags.StringArrayVar(&c.TrafficShaping, "traffic-shaping", []string{}, "Traffic shaping of a network of the container, 'NETWORK:rate=RATE[,ceil=RATE][,latency=DURATION]'")
+	flags.DurationVar(&c.DaemonWait, "wait-for-daemon", 0, "Time to wait for the docker daemon to accept API requests")
+	flags.Lookup("wait-for-daemon").NoOptDefVal = DefaultDaemonWait.String()
+	flags.DurationVar(&c.DiskUsageInterval, "disk-usage-interval", 0, "Interval to sample the disk usage of the container at, 0 disables sampling")
+	flags.StringVar(&c.LogFile, "log-file", "", "Path of a file to tee the output of the container to")
+	flags.StringVar(&c.logFileMaxSize, "log-file-max-size", "100m", "Size of the log file to rotate it at, e.g. 10m")
+	flags.IntVar(&c.LogFileMaxFiles, "log-file-max-files", DefaultLogFileMaxFiles, "Number of rotated log files to keep")
+	flags.DurationVar(&c.LogFileMaxAge, "log-file-max-age", 0, "Age of rotated log files to remove them at, 0 keeps them regardless of age")
+	flags.StringVar(&c.LogFileCompress, "log-file-compress", LogFileCompressNone, "Compression of rotated log files, 'none', 'gzip' or 'zstd'")
+	flags.StringVar(&c.logBufferSize, "log-buffer-size", "1m", "Length of log lines of the container to split them into several journal entries at, e.g. 256k")
+	flags.IntVar(&c.EventQueueSize, "event-queue-size", DefaultEventQueueSize, "Number of pending docker events to keep, dropping the oldest ones in bursts")
+	flags.StringVar(&c.diskUsageLimit, "disk-usage-limit", "", "Disk usage of the writable layer or volumes of the container to warn at, e.g. 10g")
+	flags.StringVar(&c.Engine, "engine", DefaultEngine, "Engine managing the container, 'docker' or 'nerdctl'")
+	flags.StringVar(&c.Docker.Config, "config", "", "Location of docker client config files")
+	flags.StringVar(&c.Docker.Context, "context", "", "Name of the docker context to use")
+	flags.StringVarP(&c.Docker.Host, "host", "H", "", "Docker daemon socket to connect to, a comma separated list fails over between the daemons")
+	flags.BoolVar(&c.Docker.Tls, "tls", false, "Use TLS to connect to the docker daemon")
+	flags.BoolVar(&c.Docker.TlsVerify, "tlsverify", false, "Use TLS and verify the docker daemon")
+	flags.StringVar(&c.Docker.TlsCaCert, "tlscacert", "", "Trust certs signed only by this CA")
+	flags.StringVar(&c.Docker.TlsCert, "tlscert", "", "Path to TLS certificate file")
+	flags.StringVar(&c.Docker.TlsKey, "tlskey", "", "Path to TLS key file")
+	flags.StringVar(&c.StatsD.Address, "statsd-address", "", "StatsD server to emit metrics to, <HOST>:<PORT>")
+	flags.StringVar(&c.MetricsListen, "metrics-listen", "", "Address to serve Prometheus metrics of the container on, or 'systemd' to use the socket passed by socket activation")
+	flags.StringVar(&c.StatsD.Prefix, "statsd-prefix", "systemd_docker", "Prefix of the metrics emitted to StatsD")
+	flags.StringSliceVar(&c.StatsD.Tags, "statsd-tags", []string{}, "DogStatsD tags added to the metrics, <KEY>:<VALUE>")
+	flags.BoolVar(&c.StatsD.DogStatsD, "statsd-dogstatsd", false, "Emit metrics labels as DogStatsD tags")
+}
@@ -0,0 +1,169 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"strings"
+)
+
+const (
+	GarbageContainer = "container"
+	GarbageVolume    = "volume"
+	GarbageNetwork   = "network"
+)
+
+// Garbage is a resource managed by systemd-docker which is no longer owned
+// by a unit.
+type Garbage struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Id     string `json:"id"`
+	Unit   string `json:"unit,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// FindGarbage returns the containers, volumes and networks labeled as
+// managed by systemd-docker whose unit no longer exists, along with the
+// exited containers which were not created by a unit.  Containers kept by
+// --keep-on-failure are left to --keep-failed as long as their unit exists.
+func FindGarbage(c *Context) ([]Garbage, error) {
+	client, err := c.GetClient()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := newSystemdConnection(ctx, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to systemd: %v", err)
+	}
+	defer conn.Close()
+
+	exists := make(map[string]bool)
+	unitExists := func(unit string) (bool, error) {
+		if result, ok := exists[unit]; ok {
+			return result, nil
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, dbusTimeout)
+		defer cancel()
+		properties, err := conn.GetUnitPropertiesContext(lookupCtx, unit)
+		if err != nil {
+			return false, fmt.Errorf("failed to look up unit '%s': %v", unit, err)
+		}
+		loadState, _ := properties["LoadState"].(string)
+		exists[unit] = loadState != "not-found"
+		return exists[unit], nil
+	}
+	managedFilter := map[string][]string{"label": {fmt.Sprintf("%s=true", LabelManaged)}}
+
+	var garbage []Garbage
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true, Filters: managedFilter})
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		name := ""
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		unit := container.Labels[LabelUnit]
+		item := Garbage{Kind: GarbageContainer, Name: name, Id: container.ID, Unit: unit}
+		if len(unit) == 0 {
+			if container.State == "running" || container.State == "restarting" {
+				continue
+			}
+			item.Reason = fmt.Sprintf("it is %s and not owned by a unit", container.State)
+		} else if ok, err := unitExists(unit); err != nil {
+			return nil, err
+		} else if ok {
+			continue
+		} else {
+			item.Reason = fmt.Sprintf("unit '%s' no longer exists", unit)
+		}
+		garbage = append(garbage, item)
+	}
+
+	volumes, err := client.ListVolumes(docker.ListVolumesOptions{Filters: managedFilter})
+	if err != nil {
+		return nil, err
+	}
+	for _, volume := range volumes {
+		unit := volume.Labels[LabelUnit]
+		if len(unit) == 0 {
+			continue
+		}
+		if ok, err := unitExists(unit); err != nil {
+			return nil, err
+		} else if !ok {
+			garbage = append(garbage, Garbage{Kind: GarbageVolume, Name: volume.Name, Id: volume.Name, Unit: unit, Reason: fmt.Sprintf("unit '%s' no longer exists", unit)})
+		}
+	}
+
+	networks, err := client.FilteredListNetworks(docker.NetworkFilterOpts{"label": {fmt.Sprintf("%s=true", LabelManaged): true}})
+	if err != nil {
+		return nil, err
+	}
+	for _, network := range networks {
+		unit := network.Labels[LabelUnit]
+		if len(unit) == 0 {
+			continue
+		}
+		if ok, err := unitExists(unit); err != nil {
+			return nil, err
+		} else if !ok {
+			garbage = append(garbage, Garbage{Kind: GarbageNetwork, Name: network.Name, Id: network.ID, Unit: unit, Reason: fmt.Sprintf("unit '%s' no longer exists", unit)})
+		}
+	}
+	return garbage, nil
+}
+
+// RemoveGarbage removes the resource found by FindGarbage.  Containers are
+// removed along with their anonymous volumes, even if they are still
+// running.
+func RemoveGarbage(c *Context, garbage Garbage) error {
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	switch garbage.Kind {
+	case GarbageContainer:
+		err = client.RemoveContainer(docker.RemoveContainerOptions{ID: garbage.Id, RemoveVolumes: true, Force: true})
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			return nil
+		}
+	case GarbageVolume:
+		err = client.RemoveVolumeWithOptions(docker.RemoveVolumeOptions{Name: garbage.Name})
+		switch err {
+		case docker.ErrNoSuchVolume:
+			return nil
+		case docker.ErrVolumeInUse:
+			return fmt.Errorf("volume '%s' is in use", garbage.Name)
+		}
+	case GarbageNetwork:
+		err = client.RemoveNetwork(garbage.Id)
+		if _, ok := err.(*docker.NoSuchNetwork); ok {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported garbage kind '%s'", garbage.Kind)
+	}
+	return err
+}
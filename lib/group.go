@@ -0,0 +1,206 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	GroupPolicyAll    = "all"
+	GroupPolicyQuorum = "quorum"
+
+	DefaultGroupInterval = 10 * time.Second
+
+	// groupInspectTimeout is the timeout of inspecting a member of the
+	// group.
+	groupInspectTimeout = 5 * time.Second
+
+	memberHealthy = "healthy"
+)
+
+// ValidateGroup checks the --sidecar and --group-policy flags.
+func ValidateGroup(c *Context) error {
+	if c.GroupPolicy != GroupPolicyAll && c.GroupPolicy != GroupPolicyQuorum {
+		return fmt.Errorf("unsupported group policy '%s'", c.GroupPolicy)
+	}
+	if len(c.Sidecars) > 0 && len(c.Probes) > 0 {
+		return fmt.Errorf("'sidecar' cannot be combined with 'probe'")
+	}
+	return nil
+}
+
+// groupMonitor signals readiness and watchdog pings based on the aggregate
+// health of the container and its --sidecar containers.
+type groupMonitor struct {
+	context           *Context
+	client            *docker.Client
+	members           []string
+	healthy           bool
+	syntheticInterval time.Duration
+	staleness         time.Duration
+	lastConfirmed     time.Time
+	lastStatus        string
+	trigger           watchdogTrigger
+}
+
+func createGroupMonitor(c *Context) (Monitor, error) {
+	client, err := c.GetClient()
+	if err != nil {
+		return nil, err
+	}
+
+	syntheticInterval, staleness, err := validateWatchdog(c, &docker.HealthConfig{Interval: c.groupInterval(), Timeout: groupInspectTimeout, Retries: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	members := append([]string{c.Name}, c.Sidecars...)
+	c.Log.Infof("Creating group monitor for container '%s', requiring %s of: %s\n", c.Name, c.GroupPolicy, strings.Join(members, ", "))
+	return &groupMonitor{
+		context:           c,
+		client:            client,
+		members:           members,
+		syntheticInterval: syntheticInterval,
+		staleness:         staleness,
+	}, nil
+}
+
+func (c *Context) groupInterval() time.Duration {
+	if c.GroupInterval <= 0 {
+		return DefaultGroupInterval
+	}
+	return c.GroupInterval
+}
+
+func (m *groupMonitor) Start(conn net.Conn) error {
+	m.context.Log.Infof("Starting group monitor for container '%s'\n", m.context.Name)
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	ticker := time.NewTicker(m.context.groupInterval())
+	defer ticker.Stop()
+	var synthetic <-chan time.Time
+	if m.syntheticInterval > 0 {
+		syntheticTicker := time.NewTicker(m.syntheticInterval)
+		defer syntheticTicker.Stop()
+		synthetic = syntheticTicker.C
+	}
+
+	ready := m.context.resumedReady()
+	for {
+		if HasPidDied(m.context, m.context.Pid) {
+			m.context.Log.Infof("Container '%s' has stopped, stopping group monitor\n", m.context.Name)
+			return nil
+		}
+		healthy, status := m.check()
+		if healthy {
+			m.lastConfirmed = confirmHealthy(m.context)
+			if !m.healthy {
+				m.context.Log.Infof("Group of container '%s' is %s\n", m.context.Name, status)
+			}
+		} else if m.healthy {
+			m.context.Log.Warnf("Group of container '%s' is %s\n", m.context.Name, status)
+		}
+		m.healthy = healthy
+		m.updateStatus(conn, status)
+		if healthy {
+			m.trigger.recovered()
+			ready = notifyHealthy(m.context, conn, ready)
+		} else {
+			m.trigger.failed(m.context, conn, ready)
+		}
+
+		select {
+		case <-m.context.monitorDone():
+			return nil
+		case <-ticker.C:
+		case <-synthetic:
+			if ready && m.healthy && time.Since(m.lastConfirmed) <= m.staleness {
+				ready = notifyHealthy(m.context, conn, ready)
+			}
+		}
+	}
+}
+
+// check determines the health of all members and aggregates it according to
+// the group policy: 'all' requires every member to be healthy, 'quorum' a
+// majority.  The returned status lists the health of each member.
+func (m *groupMonitor) check() (bool, string) {
+	healthyMembers := 0
+	details := make([]string, 0, len(m.members))
+	for _, member := range m.members {
+		health := m.memberHealth(member)
+		if health == memberHealthy {
+			healthyMembers++
+		}
+		details = append(details, fmt.Sprintf("%s %s", member, health))
+	}
+
+	healthy := healthyMembers == len(m.members)
+	if m.context.GroupPolicy == GroupPolicyQuorum {
+		healthy = healthyMembers > len(m.members)/2
+	}
+	state := "unhealthy"
+	if healthy {
+		state = "healthy"
+	}
+	return healthy, fmt.Sprintf("%s (%d/%d): %s", state, healthyMembers, len(m.members), strings.Join(details, ", "))
+}
+
+// memberHealth returns the health of a member: running members without a
+// health check are healthy.
+func (m *groupMonitor) memberHealth(member string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), groupInspectTimeout)
+	defer cancel()
+	container, err := m.client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: member, Context: ctx})
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return "missing"
+	}
+	if err != nil {
+		m.context.Log.Debugf("Failed to inspect member '%s' of the group of container '%s': %s\n", member, m.context.Name, err)
+		return "unknown"
+	}
+	if !container.State.Running {
+		return "stopped"
+	}
+	if len(container.State.Health.Status) == 0 || container.State.Health.Status == memberHealthy {
+		return memberHealthy
+	}
+	return container.State.Health.Status
+}
+
+func (m *groupMonitor) updateStatus(conn net.Conn, status string) {
+	if status == m.lastStatus {
+		return
+	}
+	m.lastStatus = status
+	recordHealth(m.context, m.healthy)
+	if _, err := conn.Write([]byte(fmt.Sprintf("STATUS=%s", withReadyTime(m.context, status)))); err != nil {
+		m.context.Log.Debugf("Failed to update systemd status of container '%s': %s\n", m.context.Name, err)
+	}
+}
+
+func (m *groupMonitor) Close() error {
+	m.context.Log.Infof("Closing group monitor for container '%s'\n", m.context.Name)
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// maxHostnameLength is the maximum length of a hostname label.
+const maxHostnameLength = 63
+
+var invalidHostnameChars = regexp.MustCompile(`[^a-zA-Z0-9-]+`)
+
+// HostnameArgs returns the docker run arguments setting the hostname of the
+// container from --hostname-template, unless a hostname was passed or the
+// container does not have its own UTS namespace.
+func HostnameArgs(c *Context) ([]string, error) {
+	if len(c.HostnameTemplate) == 0 || len(dockerFlagValues(c.Args, "h", "hostname")) > 0 {
+		return nil, nil
+	}
+	for _, mode := range dockerFlagValues(c.Args, "network", "net", "uts") {
+		if mode == "host" || strings.HasPrefix(mode, "container:") {
+			c.Log.Infof("Container '%s' does not have its own hostname, ignoring 'hostname-template'\n", c.Name)
+			return nil, nil
+		}
+	}
+
+	unit, err := currentUnit()
+	if err != nil {
+		// outside of a unit, the container is usually named after it
+		unit = c.Name
+	}
+	hostname, err := expandHostnameTemplate(c.HostnameTemplate, unit)
+	if err != nil {
+		return nil, err
+	}
+	if len(hostname) == 0 {
+		return nil, fmt.Errorf("hostname template '%s' expands to an empty hostname for unit '%s'", c.HostnameTemplate, unit)
+	}
+	return []string{"--hostname", hostname}, nil
+}
+
+// expandHostnameTemplate expands the unit specifiers %n, %N, %p and %i of the
+// template like systemd, and makes the result a valid hostname.
+func expandHostnameTemplate(template string, unit string) (string, error) {
+	name := unit
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		name = name[:i]
+	}
+	prefix, instance := name, ""
+	if i := strings.IndexByte(name, '@'); i >= 0 {
+		prefix, instance = name[:i], name[i+1:]
+	}
+
+	var result strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			result.WriteByte(template[i])
+			continue
+		}
+		if i+1 == len(template) {
+			return "", fmt.Errorf("hostname template '%s' ends with '%%'", template)
+		}
+		i++
+		switch template[i] {
+		case 'n':
+			result.WriteString(unit)
+		case 'N':
+			result.WriteString(name)
+		case 'p':
+			result.WriteString(prefix)
+		case 'i':
+			result.WriteString(instance)
+		case '%':
+			result.WriteByte('%')
+		default:
+			return "", fmt.Errorf("hostname template '%s' has unsupported specifier '%%%c', expected %%n, %%N, %%p or %%i", template, template[i])
+		}
+	}
+
+	hostname := strings.Trim(invalidHostnameChars.ReplaceAllString(result.String(), "-"), "-")
+	if len(hostname) > maxHostnameLength {
+		hostname = strings.TrimRight(hostname[:maxHostnameLength], "-")
+	}
+	return hostname, nil
+}
@@ -0,0 +1,210 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+const (
+	DeviceHotplugRestart = "restart"
+
+	deviceHotplugHookPrefix = "hook:"
+
+	// deviceSettleDelay is how long to wait after a uevent before checking
+	// the device nodes, so that udev has created or removed them.
+	deviceSettleDelay = time.Second
+)
+
+// DeviceHotplugData is the data available to --device-hotplug hook
+// templates.
+type DeviceHotplugData struct {
+	Name   string
+	Id     string
+	Device string
+	Action string
+}
+
+// ValidateDeviceHotplug checks the --device-hotplug action.
+func ValidateDeviceHotplug(c *Context) error {
+	if len(c.DeviceHotplug) == 0 || c.DeviceHotplug == DeviceHotplugRestart {
+		return nil
+	}
+	if !strings.HasPrefix(c.DeviceHotplug, deviceHotplugHookPrefix) {
+		return fmt.Errorf("unsupported device hotplug action '%s'", c.DeviceHotplug)
+	}
+	text := strings.TrimPrefix(c.DeviceHotplug, deviceHotplugHookPrefix)
+	if _, err := template.New("hotplug").Parse(text); err != nil {
+		return fmt.Errorf("invalid device hotplug hook template '%s': %v", text, err)
+	}
+	return nil
+}
+
+// StartDeviceMonitor subscribes to the kernel uevents and reacts to the
+// device nodes of the container being removed and re-added according to
+// --device-hotplug: 'restart' stops the container once the device is back,
+// so that systemd restarts the unit with the new device node, while
+// 'hook:<TEMPLATE>' runs the command template with '/bin/sh -c' on both.
+// The returned function stops the monitor.
+func StartDeviceMonitor(c *Context) func() {
+	nodes := deviceNodes(c.Args)
+	if len(c.DeviceHotplug) == 0 || len(nodes) == 0 {
+		return func() {}
+	}
+
+	events, err := openUevents()
+	if err != nil {
+		c.Log.Warnf("Failed to subscribe to device events for container '%s': %s\n", c.Name, err)
+		return func() {}
+	}
+
+	present := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		present[node] = deviceExists(node)
+	}
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := events.Read(buf)
+			if err != nil {
+				return
+			}
+			if isDeviceUevent(buf[:n]) {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		var settle <-chan time.Time
+		for {
+			select {
+			case <-done:
+				return
+			case <-changed:
+				settle = time.After(deviceSettleDelay)
+			case <-settle:
+				settle = nil
+				for _, node := range nodes {
+					exists := deviceExists(node)
+					if exists == present[node] {
+						continue
+					}
+					present[node] = exists
+					if err := handleDeviceHotplug(c, node, exists); err != nil {
+						c.Log.Errorf("Failed to handle hotplug of device '%s' of container '%s': %s\n", node, c.Name, err)
+					}
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		_ = events.Close()
+	}
+}
+
+func handleDeviceHotplug(c *Context, node string, exists bool) error {
+	action, description := "remove", "removed"
+	if exists {
+		action, description = "add", "added"
+	}
+
+	if c.DeviceHotplug != DeviceHotplugRestart {
+		c.Log.Infof("Device '%s' of container '%s' was %s, running hook\n", node, c.Name, description)
+		return runDeviceHotplugHook(c, DeviceHotplugData{
+			Name:   c.Name,
+			Id:     c.Id,
+			Device: node,
+			Action: action,
+		})
+	}
+
+	if !exists {
+		c.Log.Warnf("Device '%s' of container '%s' was removed, restarting the container once it is added again\n", node, c.Name)
+		_ = sendNotify(c, fmt.Sprintf("STATUS=Waiting for device '%s' to be added again", node))
+		return nil
+	}
+
+	c.Log.Noticef("Device '%s' of container '%s' was added again, stopping the container to restart it\n", node, c.Name)
+	atomic.StoreInt32(&c.deviceReplugged, 1)
+	return stopContainer(c)
+}
+
+func runDeviceHotplugHook(c *Context, data DeviceHotplugData) error {
+	t, err := template.New("hotplug").Parse(strings.TrimPrefix(c.DeviceHotplug, deviceHotplugHookPrefix))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = t.Execute(&buf, data); err != nil {
+		return err
+	}
+	_, err = runCommand("/bin/sh", "-c", buf.String())
+	return err
+}
+
+func deviceExists(node string) bool {
+	_, err := os.Stat(node)
+	return err == nil
+}
+
+// openUevents opens a netlink socket receiving the uevents of the kernel.
+func openUevents() (*os.File, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err == nil {
+		// non-blocking descriptors are handled by the runtime poller, so
+		// that closing the file wakes up a blocked Read
+		err = unix.SetNonblock(fd, true)
+	}
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "uevent"), nil
+}
+
+// isDeviceUevent returns whether the uevent, 'ACTION@DEVPATH' followed by
+// NUL-separated KEY=VALUE pairs, adds or removes a device node.
+func isDeviceUevent(event []byte) bool {
+	fields := bytes.Split(event, []byte{0})
+	if !bytes.HasPrefix(fields[0], []byte("add@")) && !bytes.HasPrefix(fields[0], []byte("remove@")) {
+		return false
+	}
+	for _, field := range fields[1:] {
+		if bytes.HasPrefix(field, []byte("DEVNAME=")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"os"
+)
+
+func imageExists(client *docker.Client, image string) (bool, error) {
+	_, err := client.InspectImage(image)
+	if err == docker.ErrNoSuchImage {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// imageChanged returns whether the image of the container resolves to another
+// image than the container was created from, f.ex. after the tag was pulled
+// again or the image of the unit was changed.
+func imageChanged(c *Context, engine ContainerEngine, container *docker.Container) (bool, error) {
+	reference := c.Image
+	if len(reference) == 0 {
+		reference = container.Config.Image
+	}
+	image, err := engine.InspectImage(c, reference)
+	if err == docker.ErrNoSuchImage {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return image.ID != container.Image, nil
+}
+
+// recreateContainer removes the running container whose image changed, so
+// that it is created again from the current image.
+func recreateContainer(c *Context, engine ContainerEngine, container *docker.Container) error {
+	c.Log.Noticef("Image '%s' of container '%s' changed, recreating it\n", container.Config.Image, c.Name)
+	setContainerId(c, container.ID)
+	if err := stopContainer(c); err != nil {
+		return err
+	}
+	err := engine.Remove(c, container.ID, c.cleanupEnabled(CleanupAnonymousVolumes))
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		err = nil
+	}
+	setContainerId(c, "")
+	return err
+}
+
+// loadImageTar loads the image archive specified by --image-tar if the image
+// of the container is not present.  Compressed archives are decompressed by
+// the daemon.
+func loadImageTar(c *Context) error {
+	if len(c.ImageTar) == 0 {
+		return nil
+	}
+
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	if len(c.Image) > 0 {
+		if exists, err := imageExists(client, c.Image); err != nil || exists {
+			return err
+		}
+	}
+
+	f, err := os.Open(c.ImageTar)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	c.Log.Infof("Loading image archive '%s' for container '%s'\n", c.ImageTar, c.Name)
+	if err = client.LoadImage(docker.LoadImageOptions{InputStream: f}); err != nil {
+		return fmt.Errorf("failed to load image archive '%s': %v", c.ImageTar, err)
+	}
+
+	if len(c.Image) > 0 {
+		if exists, err := imageExists(client, c.Image); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("image archive '%s' does not contain image '%s'", c.ImageTar, c.Image)
+		}
+	}
+	return nil
+}
+
+// checkOffline ensures that the image of the container is present locally
+// when running with --offline, as creating the container would otherwise
+// pull it from the registry.
+func checkOffline(c *Context) error {
+	if !c.Offline {
+		return nil
+	}
+
+	if len(c.Image) == 0 {
+		return fmt.Errorf("cannot determine image of container '%s'", c.Name)
+	}
+
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	exists, err := imageExists(client, c.Image)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return &ExitError{
+			Code: ExitCodeImageNotPresent,
+			Err:  fmt.Errorf("image '%s' is not present and pulling is disabled by 'offline'", c.Image),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"path"
+	"strings"
+)
+
+const (
+	EnsureInitOff    = "off"
+	EnsureInitWarn   = "warn"
+	EnsureInitInject = "inject"
+)
+
+// initPrograms are the programs known to reap zombies when running as PID 1.
+var initPrograms = map[string]bool{
+	"catatonit":   true,
+	"docker-init": true,
+	"dumb-init":   true,
+	"init":        true,
+	"my_init":     true,
+	"runsvdir":    true,
+	"s6-svscan":   true,
+	"supervisord": true,
+	"systemd":     true,
+	"tini":        true,
+	"tini-static": true,
+}
+
+// ValidateEnsureInit checks the --ensure-init flag.
+func ValidateEnsureInit(c *Context) error {
+	switch c.EnsureInit {
+	case EnsureInitOff, EnsureInitWarn, EnsureInitInject:
+		return nil
+	}
+	return fmt.Errorf("unsupported ensure init '%s'", c.EnsureInit)
+}
+
+// ensureInit checks whether PID 1 of the container reaps zombies.  As
+// MAINPID points into the container, zombies which are not reaped
+// accumulate in the unit.  Unless the docker flag init is used or the
+// entrypoint is a known init, a warning is logged with --ensure-init=warn,
+// and the docker flag init is added with --ensure-init=inject.
+func ensureInit(c *Context) error {
+	if c.EnsureInit == EnsureInitOff || len(c.Image) == 0 {
+		return nil
+	}
+
+	useInit, specified := dockerBoolFlag(c.Args, "init")
+	if useInit {
+		return nil
+	}
+
+	program, err := entrypointProgram(c)
+	if err != nil {
+		return err
+	}
+	if len(program) > 0 && initPrograms[path.Base(program)] {
+		c.Log.Debugf("PID 1 '%s' of container '%s' is a known init\n", program, c.Name)
+		return nil
+	}
+	if len(program) == 0 {
+		program = "unknown"
+	}
+
+	if c.EnsureInit == EnsureInitInject && !specified {
+		c.Log.Infof("Adding docker flag 'init' to container '%s', as its PID 1 '%s' is not a known init\n", c.Name, program)
+		c.Args = append([]string{"--init"}, c.Args...)
+		return nil
+	}
+	c.Log.Warnf("PID 1 '%s' of container '%s' is not a known init and may not reap zombies, which then accumulate in the unit, use the docker flag 'init'\n", program, c.Name)
+	return nil
+}
+
+// entrypointProgram returns the program which runs as PID 1 of the
+// container: the docker flag entrypoint, else the entrypoint of the image,
+// else the command.  An empty program is returned if the image is not
+// present yet, as docker create pulls it.
+func entrypointProgram(c *Context) (string, error) {
+	values := dockerFlagValues(c.Args, "entrypoint")
+	if len(values) > 0 && len(strings.Fields(values[len(values)-1])) > 0 {
+		return strings.Fields(values[len(values)-1])[0], nil
+	}
+
+	client, err := c.GetClient()
+	if err != nil {
+		return "", err
+	}
+	image, err := client.InspectImage(c.Image)
+	if err == docker.ErrNoSuchImage {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// an empty docker flag entrypoint resets the entrypoint of the image
+	if len(values) == 0 && image.Config != nil && len(image.Config.Entrypoint) > 0 {
+		return image.Config.Entrypoint[0], nil
+	}
+
+	if index, _ := FindImage(c.Args); index >= 0 && index+1 < len(c.Args) {
+		return c.Args[index+1], nil
+	}
+	if image.Config != nil && len(image.Config.Cmd) > 0 {
+		return image.Config.Cmd[0], nil
+	}
+	return "", nil
+}
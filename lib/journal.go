@@ -0,0 +1,110 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// journalSocket is the socket journald receives entries on using the native
+// protocol.
+var journalSocket = "/run/systemd/journal/socket"
+
+// sendJournal writes an entry with the structured fields to the journal using
+// the native protocol.  Field names must be upper case.
+func sendJournal(priority int, message string, fields map[string]string) error {
+	if _, err := os.Stat(journalSocket); err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return err
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", message)
+	writeJournalField(&buf, "PRIORITY", fmt.Sprintf("%d", priority))
+	if identifier, ok := fields["SYSLOG_IDENTIFIER"]; !ok || len(identifier) == 0 {
+		writeJournalField(&buf, "SYSLOG_IDENTIFIER", "systemd-docker")
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeJournalField(&buf, name, fields[name])
+	}
+
+	return writeJournal(conn, buf.Bytes())
+}
+
+// writeJournal sends the entry over the connection to the journal.  Entries
+// exceeding the datagram size limit of the socket are passed in a sealed
+// memfd instead, like sd_journal_send does.
+func writeJournal(conn net.Conn, entry []byte) error {
+	_, err := conn.Write(entry)
+	if !errors.Is(err, unix.EMSGSIZE) && !errors.Is(err, unix.ENOBUFS) {
+		return err
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return err
+	}
+
+	fd, err := unix.MemfdCreate("journal-entry", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "journal-entry")
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	if _, err = f.Write(entry); err != nil {
+		return err
+	}
+	// journald only accepts sealed memfds
+	if _, err = unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL); err != nil {
+		return err
+	}
+	return writeFd(sc, nil, fd)
+}
+
+func writeJournalField(buf *bytes.Buffer, name string, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(fmt.Sprintf("%s=%s\n", name, value))
+		return
+	}
+	// values containing newlines are written with an explicit length
+	buf.WriteString(name)
+	buf.WriteByte('\n')
+	_ = binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
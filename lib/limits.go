@@ -0,0 +1,262 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/docker/go-units"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+const (
+	LimitCheckOff   = "off"
+	LimitCheckClamp = "clamp"
+	LimitCheckFail  = "fail"
+)
+
+// ipcSysctls are the namespaced sysctls outside of 'fs.mqueue.' and 'net.',
+// which are the only ones docker allows to be set per container.
+var ipcSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+// hostOnlySysctls are sysctls below 'net.' which the kernel does not
+// namespace, so that they are missing in the network namespace of the
+// container.
+var hostOnlySysctls = map[string]bool{
+	"net.core.dev_weight":          true,
+	"net.core.message_burst":       true,
+	"net.core.message_cost":        true,
+	"net.core.netdev_budget":       true,
+	"net.core.netdev_budget_usecs": true,
+	"net.core.netdev_max_backlog":  true,
+	"net.core.rmem_default":        true,
+	"net.core.rmem_max":            true,
+	"net.core.wmem_default":        true,
+	"net.core.wmem_max":            true,
+	"net.ipv4.tcp_mem":             true,
+	"net.ipv4.udp_mem":             true,
+}
+
+// sysctlRanges are the values the kernel accepts for sysctls with fixed
+// bounds.
+var sysctlRanges = map[string][2]int64{
+	"fs.mqueue.msg_max":     {1, 65536},
+	"fs.mqueue.msgsize_max": {128, 16777216},
+}
+
+// ValidateLimitCheck checks the --limit-check flag.
+func ValidateLimitCheck(c *Context) error {
+	switch c.LimitCheck {
+	case LimitCheckOff, LimitCheckClamp, LimitCheckFail:
+		return nil
+	}
+	return fmt.Errorf("unsupported limit check '%s'", c.LimitCheck)
+}
+
+// checkLimits checks the docker run flags ulimit and sysctl against the
+// limits and kernel settings of the host, so that the container does not
+// die at start with an obscure EPERM or ENOENT from the runtime.  Values
+// exceeding what the host allows are clamped with a warning with
+// --limit-check=clamp, or fail with --limit-check=fail.  Sysctls which cannot
+// be set in the container fail either way.  The checks are skipped for a
+// remote daemon, whose host is not ours.
+func checkLimits(c *Context) error {
+	if c.LimitCheck == LimitCheckOff {
+		return nil
+	}
+	if endpoint, err := c.Docker.Endpoint(); err != nil || !strings.HasPrefix(endpoint, "unix://") {
+		c.Log.Debugf("Skipping limit check of container '%s', the docker daemon is not local\n", c.Name)
+		return nil
+	}
+
+	end, _ := FindImage(c.Args)
+	if end < 0 {
+		end = len(c.Args)
+	}
+
+	var rootless *bool
+	for i := 0; i < end; i++ {
+		index := i
+		name := ""
+		for _, flag := range []string{"ulimit", "sysctl"} {
+			if c.Args[i] == "--"+flag && i+1 < end {
+				name = flag
+				index = i + 1
+				i++
+				break
+			} else if strings.HasPrefix(c.Args[i], "--"+flag+"=") {
+				name = flag
+				break
+			}
+		}
+		if len(name) == 0 {
+			continue
+		}
+		value := strings.TrimPrefix(c.Args[index], "--"+name+"=")
+
+		var allowed, reason string
+		var err error
+		if name == "ulimit" {
+			if rootless == nil {
+				isRootless, err := isRootlessDaemon(c)
+				if err != nil {
+					return err
+				}
+				rootless = &isRootless
+			}
+			allowed, reason, err = checkUlimit(c, value, *rootless)
+		} else {
+			allowed, reason, err = checkSysctl(c, value)
+		}
+		if err != nil {
+			return fmt.Errorf("docker flag '%s=%s' of container '%s' is invalid: %v", name, value, c.Name, err)
+		}
+		if allowed == value {
+			continue
+		}
+		if c.LimitCheck == LimitCheckFail {
+			return fmt.Errorf("docker flag '%s=%s' of container '%s' is not allowed by the host, as %s, use '%s'", name, value, c.Name, reason, allowed)
+		}
+		c.Log.Warnf("Clamped docker flag '%s=%s' of container '%s' to '%s', as %s\n", name, value, c.Name, allowed, reason)
+		c.Args[index] = strings.TrimSuffix(c.Args[index], value) + allowed
+	}
+	return nil
+}
+
+// isRootlessDaemon returns whether the docker daemon runs rootless, and thus
+// cannot raise hard limits above its own.  Daemonless engines run rootless
+// when we are not root.
+func isRootlessDaemon(c *Context) (bool, error) {
+	if c.daemonless() {
+		return unix.Geteuid() != 0, nil
+	}
+	client, err := c.GetClient()
+	if err != nil {
+		return false, err
+	}
+	info, err := client.Info()
+	if err != nil {
+		return false, err
+	}
+	for _, option := range info.SecurityOptions {
+		if option == "name=rootless" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkUlimit returns the ulimit clamped to the hard limit the host allows,
+// along with the reason for clamping it.
+func checkUlimit(c *Context, value string, rootless bool) (string, string, error) {
+	ulimit, err := units.ParseUlimit(value)
+	if err != nil {
+		return "", "", err
+	}
+	rlimit, err := ulimit.GetRlimit()
+	if err != nil {
+		return "", "", err
+	}
+
+	max := int64(-1)
+	reason := ""
+	if ulimit.Name == "nofile" {
+		if data, err := ioutil.ReadFile(c.procPath("sys", "fs", "nr_open")); err == nil {
+			if nrOpen, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil {
+				max = nrOpen
+				reason = fmt.Sprintf("the kernel allows at most %d open files (fs.nr_open)", nrOpen)
+			}
+		}
+	}
+	if rootless {
+		// the rootless daemon runs below the same manager as us, and
+		// inherits the same hard limits
+		var own unix.Rlimit
+		if err := unix.Getrlimit(rlimit.Type, &own); err == nil && own.Max != unix.RLIM_INFINITY && (max < 0 || int64(own.Max) < max) {
+			max = int64(own.Max)
+			reason = fmt.Sprintf("the rootless docker daemon cannot raise the hard limit above %d", own.Max)
+		}
+	}
+
+	if max < 0 || (ulimit.Hard >= 0 && ulimit.Hard <= max) {
+		return value, "", nil
+	}
+	soft := ulimit.Soft
+	if soft < 0 || soft > max {
+		soft = max
+	}
+	return fmt.Sprintf("%s=%d:%d", ulimit.Name, soft, max), reason, nil
+}
+
+// checkSysctl returns the sysctl clamped to the range the kernel accepts,
+// along with the reason for clamping it.  An error is returned if the sysctl
+// cannot be set in the container.
+func checkSysctl(c *Context, value string) (string, string, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return value, "", nil
+	}
+	key := parts[0]
+
+	if !ipcSysctls[key] && !strings.HasPrefix(key, "fs.mqueue.") && !strings.HasPrefix(key, "net.") {
+		return "", "", fmt.Errorf("sysctl '%s' is not namespaced and can only be set on the host", key)
+	}
+	if hostOnlySysctls[key] {
+		return "", "", fmt.Errorf("sysctl '%s' is not namespaced by the kernel and can only be set on the host", key)
+	}
+	if !isInterfaceSysctl(key) && !strings.Contains(key, "/") {
+		if _, err := ioutil.ReadFile(c.procPath(append([]string{"sys"}, strings.Split(key, ".")...)...)); err != nil {
+			return "", "", fmt.Errorf("sysctl '%s' is not supported by the kernel of the host", key)
+		}
+	}
+
+	bounds, ok := sysctlRanges[key]
+	if !ok {
+		return value, "", nil
+	}
+	number, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("sysctl '%s' must be a number", key)
+	}
+	switch {
+	case number < bounds[0]:
+		return fmt.Sprintf("%s=%d", key, bounds[0]), fmt.Sprintf("the kernel requires at least %d", bounds[0]), nil
+	case number > bounds[1]:
+		return fmt.Sprintf("%s=%d", key, bounds[1]), fmt.Sprintf("the kernel allows at most %d", bounds[1]), nil
+	}
+	return value, "", nil
+}
+
+// isInterfaceSysctl returns whether the sysctl applies to a network
+// interface of the container, which need not exist on the host.
+func isInterfaceSysctl(key string) bool {
+	parts := strings.Split(key, ".")
+	if len(parts) < 4 || parts[0] != "net" || (parts[2] != "conf" && parts[2] != "neigh") {
+		return false
+	}
+	return parts[3] != "all" && parts[3] != "default"
+}
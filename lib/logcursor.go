@@ -0,0 +1,289 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CursorConsumerPipe and CursorConsumerLogs name the consumers of the
+	// output of a container whose cursors are persisted.
+	CursorConsumerPipe = "pipe"
+	CursorConsumerLogs = "logs"
+
+	// cursorSaveInterval is the minimum interval between writes of a cursor
+	// while following the output of a container.
+	cursorSaveInterval = time.Second
+)
+
+// logCursor is the position in the output of a container up to which a
+// consumer has read it: the timestamp docker recorded for the last line.  It
+// is persisted in the state directory, so that the consumer resumes exactly
+// where it stopped across restarts.
+type logCursor struct {
+	mu     sync.Mutex
+	path   string
+	time   time.Time
+	saved  time.Time
+	warned bool
+}
+
+// loadLogCursor reads the cursor of the consumer of the output of the
+// container, which is zero if it was never saved.
+func loadLogCursor(c *Context, consumer string) *logCursor {
+	cursor := &logCursor{path: filepath.Join(stateDirectory(), "cursors", fmt.Sprintf("%s.%s", c.Name, consumer))}
+	data, err := ioutil.ReadFile(cursor.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.Log.Warnf("Failed to read log cursor '%s': %s\n", cursor.path, err)
+		}
+		return cursor
+	}
+	if cursor.time, err = ParseLogCursor(strings.TrimSpace(string(data))); err != nil {
+		c.Log.Warnf("Ignoring log cursor '%s': %s\n", cursor.path, err)
+	}
+	cursor.saved = cursor.time
+	return cursor
+}
+
+// ParseLogCursor parses a cursor printed by 'systemd-docker logs
+// --show-cursor'.
+func ParseLogCursor(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("log cursor '%s' has a wrong format", value)
+	}
+	return t, nil
+}
+
+// String returns the cursor in the format accepted by ParseLogCursor.
+func (l *logCursor) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.time.IsZero() {
+		return ""
+	}
+	return l.time.UTC().Format(time.RFC3339Nano)
+}
+
+func (l *logCursor) get() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.time
+}
+
+func (l *logCursor) advance(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.time) {
+		l.time = t
+	}
+}
+
+// save writes the cursor, if it advanced since it was last written.
+func (l *logCursor) save() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.time.After(l.saved) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(l.path, []byte(l.time.UTC().Format(time.RFC3339Nano)+"\n"), 0644); err != nil {
+		return err
+	}
+	l.saved = l.time
+	return nil
+}
+
+// saveLogCursor saves the cursor, warning only the first time it fails, as
+// it is saved periodically.
+func saveLogCursor(c *Context, cursor *logCursor) {
+	err := cursor.save()
+	if err == nil {
+		return
+	}
+	cursor.mu.Lock()
+	warned := cursor.warned
+	cursor.warned = true
+	cursor.mu.Unlock()
+	if warned {
+		c.Log.Debugf("Failed to write log cursor '%s': %s\n", cursor.path, err)
+	} else {
+		c.Log.Warnf("Failed to write log cursor '%s': %s\n", cursor.path, err)
+	}
+}
+
+// cursorWriter strips the timestamp docker prefixes each line of the output
+// of a container with when asked to, skips the lines up to and including
+// the time after, and advances the cursor past the lines written.  As the
+// docker API only accepts whole seconds as since, this makes resuming exact.
+type cursorWriter struct {
+	out    io.Writer
+	cursor *logCursor
+	after  time.Time
+	line   []byte
+}
+
+func newCursorWriter(out io.Writer, cursor *logCursor, after time.Time) *cursorWriter {
+	return &cursorWriter{out: out, cursor: cursor, after: after}
+}
+
+func (w *cursorWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.line = append(w.line, p...)
+			break
+		}
+		var err error
+		if len(w.line) == 0 {
+			err = w.writeLine(p[:i+1])
+		} else {
+			w.line = append(w.line, p[:i+1]...)
+			err = w.writeLine(w.line)
+			w.line = w.line[:0]
+		}
+		if err != nil {
+			return n, err
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Close writes the last line if it was not terminated.
+func (w *cursorWriter) Close() error {
+	if len(w.line) == 0 {
+		return nil
+	}
+	err := w.writeLine(w.line)
+	w.line = w.line[:0]
+	return err
+}
+
+func (w *cursorWriter) writeLine(line []byte) error {
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		_, err := w.out.Write(line)
+		return err
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(line[:i]))
+	if err != nil {
+		_, err = w.out.Write(line)
+		return err
+	}
+	if !t.After(w.after) {
+		return nil
+	}
+	if _, err = w.out.Write(line[i+1:]); err != nil {
+		return err
+	}
+	w.cursor.advance(t)
+	return nil
+}
+
+// ReadLogsOptions configure which output of a container ReadLogs writes.
+type ReadLogsOptions struct {
+	Follow bool
+	Since  string
+	Cursor string
+}
+
+// ReadLogs writes the output of the container to stdout and stderr, and
+// returns the cursor after the last line written.  Unless Since or Cursor
+// is set, it resumes after the last line written by the previous call, as
+// the cursor is persisted.  Since is a time or a duration before now, and
+// includes the lines at the time, while Cursor excludes them.
+func ReadLogs(c *Context, options ReadLogsOptions, stdout io.Writer, stderr io.Writer) (string, error) {
+	engine, err := c.GetEngine()
+	if err != nil {
+		return "", err
+	}
+	container, err := engine.Inspect(c, c.Name)
+	if err != nil {
+		return "", err
+	}
+
+	cursor := loadLogCursor(c, CursorConsumerLogs)
+	after := cursor.get()
+	switch {
+	case len(options.Cursor) > 0:
+		if after, err = ParseLogCursor(options.Cursor); err != nil {
+			return "", err
+		}
+	case len(options.Since) > 0:
+		since, err := parseLogsSince(options.Since)
+		if err != nil {
+			return "", err
+		}
+		after = since.Add(-time.Nanosecond)
+	}
+
+	stdoutCursor := newCursorWriter(stdout, cursor, after)
+	stderrCursor := newCursorWriter(stderr, cursor, after)
+	ctx, cancel := c.withShutdown()
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	if options.Follow {
+		go func() {
+			ticker := time.NewTicker(cursorSaveInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					saveLogCursor(c, cursor)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	err = engine.Logs(ctx, c, container.ID, LogsOptions{Since: after, Follow: options.Follow, Timestamps: true}, stdoutCursor, stderrCursor)
+	_ = stdoutCursor.Close()
+	_ = stderrCursor.Close()
+	saveLogCursor(c, cursor)
+	if ctx.Err() != nil {
+		err = nil
+	}
+	return cursor.String(), err
+}
+
+// parseLogsSince parses an RFC 3339 time, a date, or a duration before now.
+func parseLogsSince(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("since '%s' is neither a time nor a duration", value)
+}
@@ -0,0 +1,290 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	LogFileCompressNone = "none"
+	LogFileCompressGzip = "gzip"
+	LogFileCompressZstd = "zstd"
+
+	DefaultLogFileMaxSize  = 100 * 1024 * 1024
+	DefaultLogFileMaxFiles = 5
+
+	// logFileTimestamp has a fixed width, so that rotated files sort
+	// chronologically by name
+	logFileTimestamp = "20060102T150405.000000000Z"
+)
+
+// ValidateLogFile checks the --log-file-compress algorithm.
+func ValidateLogFile(c *Context) error {
+	switch c.LogFileCompress {
+	case "", LogFileCompressNone, LogFileCompressGzip, LogFileCompressZstd:
+		return nil
+	}
+	return fmt.Errorf("unsupported log file compression '%s'", c.LogFileCompress)
+}
+
+// rotatingFile is a log file which is rotated once it exceeds
+// --log-file-max-size.  Rotated files are compressed according to
+// --log-file-compress, and only the --log-file-max-files newest ones, which
+// are not older than --log-file-max-age, are kept.  This allows teeing logs
+// to files on hosts without logrotate.
+type rotatingFile struct {
+	c    *Context
+	path string
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	wg   sync.WaitGroup
+
+	retentionMu sync.Mutex
+
+	failing bool
+	closed  bool
+}
+
+func openRotatingFile(c *Context) (*rotatingFile, error) {
+	r := &rotatingFile{c: c, path: c.LogFile}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+// Write appends to the file.  Failures are logged rather than returned, so
+// that a full disk does not stop piping the logs to the journal.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return 0, os.ErrClosed
+	}
+	if r.f != nil && r.size > 0 && r.size+int64(len(p)) > r.maxSize() {
+		if err := r.rotate(); err != nil {
+			r.c.Log.Warnf("Failed to rotate log file '%s': %s\n", r.path, err)
+		}
+	}
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			r.failed(err)
+			return len(p), nil
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err != nil {
+		r.failed(err)
+	} else if r.failing {
+		r.c.Log.Infof("Writing log file '%s' succeeds again\n", r.path)
+		r.failing = false
+	}
+	return len(p), nil
+}
+
+func (r *rotatingFile) failed(err error) {
+	if !r.failing {
+		r.c.Log.Warnf("Failed to write log file '%s': %s\n", r.path, err)
+		r.failing = true
+	}
+}
+
+// Close closes the file and waits for rotated files to be compressed.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	var err error
+	r.closed = true
+	if r.f != nil {
+		err = r.f.Close()
+		r.f = nil
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	return err
+}
+
+func (r *rotatingFile) maxSize() int64 {
+	if r.c.LogFileMaxSize <= 0 {
+		return DefaultLogFileMaxSize
+	}
+	return r.c.LogFileMaxSize
+}
+
+// rotate renames the file to '<PATH>.<TIMESTAMP>' and opens a new one.  The
+// rotated file is compressed and the retention applied in the background.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+
+	rotated := fmt.Sprintf("%s.%s", r.path, time.Now().UTC().Format(logFileTimestamp))
+	for fileExists(rotated) || fileExists(rotated+compressedSuffix(r.c.LogFileCompress)) {
+		rotated = fmt.Sprintf("%s.%s", r.path, time.Now().UTC().Format(logFileTimestamp))
+	}
+	renameErr := os.Rename(r.path, rotated)
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		// rotations in quick succession must not remove files which are
+		// still being compressed
+		r.retentionMu.Lock()
+		defer r.retentionMu.Unlock()
+		if err := compressLogFile(rotated, r.c.LogFileCompress); err != nil {
+			r.c.Log.Warnf("Failed to compress log file '%s': %s\n", rotated, err)
+		}
+		if err := r.applyRetention(); err != nil {
+			r.c.Log.Warnf("Failed to remove old log files of '%s': %s\n", r.path, err)
+		}
+	}()
+	return nil
+}
+
+// applyRetention removes the rotated files beyond --log-file-max-files, and
+// those older than --log-file-max-age.
+func (r *rotatingFile) applyRetention() error {
+	rotated, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+
+	maxFiles := r.c.LogFileMaxFiles
+	if maxFiles <= 0 {
+		maxFiles = DefaultLogFileMaxFiles
+	}
+	for i, path := range rotated {
+		if i < maxFiles {
+			if r.c.LogFileMaxAge <= 0 {
+				continue
+			}
+			if info, err := os.Stat(path); err != nil || time.Since(info.ModTime()) <= r.c.LogFileMaxAge {
+				continue
+			}
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func compressedSuffix(algorithm string) string {
+	switch algorithm {
+	case LogFileCompressGzip:
+		return ".gz"
+	case LogFileCompressZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// compressLogFile replaces the file with a compressed copy.
+func compressLogFile(path string, algorithm string) (err error) {
+	suffix := compressedSuffix(algorithm)
+	if len(suffix) == 0 {
+		return nil
+	}
+
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// already removed by the retention
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func(in *os.File) {
+		_ = in.Close()
+	}(in)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	var out io.WriteCloser
+	if algorithm == LogFileCompressGzip {
+		out = gzip.NewWriter(tmp)
+	} else if out, err = zstd.NewWriter(tmp); err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0640); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path+suffix); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
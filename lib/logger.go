@@ -19,6 +19,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 )
 
 type logger struct {
@@ -31,6 +33,14 @@ func NewLogger() *logger {
 	}
 }
 
+const (
+	PriorityError   = 3
+	PriorityWarning = 4
+	PriorityNotice  = 5
+	PriorityInfo    = 6
+	PriorityDebug   = 7
+)
+
 func (l *logger) printf(priority int, format string, v ...interface{}) {
 	l.log.Printf(fmt.Sprintf("<%d>%s", priority, format), v...)
 }
@@ -58,3 +68,22 @@ func (l *logger) Infof(format string, v ...interface{}) {
 func (l *logger) Debugf(format string, v ...interface{}) {
 	l.printf(7, format, v...)
 }
+
+// Structured writes the message with the structured fields to the journal,
+// falling back to logging the message and fields if the journal is not
+// available.
+func (l *logger) Structured(priority int, message string, fields map[string]string) {
+	if err := sendJournal(priority, message, fields); err == nil {
+		return
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, fields[name]))
+	}
+	l.printf(priority, "%s %s\n", message, strings.Join(pairs, " "))
+}
@@ -0,0 +1,251 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// logPipeDrainTimeout bounds how long the remaining output of a stopped
+// container is forwarded to the journal.
+const logPipeDrainTimeout = 5 * time.Second
+
+// PipeLogs forwards the output of the container to the journal with the
+// SYSLOG_IDENTIFIER specified by --syslog-identifier.  The container itself
+// logs to the local log driver in that case, so the output is only written to
+// the journal once.  With --log-file, the output is also teed to the file.
+// Piping resumes after the last line piped for the container, whose
+// timestamp is persisted as cursor.  The returned function stops piping.
+func PipeLogs(c *Context) func() {
+	journal := c.Logs && len(c.SyslogIdentifier) > 0
+	if !journal && len(c.LogFile) == 0 {
+		return func() {}
+	}
+
+	engine, err := c.GetEngine()
+	if err != nil {
+		c.Log.Errorf("Failed to pipe logs of container '%s': %s\n", c.Name, err)
+		return func() {}
+	}
+
+	var since time.Time
+	if c.resumed != nil {
+		since = c.resumed.LogsSince
+	} else if container, err := inspectContainer(c); err == nil {
+		since = container.State.StartedAt
+	}
+	// the output up to the cursor was already piped, unless the container
+	// was started again since
+	after := since
+	if !after.IsZero() {
+		after = after.Add(-time.Nanosecond)
+	}
+	cursor := loadLogCursor(c, CursorConsumerPipe)
+	if t := cursor.get(); t.After(after) {
+		after = t
+	}
+
+	var stdout, stderr []io.Writer
+	var closers []io.Closer
+	if journal {
+		stdoutJournal := newJournalWriter(c, PriorityInfo)
+		stderrJournal := newJournalWriter(c, PriorityError)
+		stdout = append(stdout, stdoutJournal)
+		stderr = append(stderr, stderrJournal)
+		closers = append(closers, stdoutJournal, stderrJournal)
+	}
+	if len(c.LogFile) > 0 {
+		if file, err := openRotatingFile(c); err != nil {
+			c.Log.Errorf("Failed to open log file '%s' of container '%s': %s\n", c.LogFile, c.Name, err)
+		} else {
+			stdout = append(stdout, file)
+			stderr = append(stderr, file)
+			closers = append(closers, file)
+		}
+	}
+	if len(closers) == 0 {
+		return func() {}
+	}
+
+	stdoutCursor := newCursorWriter(io.MultiWriter(stdout...), cursor, after)
+	stderrCursor := newCursorWriter(io.MultiWriter(stderr...), cursor, after)
+	closers = append([]io.Closer{stdoutCursor, stderrCursor}, closers...)
+
+	ctx, cancel := c.withShutdown()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := engine.Logs(ctx, c, c.Id, LogsOptions{Since: after, Follow: true, Timestamps: true}, stdoutCursor, stderrCursor)
+		for _, closer := range closers {
+			_ = closer.Close()
+		}
+		if err != nil && ctx.Err() == nil {
+			c.Log.Errorf("Failed to pipe logs of container '%s': %s\n", c.Name, err)
+		}
+		saveLogCursor(c, cursor)
+	}()
+	go func() {
+		ticker := time.NewTicker(cursorSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				saveLogCursor(c, cursor)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		select {
+		case <-done:
+		case <-time.After(logPipeDrainTimeout):
+			cancel()
+			<-done
+		}
+		cancel()
+	}
+}
+
+// journalEntries pools the buffers the journal entries are encoded in, which
+// are shared by the writers of all streams.
+var journalEntries = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// journalWriter sends every line written to it to the journal as a separate
+// entry.  Lines longer than --log-buffer-size are split into several
+// entries.  The fields which are the same for every entry are encoded once and
+// the connection to the journal is kept open, so that piping high-throughput
+// containers does not allocate per line.
+type journalWriter struct {
+	c      *Context
+	header []byte
+	line   []byte
+	max    int
+	conn   net.Conn
+}
+
+// newJournalWriter returns a writer which sends every line written to it to
+// the journal as a separate entry.
+func newJournalWriter(c *Context, priority int) io.WriteCloser {
+	var header bytes.Buffer
+	writeJournalField(&header, "PRIORITY", strconv.Itoa(priority))
+	writeJournalField(&header, "SYSLOG_IDENTIFIER", c.SyslogIdentifier)
+	writeJournalField(&header, "CONTAINER_NAME", c.Name)
+	writeJournalField(&header, "CONTAINER_ID", shortId(c.Id))
+	writeJournalField(&header, "CONTAINER_ID_FULL", c.Id)
+	max := c.LogBufferSize
+	if max <= 0 {
+		max = DefaultLogBufferSize
+	}
+	return &journalWriter{c: c, header: header.Bytes(), max: max}
+}
+
+func (w *journalWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.line = append(w.line, p...)
+			for len(w.line) >= w.max {
+				w.send(w.line[:w.max])
+				w.line = w.line[:copy(w.line, w.line[w.max:])]
+			}
+			break
+		}
+		if len(w.line) == 0 {
+			// send complete lines straight from the input, without copying
+			w.sendLine(p[:i])
+		} else {
+			w.line = append(w.line, p[:i]...)
+			w.sendLine(w.line)
+			w.line = w.line[:0]
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Close sends the last line if it was not terminated, and closes the
+// connection to the journal.
+func (w *journalWriter) Close() error {
+	if len(w.line) > 0 {
+		w.send(w.line)
+		w.line = w.line[:0]
+	}
+	if w.conn != nil {
+		return w.conn.Close()
+	}
+	return nil
+}
+
+// sendLine sends the line as entries of at most --log-buffer-size bytes.
+func (w *journalWriter) sendLine(line []byte) {
+	for len(line) > w.max {
+		w.send(line[:w.max])
+		line = line[w.max:]
+	}
+	w.send(line)
+}
+
+func (w *journalWriter) send(line []byte) {
+	entry := journalEntries.Get().(*bytes.Buffer)
+	defer journalEntries.Put(entry)
+	entry.Reset()
+	entry.Write(w.header)
+	entry.WriteString("MESSAGE=")
+	entry.Write(bytes.TrimSuffix(line, []byte{'\r'}))
+	entry.WriteByte('\n')
+
+	if err := w.write(entry.Bytes()); err != nil {
+		w.c.Log.Debugf("Failed to write log of container '%s' to the journal: %s\n", w.c.Name, err)
+	}
+}
+
+// write sends the entry, reconnecting once if the journal was restarted.
+func (w *journalWriter) write(entry []byte) error {
+	for attempt := 0; ; attempt++ {
+		if w.conn == nil {
+			conn, err := net.Dial("unixgram", journalSocket)
+			if err != nil {
+				return err
+			}
+			w.conn = conn
+		}
+		err := writeJournal(w.conn, entry)
+		if err == nil || attempt > 0 {
+			return err
+		}
+		_ = w.conn.Close()
+		w.conn = nil
+	}
+}
+
+func shortId(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
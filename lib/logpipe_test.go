@@ -0,0 +1,241 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeJournal receives the entries sent to the journal socket, including the
+// ones passed in a memfd.
+type fakeJournal struct {
+	conn    *net.UnixConn
+	mu      sync.Mutex
+	entries [][]byte
+	changed chan struct{}
+}
+
+func newFakeJournal(tb testing.TB) *fakeJournal {
+	tb.Helper()
+	socket := filepath.Join(tb.TempDir(), "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	previous := journalSocket
+	journalSocket = socket
+	tb.Cleanup(func() {
+		journalSocket = previous
+		_ = conn.Close()
+	})
+
+	j := &fakeJournal{conn: conn, changed: make(chan struct{}, 1)}
+	go j.serve()
+	return j
+}
+
+func (j *fakeJournal) serve() {
+	buf := make([]byte, 1024*1024)
+	oob := make([]byte, unix.CmsgSpace(4))
+	for {
+		n, oobn, _, _, err := j.conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return
+		}
+		entry := append([]byte(nil), buf[:n]...)
+		if oobn > 0 {
+			if entry, err = readMemfd(oob[:oobn]); err != nil {
+				entry = []byte(err.Error())
+			}
+		}
+		j.mu.Lock()
+		j.entries = append(j.entries, entry)
+		j.mu.Unlock()
+		select {
+		case j.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func readMemfd(oob []byte) ([]byte, error) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil || len(messages) != 1 {
+		return nil, fmt.Errorf("invalid control message")
+	}
+	fds, err := unix.ParseUnixRights(&messages[0])
+	if err != nil || len(fds) != 1 {
+		return nil, fmt.Errorf("invalid descriptors")
+	}
+	f := os.NewFile(uintptr(fds[0]), "memfd")
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	// the offset is shared with the sender, which left it at the end
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var entry bytes.Buffer
+	if _, err = entry.ReadFrom(f); err != nil {
+		return nil, err
+	}
+	return entry.Bytes(), nil
+}
+
+// messages waits for count entries, and returns their MESSAGE fields.
+func (j *fakeJournal) messages(t *testing.T, count int) []string {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		j.mu.Lock()
+		entries := j.entries
+		j.mu.Unlock()
+		if len(entries) >= count {
+			var messages []string
+			for _, entry := range entries {
+				for _, field := range strings.Split(string(entry), "\n") {
+					if strings.HasPrefix(field, "MESSAGE=") {
+						messages = append(messages, strings.TrimPrefix(field, "MESSAGE="))
+					}
+				}
+			}
+			return messages
+		}
+		select {
+		case <-j.changed:
+		case <-deadline:
+			t.Fatalf("received %d journal entries, expected %d", len(entries), count)
+		}
+	}
+}
+
+func testJournalContext(bufferSize int) *Context {
+	return &Context{
+		Name:             "journal-test",
+		Id:               "0123456789abcdef",
+		SyslogIdentifier: "journal-test",
+		LogBufferSize:    bufferSize,
+		Log:              NewLogger(),
+	}
+}
+
+func TestJournalWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		writes   []string
+		expected []string
+	}{
+		{"lines", 0, []string{"first\nsecond\n"}, []string{"first", "second"}},
+		{"partial lines", 0, []string{"fir", "st\nsec", "ond\n"}, []string{"first", "second"}},
+		{"carriage return", 0, []string{"first\r\n"}, []string{"first"}},
+		{"empty line", 0, []string{"\n"}, []string{""}},
+		{"flush on close", 0, []string{"first\nunterminated"}, []string{"first", "unterminated"}},
+		{"long line", 4, []string{"0123456789\n"}, []string{"0123", "4567", "89"}},
+		{"long partial line", 4, []string{"01234", "56789"}, []string{"0123", "4567", "89"}},
+		{"long line after partial line", 4, []string{"01", "23456789\n"}, []string{"0123", "4567", "89"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			journal := newFakeJournal(t)
+			w := newJournalWriter(testJournalContext(test.max), PriorityInfo)
+			for _, data := range test.writes {
+				if n, err := w.Write([]byte(data)); err != nil || n != len(data) {
+					t.Fatalf("wrote %d of %d bytes: %v", n, len(data), err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			messages := journal.messages(t, len(test.expected))
+			if strings.Join(messages, "|") != strings.Join(test.expected, "|") {
+				t.Errorf("messages %q, expected %q", messages, test.expected)
+			}
+		})
+	}
+}
+
+func TestJournalWriterFields(t *testing.T) {
+	journal := newFakeJournal(t)
+	w := newJournalWriter(testJournalContext(0), PriorityError)
+	_, _ = w.Write([]byte("message\n"))
+	_ = w.Close()
+
+	journal.messages(t, 1)
+	journal.mu.Lock()
+	entry := string(journal.entries[0])
+	journal.mu.Unlock()
+	for _, field := range []string{"PRIORITY=3", "SYSLOG_IDENTIFIER=journal-test", "CONTAINER_NAME=journal-test", "CONTAINER_ID=0123456789ab", "CONTAINER_ID_FULL=0123456789abcdef"} {
+		if !strings.Contains(entry, field+"\n") {
+			t.Errorf("entry %q is missing %s", entry, field)
+		}
+	}
+}
+
+func TestJournalWriterPassesLargeEntriesInMemfd(t *testing.T) {
+	journal := newFakeJournal(t)
+	w := newJournalWriter(testJournalContext(0), PriorityInfo)
+	line := strings.Repeat("x", 512*1024)
+	_, _ = w.Write([]byte(line + "\n"))
+	_ = w.Close()
+
+	if messages := journal.messages(t, 1); messages[0] != line {
+		t.Errorf("message of %d bytes, expected %d", len(messages[0]), len(line))
+	}
+}
+
+func BenchmarkJournalWriter(b *testing.B) {
+	line := []byte(strings.Repeat("x", 120) + "\n")
+	c := testJournalContext(0)
+
+	b.Run("journalWriter", func(b *testing.B) {
+		newFakeJournal(b)
+		w := newJournalWriter(c, PriorityInfo)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, _ = w.Write(line)
+		}
+		b.StopTimer()
+		_ = w.Close()
+	})
+
+	b.Run("sendJournal", func(b *testing.B) {
+		newFakeJournal(b)
+		fields := map[string]string{
+			"SYSLOG_IDENTIFIER": c.SyslogIdentifier,
+			"CONTAINER_NAME":    c.Name,
+			"CONTAINER_ID":      shortId(c.Id),
+			"CONTAINER_ID_FULL": c.Id,
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_ = sendJournal(PriorityInfo, string(bytes.TrimSuffix(line, []byte{'\n'})), fields)
+		}
+	})
+}
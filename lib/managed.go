@@ -0,0 +1,125 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"sort"
+	"strings"
+)
+
+const (
+	// LabelManaged marks the containers created by systemd-docker.
+	LabelManaged = "systemd-docker.managed"
+
+	// LabelUnit is the systemd unit supervising the container.
+	LabelUnit = "systemd-docker.unit"
+
+	DriftNone    = "none"
+	DriftImage   = "image"
+	DriftUnknown = "unknown"
+)
+
+// ManagedContainer is a container created by systemd-docker.
+type ManagedContainer struct {
+	Unit   string `json:"unit"`
+	Name   string `json:"name"`
+	Id     string `json:"id"`
+	State  string `json:"state"`
+	Health string `json:"health,omitempty"`
+	Image  string `json:"image"`
+	Drift  string `json:"drift"`
+}
+
+// ManagedLabelArgs returns the docker run arguments labeling the container as
+// managed by systemd-docker, along with the unit supervising it.
+func ManagedLabelArgs(c *Context) []string {
+	flag := "--label"
+	if c.SwarmService {
+		flag = "--container-label"
+	}
+	args := []string{flag, fmt.Sprintf("%s=true", LabelManaged)}
+	if unit, err := currentUnit(); err == nil {
+		args = append(args, flag, fmt.Sprintf("%s=%s", LabelUnit, unit))
+	}
+	return args
+}
+
+// ListManaged returns the containers on the host which are labeled as
+// managed by systemd-docker, ordered by unit and name.
+func ListManaged(c *Context) ([]ManagedContainer, error) {
+	client, err := c.GetClient()
+	if err != nil {
+		return nil, err
+	}
+
+	containers, err := client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"label": {fmt.Sprintf("%s=true", LabelManaged)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ManagedContainer, 0, len(containers))
+	for _, summary := range containers {
+		container, err := client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: summary.ID})
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		managed := ManagedContainer{
+			Name:   strings.TrimPrefix(container.Name, "/"),
+			Id:     container.ID,
+			State:  container.State.StateString(),
+			Health: container.State.Health.Status,
+			Drift:  imageDrift(client, container),
+		}
+		if container.Config != nil {
+			managed.Unit = container.Config.Labels[LabelUnit]
+			managed.Image = container.Config.Image
+		}
+		result = append(result, managed)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Unit != result[j].Unit {
+			return result[i].Unit < result[j].Unit
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// imageDrift returns whether the image reference of the container now
+// resolves to a different image than the one the container was created from.
+func imageDrift(client *docker.Client, container *docker.Container) string {
+	if container.Config == nil || len(container.Config.Image) == 0 {
+		return DriftUnknown
+	}
+	image, err := client.InspectImage(container.Config.Image)
+	if err != nil {
+		return DriftUnknown
+	}
+	if image.ID != container.Image {
+		return DriftImage
+	}
+	return DriftNone
+}
@@ -0,0 +1,144 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	MetricGauge   = "gauge"
+	MetricCounter = "counter"
+)
+
+// Metric is a single gauge or counter value reported for the managed
+// container.
+type Metric struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels map[string]string
+	Value  float64
+}
+
+// Key returns the unique key of the metric, made up of its name and labels.
+func (m *Metric) Key() string {
+	if len(m.Labels) == 0 {
+		return m.Name
+	}
+	names := make([]string, 0, len(m.Labels))
+	for name := range m.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, m.Labels[name]))
+	}
+	return fmt.Sprintf("%s{%s}", m.Name, strings.Join(pairs, ","))
+}
+
+// MetricObserver is notified of every update of a metric, with the amount
+// counters were incremented by.
+type MetricObserver func(metric Metric, delta float64)
+
+// Metrics is the registry of all metrics reported for the managed container.
+type Metrics struct {
+	mu        sync.RWMutex
+	metrics   map[string]*Metric
+	observers []MetricObserver
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		metrics: make(map[string]*Metric),
+	}
+}
+
+// SetGauge sets the value of the gauge with the specified labels, given as
+// name/value pairs.
+func (m *Metrics) SetGauge(name string, help string, value float64, labels ...string) {
+	m.update(name, help, MetricGauge, labels, func(metric *Metric) {
+		metric.Value = value
+	})
+}
+
+// AddCounter increments the counter with the specified labels, given as
+// name/value pairs.
+func (m *Metrics) AddCounter(name string, help string, value float64, labels ...string) {
+	m.update(name, help, MetricCounter, labels, func(metric *Metric) {
+		metric.Value += value
+	})
+}
+
+// AddObserver registers an observer notified of all subsequent updates.
+func (m *Metrics) AddObserver(observer MetricObserver) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observers = append(m.observers, observer)
+}
+
+// Snapshot returns a copy of all metrics, sorted by key.
+func (m *Metrics) Snapshot() []Metric {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := make([]string, 0, len(m.metrics))
+	for key := range m.metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]Metric, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, *m.metrics[key])
+	}
+	return result
+}
+
+func (m *Metrics) update(name string, help string, metricType string, labels []string, update func(metric *Metric)) {
+	metric := &Metric{
+		Name: name,
+		Help: help,
+		Type: metricType,
+	}
+	if len(labels) > 0 {
+		metric.Labels = make(map[string]string, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			metric.Labels[labels[i]] = labels[i+1]
+		}
+	}
+
+	m.mu.Lock()
+	key := metric.Key()
+	if existing, ok := m.metrics[key]; ok {
+		metric = existing
+	} else {
+		m.metrics[key] = metric
+	}
+	previous := metric.Value
+	update(metric)
+	updated := *metric
+	observers := m.observers
+	m.mu.Unlock()
+
+	for _, observer := range observers {
+		observer(updated, updated.Value-previous)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"strings"
+)
+
+// dockerHubRegistry is the registry of images whose name has no registry.
+const dockerHubRegistry = "docker.io"
+
+// ValidateRegistryMirrors checks the --registry-mirror flags, which are
+// [<REGISTRY>=]<MIRROR>, where the registry defaults to Docker Hub.
+func ValidateRegistryMirrors(c *Context) error {
+	for _, mirror := range c.RegistryMirrors {
+		registry, host := parseRegistryMirror(mirror)
+		if len(registry) == 0 || len(host) == 0 || strings.Contains(host, "://") {
+			return fmt.Errorf("registry mirror '%s' has a wrong format", mirror)
+		}
+	}
+	return nil
+}
+
+func parseRegistryMirror(mirror string) (string, string) {
+	parts := strings.SplitN(mirror, "=", 2)
+	if len(parts) == 1 {
+		return dockerHubRegistry, strings.TrimSuffix(parts[0], "/")
+	}
+	return parts[0], strings.TrimSuffix(parts[1], "/")
+}
+
+// splitRegistry returns the registry of the image reference and the path
+// of the image within it.
+func splitRegistry(reference string) (string, string) {
+	parts := strings.SplitN(reference, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry := parts[0]
+		if registry == "index.docker.io" || registry == "registry-1.docker.io" {
+			registry = dockerHubRegistry
+		}
+		return registry, parts[1]
+	}
+	if len(parts) == 1 {
+		return dockerHubRegistry, "library/" + reference
+	}
+	return dockerHubRegistry, reference
+}
+
+// mirrorReferences returns the references of the image on the mirrors of its
+// registry, in the order the mirrors were specified.
+func mirrorReferences(c *Context, reference string) []string {
+	registry, path := splitRegistry(reference)
+	var result []string
+	for _, mirror := range c.RegistryMirrors {
+		if mirrorRegistry, host := parseRegistryMirror(mirror); mirrorRegistry == registry {
+			result = append(result, host+"/"+path)
+		}
+	}
+	return result
+}
+
+// pullFromMirrors pulls the image of the container from the first mirror of
+// its registry which serves it, once pulling it from the registry failed.
+// Unless the image is pinned by digest, which docker verifies, the digest of
+// the pulled image must match the digest the registry and the other mirrors
+// report for it, as far as they are reachable.  The image is then tagged with
+// its original name, so that docker create uses it.
+func pullFromMirrors(c *Context, client *docker.Client) error {
+	references := mirrorReferences(c, c.Image)
+	if len(references) == 0 {
+		return fmt.Errorf("no mirror of the registry of image '%s' is configured", c.Image)
+	}
+
+	var lastErr error
+	for i, reference := range references {
+		c.Log.Infof("Pulling image '%s' for container '%s' from mirror '%s'\n", c.Image, c.Name, reference)
+		err := pullReference(c, client, reference)
+		if err == ErrShutdown {
+			return err
+		}
+		if err == nil {
+			sources := append([]string{c.Image}, references[:i]...)
+			err = verifyMirrorDigest(c, client, reference, append(sources, references[i+1:]...))
+			if err != nil {
+				_ = client.RemoveImage(reference)
+			}
+		}
+		if err == nil {
+			err = tagMirrorImage(c, client, reference)
+		}
+		if err != nil {
+			c.Log.Warnf("Failed to pull image '%s' for container '%s' from mirror '%s': %s\n", c.Image, c.Name, reference, err)
+			lastErr = err
+			continue
+		}
+		c.mirrorImage = reference
+		c.Metrics().AddCounter("systemd_docker_mirror_pulls_total", "Number of images pulled from a registry mirror", 1)
+		c.Log.Noticef("Pulled image '%s' for container '%s' from mirror '%s'\n", c.Image, c.Name, reference)
+		return nil
+	}
+	return lastErr
+}
+
+// verifyMirrorDigest checks that the digest of the image pulled from the
+// mirror matches the digest reported by the other sources of the image.
+func verifyMirrorDigest(c *Context, client *docker.Client, reference string, sources []string) error {
+	if strings.Contains(reference, "@") {
+		return nil
+	}
+
+	image, err := client.InspectImage(reference)
+	if err != nil {
+		return err
+	}
+	repository, _ := docker.ParseRepositoryTag(reference)
+	digest := ""
+	for _, repoDigest := range image.RepoDigests {
+		if strings.HasPrefix(repoDigest, repository+"@") {
+			digest = strings.TrimPrefix(repoDigest, repository+"@")
+		}
+	}
+	if len(digest) == 0 {
+		return fmt.Errorf("digest of image '%s' is unknown", reference)
+	}
+
+	verified := 0
+	for _, source := range sources {
+		distribution, err := client.InspectDistribution(source)
+		if err != nil {
+			c.Log.Debugf("Failed to read digest of image '%s': %s\n", source, err)
+			continue
+		}
+		if sourceDigest := distribution.Descriptor.Digest.String(); sourceDigest != digest {
+			return fmt.Errorf("digest '%s' of the image differs from digest '%s' of '%s'", digest, sourceDigest, source)
+		}
+		verified++
+	}
+	if verified == 0 {
+		c.Log.Warnf("Digest '%s' of image '%s' pulled from mirror '%s' could not be verified, no other source is reachable\n", digest, c.Image, reference)
+	} else {
+		c.Log.Infof("Verified digest '%s' of image '%s' pulled from mirror '%s' against %d other sources\n", digest, c.Image, reference, verified)
+	}
+	return nil
+}
+
+// tagMirrorImage tags the image pulled from the mirror with its original
+// name.  Images pinned by digest cannot be tagged, they are used by the
+// mirror reference instead.
+func tagMirrorImage(c *Context, client *docker.Client, reference string) error {
+	if strings.Contains(reference, "@") {
+		return nil
+	}
+	repository, tag := docker.ParseRepositoryTag(c.Image)
+	if len(tag) == 0 {
+		tag = "latest"
+	}
+	if err := client.TagImage(reference, docker.TagImageOptions{Repo: repository, Tag: tag, Force: true}); err != nil {
+		return err
+	}
+	// only removes the tag of the mirror
+	_ = client.RemoveImage(reference)
+	return nil
+}
+
+// useMirrorImage makes docker create use the image pulled from a mirror,
+// instead of pulling it from the registry again.  It rewrites the docker run
+// arguments, so it runs once the concurrent phases reading them are done.
+func useMirrorImage(c *Context) {
+	if len(c.mirrorImage) == 0 {
+		return
+	}
+	index, _ := FindImage(c.Args)
+	if index < 0 {
+		return
+	}
+	if strings.Contains(c.mirrorImage, "@") {
+		c.Args[index] = c.mirrorImage
+		c.Image = c.mirrorImage
+	}
+	if values := dockerFlagValues(c.Args, "pull"); len(values) > 0 && values[len(values)-1] == "always" {
+		c.Args = append(c.Args[:index], append([]string{"--pull", "missing"}, c.Args[index:]...)...)
+	}
+}
@@ -17,11 +17,52 @@ package lib
 
 import (
 	"errors"
+	"fmt"
 	"github.com/fsouza/go-dockerclient"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	MonitorEventHealthy   = "healthy"
+	MonitorEventUnhealthy = "unhealthy"
+	MonitorEventLog       = "log"
+)
+
+// monitorEvents are the docker events the health check monitor always
+// subscribes to.
+var monitorEvents = []string{"health_status", "exec_start", "exec_die", "die"}
+
+// ParseMonitorEvents parses the --monitor-event flags, which map additional
+// docker events to the behavior of the health check monitor: 'healthy' and
+// 'unhealthy' treat the event like the respective health status, and 'log'
+// only logs it and shows it in the systemd status.
+func ParseMonitorEvents(specs []string) (map[string]string, error) {
+	events := make(map[string]string, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("monitor event '%s' has a wrong format, expected <EVENT>=<BEHAVIOR>", spec)
+		}
+		for _, event := range monitorEvents {
+			if parts[0] == event {
+				return nil, fmt.Errorf("monitor event '%s' is always handled by the monitor", event)
+			}
+		}
+		switch parts[1] {
+		case MonitorEventHealthy, MonitorEventUnhealthy, MonitorEventLog:
+		default:
+			return nil, fmt.Errorf("unsupported monitor event behavior '%s'", parts[1])
+		}
+		events[parts[0]] = parts[1]
+	}
+	return events, nil
+}
+
 type Monitor interface {
 	Close() error
 	Start(conn net.Conn) error
@@ -29,19 +70,29 @@ type Monitor interface {
 
 type monitor struct {
 	context            *Context
-	client             *docker.Client
+	engine             ContainerEngine
 	listener           chan *docker.APIEvents
+	unsubscribe        func()
 	healthCheckCommand string
+	healthy            bool
+	healthySince       time.Time
+	failures           int
+	syntheticInterval  time.Duration
+	staleness          time.Duration
+	lastConfirmed      time.Time
+	lastLoggedFailure  time.Time
+	loggingFailure     sync.Mutex
+	trigger            watchdogTrigger
+	events             map[string]string
 }
 
 func CreateMonitor(c *Context) (Monitor, error) {
-	client, err := c.GetClient()
+	engine, err := c.GetEngine()
 	if err != nil {
 		return nil, err
 	}
 
-	containerOptions := docker.InspectContainerOptions{ID: c.Id}
-	container, err := client.InspectContainerWithOptions(containerOptions)
+	container, err := inspectContainer(c)
 	if err != nil {
 		return nil, err
 	}
@@ -58,28 +109,53 @@ func CreateMonitor(c *Context) (Monitor, error) {
 		}
 	}
 
+	syntheticInterval, staleness, err := validateWatchdog(c, container.Config.Healthcheck)
+	if err != nil {
+		return nil, err
+	}
+
 	healthCheckCommand := strings.Join(healthCheckTests, " ")
 	c.Log.Infof("Creating health check monitor for container '%s', watching health check: %s\n", c.Name, healthCheckCommand)
 
-	listener := make(chan *docker.APIEvents)
-	eventsOptions := docker.EventsOptions{
-		Filters: map[string][]string{
-			"type":      {"container"},
-			"container": {c.Id},
-			"event":     {"health_status", "exec_start", "exec_die", "die"},
-		},
+	events, err := ParseMonitorEvents(c.MonitorEvents)
+	if err != nil {
+		return nil, err
 	}
+	filter := append([]string(nil), monitorEvents...)
+	for event := range events {
+		filter = append(filter, event)
+	}
+	sort.Strings(filter[len(monitorEvents):])
 
-	if err = client.AddEventListenerWithOptions(eventsOptions, listener); err != nil {
+	listener := make(chan *docker.APIEvents)
+	unsubscribe, err := engine.Events(c, c.Id, filter, listener)
+	if err != nil {
 		return nil, err
 	}
 
-	return &monitor{
+	m := &monitor{
 		context:            c,
-		client:             client,
+		engine:             engine,
 		listener:           listener,
+		unsubscribe:        unsubscribe,
 		healthCheckCommand: healthCheckCommand,
-	}, nil
+		syntheticInterval:  syntheticInterval,
+		staleness:          staleness,
+		healthy:            c.resumedReady(),
+		healthySince:       time.Now(),
+		lastConfirmed:      c.lastConfirmedHealthy(),
+		events:             events,
+	}
+	if !m.healthy && container.State.Health.Status == "healthy" {
+		// an adopted container which is already healthy does not need to
+		// wait for its next health check
+		m.healthy = true
+		m.lastConfirmed = time.Now()
+		if checks := container.State.Health.Log; len(checks) > 0 && !checks[len(checks)-1].End.IsZero() {
+			m.lastConfirmed = checks[len(checks)-1].End
+		}
+	}
+	return m, nil
 }
 
 func (m *monitor) Start(conn net.Conn) error {
@@ -87,17 +163,41 @@ func (m *monitor) Start(conn net.Conn) error {
 	defer func(conn net.Conn) {
 		_ = conn.Close()
 	}(conn)
-	ready := false
+	ready := m.context.resumedReady()
 	lastHealthCheckCommandExecuteId := ""
+	var synthetic <-chan time.Time
+	if m.syntheticInterval > 0 {
+		ticker := time.NewTicker(m.syntheticInterval)
+		defer ticker.Stop()
+		synthetic = ticker.C
+	}
+
+	// notify right away if the container is known to be healthy, as the next
+	// health event may take longer than WatchdogSec=
+	if m.healthy && (!ready || (m.syntheticInterval > 0 && time.Since(m.lastConfirmed) <= m.staleness)) {
+		ready = m.notify(conn, ready)
+	}
 	for {
 		select {
+		case <-m.context.monitorDone():
+			return nil
+		case <-synthetic:
+			// the watchdog is pinged on a timer, independent of sparse
+			// health events, for as long as the last confirmed health is
+			// not stale
+			if ready && m.healthy && m.failures == 0 && time.Since(m.lastConfirmed) <= m.staleness {
+				ready = m.notify(conn, ready)
+			}
 		case ev, ok := <-m.listener:
 			if !ok || ev == nil {
 				return errors.New("event listener closed")
 			}
 			if strings.HasPrefix(ev.Action, "health_status: ") {
 				if ev.Action == "health_status: healthy" {
-					ready = m.notify(conn, ready)
+					ready = m.markHealthy(conn, ready)
+				} else if ev.Action == "health_status: unhealthy" {
+					m.markUnhealthy(conn)
+					go m.logHealthCheckFailure("Container '%s' became unhealthy")
 				}
 			} else if ev.Action == "die" {
 				m.context.Log.Infof("Container '%s' has stopped, stopping health check monitor\n", m.context.Name)
@@ -109,38 +209,219 @@ func (m *monitor) Start(conn net.Conn) error {
 			} else if ev.Action == "exec_die" {
 				if ev.Actor.Attributes["execID"] == lastHealthCheckCommandExecuteId {
 					if ev.Actor.Attributes["exitCode"] == "0" {
+						m.context.Metrics().AddCounter("systemd_docker_health_checks_total", "Number of health checks of the container", 1, "result", "success")
+						m.failures = 0
+						m.trigger.passed()
+						m.lastConfirmed = confirmHealthy(m.context)
+						if m.healthy {
+							m.updateStatus(conn)
+						}
 						ready = m.notify(conn, ready)
 					} else {
+						m.context.Metrics().AddCounter("systemd_docker_health_checks_total", "Number of health checks of the container", 1, "result", "failure")
+						m.failures++
+						if m.healthy {
+							m.updateStatus(conn)
+						}
 						m.context.Log.Debugf("Container '%s' health check '%s' failed with exitCode '%s'.  Skipping notify.\n", m.context.Name, lastHealthCheckCommandExecuteId, ev.Actor.Attributes["exitCode"])
+						go m.logHealthCheckFailure("Health check of container '%s' failed")
+						m.trigger.failed(m.context, conn, ready)
 					}
 				}
+			} else if behavior, ok := m.events[strings.SplitN(ev.Action, ":", 2)[0]]; ok {
+				ready = m.handleEvent(conn, ev.Action, behavior, ready)
 			}
 		}
 	}
 }
 
+// markHealthy records that the container is healthy and notifies systemd.
+func (m *monitor) markHealthy(conn net.Conn, ready bool) bool {
+	if !m.healthy {
+		m.healthy = true
+		m.healthySince = time.Now()
+		m.failures = 0
+		m.updateStatus(conn)
+	}
+	m.trigger.recovered()
+	m.lastConfirmed = confirmHealthy(m.context)
+	return m.notify(conn, ready)
+}
+
+// markUnhealthy records that the container is unhealthy, which stops the
+// watchdog pings.
+func (m *monitor) markUnhealthy(conn net.Conn) {
+	m.healthy = false
+	m.updateStatus(conn)
+}
+
+// handleEvent applies the behavior configured with --monitor-event to the
+// event.
+func (m *monitor) handleEvent(conn net.Conn, action string, behavior string, ready bool) bool {
+	switch behavior {
+	case MonitorEventHealthy:
+		m.context.Log.Infof("Container '%s' is treated as healthy after event '%s'\n", m.context.Name, action)
+		return m.markHealthy(conn, ready)
+	case MonitorEventUnhealthy:
+		m.context.Log.Warnf("Container '%s' is treated as unhealthy after event '%s'\n", m.context.Name, action)
+		m.markUnhealthy(conn)
+	default:
+		m.context.Log.Infof("Container '%s' received event '%s'\n", m.context.Name, action)
+		if _, err := conn.Write([]byte(fmt.Sprintf("STATUS=%s", withReadyTime(m.context, action)))); err != nil {
+			m.context.Log.Debugf("Failed to update systemd status of container '%s': %s\n", m.context.Name, err)
+		}
+	}
+	return ready
+}
+
 func (m *monitor) notify(conn net.Conn, ready bool) bool {
+	return notifyHealthy(m.context, conn, ready)
+}
+
+// notifyHealthy signals READY the first time the container is healthy and
+// the ready gates passed, and watchdog pings afterwards.  It returns whether
+// READY has been signaled.
+func notifyHealthy(c *Context, conn net.Conn, ready bool) bool {
 	if !ready {
+		if !readyGatesPassed(c) {
+			return false
+		}
 		if _, err := conn.Write([]byte("READY=1")); err == nil {
-			m.context.Log.Infof("Signaled to systemd that the container '%s' is healthy\n", m.context.Name)
+			c.Log.Infof("Signaled to systemd that the container '%s' is healthy\n", c.Name)
+			readyReached(c)
 		} else {
-			m.context.Log.Errorf("Failed to signal to systemd that the container '%s' is healthy: %s\n", m.context.Name, err)
+			c.Log.Errorf("Failed to signal to systemd that the container '%s' is healthy: %s\n", c.Name, err)
 			return false
 		}
 	} else {
 		if _, err := conn.Write([]byte("WATCHDOG=1")); err == nil {
-			m.context.Log.Debugf("Signaled to systemd watchdog that the container '%s' is still healthy\n", m.context.Name)
+			c.Log.Debugf("Signaled to systemd watchdog that the container '%s' is still healthy\n", c.Name)
 		} else {
-			m.context.Log.Errorf("Failed to signal to systemd watchdog that the container '%s' is still healthy: %s\n", m.context.Name, err)
+			c.Log.Errorf("Failed to signal to systemd watchdog that the container '%s' is still healthy: %s\n", c.Name, err)
 		}
 	}
 	return true
 }
 
+// updateStatus mirrors the health of the container into the systemd status.
+func (m *monitor) updateStatus(conn net.Conn) {
+	recordHealth(m.context, m.healthy)
+	var status string
+	if m.healthy {
+		status = fmt.Sprintf("healthy (%s, %d failures)", formatDuration(time.Since(m.healthySince)), m.failures)
+	} else {
+		status = "unhealthy"
+		if output := m.lastHealthCheckOutput(); len(output) > 0 {
+			status = fmt.Sprintf("unhealthy: %s", output)
+		}
+	}
+	if _, err := conn.Write([]byte(fmt.Sprintf("STATUS=%s", withReadyTime(m.context, status)))); err != nil {
+		m.context.Log.Debugf("Failed to update systemd status of container '%s': %s\n", m.context.Name, err)
+	}
+}
+
+// logHealthCheckFailure writes the output and exit code of the last failed
+// health check to the journal, so that operators can see why the container
+// is unhealthy without inspecting it.  Every failed health check is logged
+// only once.  It waits for the result of the health check, so it runs in its
+// own goroutine rather than delaying the events and watchdog pings of the
+// monitor.
+func (m *monitor) logHealthCheckFailure(format string) {
+	m.loggingFailure.Lock()
+	defer m.loggingFailure.Unlock()
+
+	// docker records the result of a health check shortly after its exec
+	// has died, so give it a moment to appear
+	result, ok := m.lastHealthCheck()
+	for i := 0; i < 5 && (!ok || !result.Start.After(m.lastLoggedFailure)); i++ {
+		time.Sleep(100 * time.Millisecond)
+		result, ok = m.lastHealthCheck()
+	}
+	if !ok || result.ExitCode == 0 || !result.Start.After(m.lastLoggedFailure) {
+		return
+	}
+	m.lastLoggedFailure = result.Start
+	recordHealthOutput(m.context, strings.TrimSpace(result.Output))
+
+	message := fmt.Sprintf(format, m.context.Name)
+	m.context.Log.Structured(PriorityWarning, message, map[string]string{
+		"CONTAINER_NAME":        m.context.Name,
+		"CONTAINER_ID":          shortId(m.context.Id),
+		"HEALTH_CHECK":          m.healthCheckCommand,
+		"HEALTH_CHECK_EXITCODE": strconv.Itoa(result.ExitCode),
+		"HEALTH_CHECK_OUTPUT":   strings.TrimSpace(result.Output),
+		"HEALTH_CHECK_DURATION": result.End.Sub(result.Start).String(),
+	})
+}
+
+func (m *monitor) lastHealthCheck() (docker.HealthCheck, bool) {
+	container, err := m.engine.Inspect(m.context, m.context.Id)
+	if err != nil || len(container.State.Health.Log) == 0 {
+		return docker.HealthCheck{}, false
+	}
+	return container.State.Health.Log[len(container.State.Health.Log)-1], true
+}
+
+func (m *monitor) lastHealthCheckOutput() string {
+	result, ok := m.lastHealthCheck()
+	if !ok {
+		return ""
+	}
+	output := strings.TrimSpace(result.Output)
+	if i := strings.IndexByte(output, '\n'); i >= 0 {
+		output = output[:i]
+	}
+	if len(output) > 200 {
+		output = output[:200] + "..."
+	}
+	return output
+}
+
+// recordHealth records the health of the container, for the health gauge,
+// for classifying its exit, and for the health history.
+func recordHealth(c *Context, healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	c.Metrics().SetGauge("systemd_docker_container_healthy", "Whether the container is healthy", value)
+
+	c.phases.mu.Lock()
+	c.phases.unhealthy = !healthy
+	c.phases.mu.Unlock()
+
+	if !recordHealthTransition(c, healthy) {
+		return
+	}
+	if healthy {
+		emitEvent(c, EventHealthy, 0)
+	} else {
+		emitEvent(c, EventUnhealthy, 0)
+	}
+}
+
+// unhealthyBeforeReady returns whether the container became unhealthy before
+// systemd was ever signaled that it is ready.
+func (c *Context) unhealthyBeforeReady() bool {
+	c.phases.mu.Lock()
+	defer c.phases.mu.Unlock()
+	return c.phases.unhealthy && !c.phases.ready
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh%dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%dd%dh", int(d.Hours())/24, int(d.Hours())%24)
+}
+
 func (m *monitor) Close() error {
 	m.context.Log.Infof("Closing health check monitor for container '%s'\n", m.context.Name)
-	if err := m.client.RemoveEventListener(m.listener); err != nil {
-		return err
-	}
+	m.unsubscribe()
 	return nil
 }
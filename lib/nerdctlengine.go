@@ -0,0 +1,366 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// NerdctlEngine is the name of the engine managing containers with
+	// nerdctl on containerd.
+	NerdctlEngine = "nerdctl"
+
+	// nerdctlPollInterval is the interval at which the state of the
+	// container is polled to synthesize its events.
+	nerdctlPollInterval = time.Second
+)
+
+func init() {
+	RegisterEngine(NerdctlEngine, newNerdctlEngine)
+}
+
+// nerdctlEngine manages containers with the nerdctl CLI of containerd, for
+// hosts which ship containerd without a docker daemon.  nerdctl accepts the
+// docker run flags and reports the state of containers in the format of
+// the docker API, while events are synthesized by polling the state of the
+// container.  The containerd namespace and address are taken from
+// CONTAINERD_NAMESPACE and CONTAINERD_ADDRESS by nerdctl.
+type nerdctlEngine struct {
+	command string
+}
+
+func newNerdctlEngine(_ *Context) (ContainerEngine, error) {
+	command := os.Getenv("NERDCTL_COMMAND")
+	if len(command) == 0 {
+		command = "nerdctl"
+	}
+	if _, err := exec.LookPath(command); err != nil {
+		return nil, fmt.Errorf("engine '%s' needs nerdctl: %v", NerdctlEngine, err)
+	}
+	return &nerdctlEngine{command: command}, nil
+}
+
+// run runs the nerdctl command and returns its standard output, or an error
+// with its standard error.
+func (e *nerdctlEngine) run(c *Context, args ...string) (string, error) {
+	cmd := exec.Command(e.command, args...)
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	err := cmd.Run()
+	c.auditCommand(cmd, start, err)
+	if err != nil {
+		return stdout.String(), fmt.Errorf("'%s %s' failed: %v: %s", e.command, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func (e *nerdctlEngine) Create(c *Context) (string, error) {
+	cmd := exec.Command(e.command, append([]string{"create"}, c.Args...)...)
+	if len(c.secretEnv) > 0 {
+		// the docker flag env takes the value of a bare name from here
+		cmd.Env = append(os.Environ(), c.secretEnv...)
+	}
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	start := time.Now()
+	err := cmd.Run()
+	c.auditCommand(cmd, start, err)
+	if err != nil {
+		if strings.Contains(stderr.String(), "is already used") {
+			return "", fmt.Errorf("%w: '%s': %v", ErrNameConflict, c.Name, err)
+		}
+		return "", fmt.Errorf("'%s create' failed: %v: %s", e.command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	// nerdctl may report the progress of pulling the image before the ID
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	return strings.TrimSpace(lines[len(lines)-1]), nil
+}
+
+func (e *nerdctlEngine) Start(c *Context, id string) error {
+	_, err := e.run(c, "start", id)
+	return err
+}
+
+func (e *nerdctlEngine) Stop(c *Context, id string, timeout time.Duration) error {
+	_, err := e.run(c, "stop", "--time", strconv.Itoa(int(timeout.Seconds())), id)
+	return err
+}
+
+func (e *nerdctlEngine) Inspect(c *Context, id string) (*docker.Container, error) {
+	cmd := exec.Command(e.command, "container", "inspect", "--mode=dockercompat", id)
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(strings.ToLower(stderr.String()), "no such") {
+			return nil, &docker.NoSuchContainer{ID: id}
+		}
+		return nil, fmt.Errorf("'%s container inspect' failed: %v: %s", e.command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var containers []*docker.Container
+	if err := json.Unmarshal([]byte(stdout.String()), &containers); err != nil {
+		return nil, fmt.Errorf("failed to parse the state of container '%s': %v", id, err)
+	}
+	if len(containers) == 0 {
+		return nil, &docker.NoSuchContainer{ID: id}
+	}
+	return containers[0], nil
+}
+
+// Events synthesizes the events of the container from the changes of its
+// state, which is polled every second.
+func (e *nerdctlEngine) Events(c *Context, id string, actions []string, listener chan *docker.APIEvents) (func(), error) {
+	// the initial state is taken before returning, so that changes once
+	// subscribed are reported
+	container, err := e.Inspect(c, id)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool, len(actions))
+	for _, action := range actions {
+		wanted[action] = true
+	}
+
+	size := c.EventQueueSize
+	if size <= 0 {
+		size = DefaultEventQueueSize
+	}
+	events := make(chan *docker.APIEvents, size)
+	done := make(chan struct{})
+	go e.pollEvents(c, id, &container.State, wanted, events, done)
+	go forwardEvents(c, events, listener, size, done)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+	}, nil
+}
+
+func (e *nerdctlEngine) pollEvents(c *Context, id string, previous *docker.State, wanted map[string]bool, events chan *docker.APIEvents, done chan struct{}) {
+	defer close(events)
+	ticker := time.NewTicker(nerdctlPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		container, err := e.Inspect(c, id)
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			if previous.Running {
+				e.sendEvent(c, container, id, "die", wanted, events, done)
+			}
+			return
+		}
+		if err != nil {
+			c.Log.Debugf("Failed to poll the state of container '%s': %s\n", c.Name, err)
+			continue
+		}
+
+		current := &container.State
+		restarted := current.StartedAt.After(previous.StartedAt)
+		if previous.Running && (!current.Running || restarted) {
+			e.sendEvent(c, container, id, "die", wanted, events, done)
+		}
+		if current.OOMKilled && !previous.OOMKilled {
+			e.sendEvent(c, container, id, "oom", wanted, events, done)
+		}
+		if current.Running && (!previous.Running || restarted) {
+			e.sendEvent(c, container, id, "start", wanted, events, done)
+		}
+		if len(current.Health.Status) > 0 && current.Health.Status != previous.Health.Status {
+			e.sendEvent(c, container, id, fmt.Sprintf("health_status: %s", current.Health.Status), wanted, events, done)
+		}
+		previous = current
+	}
+}
+
+func (e *nerdctlEngine) sendEvent(c *Context, container *docker.Container, id string, action string, wanted map[string]bool, events chan *docker.APIEvents, done chan struct{}) {
+	if !wanted[strings.SplitN(action, ":", 2)[0]] {
+		return
+	}
+
+	now := time.Now()
+	attributes := map[string]string{"name": c.Name}
+	if container != nil && action == "die" {
+		attributes["exitCode"] = strconv.Itoa(container.State.ExitCode)
+	}
+	select {
+	case events <- &docker.APIEvents{
+		Action:   action,
+		Type:     "container",
+		Actor:    docker.APIActor{ID: id, Attributes: attributes},
+		Status:   action,
+		ID:       id,
+		Time:     now.Unix(),
+		TimeNano: now.UnixNano(),
+	}:
+	case <-done:
+	}
+}
+
+func (e *nerdctlEngine) Logs(ctx context.Context, c *Context, id string, options LogsOptions, stdout io.Writer, stderr io.Writer) error {
+	args := []string{"logs"}
+	if !options.Since.IsZero() {
+		args = append(args, "--since", options.Since.Format(time.RFC3339Nano))
+	}
+	if options.Follow {
+		args = append(args, "--follow")
+	}
+	if options.Timestamps {
+		args = append(args, "--timestamps")
+	}
+	cmd := exec.CommandContext(ctx, e.command, append(args, id)...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("'%s logs' failed: %v", e.command, err)
+	}
+	return nil
+}
+
+func (e *nerdctlEngine) Remove(c *Context, id string, removeVolumes bool) error {
+	args := []string{"rm", "--force"}
+	if removeVolumes {
+		args = append(args, "--volumes")
+	}
+	_, err := e.run(c, append(args, id)...)
+	if err != nil && strings.Contains(strings.ToLower(err.Error()), "no such") {
+		return &docker.NoSuchContainer{ID: id, Err: err}
+	}
+	return err
+}
+
+func (e *nerdctlEngine) Rename(c *Context, id string, name string) error {
+	_, err := e.run(c, "rename", id, name)
+	return err
+}
+
+// List inspects the containers reported by 'nerdctl ps', as it does not
+// report them in the format of the docker API.
+func (e *nerdctlEngine) List(c *Context, name string) ([]docker.APIContainers, error) {
+	output, err := e.run(c, "ps", "--all", "--quiet", "--no-trunc", "--filter", "name="+name)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []docker.APIContainers
+	for _, id := range strings.Fields(output) {
+		container, err := e.Inspect(c, id)
+		if _, ok := err.(*docker.NoSuchContainer); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, docker.APIContainers{
+			ID:      container.ID,
+			Image:   container.Config.Image,
+			Created: container.Created.Unix(),
+			State:   container.State.StateString(),
+			Names:   []string{"/" + strings.TrimPrefix(container.Name, "/")},
+		})
+	}
+	return result, nil
+}
+
+func (e *nerdctlEngine) InspectImage(c *Context, reference string) (*docker.Image, error) {
+	cmd := exec.Command(e.command, "image", "inspect", "--mode=dockercompat", reference)
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(strings.ToLower(stderr.String()), "no such") {
+			return nil, docker.ErrNoSuchImage
+		}
+		return nil, fmt.Errorf("'%s image inspect' failed: %v: %s", e.command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var images []*docker.Image
+	if err := json.Unmarshal([]byte(stdout.String()), &images); err != nil {
+		return nil, fmt.Errorf("failed to parse image '%s': %v", reference, err)
+	}
+	if len(images) == 0 {
+		return nil, docker.ErrNoSuchImage
+	}
+	return images[0], nil
+}
+
+func (e *nerdctlEngine) Exec(c *Context, id string, options ExecOptions, command []string) error {
+	args := []string{"exec", "--interactive"}
+	if isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		args = append(args, "--tty")
+	}
+	if len(options.User) > 0 {
+		args = append(args, "--user", options.User)
+	}
+	if len(options.Workdir) > 0 {
+		args = append(args, "--workdir", options.Workdir)
+	}
+	for _, env := range options.Env {
+		args = append(args, "--env", env)
+	}
+	args = append(args, id)
+	args = append(args, command...)
+
+	cmd := exec.Command(e.command, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	err := cmd.Run()
+	c.auditCommand(cmd, start, err)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &ExitError{
+			Code: exitErr.ExitCode(),
+			Err:  fmt.Errorf("command in container '%s' exited with code %d", c.Name, exitErr.ExitCode()),
+		}
+	}
+	return err
+}
+
+// NetworkConnect fails, as nerdctl cannot connect created containers to
+// networks.  The networks of the container are specified with the docker flag
+// network instead.
+func (e *nerdctlEngine) NetworkConnect(_ *Context, _ string, network string, _ string) error {
+	return fmt.Errorf("engine '%s' cannot connect containers to network '%s', use the docker flag 'network' instead", NerdctlEngine, network)
+}
@@ -17,6 +17,10 @@ package lib
 
 import (
 	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"net"
+	"os"
+	"sort"
 	"strings"
 )
 
@@ -81,3 +85,103 @@ func (t *Networks) Set(value string) error {
 	}
 	return nil
 }
+
+// WriteIpFile writes the IP address of the container on each attached
+// network to the file specified by --ip-file, one '<NETWORK> <IP_ADDRESS>'
+// pair per line.
+func WriteIpFile(c *Context) error {
+	if len(c.IpFile) == 0 || len(c.Id) == 0 {
+		return nil
+	}
+
+	container, err := inspectContainer(c)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	if container.NetworkSettings != nil {
+		for name, network := range container.NetworkSettings.Networks {
+			if len(network.IPAddress) > 0 {
+				lines = append(lines, fmt.Sprintf("%s %s\n", name, network.IPAddress))
+			}
+			if len(network.GlobalIPv6Address) > 0 {
+				lines = append(lines, fmt.Sprintf("%s %s\n", name, network.GlobalIPv6Address))
+			}
+		}
+	}
+	sort.Strings(lines)
+
+	if err = writeFileAtomic(c.IpFile, []byte(strings.Join(lines, "")), 0644); err != nil {
+		return err
+	}
+
+	c.Log.Infof("Wrote IP file '%s' for container '%s'\n", c.IpFile, c.Name)
+	return nil
+}
+
+// RemoveIpFile removes the file written by WriteIpFile.
+func RemoveIpFile(c *Context) error {
+	if len(c.IpFile) == 0 {
+		return nil
+	}
+
+	if err := os.Remove(c.IpFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// validateNetworks ensures that the parent interfaces of any macvlan or
+// ipvlan networks the container will join exist and are up, waiting for up to
+// --network-wait for them to be configured.
+func validateNetworks(c *Context) error {
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	for name := range c.Networks.Get() {
+		network, err := client.NetworkInfo(name)
+		if _, ok := err.(*docker.NoSuchNetwork); ok {
+			return fmt.Errorf("network '%s' does not exist", name)
+		}
+		if err != nil {
+			return err
+		}
+
+		if network.Driver != "macvlan" && network.Driver != "ipvlan" {
+			continue
+		}
+
+		parent := network.Options["parent"]
+		if len(parent) == 0 {
+			continue
+		}
+
+		// docker creates missing 802.1q sub-interfaces itself, so only their
+		// link needs to exist
+		link := parent
+		if i := strings.LastIndex(parent, "."); i > 0 {
+			if _, err := net.InterfaceByName(parent); err != nil {
+				link = parent[:i]
+			}
+		}
+
+		description := fmt.Sprintf("interface '%s' of %s network '%s' to be up", link, network.Driver, name)
+		err = waitFor(c, description, c.NetworkWait, func() (bool, error) {
+			iface, err := net.InterfaceByName(link)
+			if err != nil {
+				return false, nil
+			}
+			return iface.Flags&net.FlagUp != 0, nil
+		})
+		if err != nil {
+			if _, ifaceErr := net.InterfaceByName(link); ifaceErr != nil {
+				return fmt.Errorf("parent interface '%s' of %s network '%s' does not exist", link, network.Driver, name)
+			}
+			return fmt.Errorf("parent interface '%s' of %s network '%s' is not up", link, network.Driver, name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// NotifyBridgeUrlEnv passes the URL of the notify bridge to the
+	// container.
+	NotifyBridgeUrlEnv = "SYSTEMD_DOCKER_NOTIFY_URL"
+
+	// NotifyBridgeTokenEnv passes the token authenticating to the notify
+	// bridge to the container.
+	NotifyBridgeTokenEnv = "SYSTEMD_DOCKER_NOTIFY_TOKEN"
+
+	// notifyBridgeMaxMessage is the maximum size of a relayed notification.
+	notifyBridgeMaxMessage = 64 * 1024
+)
+
+// NotifyBridgeArgs generates the token of the notify bridge and returns the
+// docker run arguments passing its URL and token to the container.
+func NotifyBridgeArgs(c *Context) ([]string, error) {
+	network, address, err := parseNotifyBridge(c.NotifyBridge)
+	if err != nil {
+		return nil, err
+	}
+
+	bridgeUrl := c.NotifyBridgeUrl
+	if len(bridgeUrl) == 0 {
+		if network == "vsock" {
+			// the container reaches the host at its well-known CID
+			_, port, _ := net.SplitHostPort(address)
+			bridgeUrl = fmt.Sprintf("vsock://%d:%s", vsockCidHost, port)
+		} else if host, _, _ := net.SplitHostPort(address); len(host) == 0 || net.ParseIP(host).IsUnspecified() {
+			return nil, fmt.Errorf("notify bridge '%s' listens on all addresses, specify the URL the container reaches it on with 'notify-bridge-url'", c.NotifyBridge)
+		} else {
+			bridgeUrl = fmt.Sprintf("http://%s/notify", address)
+		}
+	}
+
+	token := make([]byte, 32)
+	if _, err = rand.Read(token); err != nil {
+		return nil, err
+	}
+	c.notifyBridgeToken = hex.EncodeToString(token)
+
+	return []string{
+		"-e", fmt.Sprintf("%s=%s", NotifyBridgeUrlEnv, bridgeUrl),
+		"-e", fmt.Sprintf("%s=%s", NotifyBridgeTokenEnv, c.notifyBridgeToken),
+	}, nil
+}
+
+// StartNotifyBridge relays notifications which the container posts to
+// /notify of the address specified by --notify-bridge to NOTIFY_SOCKET, for
+// containers which cannot share the socket, f.ex. on a remote daemon or in
+// VM-isolated runtimes.  Requests have to carry the token passed to the
+// container as bearer token.  The returned function stops the bridge.
+func StartNotifyBridge(c *Context) (func(), error) {
+	if len(c.NotifyBridge) == 0 || len(c.notifyBridgeToken) == 0 {
+		return func() {}, nil
+	}
+
+	network, address, err := parseNotifyBridge(c.NotifyBridge)
+	if err != nil {
+		return nil, err
+	}
+	var listener net.Listener
+	if network == "vsock" {
+		listener, err = listenVsock(address)
+	} else {
+		listener, err = net.Listen(network, address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on '%s' for the notify bridge: %v", c.NotifyBridge, err)
+	}
+
+	authorization := []byte("Bearer " + c.notifyBridgeToken)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/notify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), authorization) != 1 {
+			c.Log.Warnf("Rejected notification for container '%s' from '%s' with wrong token\n", c.Name, r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, notifyBridgeMaxMessage))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		message := bridgedNotification(string(body))
+		if len(message) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err = sendNotify(c, message); err != nil {
+			c.Log.Errorf("Failed to relay notification of container '%s' to systemd: %s\n", c.Name, err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		c.Log.Debugf("Relayed notification of container '%s' to systemd: %s\n", c.Name, message)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			c.Log.Errorf("Notify bridge of container '%s' failed: %s\n", c.Name, err)
+		}
+	}()
+	c.Log.Infof("Relaying notifications of container '%s' from %s://%s\n", c.Name, network, listener.Addr())
+
+	return func() {
+		_ = server.Close()
+	}, nil
+}
+
+// parseNotifyBridge parses tcp://[HOST]:PORT or vsock://[CID]:PORT.
+func parseNotifyBridge(bridge string) (string, string, error) {
+	u, err := url.Parse(bridge)
+	if err == nil && (u.Scheme == "tcp" || u.Scheme == "vsock") && len(u.Port()) > 0 && len(u.Path) == 0 {
+		if _, err = strconv.ParseUint(u.Port(), 10, 32); err == nil {
+			return u.Scheme, u.Host, nil
+		}
+	}
+	return "", "", fmt.Errorf("notify bridge '%s' has a wrong format, expected tcp://[HOST]:PORT or vsock://[CID]:PORT", bridge)
+}
+
+// bridgedNotification drops the assignments of a relayed notification which
+// cannot be honored for the container: its MAINPID lives in another PID
+// namespace or on another host.
+func bridgedNotification(message string) string {
+	var lines []string
+	for _, line := range strings.Split(message, "\n") {
+		if len(line) > 0 && !strings.HasPrefix(line, "MAINPID=") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,154 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"strings"
+)
+
+var architectureAliases = map[string]string{
+	"x86_64":  "amd64",
+	"x86-64":  "amd64",
+	"aarch64": "arm64",
+	"armv7l":  "arm",
+	"armhf":   "arm",
+	"i386":    "386",
+	"i686":    "386",
+}
+
+// Platform is an os/architecture[/variant] tuple as used by docker's
+// --platform flag.
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// ParsePlatform parses an os[/architecture[/variant]] platform specifier.
+func ParsePlatform(value string) (Platform, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(value)), "/")
+	if len(parts) == 0 || len(parts) > 3 || len(parts[0]) == 0 {
+		return Platform{}, fmt.Errorf("platform '%s' has a wrong format", value)
+	}
+	platform := Platform{OS: parts[0]}
+	if len(parts) > 1 {
+		platform.Architecture = normalizeArchitecture(parts[1])
+	}
+	if len(parts) > 2 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+func (p Platform) String() string {
+	result := p.OS
+	if len(p.Architecture) > 0 {
+		result = fmt.Sprintf("%s/%s", result, p.Architecture)
+		if len(p.Variant) > 0 {
+			result = fmt.Sprintf("%s/%s", result, p.Variant)
+		}
+	}
+	return result
+}
+
+func normalizeArchitecture(architecture string) string {
+	architecture = strings.ToLower(architecture)
+	if alias, ok := architectureAliases[architecture]; ok {
+		return alias
+	}
+	return architecture
+}
+
+func getDaemonPlatform(client *docker.Client) (Platform, error) {
+	info, err := client.Info()
+	if err != nil {
+		return Platform{}, err
+	}
+	return Platform{
+		OS:           strings.ToLower(info.OSType),
+		Architecture: normalizeArchitecture(info.Architecture),
+	}, nil
+}
+
+// validatePlatform ensures that the platform requested with --platform
+// matches the architecture of the daemon, so that images are not
+// accidentally run under emulation.
+func validatePlatform(c *Context) error {
+	if len(c.Platform) == 0 || c.AllowEmulation || c.daemonless() {
+		return nil
+	}
+
+	requested, err := ParsePlatform(c.Platform)
+	if err != nil {
+		return err
+	}
+
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	daemon, err := getDaemonPlatform(client)
+	if err != nil {
+		return err
+	}
+
+	if requested.OS != daemon.OS || (len(requested.Architecture) > 0 && requested.Architecture != daemon.Architecture) {
+		return fmt.Errorf("platform '%s' does not match the daemon platform '%s', use 'allow-emulation' to run it anyway", requested, daemon)
+	}
+	return nil
+}
+
+// validateImagePlatform ensures that the image of the created container
+// matches the platform of the daemon, or the requested platform.
+func validateImagePlatform(c *Context) error {
+	if c.AllowEmulation || c.daemonless() {
+		return nil
+	}
+
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	container, err := client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: c.Id})
+	if err != nil {
+		return err
+	}
+
+	image, err := client.InspectImage(container.Image)
+	if err != nil {
+		return err
+	}
+
+	expected, err := getDaemonPlatform(client)
+	if err != nil {
+		return err
+	}
+	if len(c.Platform) > 0 {
+		if expected, err = ParsePlatform(c.Platform); err != nil {
+			return err
+		}
+	}
+
+	actual := Platform{OS: strings.ToLower(image.OS), Architecture: normalizeArchitecture(image.Architecture)}
+	if (len(actual.OS) > 0 && actual.OS != expected.OS) || (len(actual.Architecture) > 0 && len(expected.Architecture) > 0 && actual.Architecture != expected.Architecture) {
+		return fmt.Errorf("image '%s' of container '%s' is for platform '%s' instead of '%s', use 'allow-emulation' to run it anyway", container.Config.Image, c.Name, actual, expected)
+	}
+	return nil
+}
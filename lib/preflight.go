@@ -0,0 +1,78 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PreflightUnit reads the NotifyAccess, PrivateTmp and ProtectProc settings
+// of the unit the wrapper is running in and fails with a precise explanation
+// when they would silently break notifications or container supervision.
+func PreflightUnit(c *Context) error {
+	if !c.UnitPreflight || !runningUnderSystemd() || len(c.NotifySocket) == 0 {
+		return nil
+	}
+
+	unit, properties, err := getUnitProperties(c)
+	if err != nil {
+		c.Log.Debugf("Skipping unit preflight, failed to read unit properties: %s\n", err)
+		return nil
+	}
+
+	// once MAINPID points at the container, notifications from the wrapper
+	// or the container are only accepted with NotifyAccess=all
+	if notifyAccess, ok := properties["NotifyAccess"].(string); ok && notifyAccess != "all" {
+		return fmt.Errorf("unit '%s' has NotifyAccess=%s, but systemd-docker sends MAINPID=<container pid> and notifies on behalf of the container, which requires NotifyAccess=all", unit, notifyAccess)
+	}
+
+	// without access to /proc/<pid> the container process appears dead
+	if protectProc, ok := properties["ProtectProc"].(string); ok && protectProc != "" && protectProc != "default" {
+		return fmt.Errorf("unit '%s' has ProtectProc=%s, which hides the container process from systemd-docker, use ProtectProc=default", unit, protectProc)
+	}
+
+	// bind mounts are resolved by the docker daemon in the host namespace,
+	// not in the private /tmp of the unit
+	if privateTmp, ok := properties["PrivateTmp"].(bool); ok && privateTmp {
+		for _, mount := range bindMountSources(c.Args) {
+			if mount == "/tmp" || strings.HasPrefix(mount, "/tmp/") || mount == "/var/tmp" || strings.HasPrefix(mount, "/var/tmp/") {
+				return fmt.Errorf("unit '%s' has PrivateTmp=yes, but bind mount source '%s' is resolved by the docker daemon in the host /tmp, not the private /tmp of the unit", unit, mount)
+			}
+		}
+	}
+	return nil
+}
+
+// bindMountSources returns the host paths bind mounted by the docker run
+// arguments.
+func bindMountSources(args []string) []string {
+	var result []string
+	for _, value := range dockerFlagValues(args, "v", "volume") {
+		if source := strings.SplitN(value, ":", 2)[0]; strings.HasPrefix(source, "/") {
+			result = append(result, source)
+		}
+	}
+	for _, value := range dockerFlagValues(args, "mount") {
+		for _, option := range strings.Split(value, ",") {
+			parts := strings.SplitN(option, "=", 2)
+			if len(parts) == 2 && (parts[0] == "source" || parts[0] == "src") && strings.HasPrefix(parts[1], "/") {
+				result = append(result, parts[1])
+			}
+		}
+	}
+	return result
+}
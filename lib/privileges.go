@@ -0,0 +1,128 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const allCapabilities = "ALL"
+
+// defaultCapabilities are the capabilities docker grants containers unless
+// they are dropped.
+var defaultCapabilities = []string{
+	"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD",
+	"NET_BIND_SERVICE", "NET_RAW", "SETFCAP", "SETGID", "SETPCAP", "SETUID",
+	"SYS_CHROOT",
+}
+
+// ValidatePrivileges enforces the host-level privilege policy on the docker
+// run arguments: with --deny-privileged, privileged containers are refused,
+// and with --max-caps, containers whose effective capabilities, the docker
+// defaults adjusted by the docker flags cap-drop and cap-add, are not a subset
+// of the allowed capabilities are refused.
+func ValidatePrivileges(c *Context) error {
+	privileged := isPrivileged(c.Args)
+	if c.DenyPrivileged && privileged {
+		return fmt.Errorf("docker flag 'privileged' is denied by 'deny-privileged'")
+	}
+
+	if len(c.MaxCaps) == 0 {
+		return nil
+	}
+
+	allowed := make(map[string]bool, len(c.MaxCaps))
+	for _, capability := range c.MaxCaps {
+		allowed[normalizeCapability(capability)] = true
+	}
+	if allowed[allCapabilities] {
+		return nil
+	}
+	if privileged {
+		return fmt.Errorf("docker flag 'privileged' grants all capabilities, exceeding 'max-caps'")
+	}
+
+	effective := effectiveCapabilities(c.Args)
+	if effective[allCapabilities] {
+		return fmt.Errorf("docker flag 'cap-add=ALL' exceeds 'max-caps'")
+	}
+	var exceeding []string
+	for capability := range effective {
+		if !allowed[capability] {
+			exceeding = append(exceeding, capability)
+		}
+	}
+	if len(exceeding) > 0 {
+		sort.Strings(exceeding)
+		return fmt.Errorf("capabilities '%s' of the container are not allowed by 'max-caps'", strings.Join(exceeding, ","))
+	}
+	return nil
+}
+
+// isPrivileged returns whether the docker run arguments request a privileged
+// container.
+func isPrivileged(args []string) bool {
+	end, _ := FindImage(args)
+	if end < 0 {
+		end = len(args)
+	}
+
+	privileged := false
+	for _, arg := range args[:end] {
+		if arg == "--privileged" {
+			privileged = true
+		} else if strings.HasPrefix(arg, "--privileged=") {
+			privileged, _ = strconv.ParseBool(strings.TrimPrefix(arg, "--privileged="))
+		}
+	}
+	return privileged
+}
+
+// effectiveCapabilities returns the capabilities of the container, with ALL
+// standing for every capability.  As in docker, capabilities are dropped
+// before they are added.
+func effectiveCapabilities(args []string) map[string]bool {
+	effective := make(map[string]bool, len(defaultCapabilities))
+	for _, capability := range defaultCapabilities {
+		effective[capability] = true
+	}
+
+	for _, value := range dockerFlagValues(args, "cap-drop") {
+		for _, capability := range strings.Split(value, ",") {
+			capability = normalizeCapability(capability)
+			if capability == allCapabilities {
+				effective = make(map[string]bool)
+				continue
+			}
+			delete(effective, capability)
+		}
+	}
+	for _, value := range dockerFlagValues(args, "cap-add") {
+		for _, capability := range strings.Split(value, ",") {
+			if capability = normalizeCapability(capability); len(capability) > 0 {
+				effective[capability] = true
+			}
+		}
+	}
+	return effective
+}
+
+func normalizeCapability(capability string) string {
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(capability)), "CAP_")
+}
@@ -0,0 +1,336 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProbePolicyAll = "all"
+	ProbePolicyAny = "any"
+
+	DefaultProbeInterval = 10 * time.Second
+	DefaultProbeTimeout  = 5 * time.Second
+)
+
+// probe is a readiness probe of a port of the container, declared with
+// --probe as either http://[HOST]:PORT/PATH or tcp://[HOST]:PORT.  Without a
+// host, the IP address of the container is probed.
+type probe struct {
+	spec   string
+	scheme string
+	host   string
+	port   string
+	path   string
+}
+
+func parseProbe(spec string) (*probe, error) {
+	u, err := url.Parse(spec)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "tcp") || len(u.Port()) == 0 {
+		return nil, fmt.Errorf("probe '%s' has a wrong format, expected http://[HOST]:PORT/PATH or tcp://[HOST]:PORT", spec)
+	}
+	return &probe{
+		spec:   spec,
+		scheme: u.Scheme,
+		host:   u.Hostname(),
+		port:   u.Port(),
+		path:   u.RequestURI(),
+	}, nil
+}
+
+// ValidateProbes checks the --probe and --probe-policy flags.
+func ValidateProbes(c *Context) error {
+	if c.ProbePolicy != ProbePolicyAll && c.ProbePolicy != ProbePolicyAny {
+		return fmt.Errorf("unsupported probe policy '%s'", c.ProbePolicy)
+	}
+	for _, spec := range c.Probes {
+		if _, err := parseProbe(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *probe) check(host string, timeout time.Duration) error {
+	if len(p.host) > 0 {
+		host = p.host
+	}
+	address := net.JoinHostPort(host, p.port)
+	if p.scheme == "tcp" {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(fmt.Sprintf("%s://%s%s", p.scheme, address, p.path))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type probeMonitor struct {
+	context           *Context
+	probes            []*probe
+	host              string
+	healthy           bool
+	healthySince      time.Time
+	syntheticInterval time.Duration
+	staleness         time.Duration
+	lastConfirmed     time.Time
+	trigger           watchdogTrigger
+	passed            []bool
+}
+
+// createProbeMonitor creates a monitor which signals readiness and watchdog
+// pings based on the aggregate result of the --probe readiness probes.
+func createProbeMonitor(c *Context) (Monitor, error) {
+	var probes []*probe
+	for _, spec := range c.Probes {
+		p, err := parseProbe(spec)
+		if err != nil {
+			return nil, err
+		}
+		probes = append(probes, p)
+	}
+
+	container, err := inspectContainer(c)
+	if err != nil {
+		return nil, err
+	}
+
+	syntheticInterval, staleness, err := validateWatchdog(c, &docker.HealthConfig{Interval: c.ProbeInterval, Timeout: c.ProbeTimeout, Retries: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	c.Log.Infof("Creating probe monitor for container '%s', requiring %s of: %s\n", c.Name, c.ProbePolicy, strings.Join(c.Probes, ", "))
+	return &probeMonitor{
+		context:           c,
+		probes:            probes,
+		host:              containerAddress(container),
+		syntheticInterval: syntheticInterval,
+		staleness:         staleness,
+	}, nil
+}
+
+// containerAddress returns the address at which the ports of the container
+// can be reached.
+func containerAddress(container *docker.Container) string {
+	if container.HostConfig != nil && container.HostConfig.NetworkMode == "host" {
+		return "127.0.0.1"
+	}
+	if container.NetworkSettings != nil {
+		if len(container.NetworkSettings.IPAddress) > 0 {
+			return container.NetworkSettings.IPAddress
+		}
+		for _, network := range container.NetworkSettings.Networks {
+			if len(network.IPAddress) > 0 {
+				return network.IPAddress
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+func (m *probeMonitor) Start(conn net.Conn) error {
+	m.context.Log.Infof("Starting probe monitor for container '%s'\n", m.context.Name)
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	interval := m.context.ProbeInterval
+	if interval <= 0 {
+		interval = DefaultProbeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var synthetic <-chan time.Time
+	if m.syntheticInterval > 0 {
+		syntheticTicker := time.NewTicker(m.syntheticInterval)
+		defer syntheticTicker.Stop()
+		synthetic = syntheticTicker.C
+	}
+
+	ready := m.context.resumedReady()
+	for {
+		if HasPidDied(m.context, m.context.Pid) {
+			m.context.Log.Infof("Container '%s' has stopped, stopping probe monitor\n", m.context.Name)
+			return nil
+		}
+		results := m.check()
+		changed := m.changed(results)
+		if healthy := m.aggregate(results); healthy {
+			if !m.healthy {
+				m.healthy = true
+				m.healthySince = time.Now()
+				changed = true
+			}
+			if changed {
+				m.updateStatus(conn, fmt.Sprintf("healthy, %s", describeProbes(results)))
+			}
+			m.lastConfirmed = confirmHealthy(m.context)
+			m.trigger.recovered()
+			ready = notifyHealthy(m.context, conn, ready)
+		} else {
+			changed = changed || m.healthy || !ready
+			m.healthy = false
+			if changed {
+				m.updateStatus(conn, fmt.Sprintf("unhealthy, %s", describeProbes(results)))
+			}
+			status := probeFailures(results)
+			recordHealthOutput(m.context, status)
+			m.context.Log.Debugf("Container '%s' probes failed: %s.  Skipping notify.\n", m.context.Name, status)
+			m.trigger.failed(m.context, conn, ready)
+		}
+
+		// synthetic watchdog pings do not run the probes again, so that
+		// they neither add load nor count failures twice
+	wait:
+		for {
+			select {
+			case <-m.context.monitorDone():
+				return nil
+			case <-ticker.C:
+				break wait
+			case <-synthetic:
+				if ready && m.healthy && time.Since(m.lastConfirmed) <= m.staleness {
+					ready = notifyHealthy(m.context, conn, ready)
+				}
+			}
+		}
+	}
+}
+
+// probeResult is the result of a probe, with a nil err if it succeeded.
+type probeResult struct {
+	probe *probe
+	err   error
+}
+
+// check runs all probes concurrently, each with its own timeout, so that
+// the time to READY is bounded by the slowest probe rather than the sum of
+// all probes.
+func (m *probeMonitor) check() []probeResult {
+	timeout := m.context.ProbeTimeout
+	if timeout <= 0 {
+		timeout = DefaultProbeTimeout
+	}
+
+	results := make([]probeResult, len(m.probes))
+	var wg sync.WaitGroup
+	for i, p := range m.probes {
+		wg.Add(1)
+		go func(i int, p *probe) {
+			defer wg.Done()
+			results[i] = probeResult{probe: p, err: p.check(m.host, timeout)}
+		}(i, p)
+	}
+	wg.Wait()
+
+	for _, r := range results {
+		result := "success"
+		if r.err != nil {
+			result = "failure"
+		}
+		m.context.Metrics().AddCounter("systemd_docker_probes_total", "Number of readiness probes of the container", 1, "probe", r.probe.spec, "result", result)
+	}
+	return results
+}
+
+// aggregate combines the results of the probes according to the probe
+// policy.
+func (m *probeMonitor) aggregate(results []probeResult) bool {
+	passed := 0
+	for _, r := range results {
+		if r.err == nil {
+			passed++
+		}
+	}
+	if m.context.ProbePolicy == ProbePolicyAny {
+		return passed > 0
+	}
+	return passed == len(results)
+}
+
+// changed returns whether any probe passed or failed unlike last time.
+func (m *probeMonitor) changed(results []probeResult) bool {
+	changed := len(m.passed) != len(results)
+	passed := make([]bool, len(results))
+	for i, r := range results {
+		passed[i] = r.err == nil
+		if !changed && passed[i] != m.passed[i] {
+			changed = true
+		}
+	}
+	m.passed = passed
+	return changed
+}
+
+// describeProbes returns the number of probes which passed, followed by the
+// result of each probe, f.ex. '1/2 probes passed: http://:8080/healthz ok,
+// tcp://:5432 failed'.
+func describeProbes(results []probeResult) string {
+	passed := 0
+	details := make([]string, 0, len(results))
+	for _, r := range results {
+		if r.err == nil {
+			passed++
+			details = append(details, fmt.Sprintf("%s ok", r.probe.spec))
+		} else {
+			details = append(details, fmt.Sprintf("%s failed", r.probe.spec))
+		}
+	}
+	return fmt.Sprintf("%d/%d probes passed: %s", passed, len(results), strings.Join(details, ", "))
+}
+
+// probeFailures describes the failed probes along with their errors.
+func probeFailures(results []probeResult) string {
+	var failures []string
+	for _, r := range results {
+		if r.err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", r.probe.spec, r.err))
+		}
+	}
+	return strings.Join(failures, "; ")
+}
+
+func (m *probeMonitor) updateStatus(conn net.Conn, status string) {
+	recordHealth(m.context, m.healthy)
+	if _, err := conn.Write([]byte(fmt.Sprintf("STATUS=%s", withReadyTime(m.context, status)))); err != nil {
+		m.context.Log.Debugf("Failed to update systemd status of container '%s': %s\n", m.context.Name, err)
+	}
+}
+
+func (m *probeMonitor) Close() error {
+	m.context.Log.Infof("Closing probe monitor for container '%s'\n", m.context.Name)
+	return nil
+}
@@ -16,14 +16,17 @@
 package lib
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"strconv"
+	"strings"
 )
 
-func HasPidDied(pid int) bool {
-	_, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+func HasPidDied(c *Context, pid int) bool {
+	_, err := os.Stat(c.procPath(strconv.Itoa(pid)))
 	return os.IsNotExist(err)
 }
 
@@ -39,3 +42,14 @@ func WritePidFile(c *Context) error {
 
 	return nil
 }
+
+func runCommand(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return output.String(), fmt.Errorf("'%s %s' failed: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(output.String()))
+	}
+	return output.String(), nil
+}
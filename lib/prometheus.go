@@ -0,0 +1,184 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/fsouza/go-dockerclient"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// MetricsListenSystemd makes the metrics endpoint use the socket passed
+	// by systemd socket activation.
+	MetricsListenSystemd = "systemd"
+
+	statsTimeout = 5 * time.Second
+)
+
+// StartMetricsServer serves the metrics of the container in the Prometheus
+// text format on /metrics of the address specified by --metrics-listen.  The
+// resource usage of the container is collected on every scrape.  The
+// returned function stops the server.
+func StartMetricsServer(c *Context) (func(), error) {
+	if len(c.MetricsListen) == 0 {
+		return func() {}, nil
+	}
+
+	listener, err := metricsListener(c.MetricsListen)
+	if err != nil {
+		return nil, err
+	}
+
+	collectUnitRestarts(c)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		collectContainerStats(c)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write(formatPrometheus(c.Name, c.Metrics().Snapshot()))
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			c.Log.Errorf("Metrics endpoint of container '%s' failed: %s\n", c.Name, err)
+		}
+	}()
+	c.Log.Infof("Serving metrics of container '%s' on http://%s/metrics\n", c.Name, listener.Addr())
+
+	return func() {
+		_ = server.Close()
+	}, nil
+}
+
+func metricsListener(address string) (net.Listener, error) {
+	if address != MetricsListenSystemd {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on '%s' for metrics: %v", address, err)
+		}
+		return listener, nil
+	}
+
+	listeners, err := activation.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	for _, listener := range listeners {
+		if listener != nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("no socket was passed by systemd for metrics")
+}
+
+// collectUnitRestarts records how often systemd restarted the unit.
+func collectUnitRestarts(c *Context) {
+	if !runningUnderSystemd() {
+		return
+	}
+	if _, properties, err := getUnitProperties(c); err == nil {
+		if restarts, ok := properties["NRestarts"].(uint32); ok {
+			c.Metrics().SetGauge("systemd_docker_unit_restarts", "Number of times systemd restarted the unit", float64(restarts))
+		}
+	}
+}
+
+// collectContainerStats records the current resource usage of the container.
+func collectContainerStats(c *Context) {
+	if c.daemonless() {
+		return
+	}
+	client, err := c.GetClient()
+	if err != nil || len(c.Id) == 0 {
+		return
+	}
+
+	statsChan := make(chan *docker.Stats, 1)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		_ = client.Stats(docker.StatsOptions{
+			ID:      c.Id,
+			Stats:   statsChan,
+			Stream:  false,
+			Done:    done,
+			Timeout: statsTimeout,
+		})
+	}()
+
+	var stats *docker.Stats
+	select {
+	case stats = <-statsChan:
+	case <-time.After(statsTimeout):
+	}
+	if stats == nil {
+		c.Log.Debugf("Failed to collect stats of container '%s'\n", c.Name)
+		return
+	}
+
+	metrics := c.Metrics()
+	metrics.SetGauge("systemd_docker_container_cpu_seconds", "CPU time consumed by the container", float64(stats.CPUStats.CPUUsage.TotalUsage)/float64(time.Second))
+	metrics.SetGauge("systemd_docker_container_memory_usage_bytes", "Memory usage of the container", float64(stats.MemoryStats.Usage))
+	if stats.MemoryStats.Limit > 0 {
+		metrics.SetGauge("systemd_docker_container_memory_limit_bytes", "Memory limit of the container", float64(stats.MemoryStats.Limit))
+	}
+	metrics.SetGauge("systemd_docker_container_pids", "Number of processes of the container", float64(stats.PidsStats.Current))
+	for name, network := range stats.Networks {
+		metrics.SetGauge("systemd_docker_container_network_receive_bytes", "Bytes received by the container", float64(network.RxBytes), "interface", name)
+		metrics.SetGauge("systemd_docker_container_network_transmit_bytes", "Bytes transmitted by the container", float64(network.TxBytes), "interface", name)
+	}
+}
+
+// formatPrometheus renders the metrics in the Prometheus text format, with
+// the container name as additional label.
+func formatPrometheus(container string, metrics []Metric) []byte {
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].Name < metrics[j].Name
+	})
+
+	var buf bytes.Buffer
+	previous := ""
+	for _, metric := range metrics {
+		if metric.Name != previous {
+			buf.WriteString(fmt.Sprintf("# HELP %s %s\n", metric.Name, metric.Help))
+			buf.WriteString(fmt.Sprintf("# TYPE %s %s\n", metric.Name, metric.Type))
+			previous = metric.Name
+		}
+
+		labels := map[string]string{"container": container}
+		for name, value := range metric.Labels {
+			labels[name] = value
+		}
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pairs := make([]string, 0, len(names))
+		for _, name := range names {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", name, labels[name]))
+		}
+		buf.WriteString(fmt.Sprintf("%s{%s} %g\n", metric.Name, strings.Join(pairs, ","), metric.Value))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,292 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PullPolicyAlways  = "always"
+	PullPolicyMissing = "missing"
+	PullPolicyNever   = "never"
+
+	// DefaultPullRetryDelay is the delay before the first retry of pulling
+	// the image, unless --pull-retry-delay is specified.
+	DefaultPullRetryDelay = 5 * time.Second
+
+	// statusInterval is the minimum interval between progress updates of
+	// the systemd status.
+	statusInterval = time.Second
+
+	// maxPullRetryDelay caps the delay between retries of pulling the
+	// image.
+	maxPullRetryDelay = 5 * time.Minute
+
+	// pullExtendInterval is the minimum interval between extensions of the
+	// systemd start timeout while the pull is progressing, each by
+	// pullExtendTimeout, so that a stalled pull is not extended forever.
+	pullExtendInterval = 5 * time.Second
+	pullExtendTimeout  = 30 * time.Second
+)
+
+// ValidatePullPolicy checks the --pull-policy flag.
+func ValidatePullPolicy(c *Context) error {
+	switch c.PullPolicy {
+	case "", PullPolicyAlways, PullPolicyMissing, PullPolicyNever:
+	default:
+		return fmt.Errorf("unsupported pull policy '%s'", c.PullPolicy)
+	}
+	if c.Offline && len(c.PullPolicy) > 0 && c.PullPolicy != PullPolicyNever {
+		return fmt.Errorf("flag 'pull-policy' cannot be used with 'offline'")
+	}
+	return nil
+}
+
+// ValidatePullRetries checks the --pull-retries and --pull-retry-delay flags.
+func ValidatePullRetries(c *Context) error {
+	if c.PullRetries < 0 {
+		return fmt.Errorf("pull retries '%d' is negative", c.PullRetries)
+	}
+	if c.PullRetryDelay < 0 {
+		return fmt.Errorf("pull retry delay '%s' is negative", c.PullRetryDelay)
+	}
+	return nil
+}
+
+// setStatus updates the systemd status of the unit.
+func setStatus(c *Context, format string, v ...interface{}) {
+	if err := sendNotify(c, fmt.Sprintf("STATUS=%s", fmt.Sprintf(format, v...))); err != nil {
+		c.Log.Debugf("Failed to update systemd status of container '%s': %s\n", c.Name, err)
+	}
+}
+
+// pullImage pulls the image of the container if it is not present, reporting
+// the progress of the pull in the systemd status.  Failed pulls are retried
+// --pull-retries times, so that transient registry failures at boot do not
+// fail the unit.  Once all attempts failed, the unit fails with
+// --pull-policy=always or when the image is not present, rather than running
+// a stale image.  Daemonless engines pull the image on create.
+func pullImage(c *Context) error {
+	if c.Offline || len(c.Image) == 0 || c.daemonless() {
+		return nil
+	}
+
+	policy := PullPolicyMissing
+	if values := dockerFlagValues(c.Args, "pull"); len(values) > 0 {
+		policy = values[len(values)-1]
+	}
+	if policy == PullPolicyNever {
+		return nil
+	}
+
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	if policy != PullPolicyAlways {
+		if exists, err := imageExists(client, c.Image); err != nil || exists {
+			return err
+		}
+	}
+
+	c.Log.Infof("Pulling image '%s' for container '%s'\n", c.Image, c.Name)
+	start := time.Now()
+	delay := c.PullRetryDelay
+	for attempt := 0; ; attempt++ {
+		err = pullReference(c, client, c.Image)
+		if err != nil && err != ErrShutdown && len(c.RegistryMirrors) > 0 {
+			c.Log.Warnf("Failed to pull image '%s' for container '%s', trying mirrors: %s\n", c.Image, c.Name, err)
+			err = pullFromMirrors(c, client)
+		}
+		if err == nil || err == ErrShutdown || attempt >= c.PullRetries {
+			break
+		}
+
+		c.Log.Warnf("Failed to pull image '%s' for container '%s', retrying in %s (%d/%d): %s\n", c.Image, c.Name, delay, attempt+1, c.PullRetries, err)
+		c.Metrics().AddCounter("systemd_docker_pull_retries_total", "Number of times pulling the image was retried", 1)
+		setStatus(c, "Retrying to pull image %s in %s (%d/%d)", c.Image, delay, attempt+1, c.PullRetries)
+		extendTimeout(c, delay+pullExtendTimeout)
+		select {
+		case <-c.Done():
+			return ErrShutdown
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxPullRetryDelay {
+			delay = maxPullRetryDelay
+		}
+	}
+	if err == ErrShutdown {
+		return err
+	}
+	if err != nil {
+		// docker create would silently run a stale image with
+		// --pull=always, and could only fail pulling a missing image again
+		exists, existsErr := imageExists(client, c.Image)
+		if policy == PullPolicyAlways || existsErr != nil || !exists {
+			setStatus(c, "Pulling image %s failed", c.Image)
+			return &ExitError{
+				Code: ExitCodeImagePull,
+				Err:  fmt.Errorf("%w '%s': %v", ErrImagePull, c.Image, err),
+			}
+		}
+		c.Log.Warnf("Failed to pull image '%s' for container '%s', using the present image: %s\n", c.Image, c.Name, err)
+		return nil
+	}
+	c.recordPhase(PhasePull, start)
+	return nil
+}
+
+// pullReference pulls the image reference, reporting the progress of the
+// pull in the systemd status.  As long as the pull is progressing, systemd is
+// asked to extend the start timeout, so that large images do not fail the
+// unit.
+func pullReference(c *Context, client *docker.Client, reference string) error {
+	repository, tag := docker.ParseRepositoryTag(reference)
+	if len(tag) == 0 && !strings.Contains(repository, "@") {
+		tag = "latest"
+	}
+
+	setStatus(c, "Pulling image %s", reference)
+
+	reader, writer := io.Pipe()
+	progress := &pullProgress{layers: make(map[string]*layerProgress)}
+	var pullErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		decoder := json.NewDecoder(reader)
+		lastStatus := time.Time{}
+		lastExtend := time.Now()
+		for {
+			var message jsonMessage
+			if err := decoder.Decode(&message); err != nil {
+				_ = reader.CloseWithError(err)
+				return
+			}
+			if len(message.Error) > 0 {
+				pullErr = errors.New(message.Error)
+			}
+			if progress.update(message) && time.Since(lastExtend) >= pullExtendInterval {
+				extendTimeout(c, pullExtendTimeout)
+				lastExtend = time.Now()
+			}
+			if time.Since(lastStatus) >= statusInterval {
+				if percent, ok := progress.percent(); ok {
+					setStatus(c, "Pulling image %s (%d%%)", reference, percent)
+					lastStatus = time.Now()
+				}
+			}
+		}
+	}()
+
+	ctx, cancel := c.withShutdown()
+	defer cancel()
+	err := client.PullImage(docker.PullImageOptions{
+		Context:       ctx,
+		Repository:    repository,
+		Tag:           tag,
+		Platform:      c.Platform,
+		OutputStream:  writer,
+		RawJSONStream: true,
+	}, registryAuth(c, repository))
+	_ = writer.Close()
+	<-done
+	if ctx.Err() != nil {
+		return ErrShutdown
+	}
+	if err == nil {
+		err = pullErr
+	}
+	return err
+}
+
+type jsonMessage struct {
+	Id             string `json:"id"`
+	Status         string `json:"status"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+	Error string `json:"error"`
+}
+
+type layerProgress struct {
+	current int64
+	total   int64
+}
+
+// pullProgress aggregates the download progress of the layers of an image.
+type pullProgress struct {
+	mu     sync.Mutex
+	layers map[string]*layerProgress
+}
+
+// update records the progress reported by the message, and returns whether
+// the pull progressed, i.e. a layer was downloaded further, completed or is
+// being extracted.
+func (p *pullProgress) update(message jsonMessage) bool {
+	if len(message.Id) == 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	layer, ok := p.layers[message.Id]
+	if !ok {
+		layer = &layerProgress{}
+		p.layers[message.Id] = layer
+	}
+	previous := *layer
+	switch message.Status {
+	case "Downloading":
+		layer.current = message.ProgressDetail.Current
+		if message.ProgressDetail.Total > 0 {
+			layer.total = message.ProgressDetail.Total
+		}
+	case "Download complete", "Already exists", "Pull complete":
+		if layer.total == 0 {
+			layer.total = 1
+		}
+		layer.current = layer.total
+	case "Extracting":
+		return true
+	}
+	return *layer != previous
+}
+
+func (p *pullProgress) percent() (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var current, total int64
+	for _, layer := range p.layers {
+		current += layer.current
+		total += layer.total
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return int(current * 100 / total), true
+}
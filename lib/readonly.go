@@ -0,0 +1,84 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"path"
+	"strings"
+)
+
+// DefaultReadOnlyTmpfs are the paths a tmpfs is mounted on with
+// --enforce-read-only, as most software expects them to be writable.
+var DefaultReadOnlyTmpfs = []string{"/tmp", "/var/tmp", "/run"}
+
+// ReadOnlyArgs returns the docker run arguments making the root filesystem
+// of the container read-only with --enforce-read-only, along with a tmpfs on
+// each of the --read-only-tmpfs paths.  Passing the docker flag read-only
+// explicitly overrides the enforcement, and a path already mounted by the
+// docker run arguments gets no tmpfs.
+func ReadOnlyArgs(c *Context) []string {
+	if !c.EnforceReadOnly {
+		return nil
+	}
+
+	readOnly, specified := dockerBoolFlag(c.Args, "read-only")
+	if specified && !readOnly {
+		c.Log.Infof("Docker flag 'read-only=false' overrides 'enforce-read-only' for container '%s'\n", c.Name)
+		return nil
+	}
+
+	var result []string
+	if !specified {
+		result = append(result, "--read-only")
+	}
+
+	mounted := make(map[string]bool)
+	for _, target := range mountTargets(c.Args) {
+		mounted[path.Clean(target)] = true
+	}
+	for _, tmpfs := range c.ReadOnlyTmpfs {
+		if len(tmpfs) > 0 && !mounted[path.Clean(tmpfs)] {
+			result = append(result, "--tmpfs", tmpfs)
+		}
+	}
+	return result
+}
+
+// mountTargets returns the container paths mounted by the docker run
+// arguments.
+func mountTargets(args []string) []string {
+	var result []string
+	for _, value := range dockerFlagValues(args, "v", "volume") {
+		parts := strings.Split(value, ":")
+		if len(parts) == 1 {
+			result = append(result, parts[0])
+		} else {
+			result = append(result, parts[1])
+		}
+	}
+	for _, value := range dockerFlagValues(args, "tmpfs") {
+		result = append(result, strings.SplitN(value, ":", 2)[0])
+	}
+	for _, value := range dockerFlagValues(args, "mount") {
+		for _, option := range strings.Split(value, ",") {
+			parts := strings.SplitN(option, "=", 2)
+			if len(parts) == 2 && (parts[0] == "target" || parts[0] == "dst" || parts[0] == "destination") {
+				result = append(result, parts[1])
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,240 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+const (
+	readyGateExecPrefix = "exec:"
+	readyGateHookPrefix = "hook:"
+
+	DefaultReadyGateInterval = 5 * time.Second
+	DefaultReadyGateTimeout  = 30 * time.Second
+)
+
+// ReadyGateData is the data available to --ready-gate hook templates.
+type ReadyGateData struct {
+	Name string
+	Id   string
+	Pid  int
+}
+
+// readyGate is a condition which must hold before READY=1 is sent, declared
+// with --ready-gate as either exec:<COMMAND>, run with '/bin/sh -c' in the
+// container, or hook:<TEMPLATE>, run with '/bin/sh -c' on the host.
+type readyGate struct {
+	spec     string
+	exec     string
+	template *template.Template
+}
+
+func parseReadyGate(spec string) (*readyGate, error) {
+	switch {
+	case strings.HasPrefix(spec, readyGateExecPrefix) && len(spec) > len(readyGateExecPrefix):
+		return &readyGate{spec: spec, exec: strings.TrimPrefix(spec, readyGateExecPrefix)}, nil
+	case strings.HasPrefix(spec, readyGateHookPrefix) && len(spec) > len(readyGateHookPrefix):
+		t, err := template.New("ready-gate").Parse(strings.TrimPrefix(spec, readyGateHookPrefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ready gate hook template '%s': %v", spec, err)
+		}
+		return &readyGate{spec: spec, template: t}, nil
+	}
+	return nil, fmt.Errorf("ready gate '%s' has a wrong format, expected exec:<COMMAND> or hook:<TEMPLATE>", spec)
+}
+
+// ValidateReadyGates checks the --ready-gate flags.
+func ValidateReadyGates(c *Context) error {
+	if c.ReadyGateInterval <= 0 {
+		return fmt.Errorf("unsupported ready gate interval '%s'", c.ReadyGateInterval)
+	}
+	if c.ReadyGateTimeout <= 0 {
+		return fmt.Errorf("unsupported ready gate timeout '%s'", c.ReadyGateTimeout)
+	}
+	for _, spec := range c.ReadyGates {
+		if _, err := parseReadyGate(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readyGatesPassed runs the --ready-gate conditions in order, starting with
+// the first one which has not passed yet, and returns whether all of them
+// passed.  A gate which passed is not run again.
+func readyGatesPassed(c *Context) bool {
+	c.readyGatesMu.Lock()
+	defer c.readyGatesMu.Unlock()
+
+	for c.readyGatesPassed < len(c.ReadyGates) {
+		spec := c.ReadyGates[c.readyGatesPassed]
+		gate, err := parseReadyGate(spec)
+		if err == nil {
+			err = gate.run(c)
+		}
+		if err != nil {
+			c.Log.Infof("Ready gate '%s' of container '%s' has not passed yet: %s\n", spec, c.Name, err)
+			recordHealthOutput(c, err.Error())
+			setStatus(c, "Waiting for ready gate %d/%d", c.readyGatesPassed+1, len(c.ReadyGates))
+			return false
+		}
+		c.Log.Infof("Ready gate '%s' of container '%s' passed\n", spec, c.Name)
+		c.readyGatesPassed++
+	}
+	return true
+}
+
+func (g *readyGate) run(c *Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.ReadyGateTimeout)
+	defer cancel()
+
+	if len(g.exec) > 0 {
+		return execInContainer(ctx, c, []string{"/bin/sh", "-c", g.exec})
+	}
+
+	var buf bytes.Buffer
+	if err := g.template.Execute(&buf, ReadyGateData{Name: c.Name, Id: c.Id, Pid: c.Pid}); err != nil {
+		return err
+	}
+	return runHook(ctx, buf.String())
+}
+
+// runHook runs the command with '/bin/sh -c' in its own process group, which
+// is killed once ctx is done, so that commands started by the shell do not
+// outlive the timeout.
+func runHook(ctx context.Context, command string) error {
+	var output bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = ctx.Err()
+	}
+	return withOutput(err, output.String())
+}
+
+// withOutput appends the output of a failed command to the error.
+func withOutput(err error, output string) error {
+	if output = strings.TrimSpace(output); err == nil || len(output) == 0 {
+		return err
+	}
+	return fmt.Errorf("%v: %s", err, output)
+}
+
+// execInContainer runs the command in the container without attaching the
+// standard streams, and returns an error with its output if it does not exit
+// with 0.
+func execInContainer(ctx context.Context, c *Context, command []string) error {
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	execution, err := client.CreateExec(docker.CreateExecOptions{
+		Container:    c.Id,
+		Cmd:          command,
+		AttachStdout: true,
+		AttachStderr: true,
+		Context:      ctx,
+	})
+	if err != nil {
+		return err
+	}
+
+	var output bytes.Buffer
+	err = client.StartExec(execution.ID, docker.StartExecOptions{
+		OutputStream: &output,
+		ErrorStream:  &output,
+		Context:      ctx,
+	})
+	if err != nil {
+		return err
+	}
+
+	inspect, err := client.InspectExec(execution.ID)
+	if err != nil {
+		return err
+	}
+	if inspect.Running {
+		return fmt.Errorf("timed out after %s", c.ReadyGateTimeout)
+	}
+	if inspect.ExitCode != 0 {
+		return withOutput(fmt.Errorf("exited with code %d", inspect.ExitCode), output.String())
+	}
+	return nil
+}
+
+// gateMonitor signals READY once the ready gates passed, for containers
+// without a health check.
+type gateMonitor struct {
+	context *Context
+}
+
+func (m *gateMonitor) Start(conn net.Conn) error {
+	m.context.Log.Infof("Waiting for the ready gates of container '%s'\n", m.context.Name)
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	ticker := time.NewTicker(m.context.ReadyGateInterval)
+	defer ticker.Stop()
+	for !readyGatesPassed(m.context) {
+		select {
+		case <-m.context.monitorDone():
+			return nil
+		case <-ticker.C:
+		}
+		if HasPidDied(m.context, m.context.Pid) {
+			return nil
+		}
+	}
+
+	if _, err := conn.Write([]byte("READY=1")); err != nil {
+		return err
+	}
+	m.context.Log.Infof("Signaled to systemd that the container '%s' is ready\n", m.context.Name)
+	readyReached(m.context)
+	return nil
+}
+
+func (m *gateMonitor) Close() error {
+	return nil
+}
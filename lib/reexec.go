@@ -0,0 +1,269 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// reexecStateEnv passes the file with the serialized supervision state to
+// the re-executed binary.
+const reexecStateEnv = "SYSTEMD_DOCKER_REEXEC_STATE"
+
+// reexecState is the supervision state which is handed over to the new binary
+// when systemd-docker re-executes itself.
+type reexecState struct {
+	Id            string
+	Name          string
+	Ready         bool
+	LastHealthy   time.Time
+	LogsSince     time.Time
+	FirewallRules []string
+	ShapedDevices []string
+	CniNetworks   []string
+}
+
+// HandleReexec re-executes the systemd-docker binary on SIGUSR2, e.g. after it
+// was upgraded, without restarting the container.  The supervision state is
+// serialized to the run directory and resumed by the new binary.  The
+// returned function stops handling the signal.
+func HandleReexec(c *Context) func() {
+	pidFile := wrapperPidFile(c)
+	if err := os.MkdirAll(filepath.Dir(pidFile), 0755); err != nil {
+		c.Log.Debugf("Failed to create run directory '%s': %s\n", filepath.Dir(pidFile), err)
+	} else if err := writeFileAtomic(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		c.Log.Debugf("Failed to write pid file '%s': %s\n", pidFile, err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				if err := reexec(c); err != nil {
+					c.Log.Errorf("Failed to re-execute systemd-docker: %s\n", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+		_ = os.Remove(pidFile)
+	}
+}
+
+// SignalReexec asks the systemd-docker instance supervising the container to
+// re-execute itself.
+func SignalReexec(c *Context) error {
+	pidFile := wrapperPidFile(c)
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("no systemd-docker instance is supervising container '%s': %v", c.Name, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("pid file '%s' is invalid: %v", pidFile, err)
+	}
+	return syscall.Kill(pid, syscall.SIGUSR2)
+}
+
+func wrapperPidFile(c *Context) string {
+	return filepath.Join(runDirectory(c), fmt.Sprintf("%s.wrapper.pid", filepath.Base(c.Name)))
+}
+
+func reexecStateFile(c *Context) string {
+	return filepath.Join(runDirectory(c), fmt.Sprintf("%s.reexec.json", filepath.Base(c.Name)))
+}
+
+// supervisionState returns the current supervision state of the container.
+func supervisionState(c *Context) reexecState {
+	c.phases.mu.Lock()
+	ready := c.phases.ready
+	lastHealthy := c.phases.lastHealthy
+	c.phases.mu.Unlock()
+
+	c.supervisionMu.Lock()
+	defer c.supervisionMu.Unlock()
+	state := reexecState{
+		Id:            c.Id,
+		Name:          c.Name,
+		Ready:         ready,
+		LastHealthy:   lastHealthy,
+		LogsSince:     time.Now(),
+		FirewallRules: append([]string(nil), c.firewallRules...),
+		ShapedDevices: append([]string(nil), c.shapedDevices...),
+	}
+	for _, attachment := range c.cniAttachments {
+		state.CniNetworks = append(state.CniNetworks, attachment.config.name)
+	}
+	return state
+}
+
+// setContainerId sets the id of the supervised container under the lock
+// guarding the supervision state, which is read by the FD store and runtime
+// state goroutines.
+func setContainerId(c *Context, id string) {
+	c.supervisionMu.Lock()
+	defer c.supervisionMu.Unlock()
+	c.Id = id
+}
+
+func reexec(c *Context) error {
+	if len(c.Id) == 0 {
+		return fmt.Errorf("container '%s' is not running yet", c.Name)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	state := supervisionState(c)
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	stateFile := reexecStateFile(c)
+	if err = writeFileAtomic(stateFile, data, 0600); err != nil {
+		return err
+	}
+
+	c.Log.Infof("Re-executing '%s' to resume supervising container '%s'\n", executable, c.Name)
+	env := append(os.Environ(), fmt.Sprintf("%s=%s", reexecStateEnv, stateFile))
+	err = syscall.Exec(executable, os.Args, env)
+	_ = os.Remove(stateFile)
+	return err
+}
+
+// ResumeState loads the supervision state handed over by the previous binary
+// when systemd-docker was re-executed.
+func ResumeState(c *Context) error {
+	stateFile := os.Getenv(reexecStateEnv)
+	if len(stateFile) == 0 {
+		return nil
+	}
+	_ = os.Unsetenv(reexecStateEnv)
+
+	data, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return fmt.Errorf("failed to read re-exec state '%s': %v", stateFile, err)
+	}
+	_ = os.Remove(stateFile)
+
+	var state reexecState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse re-exec state '%s': %v", stateFile, err)
+	}
+	c.resumed = &state
+	c.Log.Infof("Resuming supervision of container '%s' after re-exec\n", state.Name)
+	return nil
+}
+
+// resumeContainer restores the supervision state of the container handed
+// over by the previous instance.  It returns false if the container is no
+// longer running, in which case it is started as usual.
+func resumeContainer(c *Context) (bool, error) {
+	engine, err := c.GetEngine()
+	if err != nil {
+		return false, err
+	}
+
+	container, err := engine.Inspect(c, c.resumed.Id)
+	if _, ok := err.(*docker.NoSuchContainer); ok || (err == nil && !container.State.Running) {
+		c.Log.Infof("Container '%s' is no longer running, not resuming it\n", c.Name)
+		c.resumed = nil
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	setContainerId(c, container.ID)
+	c.Pid = container.State.Pid
+	setPidMode(c, container)
+	rememberContainer(c, container)
+
+	c.phases.mu.Lock()
+	c.phases.ready = c.resumed.Ready
+	c.phases.lastHealthy = c.resumed.LastHealthy
+	c.phases.mu.Unlock()
+
+	c.supervisionMu.Lock()
+	c.firewallRules = c.resumed.FirewallRules
+	c.shapedDevices = c.resumed.ShapedDevices
+	c.supervisionMu.Unlock()
+	for _, name := range c.resumed.CniNetworks {
+		config, err := loadCniNetworkConfig(c, name)
+		if err != nil {
+			return false, err
+		}
+		for i, network := range c.CniNetworks {
+			if network == name {
+				c.supervisionMu.Lock()
+				c.cniAttachments = append(c.cniAttachments, &cniAttachment{
+					config:    config,
+					ifName:    fmt.Sprintf("cni%d", i),
+					netns:     c.procPath(strconv.Itoa(c.Pid), "ns", "net"),
+					container: c.Id,
+				})
+				c.supervisionMu.Unlock()
+			}
+		}
+	}
+	return true, nil
+}
+
+// resumedReady returns whether READY was already signaled before
+// systemd-docker was re-executed.
+func (c *Context) resumedReady() bool {
+	return c.resumed != nil && c.resumed.Ready
+}
+
+// confirmHealthy records that the health of the container was confirmed,
+// so that the confirmation survives restarts of systemd-docker, and returns
+// the time of the confirmation.
+func confirmHealthy(c *Context) time.Time {
+	now := time.Now()
+	c.phases.mu.Lock()
+	c.phases.lastHealthy = now
+	c.phases.mu.Unlock()
+	return now
+}
+
+// lastConfirmedHealthy returns when the health of the container was last
+// confirmed before systemd-docker was restarted, or now if it was not.
+func (c *Context) lastConfirmedHealthy() time.Time {
+	if c.resumed != nil && c.resumed.Ready && !c.resumed.LastHealthy.IsZero() {
+		return c.resumed.LastHealthy
+	}
+	return time.Now()
+}
@@ -0,0 +1,182 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// defaultRegistry is the key of Docker Hub in docker config files and for
+// credential helpers.
+const defaultRegistry = "https://index.docker.io/v1/"
+
+// dockerConfigFile is the part of a docker config file holding the
+// credentials of registries.
+type dockerConfigFile struct {
+	Auths       map[string]json.RawMessage `json:"auths"`
+	CredsStore  string                     `json:"credsStore"`
+	CredHelpers map[string]string          `json:"credHelpers"`
+}
+
+// ValidateRegistryAuthFile checks that the --registry-auth-file can be read
+// and parsed.
+func ValidateRegistryAuthFile(c *Context) error {
+	if len(c.RegistryAuthFile) == 0 {
+		return nil
+	}
+	if _, err := readDockerConfigFile(c.RegistryAuthFile); err != nil {
+		return fmt.Errorf("registry auth file '%s' cannot be read: %v", c.RegistryAuthFile, err)
+	}
+	return nil
+}
+
+// registryAuth returns the credentials for the registry of the repository,
+// from the --registry-auth-file or else the config of the docker CLI.  Like
+// the docker CLI, the credential helper of the registry is asked first, then
+// the credential store, and finally the credentials stored in the file.
+func registryAuth(c *Context, repository string) docker.AuthConfiguration {
+	registry := defaultRegistry
+	if parts := strings.SplitN(repository, "/", 2); len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry = parts[0]
+	}
+
+	paths := []string{filepath.Join(c.Docker.ConfigDir(), "config.json")}
+	if len(c.RegistryAuthFile) > 0 {
+		paths = append([]string{c.RegistryAuthFile}, paths...)
+	}
+	for _, path := range paths {
+		config, err := readDockerConfigFile(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				c.Log.Warnf("Failed to read registry credentials from '%s': %s\n", path, err)
+			}
+			continue
+		}
+		auth, found, err := config.lookup(c, path, registry)
+		if err != nil {
+			c.Log.Warnf("Failed to get credentials of registry '%s' from '%s': %s\n", registry, path, err)
+			continue
+		}
+		if found {
+			c.Log.Debugf("Using credentials of registry '%s' from '%s'\n", registry, path)
+			return auth
+		}
+	}
+	return docker.AuthConfiguration{}
+}
+
+func readDockerConfigFile(path string) (*dockerConfigFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config dockerConfigFile
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// lookup returns the credentials of the registry from the credential helpers
+// or the stored credentials of the config file.
+func (f *dockerConfigFile) lookup(c *Context, path string, registry string) (docker.AuthConfiguration, bool, error) {
+	host := registryHost(registry)
+	for key, helper := range f.CredHelpers {
+		if registryHost(key) == host {
+			return credentialHelperAuth(c, helper, key)
+		}
+	}
+	if len(f.CredsStore) > 0 {
+		if auth, found, err := credentialHelperAuth(c, f.CredsStore, registry); err != nil || found {
+			return auth, found, err
+		}
+	}
+
+	for key, raw := range f.Auths {
+		if registryHost(key) != host {
+			continue
+		}
+		// decoded like the docker CLI does, as the file may hold the
+		// credentials in the auth, identitytoken or registrytoken fields
+		data, err := json.Marshal(map[string]json.RawMessage{key: raw})
+		if err != nil {
+			return docker.AuthConfiguration{}, false, err
+		}
+		configs, err := docker.NewAuthConfigurations(bytes.NewReader(data))
+		if err != nil {
+			return docker.AuthConfiguration{}, false, err
+		}
+		if auth, ok := configs.Configs[key]; ok {
+			return auth, true, nil
+		}
+	}
+	return docker.AuthConfiguration{}, false, nil
+}
+
+// credentialHelperAuth returns the credentials of the registry from the
+// docker-credential-<HELPER> program.  Credentials which the helper does not
+// know about are not found rather than an error.
+func credentialHelperAuth(c *Context, helper string, registry string) (docker.AuthConfiguration, bool, error) {
+	cmd := exec.Command(fmt.Sprintf("docker-credential-%s", helper), "get")
+	cmd.Stdin = strings.NewReader(registry)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(output, "credentials not found") {
+			return docker.AuthConfiguration{}, false, nil
+		}
+		return docker.AuthConfiguration{}, false, fmt.Errorf("credential helper '%s' failed: %v: %s", helper, err, output)
+	}
+
+	var credentials struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &credentials); err != nil {
+		return docker.AuthConfiguration{}, false, fmt.Errorf("failed to parse the output of credential helper '%s': %v", helper, err)
+	}
+	auth := docker.AuthConfiguration{ServerAddress: registry}
+	if credentials.Username == "<token>" {
+		// helpers return identity tokens with this username
+		auth.IdentityToken = credentials.Secret
+	} else {
+		auth.Username = credentials.Username
+		auth.Password = credentials.Secret
+	}
+	return auth, true, nil
+}
+
+// registryHost returns the host of the registry key of a docker config
+// file, which may be a URL, with the aliases of Docker Hub resolved.
+func registryHost(key string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+	switch host {
+	case "docker.io", "registry-1.docker.io":
+		return "index.docker.io"
+	}
+	return host
+}
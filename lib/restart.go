@@ -0,0 +1,74 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	RestartCheckWarn = "warn"
+	RestartCheckFail = "fail"
+)
+
+// CheckRestartPolicy handles a docker --restart policy, which was stripped
+// from the docker run arguments.  Docker restarting the container while
+// systemd also restarts the unit leads to duplicate containers and a stale
+// MAINPID, so restarting is left to systemd.  Depending on --restart-check,
+// either a warning with the equivalent systemd configuration is logged or an
+// error is returned.
+func CheckRestartPolicy(c *Context) error {
+	if len(c.DockerRestart) == 0 || c.DockerRestart == "no" {
+		return nil
+	}
+
+	equivalent, err := systemdRestart(c.DockerRestart)
+	if err != nil {
+		return err
+	}
+
+	if c.RestartCheck == RestartCheckFail {
+		return fmt.Errorf("docker flag 'restart=%s' conflicts with systemd restarting the unit, remove it and use '%s' in the unit instead", c.DockerRestart, equivalent)
+	}
+
+	if runningUnderSystemd() {
+		if unit, properties, err := getUnitProperties(c); err == nil {
+			if restart, ok := properties["Restart"].(string); ok && restart != "no" {
+				c.Log.Infof("Ignoring docker flag 'restart=%s', unit '%s' is restarted by systemd with Restart=%s\n", c.DockerRestart, unit, restart)
+				return nil
+			}
+		}
+	}
+	c.Log.Warnf("Ignoring docker flag 'restart=%s', use '%s' in the unit instead\n", c.DockerRestart, equivalent)
+	return nil
+}
+
+// systemdRestart returns the systemd configuration equivalent to the docker
+// restart policy.
+func systemdRestart(policy string) (string, error) {
+	parts := strings.SplitN(policy, ":", 2)
+	switch parts[0] {
+	case "always", "unless-stopped":
+		return "Restart=always", nil
+	case "on-failure":
+		if len(parts) == 2 {
+			return fmt.Sprintf("Restart=on-failure and StartLimitBurst=%s", parts[1]), nil
+		}
+		return "Restart=on-failure", nil
+	}
+	return "", fmt.Errorf("unsupported docker restart policy '%s'", policy)
+}
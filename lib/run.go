@@ -0,0 +1,503 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Run runs and supervises the container described by the docker run
+// arguments, until it exits or the context is shut down.
+func Run(c *Context, args []string) (err error) {
+	defer func() {
+		WriteFailure(c, err)
+	}()
+
+	if c.ExpandEnv {
+		// the command of the container is left to the container
+		end, _ := FindImage(args)
+		if end < 0 {
+			end = len(args) - 1
+		}
+		expanded, err := ExpandEnvironment(args[:end+1], os.LookupEnv)
+		if err != nil {
+			return err
+		}
+		args = append(expanded, args[end+1:]...)
+	}
+
+	newArgs := make([]string, 0, len(args))
+
+	logTagSpecified := false
+	skipNext := false
+	for i, arg := range args {
+		if skipNext {
+			skipNext = false
+			continue
+		}
+		add := true
+
+		switch {
+		case strings.HasPrefix(arg, "-rm") || strings.HasPrefix(arg, "--rm"):
+			if strings.Contains(arg, "=") {
+				if rm, err := strconv.ParseBool(strings.SplitN(arg, "=", 2)[1]); err != nil {
+					return errors.Errorf("")
+				} else if rm {
+					c.Rm = true
+				}
+			} else {
+				c.Rm = true
+			}
+			add = false
+		case strings.HasPrefix(arg, "-restart") || strings.HasPrefix(arg, "--restart"):
+			if strings.Contains(arg, "=") {
+				c.DockerRestart = strings.SplitN(arg, "=", 2)[1]
+			} else if len(args) > i+1 {
+				c.DockerRestart = args[i+1]
+				skipNext = true
+			}
+			add = false
+		case arg == "-d" || arg == "-detach" || arg == "--detach":
+			c.Log.Warnf("docker flag 'detach' is ignored")
+			add = false
+		case strings.HasPrefix(arg, "-name") || strings.HasPrefix(arg, "--name"):
+			if strings.Contains(arg, "=") {
+				c.Name = strings.SplitN(arg, "=", 2)[1]
+			} else if len(args) > i+1 {
+				c.Name = args[i+1]
+			}
+		case strings.HasPrefix(arg, "-platform") || strings.HasPrefix(arg, "--platform"):
+			if strings.Contains(arg, "=") {
+				c.Platform = strings.SplitN(arg, "=", 2)[1]
+			} else if len(args) > i+1 {
+				c.Platform = args[i+1]
+			}
+		case strings.HasPrefix(arg, "-pull") || strings.HasPrefix(arg, "--pull"):
+			if c.Offline {
+				return fmt.Errorf("docker flag 'pull' cannot be used with 'offline'")
+			}
+			if len(c.PullPolicy) > 0 {
+				return fmt.Errorf("docker flag 'pull' cannot be used with 'pull-policy'")
+			}
+		case strings.HasPrefix(arg, "-log-driver") || strings.HasPrefix(arg, "--log-driver"):
+			c.Log.Warnf("docker flag 'log-driver' is ignored")
+			add = false
+		case strings.HasPrefix(arg, "-log-opt") || strings.HasPrefix(arg, "--log-opt"):
+			var value string
+			if strings.Contains(arg, "=") {
+				value = strings.SplitN(arg, "=", 2)[1]
+			} else if len(args) > i+1 {
+				value = args[i+1]
+			}
+			if strings.HasPrefix(value, "tag=") {
+				logTagSpecified = true
+			}
+		}
+		if add {
+			newArgs = append(newArgs, arg)
+		}
+	}
+
+	if len(c.Name) == 0 && len(c.AdoptId) == 0 {
+		return fmt.Errorf("required docker flag 'name' is not set")
+	}
+
+	if c.SwarmService {
+		switch {
+		case len(c.AdoptId) > 0:
+			return fmt.Errorf("flag 'id' cannot be used with 'swarm-service'")
+		case c.Networks.Len() > 0 || len(c.CniNetworks) > 0:
+			return fmt.Errorf("additional networks cannot be joined with 'swarm-service', use the docker flag 'network' instead")
+		case c.Offline:
+			return fmt.Errorf("flag 'offline' cannot be used with 'swarm-service'")
+		case len(c.EncryptedEnvFiles) > 0:
+			return fmt.Errorf("flag 'encrypted-env-file' cannot be used with 'swarm-service'")
+		case len(c.PullPolicy) > 0:
+			return fmt.Errorf("flag 'pull-policy' cannot be used with 'swarm-service'")
+		}
+	}
+
+	if len(c.diskUsageLimit) > 0 {
+		limit, err := units.RAMInBytes(c.diskUsageLimit)
+		if err != nil {
+			return fmt.Errorf("disk usage limit '%s' has a wrong format", c.diskUsageLimit)
+		}
+		c.DiskUsageLimit = limit
+	}
+
+	size, err := units.RAMInBytes(c.logBufferSize)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("log buffer size '%s' has a wrong format", c.logBufferSize)
+	}
+	c.LogBufferSize = int(size)
+
+	maxSize, err := units.RAMInBytes(c.logFileMaxSize)
+	if err != nil || maxSize <= 0 {
+		return fmt.Errorf("log file max size '%s' has a wrong format", c.logFileMaxSize)
+	}
+	c.LogFileMaxSize = maxSize
+
+	if err := ValidateLogFile(c); err != nil {
+		return err
+	}
+
+	if c.EventQueueSize <= 0 {
+		return fmt.Errorf("event queue size '%d' is not positive", c.EventQueueSize)
+	}
+
+	if c.WatchdogCheck != WatchdogCheckWarn && c.WatchdogCheck != WatchdogCheckFail {
+		return fmt.Errorf("unsupported watchdog check '%s'", c.WatchdogCheck)
+	}
+
+	if c.WatchdogTriggerFailures < 0 {
+		return fmt.Errorf("watchdog trigger failures '%d' is negative", c.WatchdogTriggerFailures)
+	}
+
+	if c.MaxRuntimeExitCode < 0 || c.MaxRuntimeExitCode > 255 {
+		return fmt.Errorf("max runtime exit code '%d' is not between 0 and 255", c.MaxRuntimeExitCode)
+	}
+
+	if c.StaleContainer != StaleContainerFail && c.StaleContainer != StaleContainerAdopt {
+		return fmt.Errorf("unsupported stale container action '%s'", c.StaleContainer)
+	}
+
+	if c.RestartCheck != RestartCheckWarn && c.RestartCheck != RestartCheckFail {
+		return fmt.Errorf("unsupported restart check '%s'", c.RestartCheck)
+	}
+	if err := CheckRestartPolicy(c); err != nil {
+		return err
+	}
+
+	if err := ValidateEngine(c); err != nil {
+		return err
+	}
+	if _, err := c.GetEngine(); err != nil {
+		return err
+	}
+	if err := ValidateDaemonless(c); err != nil {
+		return err
+	}
+
+	if err := ValidateUnitMetadata(c); err != nil {
+		return err
+	}
+
+	if err := ValidateCleanup(c); err != nil {
+		return err
+	}
+
+	if err := ValidateDeviceHotplug(c); err != nil {
+		return err
+	}
+
+	if err := ValidateProbes(c); err != nil {
+		return err
+	}
+
+	if err := ValidateEnsureInit(c); err != nil {
+		return err
+	}
+
+	if err := ValidateLimitCheck(c); err != nil {
+		return err
+	}
+
+	if err := ValidateRegistryMirrors(c); err != nil {
+		return err
+	}
+
+	if err := ValidatePullPolicy(c); err != nil {
+		return err
+	}
+
+	if err := ValidatePullRetries(c); err != nil {
+		return err
+	}
+
+	if err := ValidateRegistryAuthFile(c); err != nil {
+		return err
+	}
+
+	if err := ValidateVerifySignature(c); err != nil {
+		return err
+	}
+
+	if err := ValidateExpectedDigest(c); err != nil {
+		return err
+	}
+
+	if err := ValidateReadyGates(c); err != nil {
+		return err
+	}
+
+	if _, err := ParseMonitorEvents(c.MonitorEvents); err != nil {
+		return err
+	}
+
+	if err := ValidateGroup(c); err != nil {
+		return err
+	}
+
+	switch c.Firewall {
+	case "", FirewallNftables, FirewallFirewalld:
+	default:
+		return fmt.Errorf("unsupported firewall '%s'", c.Firewall)
+	}
+
+	if err := ValidateTrafficShaping(c); err != nil {
+		return err
+	}
+
+	if !c.embedded {
+		c.NotifySocket = os.Getenv("NOTIFY_SOCKET")
+	}
+	if c.flags == nil || !c.flags.Changed("user-manager") {
+		c.UserManager = IsUserManager()
+	}
+	ConfigureUserManager(c)
+	c.Args = newArgs
+	_, c.Image = FindImage(c.Args)
+
+	if err := ValidatePrivileges(c); err != nil {
+		return err
+	}
+
+	for _, val := range c.Cgroups {
+		if val == "all" {
+			c.Cgroups = nil
+			c.AllCgroups = true
+			break
+		}
+	}
+
+	var autoArgs []string
+	if c.Logs && len(c.SyslogIdentifier) > 0 {
+		autoArgs = append(autoArgs, "--log-driver", "local")
+	} else if c.Logs {
+		autoArgs = append(autoArgs, "--log-driver", "journald")
+		if !logTagSpecified {
+			autoArgs = append(autoArgs, "--log-opt", fmt.Sprintf("tag=%s", c.Name))
+		}
+	}
+	if c.Notify {
+		if len(c.NotifySocket) > 0 {
+			if len(c.NotifyBridge) > 0 {
+				bridgeArgs, err := NotifyBridgeArgs(c)
+				if err != nil {
+					return err
+				}
+				autoArgs = append(autoArgs, bridgeArgs...)
+			} else {
+				autoArgs = append(autoArgs, "-e", fmt.Sprintf("NOTIFY_SOCKET=%s", c.NotifySocket))
+				if c.SwarmService {
+					autoArgs = append(autoArgs, "--mount", fmt.Sprintf("type=bind,source=%s,target=%s", c.NotifySocket, c.NotifySocket))
+				} else {
+					autoArgs = append(autoArgs, "-v", fmt.Sprintf("%s:%s", c.NotifySocket, c.NotifySocket))
+				}
+			}
+		} else {
+			c.Log.Warnf("No NOTIFY_SOCKET found, 'notify' flag will have no effect")
+		}
+	} else {
+		c.Notify = false
+	}
+
+	if c.Offline {
+		autoArgs = append(autoArgs, "--pull", PullPolicyNever)
+	} else if len(c.PullPolicy) > 0 {
+		autoArgs = append(autoArgs, "--pull", c.PullPolicy)
+	}
+
+	autoArgs = append(autoArgs, ManagedLabelArgs(c)...)
+	autoArgs = append(autoArgs, UnitMetadataArgs(c)...)
+	autoArgs = append(autoArgs, ReadOnlyArgs(c)...)
+
+	hostnameArgs, err := HostnameArgs(c)
+	if err != nil {
+		return err
+	}
+	autoArgs = append(autoArgs, hostnameArgs...)
+
+	if c.Env {
+		environ, err := InheritedEnvironment(c, os.Environ())
+		if err != nil {
+			return err
+		}
+		for _, val := range environ {
+			autoArgs = append(autoArgs, "-e", val)
+		}
+	}
+
+	encryptedEnvArgs, err := EncryptedEnvArgs(c)
+	if err != nil {
+		return err
+	}
+	autoArgs = append(autoArgs, encryptedEnvArgs...)
+
+	if len(autoArgs) > 0 {
+		c.Args = append(autoArgs, c.Args...)
+	}
+
+	if !c.embedded {
+		stopHandlingSignals := HandleSignals(c)
+		defer stopHandlingSignals()
+	}
+
+	err = ResumeState(c)
+	if err != nil {
+		return err
+	}
+
+	err = LoadFdStore(c)
+	if err != nil {
+		return err
+	}
+
+	err = LoadRuntimeState(c)
+	if err != nil {
+		return err
+	}
+
+	err = StartStatsD(c)
+	if err != nil {
+		return err
+	}
+
+	stopMetricsServer, err := StartMetricsServer(c)
+	if err != nil {
+		return err
+	}
+	defer stopMetricsServer()
+
+	stopNotifyBridge, err := StartNotifyBridge(c)
+	if err != nil {
+		return err
+	}
+	defer stopNotifyBridge()
+
+	err = PreflightUnit(c)
+	if err != nil {
+		return err
+	}
+
+	err = WaitForDaemon(c)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = DetachCniNetworks(c)
+	}()
+	err = RunContainer(c)
+	if err != nil {
+		return err
+	}
+	ClearFailure(c)
+
+	err = MoveCgroups(c)
+	if err != nil {
+		return err
+	}
+
+	defer StopMonitor(c)
+	err = Notify(c)
+	if err != nil {
+		return err
+	}
+
+	if !c.embedded {
+		stopHandlingReexec := HandleReexec(c)
+		defer stopHandlingReexec()
+	}
+
+	stopFdStore := StartFdStore(c)
+	defer stopFdStore()
+
+	stopRuntimeState := StartRuntimeState(c)
+	defer stopRuntimeState()
+
+	err = WritePidFile(c)
+	if err != nil {
+		return err
+	}
+
+	err = WriteEnvFile(c)
+	if err != nil {
+		return err
+	}
+
+	err = WriteIpFile(c)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = RemoveIpFile(c)
+	}()
+
+	WriteStateFile(c)
+	defer RemoveStateFile(c)
+
+	defer func() {
+		_ = RemoveFirewallRules(c)
+	}()
+	err = AddFirewallRules(c)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = RemoveTrafficShaping(c)
+	}()
+	err = ApplyTrafficShaping(c)
+	if err != nil {
+		return err
+	}
+
+	DropCapabilities(c)
+
+	stopDiskUsageMonitor := StartDiskUsageMonitor(c)
+	stopDeviceMonitor := StartDeviceMonitor(c)
+	stopPipeLogs := PipeLogs(c)
+	err = WaitForContainerExit(c)
+	notifyStopping(c)
+	stopPipeLogs()
+	stopDeviceMonitor()
+	stopDiskUsageMonitor()
+	RecordVolumeUse(c)
+	if err == ErrShutdown {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = BackupVolumes(c)
+	if err != nil {
+		return err
+	}
+
+	err = RemoveContainer(c)
+	if err != nil {
+		return err
+	}
+
+	return ContainerExitError(c)
+}
@@ -0,0 +1,43 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"time"
+)
+
+// maxRuntimeDeadline returns a channel which fires once the container has run
+// for --max-runtime, or nil without a maximum runtime.  The runtime counts
+// from when the container was started, so that adopting the container or
+// restarting systemd-docker does not extend it.
+func maxRuntimeDeadline(c *Context, engine ContainerEngine) <-chan time.Time {
+	if c.MaxRuntime <= 0 {
+		return nil
+	}
+
+	started := time.Now()
+	container, err := engine.Inspect(c, c.Id)
+	if err == nil && !container.State.StartedAt.IsZero() {
+		started = container.State.StartedAt
+	}
+
+	remaining := c.MaxRuntime - time.Since(started)
+	if remaining < 0 {
+		remaining = 0
+	}
+	c.Log.Infof("Container '%s' will be stopped after its maximum runtime of %s, at %s\n", c.Name, c.MaxRuntime, started.Add(c.MaxRuntime).Format(time.RFC3339))
+	return time.After(remaining)
+}
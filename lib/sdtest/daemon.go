@@ -0,0 +1,360 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sdtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	dockerTesting "github.com/fsouza/go-dockerclient/testing"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	startPath     = regexp.MustCompile(`^(/v[0-9.]+)?/containers/([^/]+)/start$`)
+	stopPath      = regexp.MustCompile(`^(/v[0-9.]+)?/containers/([^/]+)/(stop|kill)$`)
+	containerPath = regexp.MustCompile(`^(/v[0-9.]+)?/containers/([^/]+)$`)
+	eventsPath    = regexp.MustCompile(`^(/v[0-9.]+)?/events$`)
+)
+
+// Daemon is the docker daemon lifecycle tests run against, either a real
+// daemon or an in-process fake.
+type Daemon struct {
+	host      string
+	server    *dockerTesting.DockerServer
+	mu        sync.Mutex
+	processes map[string]*process
+	listeners map[chan docker.APIEvents]struct{}
+	done      chan struct{}
+}
+
+// process backs a container started by the fake daemon.
+type process struct {
+	cmd      *exec.Cmd
+	exitCode int
+	exited   chan struct{}
+}
+
+// NewFakeDaemon starts an in-process fake of the docker API on a random
+// local port.  Each started container is backed by a sleep process, so that
+// it has a real pid, and dies with a 'die' event once the process exits.
+func NewFakeDaemon() (*Daemon, error) {
+	server, err := dockerTesting.NewServer("127.0.0.1:0", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	host := fmt.Sprintf("tcp://%s", strings.TrimSuffix(strings.TrimPrefix(server.URL(), "http://"), "/"))
+	d := &Daemon{
+		host:      host,
+		server:    server,
+		processes: map[string]*process{},
+		listeners: map[chan docker.APIEvents]struct{}{},
+		done:      make(chan struct{}),
+	}
+	server.CustomHandler(startPath.String(), http.HandlerFunc(d.startContainer))
+	server.CustomHandler(stopPath.String(), http.HandlerFunc(d.stopContainer))
+	server.CustomHandler(containerPath.String(), http.HandlerFunc(d.removeContainer))
+	server.CustomHandler(eventsPath.String(), http.HandlerFunc(d.streamEvents))
+	return d, nil
+}
+
+// RealDaemon returns the daemon listening on host, f.ex.
+// 'unix:///var/run/docker.sock'.
+func RealDaemon(host string) *Daemon {
+	return &Daemon{host: host}
+}
+
+// Host returns the endpoint of the daemon, to be passed as DOCKER_HOST.
+func (d *Daemon) Host() string {
+	return d.host
+}
+
+// Fake returns the fake daemon, to prepare failures or mutate the state of
+// containers, or nil for a real daemon.
+func (d *Daemon) Fake() *dockerTesting.DockerServer {
+	return d.server
+}
+
+// Client returns an API client of the daemon.
+func (d *Daemon) Client() (*docker.Client, error) {
+	return docker.NewClient(d.host)
+}
+
+// Exit lets the container started by the fake daemon exit with the exit
+// code, and waits for it to be recorded.
+func (d *Daemon) Exit(id string, exitCode int) error {
+	container, err := d.inspect(id)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	p, ok := d.processes[container.ID]
+	if ok {
+		p.exitCode = exitCode
+	}
+	d.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("container '%s' is not running", id)
+	}
+	_ = p.cmd.Process.Kill()
+	<-p.exited
+	return nil
+}
+
+// Close stops a fake daemon and kills the processes of its containers.
+func (d *Daemon) Close() {
+	if d.server == nil {
+		return
+	}
+	d.server.Stop()
+	close(d.done)
+	d.mu.Lock()
+	var processes []*process
+	for _, p := range d.processes {
+		processes = append(processes, p)
+	}
+	d.mu.Unlock()
+	for _, p := range processes {
+		_ = p.cmd.Process.Kill()
+		<-p.exited
+	}
+}
+
+// inspect returns the container from the fake daemon.
+func (d *Daemon) inspect(id string) (*docker.Container, error) {
+	recorder := httptest.NewRecorder()
+	d.server.DefaultHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/containers/"+id+"/json", nil))
+	if recorder.Code != http.StatusOK {
+		return nil, fmt.Errorf("no such container '%s'", id)
+	}
+	var container docker.Container
+	if err := json.NewDecoder(recorder.Body).Decode(&container); err != nil {
+		return nil, err
+	}
+	return &container, nil
+}
+
+// startContainer starts the process backing the container once the fake
+// started the container, before responding, so that the client never sees
+// a made up pid.
+func (d *Daemon) startContainer(w http.ResponseWriter, r *http.Request) {
+	recorder := httptest.NewRecorder()
+	d.server.DefaultHandler().ServeHTTP(recorder, r)
+	defer func() {
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(recorder.Code)
+		_, _ = w.Write(recorder.Body.Bytes())
+	}()
+	if recorder.Code >= 300 {
+		return
+	}
+
+	container, err := d.inspect(startPath.FindStringSubmatch(r.URL.Path)[2])
+	if err != nil {
+		recorder = httptest.NewRecorder()
+		http.Error(recorder, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cmd := exec.Command("sleep", "3600")
+	if err = cmd.Start(); err != nil {
+		recorder = httptest.NewRecorder()
+		http.Error(recorder, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	state := container.State
+	state.Pid = cmd.Process.Pid
+	_ = d.server.MutateContainer(container.ID, state)
+
+	p := &process{cmd: cmd, exitCode: -1, exited: make(chan struct{})}
+	d.mu.Lock()
+	d.processes[container.ID] = p
+	d.mu.Unlock()
+	go d.wait(container, p)
+}
+
+// wait records the exit of the process backing the container, and sends the
+// 'die' event.
+func (d *Daemon) wait(container *docker.Container, p *process) {
+	err := p.cmd.Wait()
+
+	d.mu.Lock()
+	delete(d.processes, container.ID)
+	exitCode := p.exitCode
+	d.mu.Unlock()
+	if exitCode < 0 {
+		exitCode = 0
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				exitCode = 128 + int(status.Signal())
+			}
+		}
+	}
+
+	if current, err := d.inspect(container.ID); err == nil {
+		state := current.State
+		state.Running = false
+		state.Pid = 0
+		state.ExitCode = exitCode
+		state.FinishedAt = time.Now()
+		_ = d.server.MutateContainer(container.ID, state)
+	}
+	close(p.exited)
+
+	now := time.Now()
+	d.publish(docker.APIEvents{
+		Status: "die",
+		ID:     container.ID,
+		From:   container.Config.Image,
+		Type:   "container",
+		Action: "die",
+		Actor: docker.APIActor{
+			ID: container.ID,
+			Attributes: map[string]string{
+				"name":     strings.TrimPrefix(container.Name, "/"),
+				"exitCode": strconv.Itoa(exitCode),
+			},
+		},
+		Time:     now.Unix(),
+		TimeNano: now.UnixNano(),
+	})
+}
+
+// stopContainer stops or kills the process backing the container, like the
+// daemon does.
+func (d *Daemon) stopContainer(w http.ResponseWriter, r *http.Request) {
+	match := stopPath.FindStringSubmatch(r.URL.Path)
+	container, err := d.inspect(match[2])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	d.mu.Lock()
+	p, ok := d.processes[container.ID]
+	d.mu.Unlock()
+	if !ok {
+		http.Error(w, "Container not running", http.StatusNotModified)
+		return
+	}
+
+	if match[3] == "kill" {
+		_ = p.cmd.Process.Kill()
+	} else {
+		_ = p.cmd.Process.Signal(syscall.SIGTERM)
+	}
+	<-p.exited
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeContainer kills the process backing a force removed container.
+func (d *Daemon) removeContainer(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete && r.URL.Query().Get("force") != "" {
+		if container, err := d.inspect(containerPath.FindStringSubmatch(r.URL.Path)[2]); err == nil {
+			d.mu.Lock()
+			p, ok := d.processes[container.ID]
+			d.mu.Unlock()
+			if ok {
+				_ = p.cmd.Process.Kill()
+				<-p.exited
+			}
+		}
+	}
+	d.server.DefaultHandler().ServeHTTP(w, r)
+}
+
+// streamEvents streams the 'die' events of containers, filtered by the
+// 'container' filter like the daemon does.
+func (d *Daemon) streamEvents(w http.ResponseWriter, r *http.Request) {
+	var filters map[string][]string
+	if value := r.URL.Query().Get("filters"); len(value) > 0 {
+		if err := json.Unmarshal([]byte(value), &filters); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	events := make(chan docker.APIEvents, 16)
+	d.mu.Lock()
+	d.listeners[events] = struct{}{}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.listeners, events)
+		d.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case event := <-events:
+			if !matchesContainer(filters["container"], event) {
+				continue
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// publish sends the event to all event streams.
+func (d *Daemon) publish(event docker.APIEvents) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for listener := range d.listeners {
+		select {
+		case listener <- event:
+		default:
+		}
+	}
+}
+
+func matchesContainer(containers []string, event docker.APIEvents) bool {
+	if len(containers) == 0 {
+		return true
+	}
+	for _, container := range containers {
+		if container == event.Actor.ID || container == event.Actor.Attributes["name"] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sdtest provides an integration layer for lifecycle tests of
+// systemd-docker: a NOTIFY_SOCKET server recording the notifications systemd
+// would receive, and a real or fake docker daemon to run containers against.
+package sdtest
+
+import (
+	"github.com/kadaan/systemd-docker/lib"
+	"os"
+	"os/exec"
+)
+
+// Harness is the environment of a lifecycle test.
+type Harness struct {
+	Notify *NotifyServer
+	Daemon *Daemon
+}
+
+// New returns a harness running against the daemon, which is closed along
+// with the harness.
+func New(daemon *Daemon) (*Harness, error) {
+	notify, err := NewNotifyServer()
+	if err != nil {
+		return nil, err
+	}
+	return &Harness{Notify: notify, Daemon: daemon}, nil
+}
+
+// NewFake returns a harness running against a fake daemon.
+func NewFake() (*Harness, error) {
+	daemon, err := NewFakeDaemon()
+	if err != nil {
+		return nil, err
+	}
+	h, err := New(daemon)
+	if err != nil {
+		daemon.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+// Context returns a context for driving the lib functions directly, which
+// notifies the harness and uses its daemon.
+func (h *Harness) Context(name string, args ...string) *lib.Context {
+	c := &lib.Context{
+		Args:         args,
+		Name:         name,
+		NotifySocket: h.Notify.Socket(),
+		Log:          lib.NewLogger(),
+	}
+	c.Docker.Host = h.Daemon.Host()
+	return c
+}
+
+// Environ returns the environment of a systemd-docker process run by the
+// harness.
+func (h *Harness) Environ() []string {
+	return append(os.Environ(),
+		"NOTIFY_SOCKET="+h.Notify.Socket(),
+		"DOCKER_HOST="+h.Daemon.Host(),
+	)
+}
+
+// Command returns the command running the systemd-docker binary with the
+// arguments in the environment of the harness.
+func (h *Harness) Command(binary string, args ...string) *exec.Cmd {
+	cmd := exec.Command(binary, args...)
+	cmd.Env = h.Environ()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// Close stops the notify server and the daemon.
+func (h *Harness) Close() error {
+	h.Daemon.Close()
+	return h.Notify.Close()
+}
@@ -0,0 +1,166 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sdtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NotifyServer is a NOTIFY_SOCKET server recording the messages sent by
+// systemd-docker and the container, like systemd would receive them.
+type NotifyServer struct {
+	directory string
+	conn      *net.UnixConn
+	mu        sync.Mutex
+	messages  []string
+	changed   chan struct{}
+	done      chan struct{}
+}
+
+// NewNotifyServer listens on a datagram socket in a new temporary directory.
+func NewNotifyServer() (*NotifyServer, error) {
+	directory, err := ioutil.TempDir("", "sdtest")
+	if err != nil {
+		return nil, err
+	}
+
+	socket := filepath.Join(directory, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		_ = os.RemoveAll(directory)
+		return nil, err
+	}
+	// the container may run as any user
+	_ = os.Chmod(socket, 0777)
+
+	s := &NotifyServer{
+		directory: directory,
+		conn:      conn,
+		changed:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *NotifyServer) serve() {
+	defer close(s.done)
+	buf := make([]byte, 4096)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		// a datagram can carry several newline-separated assignments
+		for _, message := range strings.Split(strings.TrimSpace(string(buf[:n])), "\n") {
+			if len(message) > 0 {
+				s.messages = append(s.messages, message)
+			}
+		}
+		close(s.changed)
+		s.changed = make(chan struct{})
+		s.mu.Unlock()
+	}
+}
+
+// Socket returns the path of the socket, to be passed as NOTIFY_SOCKET.
+func (s *NotifyServer) Socket() string {
+	return s.conn.LocalAddr().String()
+}
+
+// Messages returns the messages received so far, in the order they were
+// received, one assignment each, f.ex. 'READY=1'.
+func (s *NotifyServer) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+// Values returns the values assigned to the variable by the messages
+// received so far, f.ex. the pids of MAINPID.
+func (s *NotifyServer) Values(name string) []string {
+	var result []string
+	for _, message := range s.Messages() {
+		if strings.HasPrefix(message, name+"=") {
+			result = append(result, strings.TrimPrefix(message, name+"="))
+		}
+	}
+	return result
+}
+
+// WaitFor waits for up to timeout for a message starting with prefix, and
+// returns the first one.
+func (s *NotifyServer) WaitFor(prefix string, timeout time.Duration) (string, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		for _, message := range s.messages {
+			if strings.HasPrefix(message, prefix) {
+				s.mu.Unlock()
+				return message, nil
+			}
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-s.done:
+			return "", fmt.Errorf("notify server closed while waiting for '%s'", prefix)
+		case <-deadline:
+			return "", fmt.Errorf("no message '%s' within %s, received %s", prefix, timeout, strings.Join(s.Messages(), ","))
+		}
+	}
+}
+
+// Sequence checks that messages starting with each of the prefixes were
+// received in the given order, f.ex. MAINPID before READY=1.
+func (s *NotifyServer) Sequence(prefixes ...string) error {
+	messages := s.Messages()
+	i := 0
+	for _, message := range messages {
+		if i < len(prefixes) && strings.HasPrefix(message, prefixes[i]) {
+			i++
+		}
+	}
+	if i < len(prefixes) {
+		return fmt.Errorf("no message '%s' in order, received %s", prefixes[i], strings.Join(messages, ","))
+	}
+	return nil
+}
+
+// Reset forgets the messages received so far.
+func (s *NotifyServer) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = nil
+}
+
+// Close stops the server and removes its socket.
+func (s *NotifyServer) Close() error {
+	err := s.conn.Close()
+	<-s.done
+	_ = os.RemoveAll(s.directory)
+	return err
+}
@@ -0,0 +1,171 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	apparmorEnabledFile  = "/sys/module/apparmor/parameters/enabled"
+	apparmorProfilesFile = "/sys/kernel/security/apparmor/profiles"
+	selinuxEnforceFile   = "/sys/fs/selinux/enforce"
+)
+
+// validateSecurityProfiles checks that the seccomp profiles, AppArmor
+// profiles and SELinux labels passed with the docker run flag security-opt
+// exist on the host, so that a typo fails with an actionable error instead of
+// an opaque one from docker.  Relative seccomp profile paths are resolved
+// against the working directory of the unit, and replaced with the absolute
+// path in the docker run arguments.
+func validateSecurityProfiles(c *Context) error {
+	end, _ := FindImage(c.Args)
+	if end < 0 {
+		end = len(c.Args)
+	}
+
+	for i := 0; i < end; i++ {
+		index := i
+		value := ""
+		if c.Args[i] == "--security-opt" && i+1 < end {
+			index = i + 1
+			value = c.Args[index]
+			i++
+		} else if strings.HasPrefix(c.Args[i], "--security-opt=") {
+			value = strings.TrimPrefix(c.Args[i], "--security-opt=")
+		} else {
+			continue
+		}
+
+		// docker still accepts ':' as the separator for compatibility
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			parts = strings.SplitN(value, ":", 2)
+		}
+		if len(parts) != 2 {
+			continue
+		}
+
+		var err error
+		switch parts[0] {
+		case "seccomp":
+			var profile string
+			profile, err = validateSeccompProfile(c, parts[1])
+			if err == nil && profile != parts[1] {
+				c.Log.Debugf("Resolved seccomp profile '%s' of container '%s' to '%s'\n", parts[1], c.Name, profile)
+				c.Args[index] = strings.TrimSuffix(c.Args[index], value) + "seccomp=" + profile
+			}
+		case "apparmor":
+			err = validateApparmorProfile(parts[1])
+		case "label":
+			err = validateSelinuxLabel(parts[1])
+		}
+		if err != nil {
+			return fmt.Errorf("docker flag 'security-opt=%s' of container '%s' is invalid: %v", value, c.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateSeccompProfile returns the absolute path of the seccomp profile,
+// after checking that it is readable.
+func validateSeccompProfile(c *Context, profile string) (string, error) {
+	if profile == "unconfined" || profile == "builtin" {
+		return profile, nil
+	}
+
+	if !filepath.IsAbs(profile) {
+		directory, err := unitWorkingDirectory(c)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve relative seccomp profile: %v", err)
+		}
+		profile = filepath.Join(directory, profile)
+	}
+
+	data, err := ioutil.ReadFile(profile)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("seccomp profile '%s' does not exist", profile)
+	}
+	if err != nil {
+		return "", fmt.Errorf("seccomp profile '%s' is not readable: %v", profile, err)
+	}
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return "", fmt.Errorf("seccomp profile '%s' is empty", profile)
+	}
+	return profile, nil
+}
+
+// unitWorkingDirectory returns the WorkingDirectory of the unit the wrapper
+// is running in, or the current directory when it is not set.
+func unitWorkingDirectory(c *Context) (string, error) {
+	if runningUnderSystemd() {
+		if _, properties, err := getUnitProperties(c); err == nil {
+			if directory, ok := properties["WorkingDirectory"].(string); ok && filepath.IsAbs(directory) {
+				return directory, nil
+			}
+		}
+	}
+	return os.Getwd()
+}
+
+// validateApparmorProfile checks that AppArmor is enabled and the profile is
+// loaded.  When the loaded profiles cannot be read, only the former is
+// checked.
+func validateApparmorProfile(profile string) error {
+	if profile == "unconfined" {
+		return nil
+	}
+
+	enabled, err := ioutil.ReadFile(apparmorEnabledFile)
+	if err != nil || strings.TrimSpace(string(enabled)) != "Y" {
+		return fmt.Errorf("AppArmor profile '%s' requested, but AppArmor is not enabled on the host", profile)
+	}
+
+	f, err := os.Open(apparmorProfilesFile)
+	if err != nil {
+		return nil
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	// each line is '<PROFILE> (<MODE>)'
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.LastIndex(line, " ("); i >= 0 && line[:i] == profile {
+			return nil
+		}
+	}
+	return fmt.Errorf("AppArmor profile '%s' is not loaded, load it with 'apparmor_parser -r <FILE>'", profile)
+}
+
+// validateSelinuxLabel checks that SELinux is enabled when a label other
+// than 'disable' is requested.
+func validateSelinuxLabel(label string) error {
+	if label == "disable" || label == "nested" {
+		return nil
+	}
+	if _, err := os.Stat(selinuxEnforceFile); err != nil {
+		return fmt.Errorf("SELinux label '%s' requested, but SELinux is not enabled on the host", label)
+	}
+	return nil
+}
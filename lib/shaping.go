@@ -0,0 +1,217 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var tcRateRegex = regexp.MustCompile(`(?i)^[0-9]+(\.[0-9]+)?([kmgt]i?)?(bit|bps)$`)
+
+// trafficShaping is the traffic shaping of a network of the container,
+// declared with --traffic-shaping.
+type trafficShaping struct {
+	network string
+	rate    string
+	ceil    string
+	latency time.Duration
+}
+
+// ValidateTrafficShaping parses the --traffic-shaping flags, which have the
+// format 'NETWORK:rate=RATE[,ceil=RATE][,latency=DURATION]'.
+func ValidateTrafficShaping(c *Context) error {
+	c.trafficShaping = nil
+	for _, spec := range c.TrafficShaping {
+		shaping, err := parseTrafficShaping(spec)
+		if err != nil {
+			return err
+		}
+		for _, other := range c.trafficShaping {
+			if other.network == shaping.network {
+				return fmt.Errorf("traffic shaping of network '%s' is specified more than once", shaping.network)
+			}
+		}
+		c.trafficShaping = append(c.trafficShaping, shaping)
+	}
+	return nil
+}
+
+func parseTrafficShaping(spec string) (*trafficShaping, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+		return nil, fmt.Errorf("traffic shaping '%s' has a wrong format", spec)
+	}
+
+	shaping := &trafficShaping{network: strings.TrimSpace(parts[0])}
+	for _, option := range strings.Split(parts[1], ",") {
+		keyValue := strings.SplitN(strings.TrimSpace(option), "=", 2)
+		if len(keyValue) != 2 {
+			return nil, fmt.Errorf("traffic shaping '%s' has a wrong format", spec)
+		}
+		key, value := keyValue[0], keyValue[1]
+		switch key {
+		case "rate", "ceil":
+			if !tcRateRegex.MatchString(value) {
+				return nil, fmt.Errorf("traffic shaping '%s' has an invalid %s '%s'", spec, key, value)
+			}
+			if key == "rate" {
+				shaping.rate = value
+			} else {
+				shaping.ceil = value
+			}
+		case "latency":
+			latency, err := time.ParseDuration(value)
+			if err != nil || latency <= 0 {
+				return nil, fmt.Errorf("traffic shaping '%s' has an invalid latency '%s'", spec, value)
+			}
+			shaping.latency = latency
+		default:
+			return nil, fmt.Errorf("unsupported traffic shaping option '%s'", key)
+		}
+	}
+	if len(shaping.rate) == 0 {
+		return nil, fmt.Errorf("traffic shaping '%s' has no rate", spec)
+	}
+	if len(shaping.ceil) == 0 {
+		shaping.ceil = shaping.rate
+	}
+	return shaping, nil
+}
+
+// ApplyTrafficShaping configures the declared traffic shaping on the host
+// side of the veth pair connecting the container to each network, which
+// limits the traffic the container receives over the network.  Traffic is
+// shaped with an HTB class, and delayed with a netem qdisc below it when a
+// latency is declared.  As the qdiscs are replaced, applying the traffic
+// shaping again after a re-exec is harmless.
+func ApplyTrafficShaping(c *Context) error {
+	// the shaped devices were restored after a re-exec
+	if len(c.trafficShaping) == 0 || c.resumed != nil {
+		return nil
+	}
+
+	container, err := inspectContainer(c)
+	if err != nil {
+		return err
+	}
+
+	for _, shaping := range c.trafficShaping {
+		var mac string
+		if container.NetworkSettings != nil {
+			if network, ok := container.NetworkSettings.Networks[shaping.network]; ok {
+				mac = network.MacAddress
+			}
+		}
+		if len(mac) == 0 {
+			return fmt.Errorf("container '%s' is not attached to network '%s' with an interface to shape", c.Name, shaping.network)
+		}
+
+		device, err := hostVeth(c, mac)
+		if err != nil {
+			return fmt.Errorf("failed to find the veth of container '%s' on network '%s': %v", c.Name, shaping.network, err)
+		}
+
+		c.supervisionMu.Lock()
+		c.shapedDevices = append(c.shapedDevices, device)
+		c.supervisionMu.Unlock()
+		if err = shapeDevice(device, shaping); err != nil {
+			return err
+		}
+		c.Log.Infof("Shaped traffic of container '%s' on network '%s' (%s) to rate %s, ceil %s, latency %s\n", c.Name, shaping.network, device, shaping.rate, shaping.ceil, shaping.latency)
+	}
+	return nil
+}
+
+// RemoveTrafficShaping removes the qdiscs added by ApplyTrafficShaping.  The
+// veth is usually already gone once the container stopped, which is fine.
+func RemoveTrafficShaping(c *Context) error {
+	var lastErr error
+	for _, device := range c.shapedDevices {
+		if _, err := net.InterfaceByName(device); err != nil {
+			continue
+		}
+		if _, err := runCommand("tc", "qdisc", "del", "dev", device, "root"); err != nil {
+			c.Log.Errorf("Failed to remove traffic shaping of container '%s' from '%s': %s\n", c.Name, device, err)
+			lastErr = err
+		} else {
+			c.Log.Infof("Removed traffic shaping of container '%s' from '%s'\n", c.Name, device)
+		}
+	}
+	c.supervisionMu.Lock()
+	c.shapedDevices = nil
+	c.supervisionMu.Unlock()
+	return lastErr
+}
+
+func shapeDevice(device string, shaping *trafficShaping) error {
+	commands := [][]string{
+		{"qdisc", "replace", "dev", device, "root", "handle", "1:", "htb", "default", "10"},
+		{"class", "replace", "dev", device, "parent", "1:", "classid", "1:10", "htb", "rate", shaping.rate, "ceil", shaping.ceil},
+	}
+	if shaping.latency > 0 {
+		commands = append(commands, []string{"qdisc", "replace", "dev", device, "parent", "1:10", "handle", "10:", "netem", "delay", fmt.Sprintf("%dus", shaping.latency.Microseconds())})
+	}
+	for _, args := range commands {
+		if _, err := runCommand("tc", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hostVeth returns the name of the host side of the veth pair whose
+// container side has the MAC address.  The container side is found in the
+// network namespace of the container, and its peer by the interface index it
+// links to.
+func hostVeth(c *Context, mac string) (string, error) {
+	output, err := runCommand("nsenter", "--target", strconv.Itoa(c.Pid), "--net", "ip", "-o", "-d", "link", "show")
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if !strings.Contains(strings.ToLower(line), fmt.Sprintf("link/ether %s ", strings.ToLower(mac))) {
+			continue
+		}
+		// f.ex. '12: eth0@if13: <BROADCAST,MULTICAST,UP,LOWER_UP> ...'
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			break
+		}
+		name := strings.TrimSuffix(fields[1], ":")
+		i := strings.LastIndex(name, "@if")
+		// the peer of macvlan and ipvlan interfaces is their parent
+		// interface, which must not be shaped
+		if i < 0 || !strings.Contains(line, " veth ") {
+			return "", fmt.Errorf("interface '%s' is not a veth", name)
+		}
+		index, err := strconv.Atoi(name[i+3:])
+		if err != nil {
+			return "", fmt.Errorf("interface '%s' is not a veth", name)
+		}
+		peer, err := net.InterfaceByIndex(index)
+		if err != nil {
+			return "", fmt.Errorf("peer of interface '%s' is not in the host network namespace: %v", name[:i], err)
+		}
+		return peer.Name, nil
+	}
+	return "", fmt.Errorf("no interface with MAC address '%s'", mac)
+}
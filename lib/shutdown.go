@@ -0,0 +1,129 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"github.com/fsouza/go-dockerclient"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// defaultStopTimeout is the time in seconds the container is given to stop
+// before it is killed, unless it specifies a stop timeout itself.
+const defaultStopTimeout = 10
+
+// ErrShutdown is returned when systemd-docker stops supervising the
+// container because it received SIGTERM or SIGINT.
+var ErrShutdown = errors.New("shutting down")
+
+// HandleSignals shuts systemd-docker down gracefully on SIGTERM and SIGINT:
+// in-flight operations are cancelled, systemd is notified that the unit is
+// stopping and, with --stop-on-signal, the container is stopped.  The
+// returned function stops handling the signals.
+func HandleSignals(c *Context) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			c.Log.Infof("Received %s, shutting down\n", sig)
+			notifyStopping(c)
+			c.Shutdown()
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// notifyStopping signals to systemd that the unit is stopping, once either a
+// signal was received or the container exited.
+func notifyStopping(c *Context) {
+	c.stoppingOnce.Do(func() {
+		if err := sendNotify(c, "STOPPING=1"); err != nil {
+			c.Log.Debugf("Failed to signal to systemd that the container '%s' is stopping: %s\n", c.Name, err)
+		}
+	})
+}
+
+// Shutdown cancels all in-flight operations of the context.
+func (c *Context) Shutdown() {
+	c.initShutdown()
+	c.shutdownOnce.Do(func() {
+		close(c.shutdown)
+	})
+}
+
+// Done returns a channel which is closed once the context is shut down.
+func (c *Context) Done() <-chan struct{} {
+	c.initShutdown()
+	return c.shutdown
+}
+
+// withShutdown returns a context.Context which is cancelled once the context
+// is shut down, for cancelling in-flight API calls.
+func (c *Context) withShutdown() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-c.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+func (c *Context) initShutdown() {
+	c.shutdownInit.Do(func() {
+		c.shutdown = make(chan struct{})
+	})
+}
+
+// stopContainer stops the container, giving it its stop timeout to exit.
+func stopContainer(c *Context) error {
+	engine, err := c.GetEngine()
+	if err != nil {
+		return err
+	}
+
+	timeout := uint(defaultStopTimeout)
+	if container, err := engine.Inspect(c, c.Id); err == nil && container.Config != nil && container.Config.StopTimeout > 0 {
+		timeout = uint(container.Config.StopTimeout)
+	}
+
+	c.Log.Infof("Stopping container '%s'\n", c.Name)
+	if daemonless, ok := engine.(DaemonlessEngine); ok {
+		return daemonless.Stop(c, c.Id, time.Duration(timeout)*time.Second)
+	}
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+	err = client.StopContainer(c.Id, timeout)
+	if _, ok := err.(*docker.ContainerNotRunning); ok {
+		return nil
+	}
+	return err
+}
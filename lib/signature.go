@@ -0,0 +1,156 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureVerifierCosign   = "cosign"
+	SignatureVerifierNotation = "notation"
+)
+
+// ValidateVerifySignature checks the --verify-signature flag, which is
+// cosign:<KEY> or notation[:<CONFIG_DIR>].
+func ValidateVerifySignature(c *Context) error {
+	if len(c.VerifySignature) == 0 {
+		return nil
+	}
+	verifier, source := parseVerifySignature(c.VerifySignature)
+	switch verifier {
+	case SignatureVerifierCosign:
+		if len(source) == 0 {
+			return fmt.Errorf("signature verification '%s' has a wrong format", c.VerifySignature)
+		}
+	case SignatureVerifierNotation:
+	default:
+		return fmt.Errorf("unsupported signature verifier '%s'", verifier)
+	}
+	if _, err := exec.LookPath(verifier); err != nil {
+		return fmt.Errorf("signature verifier '%s' is not installed: %v", verifier, err)
+	}
+	return nil
+}
+
+func parseVerifySignature(value string) (string, string) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// verifySignature verifies the signature of the image of the container with
+// --verify-signature before the container is created.  The image is verified
+// by the digest it was pulled with, and the container is created from that
+// digest, so that the verified image is the one which is run.
+func verifySignature(c *Context) error {
+	if len(c.VerifySignature) == 0 || len(c.Image) == 0 {
+		return nil
+	}
+
+	reference, err := signatureReference(c)
+	if err != nil {
+		return err
+	}
+
+	verifier, source := parseVerifySignature(c.VerifySignature)
+	setStatus(c, "Verifying signature of image %s", c.Image)
+	c.Log.Infof("Verifying the signature of image '%s' for container '%s' with %s\n", reference, c.Name, verifier)
+
+	var cmd *exec.Cmd
+	switch verifier {
+	case SignatureVerifierCosign:
+		cmd = exec.Command(verifier, "verify", "--key", source, reference)
+	case SignatureVerifierNotation:
+		cmd = exec.Command(verifier, "verify", reference)
+		if len(source) > 0 {
+			// notation reads its trust policy and trust store from
+			// <XDG_CONFIG_HOME>/notation
+			cmd.Env = append(os.Environ(), fmt.Sprintf("XDG_CONFIG_HOME=%s", source))
+		}
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	start := time.Now()
+	err = cmd.Run()
+	c.auditCommand(cmd, start, err)
+	if err != nil {
+		c.Metrics().AddCounter("systemd_docker_signature_failures_total", "Number of images whose signature could not be verified", 1)
+		setStatus(c, "Signature verification of image %s failed", c.Image)
+		return &ExitError{
+			Code: ExitCodeSignatureInvalid,
+			Err:  fmt.Errorf("signature of image '%s' could not be verified with %s: %v: %s", reference, verifier, err, lastLine(output.String())),
+		}
+	}
+	c.Log.Noticef("Verified the signature of image '%s' for container '%s'\n", reference, c.Name)
+	return nil
+}
+
+// signatureReference returns the reference of the image by the digest it was
+// pulled with from its own repository, and pins the container to it.
+func signatureReference(c *Context) (string, error) {
+	if strings.Contains(c.Image, "@") {
+		return c.Image, nil
+	}
+
+	client, err := c.GetClient()
+	if err != nil {
+		return "", err
+	}
+	// verify the image the digest was checked for, if it was
+	reference := c.Image
+	if len(c.pinnedImage) > 0 {
+		reference = c.pinnedImage
+	}
+	image, err := client.InspectImage(reference)
+	if err == docker.ErrNoSuchImage {
+		return "", &ExitError{
+			Code: ExitCodeSignatureInvalid,
+			Err:  fmt.Errorf("image '%s' is not present, its signature cannot be verified before it was pulled", c.Image),
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	repository, _ := docker.ParseRepositoryTag(c.Image)
+	for _, digest := range image.RepoDigests {
+		if strings.HasPrefix(digest, repository+"@") {
+			c.pinnedImage = digest
+			return digest, nil
+		}
+	}
+	return "", &ExitError{
+		Code: ExitCodeSignatureInvalid,
+		Err:  fmt.Errorf("image '%s' has no digest of repository '%s', its signature cannot be verified", c.Image, repository),
+	}
+}
+
+// lastLine returns the last non-empty line of the output, which holds the
+// reason of the failure of most tools.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,58 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"time"
+)
+
+const (
+	StaleContainerFail  = "fail"
+	StaleContainerAdopt = "adopt"
+)
+
+// checkStaleContainer verifies that the running container is still the
+// instance which is supervised.  Docker restarting the container, f.ex. after
+// a crash of the daemon, changes its start time and its main process.
+func checkStaleContainer(c *Context, engine ContainerEngine, container *docker.Container) error {
+	if c.startedAt.IsZero() {
+		c.startedAt = container.State.StartedAt
+		return nil
+	}
+	if container.State.StartedAt.Equal(c.startedAt) {
+		return nil
+	}
+	return remediateStaleContainer(c, engine, fmt.Sprintf("container '%s' was restarted outside of systemd-docker at %s", c.Name, container.State.StartedAt.Format(time.RFC3339)))
+}
+
+// remediateStaleContainer handles a supervised container which was replaced
+// or lost.  With --stale-container=adopt, the running container with the name
+// is adopted by re-executing systemd-docker to resume supervising it, else an
+// error with the reason is returned to fail the unit.
+func remediateStaleContainer(c *Context, engine ContainerEngine, reason string) error {
+	if c.StaleContainer == StaleContainerAdopt && !c.SwarmService {
+		container, err := engine.Inspect(c, c.Name)
+		if err == nil && container.State.Running {
+			c.Log.Warnf("The %s, adopting container '%s' (%s)\n", reason, c.Name, shortId(container.ID))
+			setContainerId(c, container.ID)
+			return reexec(c)
+		}
+	}
+	return errors.New(reason)
+}
@@ -0,0 +1,199 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// runtimeStateFileName is the name of the file in the directory of the
+	// container holding the state which survives the systemd-docker instance.
+	runtimeStateFileName = "runtime.json"
+
+	// runtimeStateInterval is the interval at which the persisted state is
+	// updated.
+	runtimeStateInterval = 5 * time.Second
+
+	// maxHealthHistory is the number of health transitions which are kept.
+	maxHealthHistory = 50
+)
+
+// runtimeState is persisted in the directory of the container, so that a
+// systemd-docker instance started after the previous one crashed resumes
+// supervising the container, and so that counters survive the instance.
+type runtimeState struct {
+	WrapperPid  int
+	Supervision *reexecState
+	Starts      int
+	Health      []healthTransition
+}
+
+// healthTransition records when the container became healthy or unhealthy.
+type healthTransition struct {
+	Time    time.Time
+	Healthy bool
+}
+
+// runtimeDirectory returns the RuntimeDirectory= of the unit, if it has one.
+func runtimeDirectory() string {
+	if dir := os.Getenv("RUNTIME_DIRECTORY"); len(dir) > 0 {
+		// systemd passes a colon separated list for multiple directories
+		return strings.SplitN(dir, ":", 2)[0]
+	}
+	return ""
+}
+
+// containerDirectory returns the directory holding the runtime state of the
+// container, which is the RuntimeDirectory= of the unit if it has one.
+func containerDirectory(c *Context) string {
+	if dir := runtimeDirectory(); len(dir) > 0 {
+		return dir
+	}
+	return filepath.Join(runDirectory(c), filepath.Base(c.Name))
+}
+
+// LoadRuntimeState loads the state persisted by the previous systemd-docker
+// instance of the container.  If that instance died while supervising the
+// container, the container is resumed instead of being restarted, unless
+// the state was already handed over by a re-exec or the FD store.
+func LoadRuntimeState(c *Context) error {
+	if len(c.Name) == 0 && len(runtimeDirectory()) == 0 {
+		return nil
+	}
+
+	path := filepath.Join(containerDirectory(c), runtimeStateFileName)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state runtimeState
+	if err = json.Unmarshal(data, &state); err != nil {
+		c.Log.Warnf("Ignoring invalid runtime state '%s': %s\n", path, err)
+		return nil
+	}
+
+	c.runtimeStateMu.Lock()
+	c.runtimeState.Starts = state.Starts
+	c.runtimeState.Health = state.Health
+	c.runtimeStateMu.Unlock()
+
+	if c.resumed != nil || state.Supervision == nil || state.WrapperPid == os.Getpid() || !HasPidDied(c, state.WrapperPid) {
+		return nil
+	}
+	if len(c.Name) > 0 && state.Supervision.Name != c.Name {
+		return nil
+	}
+	c.resumed = state.Supervision
+	c.Log.Infof("Resuming supervision of container '%s' after systemd-docker (pid %d) died\n", state.Supervision.Name, state.WrapperPid)
+	return nil
+}
+
+// StartRuntimeState periodically persists the supervision state of the
+// container, along with the start counter and the health history.  The
+// returned function stops updating the state and, once the container has
+// stopped, forgets the supervision state so that it is not resumed.
+func StartRuntimeState(c *Context) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(runtimeStateInterval)
+		defer ticker.Stop()
+		for {
+			writeRuntimeState(c, true)
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		writeRuntimeState(c, c.stoppedAt.IsZero())
+	}
+}
+
+func writeRuntimeState(c *Context, supervising bool) {
+	c.runtimeStateMu.Lock()
+	state := c.runtimeState
+	state.Health = append([]healthTransition(nil), c.runtimeState.Health...)
+	c.runtimeStateMu.Unlock()
+
+	state.WrapperPid = os.Getpid()
+	if supervising && len(c.Id) > 0 {
+		supervision := supervisionState(c)
+		state.Supervision = &supervision
+	}
+
+	path := filepath.Join(containerDirectory(c), runtimeStateFileName)
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = writeFileAtomic(path, data, 0600)
+	}
+	if err != nil {
+		c.Log.Debugf("Failed to write runtime state '%s': %s\n", path, err)
+	}
+}
+
+// countStart counts that the container was started, and returns how often
+// it was started by systemd-docker.
+func countStart(c *Context) int {
+	c.runtimeStateMu.Lock()
+	defer c.runtimeStateMu.Unlock()
+	c.runtimeState.Starts++
+	return c.runtimeState.Starts
+}
+
+// startCount returns how often the container was started by systemd-docker.
+func startCount(c *Context) int {
+	c.runtimeStateMu.Lock()
+	defer c.runtimeStateMu.Unlock()
+	return c.runtimeState.Starts
+}
+
+// recordHealthTransition adds a change of the health of the container to
+// the health history, and returns whether the health changed.
+func recordHealthTransition(c *Context, healthy bool) bool {
+	c.runtimeStateMu.Lock()
+	defer c.runtimeStateMu.Unlock()
+
+	history := c.runtimeState.Health
+	if len(history) > 0 && history[len(history)-1].Healthy == healthy {
+		return false
+	}
+	history = append(history, healthTransition{Time: time.Now(), Healthy: healthy})
+	if len(history) > maxHealthHistory {
+		history = history[len(history)-maxHealthHistory:]
+	}
+	c.runtimeState.Health = history
+	return true
+}
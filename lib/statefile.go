@@ -0,0 +1,146 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// stateFileName is the name of the file in the state directory of the
+// container which describes the supervised container.
+const stateFileName = "state.json"
+
+// ContainerState is the content of the state file of a container.
+type ContainerState struct {
+	Name        string            `json:"name"`
+	Id          string            `json:"id"`
+	Pid         int               `json:"pid"`
+	WrapperPid  int               `json:"wrapperPid"`
+	Image       string            `json:"image"`
+	ImageId     string            `json:"imageId"`
+	ImageDigest string            `json:"imageDigest,omitempty"`
+	StartedAt   time.Time         `json:"startedAt"`
+	Starts      int               `json:"starts"`
+	Ready       bool              `json:"ready"`
+	Networks    map[string]string `json:"networks"`
+	CniNetworks []string          `json:"cniNetworks,omitempty"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+}
+
+// WriteStateFile writes the state of the running container to state.json in
+// the directory of the container.  The file is rewritten atomically
+// whenever the state changes, until it is removed by RemoveStateFile.
+func WriteStateFile(c *Context) {
+	if len(c.Id) == 0 {
+		return
+	}
+
+	c.stateFileMu.Lock()
+	defer c.stateFileMu.Unlock()
+
+	path := filepath.Join(containerDirectory(c), stateFileName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		c.Log.Warnf("Failed to create state directory '%s': %s\n", filepath.Dir(path), err)
+		return
+	}
+	if err := writeState(c, path); err != nil {
+		c.Log.Warnf("Failed to write state file '%s': %s\n", path, err)
+		return
+	}
+	c.stateFile = path
+	c.Log.Debugf("Wrote state file '%s' for container '%s'\n", path, c.Name)
+}
+
+// updateStateFile rewrites the state file, if it was written.
+func updateStateFile(c *Context) {
+	c.stateFileMu.Lock()
+	defer c.stateFileMu.Unlock()
+
+	if len(c.stateFile) == 0 {
+		return
+	}
+	if err := writeState(c, c.stateFile); err != nil {
+		c.Log.Warnf("Failed to update state file '%s': %s\n", c.stateFile, err)
+	}
+}
+
+// RemoveStateFile removes the state file written by WriteStateFile, along
+// with the directory of the container once it is empty.
+func RemoveStateFile(c *Context) {
+	c.stateFileMu.Lock()
+	defer c.stateFileMu.Unlock()
+
+	if len(c.stateFile) == 0 {
+		return
+	}
+	if err := os.Remove(c.stateFile); err != nil && !os.IsNotExist(err) {
+		c.Log.Warnf("Failed to remove state file '%s': %s\n", c.stateFile, err)
+	}
+	if len(runtimeDirectory()) == 0 {
+		_ = os.Remove(filepath.Dir(c.stateFile))
+	}
+	c.stateFile = ""
+}
+
+func writeState(c *Context, path string) error {
+	container, err := inspectContainer(c)
+	if err != nil {
+		return err
+	}
+
+	c.phases.mu.Lock()
+	ready := c.phases.ready
+	c.phases.mu.Unlock()
+
+	state := ContainerState{
+		Name:       c.Name,
+		Id:         container.ID,
+		Pid:        c.Pid,
+		WrapperPid: os.Getpid(),
+		Image:      c.Image,
+		ImageId:    container.Image,
+		StartedAt:  container.State.StartedAt,
+		Starts:     startCount(c),
+		Ready:      ready,
+		Networks:   map[string]string{},
+		UpdatedAt:  time.Now(),
+	}
+	if container.NetworkSettings != nil {
+		for name, network := range container.NetworkSettings.Networks {
+			state.Networks[name] = network.IPAddress
+		}
+	}
+	for _, attachment := range c.cniAttachments {
+		state.CniNetworks = append(state.CniNetworks, attachment.config.name)
+	}
+	sort.Strings(state.CniNetworks)
+
+	if client, err := c.GetClient(); err == nil {
+		if digest, err := getImageDigest(client, container.Image); err == nil {
+			state.ImageDigest = digest
+		}
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,103 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+type statsdSink struct {
+	conn      net.Conn
+	prefix    string
+	tags      []string
+	dogStatsD bool
+}
+
+// StartStatsD emits all metric updates to the StatsD server specified by
+// --statsd-address.  With --statsd-dogstatsd the metric labels and
+// --statsd-tags are sent as DogStatsD tags, otherwise the label values are
+// appended to the metric name.
+func StartStatsD(c *Context) error {
+	if len(c.StatsD.Address) == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("udp", c.StatsD.Address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to statsd '%s': %v", c.StatsD.Address, err)
+	}
+
+	sink := &statsdSink{
+		conn:      conn,
+		prefix:    c.StatsD.Prefix,
+		tags:      append([]string{fmt.Sprintf("container:%s", c.Name)}, c.StatsD.Tags...),
+		dogStatsD: c.StatsD.DogStatsD,
+	}
+	c.Metrics().AddObserver(sink.observe)
+	c.Log.Infof("Emitting metrics of container '%s' to statsd '%s'\n", c.Name, c.StatsD.Address)
+	return nil
+}
+
+func (s *statsdSink) observe(metric Metric, delta float64) {
+	var value string
+	switch {
+	case strings.HasSuffix(metric.Name, "_duration_seconds"):
+		value = fmt.Sprintf("%d|ms", int64(metric.Value*1000))
+	case metric.Type == MetricCounter:
+		value = fmt.Sprintf("%g|c", delta)
+	default:
+		value = fmt.Sprintf("%g|g", metric.Value)
+	}
+
+	name := strings.TrimPrefix(metric.Name, "systemd_docker_")
+	if len(s.prefix) > 0 {
+		name = fmt.Sprintf("%s.%s", strings.TrimSuffix(s.prefix, "."), name)
+	}
+
+	labels := make([]string, 0, len(metric.Labels))
+	for label := range metric.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	line := ""
+	if s.dogStatsD {
+		tags := append([]string(nil), s.tags...)
+		for _, label := range labels {
+			tags = append(tags, fmt.Sprintf("%s:%s", label, metric.Labels[label]))
+		}
+		line = fmt.Sprintf("%s:%s|#%s", name, value, strings.Join(tags, ","))
+	} else {
+		for _, label := range labels {
+			name = fmt.Sprintf("%s.%s", name, statsdName(metric.Labels[label]))
+		}
+		line = fmt.Sprintf("%s:%s", name, value)
+	}
+	_, _ = s.conn.Write([]byte(line))
+}
+
+func statsdName(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ' ':
+			return '_'
+		}
+		return r
+	}, value)
+}
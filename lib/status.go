@@ -0,0 +1,112 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContainerStatus is the status of a container managed by systemd-docker.
+type ContainerStatus struct {
+	Name        string            `json:"name"`
+	Id          string            `json:"id"`
+	State       string            `json:"state"`
+	Pid         int               `json:"pid"`
+	Health      string            `json:"health,omitempty"`
+	StartedAt   time.Time         `json:"startedAt"`
+	ExitCode    int               `json:"exitCode"`
+	Image       string            `json:"image"`
+	ImageId     string            `json:"imageId"`
+	Digest      string            `json:"digest,omitempty"`
+	IpAddresses map[string]string `json:"ipAddresses"`
+	Supervised  bool              `json:"supervised"`
+	WrapperPid  int               `json:"wrapperPid,omitempty"`
+}
+
+// GetStatus returns the status of the container with the name, and whether
+// a systemd-docker instance is supervising it.
+func GetStatus(c *Context) (*ContainerStatus, error) {
+	engine, err := c.GetEngine()
+	if err != nil {
+		return nil, err
+	}
+
+	container, err := engine.Inspect(c, c.Name)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return nil, fmt.Errorf("container '%s' does not exist", c.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ContainerStatus{
+		Name:        strings.TrimPrefix(container.Name, "/"),
+		Id:          container.ID,
+		State:       container.State.StateString(),
+		Pid:         container.State.Pid,
+		Health:      container.State.Health.Status,
+		StartedAt:   container.State.StartedAt,
+		ExitCode:    container.State.ExitCode,
+		ImageId:     container.Image,
+		IpAddresses: make(map[string]string),
+	}
+	if container.Config != nil {
+		status.Image = container.Config.Image
+	}
+	if container.NetworkSettings != nil {
+		for name, network := range container.NetworkSettings.Networks {
+			if len(network.IPAddress) > 0 {
+				status.IpAddresses[name] = network.IPAddress
+			} else if len(network.GlobalIPv6Address) > 0 {
+				status.IpAddresses[name] = network.GlobalIPv6Address
+			}
+		}
+	}
+	if client, err := c.GetClient(); err == nil {
+		status.Digest = imageDigest(client, status.Image, status.ImageId)
+	}
+	if data, err := ioutil.ReadFile(wrapperPidFile(c)); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && !HasPidDied(c, pid) {
+			status.Supervised = true
+			status.WrapperPid = pid
+		}
+	}
+	return status, nil
+}
+
+// imageDigest returns the repository digest of the image, preferring the
+// digest of the repository the image was referenced by.
+func imageDigest(client *docker.Client, reference string, id string) string {
+	image, err := client.InspectImage(id)
+	if err != nil || len(image.RepoDigests) == 0 {
+		return ""
+	}
+	digests := append([]string(nil), image.RepoDigests...)
+	sort.Strings(digests)
+	repository, _ := docker.ParseRepositoryTag(reference)
+	for _, digest := range digests {
+		if strings.HasPrefix(digest, repository+"@") {
+			return digest
+		}
+	}
+	return digests[0]
+}
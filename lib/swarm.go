@@ -0,0 +1,117 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// DefaultSwarmTaskWait is the default time to wait for the task of a swarm
+// service to start.
+const DefaultSwarmTaskWait = 2 * time.Minute
+
+// runService creates the swarm service of the container with a single
+// replica and waits for its task to start.  The container of the task is then
+// supervised like a plain container.  An existing service with the same name
+// is replaced, so that the arguments of the unit are authoritative, and swarm
+// never restarts the task, as restarting is left to systemd.
+func runService(c *Context) error {
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	if _, err = client.InspectService(c.Name); err == nil {
+		c.Log.Infof("Replacing existing swarm service '%s'\n", c.Name)
+		if err = client.RemoveService(docker.RemoveServiceOptions{ID: c.Name}); err != nil {
+			return err
+		}
+	} else if _, ok := err.(*docker.NoSuchService); !ok {
+		return err
+	}
+
+	setStatus(c, "Creating swarm service")
+	start := time.Now()
+	args := append([]string{"service", "create", "--detach", "--replicas", "1", "--restart-condition", "none"}, c.Args...)
+	c.Cmd = dockerCommand(c, args...)
+	c.Cmd.Stdout = ioutil.Discard
+	c.Cmd.Stderr = os.Stderr
+	err = c.Cmd.Run()
+	c.auditCommand(c.Cmd, start, err)
+	if err != nil {
+		return fmt.Errorf("failed to create swarm service '%s': %v", c.Name, err)
+	}
+	c.recordPhase(PhaseCreate, start)
+
+	setStatus(c, "Starting swarm service")
+	start = time.Now()
+	err = waitFor(c, fmt.Sprintf("the task of swarm service '%s' to start", c.Name), c.SwarmTaskWait, func() (bool, error) {
+		return serviceTaskStarted(c, client)
+	})
+	if err != nil {
+		return err
+	}
+	c.recordPhase(PhaseStart, start)
+	c.Metrics().AddCounter("systemd_docker_starts_total", "Number of times the container was started", 1)
+	c.Log.Infof("Swarm service '%s' is running in container '%s' with pid %d\n", c.Name, shortId(c.Id), c.Pid)
+	return nil
+}
+
+// serviceTaskStarted returns whether the task of the swarm service is
+// running, recording the container and pid of the task.
+func serviceTaskStarted(c *Context, client *docker.Client) (bool, error) {
+	tasks, err := client.ListTasks(docker.ListTasksOptions{
+		Filters: map[string][]string{"service": {c.Name}},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	for _, task := range tasks {
+		switch task.Status.State {
+		case "running":
+			if task.Status.ContainerStatus == nil || task.Status.ContainerStatus.PID == 0 {
+				continue
+			}
+			setContainerId(c, task.Status.ContainerStatus.ContainerID)
+			c.Pid = task.Status.ContainerStatus.PID
+			return true, nil
+		case "failed", "rejected", "complete", "shutdown", "orphaned":
+			if task.DesiredState == "running" {
+				return false, fmt.Errorf("task of swarm service '%s' is %s: %s", c.Name, task.Status.State, task.Status.Err)
+			}
+		}
+	}
+	return false, nil
+}
+
+// removeService removes the swarm service of the container.
+func removeService(c *Context) error {
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	err = client.RemoveService(docker.RemoveServiceOptions{ID: c.Name})
+	if _, ok := err.(*docker.NoSuchService); ok {
+		return nil
+	}
+	return err
+}
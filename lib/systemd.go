@@ -16,22 +16,22 @@
 package lib
 
 import (
-	"errors"
 	"fmt"
 	"net"
 	"os"
+	"time"
 )
 
 func Notify(c *Context) error {
-	if HasPidDied(c.Pid) {
-		return errors.New(fmt.Sprintf("container '%s' exited before we could notify systemd", c.Name))
+	if HasPidDied(c, c.Pid) {
+		return fmt.Errorf("%w: container '%s' exited before we could notify systemd", ErrStart, c.Name)
 	}
 
 	if len(c.NotifySocket) == 0 {
 		return nil
 	}
 
-	conn, err := net.Dial("unixgram", c.NotifySocket)
+	conn, err := dialNotify(c)
 	if err != nil {
 		return err
 	}
@@ -42,17 +42,27 @@ func Notify(c *Context) error {
 		return err
 	}
 
-	if HasPidDied(c.Pid) {
+	if HasPidDied(c, c.Pid) {
 		_, _ = conn.Write([]byte(fmt.Sprintf("MAINPID=%d", os.Getpid())))
 		_ = conn.Close()
-		return errors.New(fmt.Sprintf("container '%s' exited before we could notify systemd", c.Name))
+		return fmt.Errorf("%w: container '%s' exited before we could notify systemd", ErrStart, c.Name)
 	}
 
 	if !c.Notify {
-		m, err := CreateMonitor(c)
+		var m Monitor
+		if len(c.Sidecars) > 0 {
+			m, err = createGroupMonitor(c)
+		} else if len(c.Probes) > 0 {
+			m, err = createProbeMonitor(c)
+		} else {
+			m, err = CreateMonitor(c)
+		}
 		if err != nil {
 			return err
 		}
+		if m == nil && len(c.ReadyGates) > 0 && !c.resumedReady() {
+			m = &gateMonitor{context: c}
+		}
 		if m == nil {
 			defer func(conn net.Conn) {
 				_ = conn.Close()
@@ -60,11 +70,15 @@ func Notify(c *Context) error {
 
 			if _, err = conn.Write([]byte("READY=1")); err == nil {
 				c.Log.Infof("Signaled to systemd that the container '%s' is healthy\n", c.Name)
+				readyReached(c)
 			} else {
 				return err
 			}
 		} else {
+			c.monitorCtx, c.stopMonitorCtx = c.withShutdown()
+			c.monitors.Add(1)
 			go func(m Monitor) {
+				defer c.monitors.Done()
 				defer func(m Monitor) {
 					_ = m.Close()
 				}(m)
@@ -75,3 +89,98 @@ func Notify(c *Context) error {
 
 	return nil
 }
+
+// StopMonitor stops the monitor started by Notify and waits for it to
+// return, so that it neither notifies systemd nor emits lifecycle events once
+// Run returned.
+func StopMonitor(c *Context) {
+	if c.stopMonitorCtx == nil {
+		return
+	}
+	c.stopMonitorCtx()
+	c.monitors.Wait()
+}
+
+// monitorDone returns a channel which is closed once the monitor is stopped
+// by StopMonitor or the context is shut down.
+func (c *Context) monitorDone() <-chan struct{} {
+	if c.monitorCtx == nil {
+		return c.Done()
+	}
+	return c.monitorCtx.Done()
+}
+
+// dialNotify connects to NOTIFY_SOCKET, reusing the socket kept in the FD
+// store when there is one.
+func dialNotify(c *Context) (*net.UnixConn, error) {
+	if c.notifyFile != nil {
+		conn, err := net.FileConn(c.notifyFile)
+		if err != nil {
+			return nil, err
+		}
+		if unixConn, ok := conn.(*net.UnixConn); ok {
+			return unixConn, nil
+		}
+		_ = conn.Close()
+		return nil, fmt.Errorf("descriptor '%s' in the FD store is not a unix socket", fdStoreNotifyName)
+	}
+	return net.DialUnix("unixgram", nil, &net.UnixAddr{Name: c.NotifySocket, Net: "unixgram"})
+}
+
+func sendNotify(c *Context, state string) error {
+	if len(c.NotifySocket) == 0 {
+		return nil
+	}
+
+	conn, err := dialNotify(c)
+	if err != nil {
+		return err
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func extendTimeout(c *Context, extension time.Duration) {
+	if err := sendNotify(c, fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", extension.Microseconds())); err != nil {
+		c.Log.Warnf("Failed to extend systemd start timeout: %s\n", err)
+	}
+}
+
+// waitFor polls check until it reports true, returns an error, or timeout
+// elapses.  While waiting, systemd is asked to extend the start timeout so
+// that the unit is not killed.
+func waitFor(c *Context, description string, timeout time.Duration, check func() (bool, error)) error {
+	const interval = 500 * time.Millisecond
+	deadline := time.Now().Add(timeout)
+	lastExtend := time.Time{}
+	logged := false
+	for {
+		done, err := check()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("%w: waited %s for %s", ErrStartTimeout, timeout, description)
+		}
+		if !logged {
+			c.Log.Infof("Waiting up to %s for %s\n", timeout, description)
+			logged = true
+		}
+		if time.Since(lastExtend) >= 5*time.Second {
+			extendTimeout(c, 10*time.Second)
+			lastExtend = time.Now()
+		}
+		select {
+		case <-c.Done():
+			return ErrShutdown
+		case <-time.After(interval):
+		}
+	}
+}
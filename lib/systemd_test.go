@@ -0,0 +1,145 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib_test
+
+import (
+	"context"
+	"errors"
+	"github.com/kadaan/systemd-docker/lib"
+	"github.com/kadaan/systemd-docker/lib/sdtest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const lifecycleTimeout = 10 * time.Second
+
+// startManaged runs the container with RunManaged against a fake daemon,
+// probing a local HTTP server so that the monitor sends watchdog pings.
+func startManaged(t *testing.T, ctx context.Context, name string) (*sdtest.Harness, <-chan error) {
+	t.Helper()
+	t.Setenv("STATE_DIRECTORY", t.TempDir())
+	t.Setenv("RUNTIME_DIRECTORY", t.TempDir())
+
+	h, err := sdtest.NewFake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = h.Close()
+	})
+
+	probed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(probed.Close)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- lib.RunManaged(ctx, lib.ManagedOptions{
+			Flags: []string{
+				"--host", h.Daemon.Host(),
+				"--probe", probed.URL + "/",
+				"--probe-interval", "50ms",
+			},
+			Args:         []string{"--name", name, "busybox:latest"},
+			NotifySocket: h.Notify.Socket(),
+		})
+	}()
+	return h, result
+}
+
+func waitForExit(t *testing.T, result <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(lifecycleTimeout):
+		t.Fatal("container was still supervised")
+		return nil
+	}
+}
+
+func TestRunNotifiesLifecycle(t *testing.T) {
+	h, result := startManaged(t, context.Background(), "sdtest-lifecycle")
+	if _, err := h.Notify.WaitFor("WATCHDOG=1", lifecycleTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := h.Daemon.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	container, err := client.InspectContainer("sdtest-lifecycle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pids := h.Notify.Values("MAINPID"); len(pids) == 0 || pids[0] != strconv.Itoa(container.State.Pid) {
+		t.Errorf("MAINPID %v, expected the pid %d of the container", pids, container.State.Pid)
+	}
+
+	if err = h.Daemon.Exit(container.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = waitForExit(t, result); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = h.Notify.WaitFor("STOPPING=1", lifecycleTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Notify.Sequence("MAINPID=", "READY=1", "WATCHDOG=1", "STOPPING=1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunReturnsExitCode(t *testing.T) {
+	h, result := startManaged(t, context.Background(), "sdtest-exit-code")
+	if _, err := h.Notify.WaitFor("READY=1", lifecycleTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Daemon.Exit("sdtest-exit-code", 3); err != nil {
+		t.Fatal(err)
+	}
+	err := waitForExit(t, result)
+	var exitErr *lib.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 3 {
+		t.Fatalf("error %v, expected exit code 3", err)
+	}
+	if _, err = h.Notify.WaitFor("STOPPING=1", lifecycleTimeout); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunNotifiesStoppingOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h, result := startManaged(t, ctx, "sdtest-shutdown")
+	if _, err := h.Notify.WaitFor("READY=1", lifecycleTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := waitForExit(t, result); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := h.Notify.WaitFor("STOPPING=1", lifecycleTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Notify.Sequence("MAINPID=", "READY=1", "STOPPING=1"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PhasePull   = "pull"
+	PhaseCreate = "create"
+	PhaseJoin   = "join"
+	PhaseStart  = "start"
+	PhaseReady  = "ready"
+	PhaseStop   = "stop"
+)
+
+// PhaseTiming is the duration of a lifecycle phase of the container.
+type PhaseTiming struct {
+	Phase    string
+	Duration time.Duration
+}
+
+type phaseTimings struct {
+	mu        sync.Mutex
+	started   time.Time
+	timings   []PhaseTiming
+	ready     bool
+	unhealthy bool
+
+	// healthOutput is the output of the last failed health check
+	healthOutput string
+
+	// lastHealthy is when the health of the container was last confirmed
+	lastHealthy time.Time
+
+	// readyIn is how long the container took to become ready
+	readyIn time.Duration
+}
+
+// recordPhase records the duration of the phase which started at start.
+func (c *Context) recordPhase(phase string, start time.Time) {
+	duration := time.Since(start)
+	c.phases.mu.Lock()
+	c.phases.timings = append(c.phases.timings, PhaseTiming{Phase: phase, Duration: duration})
+	c.phases.mu.Unlock()
+
+	c.Metrics().SetGauge("systemd_docker_phase_duration_seconds", "Duration of the lifecycle phases of the container", duration.Seconds(), "phase", phase)
+	c.Log.Debugf("Phase '%s' of container '%s' took %s\n", phase, c.Name, duration.Round(time.Millisecond))
+	emitEvent(c, phase, duration)
+}
+
+// PhaseTimings returns the durations of the lifecycle phases recorded so far.
+func (c *Context) PhaseTimings() []PhaseTiming {
+	c.phases.mu.Lock()
+	defer c.phases.mu.Unlock()
+	return append([]PhaseTiming(nil), c.phases.timings...)
+}
+
+func (c *Context) startTelemetry() {
+	c.phases.mu.Lock()
+	defer c.phases.mu.Unlock()
+	if c.phases.started.IsZero() {
+		c.phases.started = time.Now()
+	}
+}
+
+// readyReached records the time to ready, once, and writes the phase
+// durations to the journal.
+func readyReached(c *Context) {
+	c.phases.mu.Lock()
+	if c.phases.ready || c.phases.started.IsZero() {
+		c.phases.mu.Unlock()
+		return
+	}
+	c.phases.ready = true
+	started := c.phases.started
+	c.phases.mu.Unlock()
+
+	c.recordPhase(PhaseReady, started)
+	c.phases.mu.Lock()
+	c.phases.readyIn = time.Since(started)
+	c.phases.mu.Unlock()
+
+	summary := logPhaseTimings(c, fmt.Sprintf("Container '%s' is ready", c.Name))
+	setStatus(c, "Ready in %s (%s)", formatSeconds(time.Since(started)), summary)
+	updateStateFile(c)
+}
+
+// stopReached records the duration of cleaning up after the container
+// stopped and writes the phase durations to the journal.
+func stopReached(c *Context) {
+	if c.stoppedAt.IsZero() {
+		return
+	}
+	c.recordPhase(PhaseStop, c.stoppedAt)
+	logPhaseTimings(c, fmt.Sprintf("Container '%s' has been stopped", c.Name))
+}
+
+// logPhaseTimings writes the message to the journal, along with a one-line
+// summary of the phase durations, f.ex. 'pull 12.3s, create 0.4s, start
+// 1.1s, ready 8.7s', and the duration of each phase as structured field.
+// The summary is returned.
+func logPhaseTimings(c *Context, message string) string {
+	fields := map[string]string{
+		"CONTAINER_NAME": c.Name,
+		"CONTAINER_ID":   c.Id,
+	}
+	timings := c.PhaseTimings()
+	summary := make([]string, 0, len(timings))
+	for _, timing := range timings {
+		fields[fmt.Sprintf("SYSTEMD_DOCKER_%s_USEC", strings.ToUpper(timing.Phase))] = fmt.Sprintf("%d", timing.Duration.Microseconds())
+		summary = append(summary, fmt.Sprintf("%s %s", timing.Phase, formatSeconds(timing.Duration)))
+	}
+	c.Log.Structured(PriorityInfo, fmt.Sprintf("%s: %s", message, strings.Join(summary, ", ")), fields)
+	return strings.Join(summary, ", ")
+}
+
+// withReadyTime appends how long the container took to become ready to the
+// systemd status, so that it stays visible after health updates.
+func withReadyTime(c *Context, status string) string {
+	c.phases.mu.Lock()
+	readyIn := c.phases.readyIn
+	c.phases.mu.Unlock()
+	if readyIn <= 0 {
+		return status
+	}
+	return fmt.Sprintf("%s; ready in %s", status, formatSeconds(readyIn))
+}
+
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.1fs", d.Seconds())
+}
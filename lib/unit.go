@@ -0,0 +1,82 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	systemdDbus "github.com/coreos/go-systemd/v22/dbus"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const dbusTimeout = 5 * time.Second
+
+// currentUnit returns the name of the service unit the wrapper is running
+// in, determined from its cgroup.
+func currentUnit() (string, error) {
+	cgroups, err := readCgroups("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+
+	// prefer the unified hierarchy, then the systemd named hierarchy
+	for _, hierarchy := range []string{"", "name=systemd"} {
+		if cgroup, ok := cgroups[hierarchy]; ok {
+			for dir := cgroup; dir != "/" && dir != "." && len(dir) > 0; dir = path.Dir(dir) {
+				if strings.HasSuffix(path.Base(dir), ".service") {
+					return path.Base(dir), nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("not running in a systemd service unit")
+}
+
+// runningUnderSystemd returns whether the wrapper was started by systemd.
+func runningUnderSystemd() bool {
+	return len(os.Getenv("INVOCATION_ID")) > 0
+}
+
+// getUnitProperties reads the Service properties of the unit the wrapper is
+// running in over D-Bus.
+func getUnitProperties(c *Context) (string, map[string]interface{}, error) {
+	unit, err := currentUnit()
+	if err != nil {
+		return "", nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbusTimeout)
+	defer cancel()
+
+	conn, err := newSystemdConnection(ctx, c)
+	if err != nil {
+		return unit, nil, err
+	}
+	defer conn.Close()
+
+	properties, err := conn.GetUnitTypePropertiesContext(ctx, unit, "Service")
+	return unit, properties, err
+}
+
+func newSystemdConnection(ctx context.Context, c *Context) (*systemdDbus.Conn, error) {
+	if c.UserManager {
+		return systemdDbus.NewUserConnectionContext(ctx)
+	}
+	return systemdDbus.NewWithContext(ctx)
+}
@@ -0,0 +1,181 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	UnitMetadataLabels = "labels"
+	UnitMetadataEnv    = "env"
+
+	// unitMetadataKeyPrefix is the prefix of custom keys in unit files
+	// which are attached to the container.
+	unitMetadataKeyPrefix = "X-systemd-docker-"
+)
+
+var invalidEnvChars = regexp.MustCompile(`[^A-Z0-9_]+`)
+
+// unitMetadata is the metadata of the unit attached to the container.
+type unitMetadata struct {
+	unit        string
+	description string
+	partOf      []string
+	custom      map[string]string
+}
+
+// ValidateUnitMetadata checks the --unit-metadata flag.
+func ValidateUnitMetadata(c *Context) error {
+	for _, target := range c.UnitMetadata {
+		if target != UnitMetadataLabels && target != UnitMetadataEnv {
+			return fmt.Errorf("unsupported unit metadata target '%s'", target)
+		}
+	}
+	return nil
+}
+
+// UnitMetadataArgs returns the docker run arguments attaching the
+// Description and PartOf of the unit, and the custom X-systemd-docker-<NAME>
+// keys of its unit file and drop-ins, to the container as labels and/or
+// environment variables as specified by --unit-metadata.  Failing to read the
+// metadata is not fatal.
+func UnitMetadataArgs(c *Context) []string {
+	if len(c.UnitMetadata) == 0 || !runningUnderSystemd() {
+		return nil
+	}
+
+	metadata, err := readUnitMetadata(c)
+	if err != nil {
+		c.Log.Warnf("Failed to read metadata of the unit of container '%s': %s\n", c.Name, err)
+		return nil
+	}
+
+	names := make([]string, 0, len(metadata.custom))
+	for name := range metadata.custom {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, target := range c.UnitMetadata {
+		switch target {
+		case UnitMetadataLabels:
+			args = append(args,
+				"--label", fmt.Sprintf("org.systemd.unit=%s", metadata.unit),
+				"--label", fmt.Sprintf("org.systemd.unit.description=%s", metadata.description),
+				"--label", fmt.Sprintf("org.systemd.unit.part-of=%s", strings.Join(metadata.partOf, ",")))
+			for _, name := range names {
+				args = append(args, "--label", fmt.Sprintf("%s=%s", name, metadata.custom[name]))
+			}
+		case UnitMetadataEnv:
+			args = append(args,
+				"-e", fmt.Sprintf("SYSTEMD_UNIT=%s", metadata.unit),
+				"-e", fmt.Sprintf("SYSTEMD_UNIT_DESCRIPTION=%s", metadata.description),
+				"-e", fmt.Sprintf("SYSTEMD_UNIT_PART_OF=%s", strings.Join(metadata.partOf, ",")))
+			for _, name := range names {
+				args = append(args, "-e", fmt.Sprintf("%s=%s", invalidEnvChars.ReplaceAllString(strings.ToUpper(name), "_"), metadata.custom[name]))
+			}
+		}
+	}
+	return args
+}
+
+// readUnitMetadata reads the metadata of the unit over D-Bus.  Custom keys
+// are not exposed over D-Bus, so they are read from the unit file and its
+// drop-ins, later files overriding earlier ones.
+func readUnitMetadata(c *Context) (*unitMetadata, error) {
+	unit, err := currentUnit()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dbusTimeout)
+	defer cancel()
+
+	conn, err := newSystemdConnection(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	properties, err := conn.GetUnitPropertiesContext(ctx, unit)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &unitMetadata{
+		unit:   unit,
+		custom: make(map[string]string),
+	}
+	metadata.description, _ = properties["Description"].(string)
+	metadata.partOf, _ = properties["PartOf"].([]string)
+
+	var files []string
+	if fragment, ok := properties["FragmentPath"].(string); ok && len(fragment) > 0 {
+		files = append(files, fragment)
+	}
+	if dropIns, ok := properties["DropInPaths"].([]string); ok {
+		files = append(files, dropIns...)
+	}
+	for _, file := range files {
+		if err = readCustomUnitKeys(file, metadata.custom); err != nil {
+			return nil, err
+		}
+	}
+	return metadata, nil
+}
+
+// readCustomUnitKeys reads the X-systemd-docker-<NAME> keys of the unit file.
+// An empty value removes the key, as for list settings of systemd.
+func readCustomUnitKeys(file string, keys map[string]string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, unitMetadataKeyPrefix) {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(strings.TrimPrefix(parts[0], unitMetadataKeyPrefix))
+		value := strings.TrimSpace(parts[1])
+		if len(name) == 0 {
+			continue
+		}
+		if len(value) == 0 {
+			delete(keys, name)
+		} else {
+			keys[name] = value
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,105 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var userManagerCgroupRegex = regexp.MustCompile(`/user@\d+\.service/`)
+
+// IsUserManager returns whether the wrapper is running in a unit of a systemd
+// user manager, i.e. was started by `systemctl --user`.
+func IsUserManager() bool {
+	return isUserManager("/proc/self/cgroup")
+}
+
+func isUserManager(procFile string) bool {
+	if !runningUnderSystemd() {
+		return false
+	}
+	cgroups, err := readCgroups(procFile)
+	if err != nil {
+		return false
+	}
+	for _, cgroup := range cgroups {
+		if userManagerCgroupRegex.MatchString(cgroup) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigureUserManager adapts the context to a systemd user manager.  Unless
+// an endpoint was specified, the rootless docker daemon of the user is used.
+func ConfigureUserManager(c *Context) {
+	if !c.UserManager {
+		return
+	}
+
+	if strings.HasPrefix(c.NotifySocket, "@") && c.Notify && len(c.NotifyBridge) == 0 {
+		c.Log.Warnf("NOTIFY_SOCKET '%s' is an abstract socket which cannot be passed to the container, 'notify' flag will have no effect without 'notify-bridge'\n", c.NotifySocket)
+		c.Notify = false
+	}
+
+	if len(c.Docker.Host) > 0 || len(c.Docker.Context) > 0 || len(os.Getenv("DOCKER_HOST")) > 0 || len(os.Getenv("DOCKER_CONTEXT")) > 0 {
+		return
+	}
+	if host := rootlessDockerHost(); len(host) > 0 {
+		c.Log.Debugf("Using rootless docker daemon '%s'\n", host)
+		c.Docker.Host = host
+	}
+}
+
+// rootlessDockerHost returns the endpoint of the rootless docker daemon of the
+// user, if its socket exists.
+func rootlessDockerHost() string {
+	runtimeDir := userRuntimeDir()
+	if len(runtimeDir) == 0 {
+		return ""
+	}
+	socket := filepath.Join(runtimeDir, "docker.sock")
+	if _, err := os.Stat(socket); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("unix://%s", socket)
+}
+
+func userRuntimeDir() string {
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); len(runtimeDir) > 0 {
+		return runtimeDir
+	}
+	runtimeDir := fmt.Sprintf("/run/user/%d", os.Getuid())
+	if _, err := os.Stat(runtimeDir); err != nil {
+		return ""
+	}
+	return runtimeDir
+}
+
+// runDirectory returns the directory for the runtime state of systemd-docker,
+// which is located in the runtime directory of the user for user managers.
+func runDirectory(c *Context) string {
+	if c.UserManager {
+		if runtimeDir := userRuntimeDir(); len(runtimeDir) > 0 {
+			return filepath.Join(runtimeDir, "systemd-docker")
+		}
+	}
+	return DefaultRunDirectory
+}
@@ -0,0 +1,156 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsUserManager(t *testing.T) {
+	tests := []struct {
+		name         string
+		invocationId string
+		cgroup       string
+		expected     bool
+	}{
+		{"user manager", "0123456789abcdef", "0::/user.slice/user-1000.slice/user@1000.service/app.slice/app.service\n", true},
+		{"user manager with cgroup v1", "0123456789abcdef", "1:name=systemd:/user.slice/user-1000.slice/user@1000.service/app.service\n", true},
+		{"system manager", "0123456789abcdef", "0::/system.slice/app.service\n", false},
+		{"user session", "0123456789abcdef", "0::/user.slice/user-1000.slice/session-2.scope\n", false},
+		{"not under systemd", "", "0::/user.slice/user-1000.slice/user@1000.service/app.slice/app.service\n", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("INVOCATION_ID", test.invocationId)
+			procFile := filepath.Join(t.TempDir(), "cgroup")
+			if err := ioutil.WriteFile(procFile, []byte(test.cgroup), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if actual := isUserManager(procFile); actual != test.expected {
+				t.Errorf("isUserManager %t, expected %t", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestConfigureUserManager(t *testing.T) {
+	runtimeDir := t.TempDir()
+	socket := filepath.Join(runtimeDir, "docker.sock")
+	rootless := fmt.Sprintf("unix://%s", socket)
+
+	tests := []struct {
+		name         string
+		userManager  bool
+		socket       bool
+		host         string
+		dockerHost   string
+		notifySocket string
+		expectedHost string
+		notify       bool
+	}{
+		{"system manager", false, true, "", "", "/run/systemd/notify", "", true},
+		{"rootless daemon", true, true, "", "", "/run/user/1000/systemd/notify", rootless, true},
+		{"no rootless daemon", true, false, "", "", "/run/user/1000/systemd/notify", "", true},
+		{"host flag", true, true, "tcp://127.0.0.1:2375", "", "/run/user/1000/systemd/notify", "tcp://127.0.0.1:2375", true},
+		{"DOCKER_HOST", true, true, "", "tcp://127.0.0.1:2375", "/run/user/1000/systemd/notify", "", true},
+		{"abstract notify socket", true, true, "", "", "@/org/freedesktop/systemd1/notify", rootless, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+			t.Setenv("DOCKER_HOST", test.dockerHost)
+			t.Setenv("DOCKER_CONTEXT", "")
+			_ = os.Remove(socket)
+			if test.socket {
+				if err := ioutil.WriteFile(socket, nil, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c := &Context{UserManager: test.userManager, NotifySocket: test.notifySocket, Notify: true, Log: NewLogger()}
+			c.Docker.Host = test.host
+			ConfigureUserManager(c)
+			if c.Docker.Host != test.expectedHost {
+				t.Errorf("host '%s', expected '%s'", c.Docker.Host, test.expectedHost)
+			}
+			if c.Notify != test.notify {
+				t.Errorf("notify %t, expected %t", c.Notify, test.notify)
+			}
+		})
+	}
+}
+
+func TestRootlessDockerHost(t *testing.T) {
+	withSocket := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(withSocket, "docker.sock"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		runtimeDir string
+		expected   string
+	}{
+		{"socket", withSocket, fmt.Sprintf("unix://%s/docker.sock", withSocket)},
+		{"no socket", t.TempDir(), ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("XDG_RUNTIME_DIR", test.runtimeDir)
+			if actual := rootlessDockerHost(); actual != test.expected {
+				t.Errorf("host '%s', expected '%s'", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestRunDirectory(t *testing.T) {
+	runtimeDir := t.TempDir()
+	// without XDG_RUNTIME_DIR, the runtime directory of the user is used if
+	// it exists
+	fallback := DefaultRunDirectory
+	if dir := fmt.Sprintf("/run/user/%d", os.Getuid()); directoryExists(dir) {
+		fallback = filepath.Join(dir, "systemd-docker")
+	}
+
+	tests := []struct {
+		name        string
+		userManager bool
+		runtimeDir  string
+		expected    string
+	}{
+		{"system manager", false, runtimeDir, DefaultRunDirectory},
+		{"user manager", true, runtimeDir, filepath.Join(runtimeDir, "systemd-docker")},
+		{"user manager without XDG_RUNTIME_DIR", true, "", fallback},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("XDG_RUNTIME_DIR", test.runtimeDir)
+			if actual := runDirectory(&Context{UserManager: test.userManager}); actual != test.expected {
+				t.Errorf("run directory '%s', expected '%s'", actual, test.expected)
+			}
+		})
+	}
+}
+
+func directoryExists(dir string) bool {
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
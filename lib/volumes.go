@@ -0,0 +1,197 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultStateDirectory is the directory for state which must survive
+	// reboots, unless systemd passes a StateDirectory= in $STATE_DIRECTORY.
+	DefaultStateDirectory = "/var/lib/systemd-docker"
+
+	// volumeUnitLabel labels the named volumes created by systemd-docker
+	// with the name of the container, so that only those are ever pruned.
+	volumeUnitLabel = "systemd-docker.container"
+)
+
+// stateDirectory returns the directory for state which must survive reboots.
+func stateDirectory() string {
+	if dir := os.Getenv("STATE_DIRECTORY"); len(dir) > 0 {
+		// systemd passes a colon separated list for multiple directories
+		return strings.SplitN(dir, ":", 2)[0]
+	}
+	return DefaultStateDirectory
+}
+
+// namedVolumes returns the named volumes mounted by the docker run arguments.
+func namedVolumes(args []string) []string {
+	var result []string
+	for _, value := range dockerFlagValues(args, "v", "volume") {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) == 2 && len(parts[0]) > 0 && !strings.HasPrefix(parts[0], "/") && !strings.HasPrefix(parts[0], ".") {
+			result = append(result, parts[0])
+		}
+	}
+	for _, value := range dockerFlagValues(args, "mount") {
+		mountType, source := "volume", ""
+		for _, option := range strings.Split(value, ",") {
+			parts := strings.SplitN(option, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch parts[0] {
+			case "type":
+				mountType = parts[1]
+			case "source", "src":
+				source = parts[1]
+			}
+		}
+		if mountType == "volume" && len(source) > 0 {
+			result = append(result, source)
+		}
+	}
+	return result
+}
+
+// prepareVolumes applies the volume retention policy and creates the missing
+// named volumes of the container, labeled so that they can be pruned later.
+func prepareVolumes(c *Context) error {
+	volumes := namedVolumes(c.Args)
+	if (len(volumes) == 0 && !c.FreshVolumes && c.VolumeRetentionDays <= 0) || c.daemonless() {
+		return nil
+	}
+
+	client, err := c.GetClient()
+	if err != nil {
+		return err
+	}
+
+	if err = pruneVolumes(c, client); err != nil {
+		return err
+	}
+
+	for _, name := range volumes {
+		if _, err = client.InspectVolume(name); err == nil {
+			continue
+		} else if err != docker.ErrNoSuchVolume {
+			return err
+		}
+		if c.VolumePruneDryRun {
+			continue
+		}
+		labels := map[string]string{volumeUnitLabel: c.Name, LabelManaged: "true"}
+		if unit, err := currentUnit(); err == nil {
+			labels[LabelUnit] = unit
+		}
+		_, err = client.CreateVolume(docker.CreateVolumeOptions{
+			Name:   name,
+			Labels: labels,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create volume '%s': %v", name, err)
+		}
+		c.Log.Infof("Created volume '%s' for container '%s'\n", name, c.Name)
+	}
+	RecordVolumeUse(c)
+	return nil
+}
+
+// pruneVolumes removes the named volumes created for the container which are
+// not in use, either all of them with --fresh-volumes or those which have not
+// been used for --volume-retention-days.
+func pruneVolumes(c *Context, client *docker.Client) error {
+	if !c.FreshVolumes && c.VolumeRetentionDays <= 0 {
+		return nil
+	}
+
+	volumes, err := client.ListVolumes(docker.ListVolumesOptions{
+		Filters: map[string][]string{"label": {fmt.Sprintf("%s=%s", volumeUnitLabel, c.Name)}},
+	})
+	if err != nil {
+		return err
+	}
+
+	retention := time.Duration(c.VolumeRetentionDays) * 24 * time.Hour
+	for _, volume := range volumes {
+		var reason string
+		if c.FreshVolumes {
+			reason = "fresh volumes were requested"
+		} else if lastUsed := volumeLastUsed(volume); time.Since(lastUsed) > retention {
+			reason = fmt.Sprintf("it was last used %s ago", formatDuration(time.Since(lastUsed)))
+		} else {
+			continue
+		}
+
+		if c.VolumePruneDryRun {
+			c.Log.Noticef("Would remove volume '%s' of container '%s', as %s\n", volume.Name, c.Name, reason)
+			continue
+		}
+		err = client.RemoveVolumeWithOptions(docker.RemoveVolumeOptions{Name: volume.Name})
+		switch err {
+		case nil:
+			_ = os.Remove(volumeUseFile(volume.Name))
+			c.Log.Noticef("Removed volume '%s' of container '%s', as %s\n", volume.Name, c.Name, reason)
+		case docker.ErrNoSuchVolume:
+		case docker.ErrVolumeInUse:
+			c.Log.Warnf("Cannot remove volume '%s' of container '%s', it is in use\n", volume.Name, c.Name)
+		default:
+			return fmt.Errorf("failed to remove volume '%s': %v", volume.Name, err)
+		}
+	}
+	return nil
+}
+
+// RecordVolumeUse records that the named volumes of the container are used
+// now, for the volume retention policy.
+func RecordVolumeUse(c *Context) {
+	if c.VolumeRetentionDays <= 0 {
+		return
+	}
+	now := time.Now()
+	for _, name := range namedVolumes(c.Args) {
+		file := volumeUseFile(name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			c.Log.Debugf("Failed to record use of volume '%s': %s\n", name, err)
+			return
+		}
+		if err := os.Chtimes(file, now, now); os.IsNotExist(err) {
+			var f *os.File
+			if f, err = os.Create(file); err == nil {
+				_ = f.Close()
+			}
+		}
+	}
+}
+
+func volumeUseFile(name string) string {
+	return filepath.Join(stateDirectory(), "volumes", filepath.Base(name))
+}
+
+// volumeLastUsed returns when the volume was last used, falling back to its
+// creation time if its use was never recorded.
+func volumeLastUsed(volume docker.Volume) time.Time {
+	if info, err := os.Stat(volumeUseFile(volume.Name)); err == nil {
+		return info.ModTime()
+	}
+	return volume.CreatedAt
+}
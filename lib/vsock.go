@@ -0,0 +1,124 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"strconv"
+)
+
+// vsockCidHost is the well-known context ID of the host.
+const vsockCidHost = unix.VMADDR_CID_HOST
+
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a *vsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a *vsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.cid, a.port)
+}
+
+// vsockListener accepts AF_VSOCK stream connections, which are not supported
+// by the net package.
+type vsockListener struct {
+	fd   int
+	addr *vsockAddr
+}
+
+type vsockConn struct {
+	*os.File
+	local  *vsockAddr
+	remote *vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// listenVsock listens on [CID]:PORT, on any CID if it is omitted.
+func listenVsock(address string) (net.Listener, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addr := &vsockAddr{cid: unix.VMADDR_CID_ANY}
+	if len(host) > 0 {
+		cid, err := strconv.ParseUint(host, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("vsock CID '%s' is not a number", host)
+		}
+		addr.cid = uint32(cid)
+	}
+	port, err := strconv.ParseUint(portString, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	addr.port = uint32(port)
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err = unix.Bind(fd, &unix.SockaddrVM{CID: addr.cid, Port: addr.port}); err == nil {
+		err = unix.Listen(fd, unix.SOMAXCONN)
+	}
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	return &vsockListener{fd: fd, addr: addr}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	fd, sa, err := unix.Accept4(l.fd, unix.SOCK_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	// non-blocking descriptors are handled by the runtime poller, which
+	// provides deadlines
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	remote := &vsockAddr{}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote.cid, remote.port = vm.CID, vm.Port
+	}
+	return &vsockConn{File: os.NewFile(uintptr(fd), "vsock:"+remote.String()), local: l.addr, remote: remote}, nil
+}
+
+// Close stops accepting connections.  Shutting the socket down first wakes
+// up a blocked Accept.
+func (l *vsockListener) Close() error {
+	_ = unix.Shutdown(l.fd, unix.SHUT_RDWR)
+	return unix.Close(l.fd)
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,147 @@
+// Copyright © 2021 Joel Baranick <jbaranick@gmail.com>
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+// 	  http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	WatchdogCheckWarn = "warn"
+	WatchdogCheckFail = "fail"
+
+	defaultHealthCheckInterval = 30 * time.Second
+	defaultHealthCheckTimeout  = 30 * time.Second
+	defaultHealthCheckRetries  = 3
+)
+
+// watchdogTimeout returns the WatchdogSec of the unit, or 0 if the watchdog
+// is not enabled for us.
+func watchdogTimeout() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// validateWatchdog checks whether the health check of the container can
+// confirm health within the watchdog timeout, and returns the interval at
+// which synthetic watchdog pings are sent while the container is known to be
+// healthy, along with how long a confirmed health state stays fresh.  If the
+// health check cannot confirm health within the watchdog timeout, an error is
+// returned with --watchdog-check=fail.
+func validateWatchdog(c *Context, healthCheck *docker.HealthConfig) (time.Duration, time.Duration, error) {
+	timeout := watchdogTimeout()
+	if timeout <= 0 {
+		return 0, 0, nil
+	}
+
+	interval := healthCheck.Interval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	checkTimeout := healthCheck.Timeout
+	if checkTimeout <= 0 {
+		checkTimeout = defaultHealthCheckTimeout
+	}
+	retries := healthCheck.Retries
+	if retries <= 0 {
+		retries = defaultHealthCheckRetries
+	}
+
+	// in the worst case, a successful health check ends a full interval
+	// plus timeout after the previous one
+	worstCase := interval + checkTimeout
+	staleness := c.WatchdogStaleness
+	if staleness <= 0 {
+		staleness = worstCase
+	}
+
+	if worstCase >= timeout {
+		message := fmt.Sprintf("health check of container '%s' (interval %s, timeout %s) cannot confirm health within WatchdogSec=%s", c.Name, interval, checkTimeout, timeout)
+		if c.WatchdogCheck == WatchdogCheckFail {
+			return 0, 0, errors.New(message)
+		}
+		c.Log.Warnf("The %s, sending synthetic watchdog pings every %s for up to %s after health was last confirmed\n", message, timeout/2, staleness)
+	} else if worstCase := time.Duration(retries) * (interval + checkTimeout); worstCase >= timeout {
+		c.Log.Warnf("Transient health check failures of container '%s' will trigger the watchdog before docker marks it unhealthy after %d retries\n", c.Name, retries)
+	}
+	return timeout / 2, staleness, nil
+}
+
+// watchdogTrigger sends WATCHDOG=trigger once the container has been
+// unhealthy for --watchdog-trigger-unhealthy, or its health check failed
+// --watchdog-trigger-failures times in a row, so that systemd applies the
+// watchdog action right away instead of waiting for WatchdogSec= to elapse.
+type watchdogTrigger struct {
+	failures       int
+	unhealthySince time.Time
+	triggered      bool
+}
+
+// failed records a failed health check, which leaves the container
+// unhealthy, and triggers the watchdog once a threshold is exceeded.  The
+// watchdog is only triggered after READY was signaled, as the start timeout
+// of the unit applies before.
+func (t *watchdogTrigger) failed(c *Context, conn net.Conn, ready bool) {
+	t.failures++
+	if t.unhealthySince.IsZero() {
+		t.unhealthySince = time.Now()
+	}
+	if !ready || t.triggered {
+		return
+	}
+
+	var reason string
+	switch {
+	case c.WatchdogTriggerFailures > 0 && t.failures >= c.WatchdogTriggerFailures:
+		reason = fmt.Sprintf("its health check failed %d times in a row", t.failures)
+	case c.WatchdogTriggerUnhealthy > 0 && time.Since(t.unhealthySince) >= c.WatchdogTriggerUnhealthy:
+		reason = fmt.Sprintf("it has been unhealthy for %s", formatDuration(time.Since(t.unhealthySince)))
+	default:
+		return
+	}
+
+	if _, err := conn.Write([]byte("WATCHDOG=trigger")); err != nil {
+		c.Log.Errorf("Failed to trigger the systemd watchdog for container '%s': %s\n", c.Name, err)
+		return
+	}
+	t.triggered = true
+	c.Metrics().AddCounter("systemd_docker_watchdog_triggers_total", "Number of times the systemd watchdog was triggered", 1)
+	c.Log.Warnf("Triggered the systemd watchdog for container '%s', as %s\n", c.Name, reason)
+}
+
+// passed records a successful health check.
+func (t *watchdogTrigger) passed() {
+	t.failures = 0
+}
+
+// recovered records that the container is healthy again.
+func (t *watchdogTrigger) recovered() {
+	t.failures = 0
+	t.unhealthySince = time.Time{}
+	t.triggered = false
+}
@@ -17,6 +17,7 @@ package version
 
 import (
 	"bytes"
+	"encoding/json"
 	"runtime"
 	"strings"
 	"text/template"
@@ -43,16 +44,47 @@ var (
 	goVersion = runtime.Version()
 )
 
+const (
+	// MinDockerAPIVersion is the oldest Docker API version supported.
+	MinDockerAPIVersion = "1.25"
+
+	// MaxDockerAPIVersion is the newest Docker API version supported.
+	MaxDockerAPIVersion = "1.41"
+)
+
 var versionInfoTmpl = `
 systemd-docker, version {{.version}} (branch: {{.branch}}, revision: {{.revision}})
   build user:       {{.buildUser}}@{{.buildHost}}
   build date:       {{.buildDate}}
   go version:       {{.goVersion}}
+  docker api:       {{.dockerApiMin}} - {{.dockerApiMax}}
 `
 
 // Print formats the version info as a string.
 func Print() string {
 	m := map[string]string{
+		"version":      Version,
+		"revision":     Revision,
+		"branch":       Branch,
+		"buildUser":    BuildUser,
+		"buildHost":    BuildHost,
+		"buildDate":    BuildDate,
+		"goVersion":    goVersion,
+		"dockerApiMin": MinDockerAPIVersion,
+		"dockerApiMax": MaxDockerAPIVersion,
+	}
+	t := template.Must(template.New("version").Parse(versionInfoTmpl))
+
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, "version", m); err != nil {
+		panic(err)
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// PrintJSON formats the version info as a JSON document.
+func PrintJSON() string {
+	m := map[string]interface{}{
 		"version":   Version,
 		"revision":  Revision,
 		"branch":    Branch,
@@ -60,12 +92,14 @@ func Print() string {
 		"buildHost": BuildHost,
 		"buildDate": BuildDate,
 		"goVersion": goVersion,
+		"dockerApiVersion": map[string]string{
+			"min": MinDockerAPIVersion,
+			"max": MaxDockerAPIVersion,
+		},
 	}
-	t := template.Must(template.New("version").Parse(versionInfoTmpl))
-
-	var buf bytes.Buffer
-	if err := t.ExecuteTemplate(&buf, "version", m); err != nil {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
 		panic(err)
 	}
-	return strings.TrimSpace(buf.String())
+	return string(b)
 }